@@ -87,6 +87,50 @@ curl -X PUT http://localhost:2020/veil/api/keys/status \
   "is_active": false
 }' | jq
 
+# -- list keys (values are masked)
+curl "http://localhost:2020/veil/api/keys?path=/weather/*" | jq
+
+# ---------- Routes ---------- #
+
+curl "http://localhost:2020/veil/api/routes?path_prefix=/weather&sort=-request_count&limit=10" | jq
+
+curl http://localhost:2020/veil/api/routes/weather/* | jq
+
+# ---------- Catalog ---------- #
+
+# -- export with key digests (only valid on gateways with the same key_pepper)
+curl "http://localhost:2020/veil/api/export?keys=hashed&format=yaml" > catalog.yaml
+
+# -- preview, then apply, a catalog that replaces every API
+curl -X POST "http://localhost:2020/veil/api/import?mode=replace&dry_run=true" \
+-H "Content-Type: application/yaml" \
+--data-binary @catalog.yaml | jq
+
+curl -X POST "http://localhost:2020/veil/api/import?mode=replace" \
+-H "Content-Type: application/yaml" \
+--data-binary @catalog.yaml | jq
+
+# ---------- Contract validation ---------- #
+
+# -- store an OpenAPI document, then validate an API's requests against it
+curl -X PUT http://localhost:2020/veil/api/specs/orders \
+-H "Content-Type: application/yaml" \
+--data-binary @orders.yaml | jq
+
+curl -X POST http://localhost:2020/veil/api/routes \
+-H "Content-Type: application/json" \
+-d '{
+  "path": "/shop/v1/*",
+  "upstream": "http://localhost:8085/v1",
+  "required_subscription": "shop-subscription",
+  "methods": ["GET", "POST"],
+  "spec": "orders",
+  "response_validation": "monitor",
+  "api_keys": [{"key": "shop-key", "name": "Shop Key"}]
+}' | jq
+
+curl http://localhost:2020/veil/api/specs | jq
+
 
 # -- HTTP BIN ---
 curl -X POST http://localhost:2020/veil/api/routes \
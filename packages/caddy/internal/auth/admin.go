@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Role is the permission level granted to a management API caller
+type Role string
+
+const (
+	// RoleReadOnly may only read routes and keys
+	RoleReadOnly Role = "read-only"
+	// RoleKeyManager may additionally add, delete and (de)activate API keys
+	RoleKeyManager Role = "key-manager"
+	// RoleRouteAdmin may perform every management operation
+	RoleRouteAdmin Role = "route-admin"
+)
+
+// rank orders roles so that a higher role includes all lower ones
+func (r Role) rank() int {
+	switch r {
+	case RoleReadOnly:
+		return 1
+	case RoleKeyManager:
+		return 2
+	case RoleRouteAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// Valid reports whether the role is one of the known roles
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether the role is sufficient for the required role
+func (r Role) Allows(required Role) bool {
+	return r.rank() > 0 && r.rank() >= required.rank()
+}
+
+// Operation classifies a management API call for authorization
+type Operation string
+
+const (
+	OpRead        Operation = "read"
+	OpManageKeys  Operation = "manage_keys"
+	OpManageRoute Operation = "manage_routes"
+)
+
+// RequiredRole returns the minimum role needed to perform the operation
+func (op Operation) RequiredRole() Role {
+	switch op {
+	case OpRead:
+		return RoleReadOnly
+	case OpManageKeys:
+		return RoleKeyManager
+	default:
+		return RoleRouteAdmin
+	}
+}
+
+// Header names used by HMAC-signed management requests
+const (
+	HeaderKeyID     = "X-Veil-Key-Id"
+	HeaderTimestamp = "X-Veil-Timestamp"
+	HeaderSignature = "X-Veil-Signature"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request carries
+	// no credentials of the kind it understands, so the next one can be tried
+	ErrNoCredentials = errors.New("no credentials presented")
+	// ErrInvalidCredentials is returned when credentials are present but wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal identifies an authenticated management API caller
+type Principal struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	Method string `json:"method"`
+}
+
+// Authenticator resolves the caller of a management API request
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// TokenCredential is a static bearer token granted a role
+type TokenCredential struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// HMACCredential is a shared secret used to sign requests
+type HMACCredential struct {
+	KeyID  string `json:"key_id"`
+	Secret string `json:"secret"`
+	Role   Role   `json:"role"`
+}
+
+// ClientCertIdentity maps a verified TLS client certificate to a role.
+// Either the subject common name or the SHA-256 fingerprint must match.
+type ClientCertIdentity struct {
+	CommonName  string `json:"common_name,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Role        Role   `json:"role"`
+}
+
+// AdminConfig configures authentication for the /veil/api/ management API.
+// Without credentials every call is denied unless InsecureOpen is set.
+type AdminConfig struct {
+	Tokens       []TokenCredential    `json:"tokens,omitempty"`
+	HMACKeys     []HMACCredential     `json:"hmac_keys,omitempty"`
+	ClientCerts  []ClientCertIdentity `json:"client_certs,omitempty"`
+	MaxClockSkew caddy.Duration       `json:"max_clock_skew,omitempty"`
+	// InsecureOpen allows unauthenticated calls, for local development only
+	InsecureOpen bool `json:"insecure_open,omitempty"`
+}
+
+// Open reports whether unauthenticated calls are explicitly allowed
+func (c *AdminConfig) Open() bool {
+	return c != nil && c.InsecureOpen && !c.Enabled()
+}
+
+// Enabled reports whether any credential is configured
+func (c *AdminConfig) Enabled() bool {
+	return c != nil && (len(c.Tokens) > 0 || len(c.HMACKeys) > 0 || len(c.ClientCerts) > 0)
+}
+
+// Validate checks that every configured credential is complete
+func (c *AdminConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.InsecureOpen && c.Enabled() {
+		return fmt.Errorf("admin insecure_open cannot be combined with credentials")
+	}
+	for _, t := range c.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("admin token %q has no value", t.Name)
+		}
+		if !t.Role.Valid() {
+			return fmt.Errorf("admin token %q has unknown role %q", t.Name, t.Role)
+		}
+	}
+	for _, k := range c.HMACKeys {
+		if k.KeyID == "" || k.Secret == "" {
+			return fmt.Errorf("admin hmac key requires key_id and secret")
+		}
+		if !k.Role.Valid() {
+			return fmt.Errorf("admin hmac key %q has unknown role %q", k.KeyID, k.Role)
+		}
+	}
+	for _, cc := range c.ClientCerts {
+		if cc.CommonName == "" && cc.Fingerprint == "" {
+			return fmt.Errorf("admin client certificate requires common_name or fingerprint")
+		}
+		if !cc.Role.Valid() {
+			return fmt.Errorf("admin client certificate has unknown role %q", cc.Role)
+		}
+	}
+	return nil
+}
+
+// Authenticators builds the authenticator chain for the configuration.
+// Client certificates are tried first, then HMAC signatures, then tokens.
+func (c *AdminConfig) Authenticators() []Authenticator {
+	var chain []Authenticator
+	if len(c.ClientCerts) > 0 {
+		chain = append(chain, &ClientCertAuthenticator{Identities: c.ClientCerts})
+	}
+	if len(c.HMACKeys) > 0 {
+		skew := time.Duration(c.MaxClockSkew)
+		if skew <= 0 {
+			skew = 5 * time.Minute
+		}
+		chain = append(chain, &HMACAuthenticator{Keys: c.HMACKeys, MaxClockSkew: skew})
+	}
+	if len(c.Tokens) > 0 {
+		chain = append(chain, &TokenAuthenticator{Tokens: c.Tokens})
+	}
+	return chain
+}
+
+// Authenticate runs the chain and returns the first resolved principal.
+// ErrNoCredentials is returned only if no authenticator recognised the request.
+func Authenticate(chain []Authenticator, r *http.Request) (*Principal, error) {
+	for _, a := range chain {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// TokenAuthenticator accepts "Authorization: Bearer <token>"
+type TokenAuthenticator struct {
+	Tokens []TokenCredential
+}
+
+// Authenticate implements Authenticator.
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	presented := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+
+	// Compare against every token so timing does not reveal which one matched
+	var match *TokenCredential
+	for i := range a.Tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(a.Tokens[i].Token)) == 1 && match == nil {
+			match = &a.Tokens[i]
+		}
+	}
+	if match == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: match.Name, Role: match.Role, Method: "token"}, nil
+}
+
+// HMACAuthenticator verifies requests signed with a shared secret.
+// The signature is hex(HMAC-SHA256(secret, StringToSign(...))). There is no
+// nonce: a captured request can be replayed until its timestamp is more than
+// MaxClockSkew old, so the skew bounds the replay window.
+type HMACAuthenticator struct {
+	Keys         []HMACCredential
+	MaxClockSkew time.Duration
+}
+
+// StringToSign returns the canonical string covered by an HMAC signature
+func StringToSign(method, requestURI, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{method, requestURI, timestamp, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+// Sign computes the signature for a request; exported for clients and tests
+func Sign(secret, method, requestURI, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(method, requestURI, timestamp, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate implements Authenticator.
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	keyID := r.Header.Get(HeaderKeyID)
+	signature := r.Header.Get(HeaderSignature)
+	if keyID == "" && signature == "" {
+		return nil, ErrNoCredentials
+	}
+
+	var cred *HMACCredential
+	for i := range a.Keys {
+		if a.Keys[i].KeyID == keyID {
+			cred = &a.Keys[i]
+			break
+		}
+	}
+	if cred == nil || signature == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	timestamp := r.Header.Get(HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.MaxClockSkew {
+		return nil, fmt.Errorf("%w: timestamp outside allowed clock skew", ErrInvalidCredentials)
+	}
+
+	// Read and restore the body so downstream handlers can decode it
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %v", err)
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+
+	expected := Sign(cred.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: cred.KeyID, Role: cred.Role, Method: "hmac"}, nil
+}
+
+// ClientCertAuthenticator maps a verified TLS client certificate to a role.
+// It relies on Caddy's client_auth policy to have verified the chain.
+type ClientCertAuthenticator struct {
+	Identities []ClientCertIdentity
+}
+
+// Authenticate implements Authenticator.
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	for _, id := range a.Identities {
+		if id.Fingerprint != "" && strings.EqualFold(normalizeFingerprint(id.Fingerprint), fingerprint) {
+			return &Principal{Name: leaf.Subject.CommonName, Role: id.Role, Method: "mtls"}, nil
+		}
+		if id.CommonName != "" && id.CommonName == leaf.Subject.CommonName {
+			return &Principal{Name: leaf.Subject.CommonName, Role: id.Role, Method: "mtls"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// normalizeFingerprint strips the colons commonly used when printing fingerprints
+func normalizeFingerprint(fp string) string {
+	return strings.ReplaceAll(fp, ":", "")
+}
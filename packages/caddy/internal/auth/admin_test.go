@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRole_Allows(t *testing.T) {
+	assert.True(t, RoleRouteAdmin.Allows(RoleKeyManager))
+	assert.True(t, RoleKeyManager.Allows(RoleReadOnly))
+	assert.True(t, RoleReadOnly.Allows(RoleReadOnly))
+	assert.False(t, RoleReadOnly.Allows(RoleKeyManager))
+	assert.False(t, RoleKeyManager.Allows(RoleRouteAdmin))
+	assert.False(t, Role("unknown").Allows(RoleReadOnly))
+}
+
+func TestAdminConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *AdminConfig
+		expectError bool
+	}{
+		{
+			name:        "Nil Config",
+			config:      nil,
+			expectError: false,
+		},
+		{
+			name: "Valid Token",
+			config: &AdminConfig{
+				Tokens: []TokenCredential{{Name: "ops", Token: "secret", Role: RoleRouteAdmin}},
+			},
+			expectError: false,
+		},
+		{
+			name: "Unknown Role",
+			config: &AdminConfig{
+				Tokens: []TokenCredential{{Name: "ops", Token: "secret", Role: "superuser"}},
+			},
+			expectError: true,
+		},
+		{
+			name: "HMAC Key Without Secret",
+			config: &AdminConfig{
+				HMACKeys: []HMACCredential{{KeyID: "ci", Role: RoleReadOnly}},
+			},
+			expectError: true,
+		},
+		{
+			name: "Client Cert Without Identity",
+			config: &AdminConfig{
+				ClientCerts: []ClientCertIdentity{{Role: RoleReadOnly}},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	config := &AdminConfig{
+		Tokens: []TokenCredential{
+			{Name: "reader", Token: "read-token", Role: RoleReadOnly},
+			{Name: "admin", Token: "admin-token", Role: RoleRouteAdmin},
+		},
+		HMACKeys: []HMACCredential{
+			{KeyID: "ci", Secret: "hmac-secret", Role: RoleKeyManager},
+		},
+	}
+	chain := config.Authenticators()
+
+	body := []byte(`{"path":"/weather/*"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantErr    error
+		wantName   string
+		wantRole   Role
+		wantMethod string
+	}{
+		{
+			name:    "No Credentials",
+			headers: map[string]string{},
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:       "Valid Token",
+			headers:    map[string]string{"Authorization": "Bearer admin-token"},
+			wantName:   "admin",
+			wantRole:   RoleRouteAdmin,
+			wantMethod: "token",
+		},
+		{
+			name:    "Invalid Token",
+			headers: map[string]string{"Authorization": "Bearer nope"},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "Valid HMAC Signature",
+			headers: map[string]string{
+				HeaderKeyID:     "ci",
+				HeaderTimestamp: now,
+				HeaderSignature: Sign("hmac-secret", "POST", "/veil/api/keys", now, body),
+			},
+			wantName:   "ci",
+			wantRole:   RoleKeyManager,
+			wantMethod: "hmac",
+		},
+		{
+			name: "HMAC Signature Over Different Body",
+			headers: map[string]string{
+				HeaderKeyID:     "ci",
+				HeaderTimestamp: now,
+				HeaderSignature: Sign("hmac-secret", "POST", "/veil/api/keys", now, []byte(`{}`)),
+			},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "HMAC Timestamp Outside Skew",
+			headers: map[string]string{
+				HeaderKeyID:     "ci",
+				HeaderTimestamp: stale,
+				HeaderSignature: Sign("hmac-secret", "POST", "/veil/api/keys", stale, body),
+			},
+			wantErr: ErrInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/veil/api/keys", bytes.NewReader(body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			principal, err := Authenticate(chain, req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, principal)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantName, principal.Name)
+			assert.Equal(t, tt.wantRole, principal.Role)
+			assert.Equal(t, tt.wantMethod, principal.Method)
+		})
+	}
+}
@@ -2,14 +2,25 @@ package dto
 
 import (
 	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/events"
 )
 
 // APIKeyDTO represents an API key in requests and responses
 type APIKeyDTO struct {
-	Key       string     `json:"key"`
-	Name      string     `json:"name"`
-	IsActive  *bool      `json:"is_active,omitempty"`
-	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string        `json:"key"`
+	Name      string        `json:"name"`
+	IsActive  *bool         `json:"is_active,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	RateLimit *RateLimitDTO `json:"rate_limit,omitempty"`
+}
+
+// RateLimitDTO represents request limits for an API or an API key
+type RateLimitDTO struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty" yaml:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty" yaml:"burst,omitempty"`
+	RequestsPerMinute int     `json:"requests_per_minute,omitempty" yaml:"requests_per_minute,omitempty"`
+	RequestsPerDay    int     `json:"requests_per_day,omitempty" yaml:"requests_per_day,omitempty"`
 }
 
 // APIOnboardRequestDTO represents the request body for API onboarding
@@ -21,6 +32,136 @@ type APIOnboardRequestDTO struct {
 	RequiredHeaders      []string       `json:"required_headers"`
 	Parameters           []ParameterDTO `json:"parameters"`
 	APIKeys              []APIKeyDTO    `json:"api_keys"`
+	RateLimit            *RateLimitDTO  `json:"rate_limit,omitempty"`
+	// Upstreams balances requests across several targets instead of Upstream
+	Upstreams      []UpstreamTargetDTO `json:"upstreams,omitempty"`
+	LoadBalancing  *LoadBalancingDTO   `json:"load_balancing,omitempty"`
+	HealthChecks   *HealthChecksDTO    `json:"health_checks,omitempty"`
+	Canary         *CanaryDTO          `json:"canary,omitempty"`
+	TLS            *UpstreamTLSDTO     `json:"tls,omitempty"`
+	UpstreamAuth   *UpstreamAuthDTO    `json:"upstream_auth,omitempty"`
+	RequestHeaders *HeaderPolicyDTO    `json:"request_headers,omitempty"`
+	Transforms     *TransformsDTO      `json:"transforms,omitempty"`
+	// Spec names a stored OpenAPI document requests are validated against
+	Spec string `json:"spec,omitempty"`
+	// ResponseValidation is "monitor" to also check upstream responses
+	ResponseValidation string `json:"response_validation,omitempty"`
+}
+
+// UpstreamTargetDTO is one upstream target of an API
+type UpstreamTargetDTO struct {
+	URL    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// LoadBalancingDTO selects the upstream target of each request
+type LoadBalancingDTO struct {
+	Policy      string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Retries     int    `json:"retries,omitempty" yaml:"retries,omitempty"`
+	TryDuration string `json:"try_duration,omitempty" yaml:"try_duration,omitempty"`
+}
+
+// HealthChecksDTO configures active and passive upstream health checks
+type HealthChecksDTO struct {
+	Active  *ActiveHealthCheckDTO  `json:"active,omitempty" yaml:"active,omitempty"`
+	Passive *PassiveHealthCheckDTO `json:"passive,omitempty" yaml:"passive,omitempty"`
+}
+
+// ActiveHealthCheckDTO polls every upstream target
+type ActiveHealthCheckDTO struct {
+	Path         string `json:"path" yaml:"path"`
+	Interval     string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout      string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty" yaml:"expect_status,omitempty"`
+}
+
+// PassiveHealthCheckDTO marks upstream targets unhealthy after failed requests
+type PassiveHealthCheckDTO struct {
+	FailDuration     string `json:"fail_duration" yaml:"fail_duration"`
+	MaxFails         int    `json:"max_fails,omitempty" yaml:"max_fails,omitempty"`
+	UnhealthyStatus  []int  `json:"unhealthy_status,omitempty" yaml:"unhealthy_status,omitempty"`
+	UnhealthyLatency string `json:"unhealthy_latency,omitempty" yaml:"unhealthy_latency,omitempty"`
+}
+
+// HeaderPolicyDTO rewrites the request headers sent to an API's upstream
+type HeaderPolicyDTO struct {
+	Remove          []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+	Rename          map[string]string `json:"rename,omitempty" yaml:"rename,omitempty"`
+	Set             map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Append          map[string]string `json:"append,omitempty" yaml:"append,omitempty"`
+	DisableIdentity bool              `json:"disable_identity,omitempty" yaml:"disable_identity,omitempty"`
+}
+
+// TransformsDTO rewrites an API's requests and its upstream's responses
+type TransformsDTO struct {
+	Request  *RequestTransformDTO  `json:"request,omitempty" yaml:"request,omitempty"`
+	Response *ResponseTransformDTO `json:"response,omitempty" yaml:"response,omitempty"`
+}
+
+// RequestTransformDTO rewrites requests sent to an API's upstream
+type RequestTransformDTO struct {
+	Paths        []PathRewriteDTO  `json:"paths,omitempty" yaml:"paths,omitempty"`
+	SetQuery     map[string]string `json:"set_query,omitempty" yaml:"set_query,omitempty"`
+	RemoveQuery  []string          `json:"remove_query,omitempty" yaml:"remove_query,omitempty"`
+	RenameFields map[string]string `json:"rename_fields,omitempty" yaml:"rename_fields,omitempty"`
+}
+
+// PathRewriteDTO rewrites request paths matching From to To
+type PathRewriteDTO struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// ResponseTransformDTO rewrites the responses of an API's upstream
+type ResponseTransformDTO struct {
+	SetHeaders    map[string]string `json:"set_headers,omitempty" yaml:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty" yaml:"remove_headers,omitempty"`
+	RenameFields  map[string]string `json:"rename_fields,omitempty" yaml:"rename_fields,omitempty"`
+	RemoveFields  []string          `json:"remove_fields,omitempty" yaml:"remove_fields,omitempty"`
+}
+
+// UpstreamAuthDTO holds the credentials the gateway presents to an API's
+// upstream. Route listings omit the secrets; catalogs carry them encrypted.
+type UpstreamAuthDTO struct {
+	Type         string   `json:"type" yaml:"type"`
+	Header       string   `json:"header,omitempty" yaml:"header,omitempty"`
+	Value        string   `json:"value,omitempty" yaml:"value,omitempty"`
+	Username     string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Password     string   `json:"password,omitempty" yaml:"password,omitempty"`
+	TokenURL     string   `json:"token_url,omitempty" yaml:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// UpstreamTLSDTO configures the TLS connections to an API's https upstreams
+type UpstreamTLSDTO struct {
+	CA                 string   `json:"ca,omitempty" yaml:"ca,omitempty"`
+	ServerName         string   `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	PinnedSHA256       []string `json:"pinned_sha256,omitempty" yaml:"pinned_sha256,omitempty"`
+	ClientCertificate  string   `json:"client_certificate,omitempty" yaml:"client_certificate,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"`
+}
+
+// CanaryDTO routes part of an API's traffic to a new upstream. Keys are
+// subscription keys or, in responses and catalogs, their digests.
+type CanaryDTO struct {
+	Upstream string   `json:"upstream" yaml:"upstream"`
+	Weight   int      `json:"weight" yaml:"weight"`
+	Sticky   bool     `json:"sticky,omitempty" yaml:"sticky,omitempty"`
+	Keys     []string `json:"keys,omitempty" yaml:"keys,omitempty"`
+}
+
+// CanaryWeightDTO is the request body for shifting canary traffic
+type CanaryWeightDTO struct {
+	Weight *int `json:"weight"`
+}
+
+// CanaryResponseDTO describes the canary of an API
+type CanaryResponseDTO struct {
+	Status string     `json:"status"`
+	Path   string     `json:"path"`
+	Canary *CanaryDTO `json:"canary,omitempty"`
 }
 
 // APIKeysRequestDTO represents the request body for adding API keys
@@ -45,9 +186,10 @@ type APIResponseDTO struct {
 
 // ParameterDTO represents an API parameter in requests and responses
 type ParameterDTO struct {
-	Name     string `json:"name"`
-	Type     string `json:"type"` // query, path, header, body
-	Required bool   `json:"required"`
+	Name       string `json:"name" yaml:"name"`
+	Type       string `json:"type" yaml:"type"` // query, path, header, body
+	Required   bool   `json:"required" yaml:"required"`
+	Validation string `json:"validation,omitempty" yaml:"validation,omitempty"` // regex pattern for validation
 }
 
 // APIKeyDeleteRequestDTO represents the request body for deleting an API key
@@ -55,3 +197,249 @@ type APIKeyDeleteRequestDTO struct {
 	Path   string `json:"path"`
 	APIKey string `json:"api_key"`
 }
+
+// ErrorResponseDTO represents a structured error response
+type ErrorResponseDTO struct {
+	Status  string      `json:"status"`
+	Code    string      `json:"code"`
+	Error   string      `json:"error"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// RouteDriftDTO reports differences between the APIs stored in the database
+// and the routes loaded in the running Caddy config
+type RouteDriftDTO struct {
+	Status    string    `json:"status"`
+	InSync    bool      `json:"in_sync"`
+	Missing   []string  `json:"missing"`  // stored APIs without a route
+	Orphaned  []string  `json:"orphaned"` // routes without a stored API
+	Changed   []string  `json:"changed"`  // routes that differ from the stored API
+	Applied   bool      `json:"applied"`  // whether the route table was rewritten
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// EventQueueStatsDTO reports the state of the usage event queue. Stats are
+// omitted for queues that do not keep delivery counters.
+type EventQueueStatsDTO struct {
+	Status  string             `json:"status"`
+	Enabled bool               `json:"enabled"`
+	Queue   string             `json:"queue,omitempty"`
+	Stats   *events.QueueStats `json:"stats,omitempty"`
+}
+
+// DeadLetterReplayDTO reports the outcome of a dead-letter replay
+type DeadLetterReplayDTO struct {
+	Status string `json:"status"`
+	events.ReplayResult
+}
+
+// PageDTO describes the page of a listing
+type PageDTO struct {
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+}
+
+// APIKeyInfoDTO describes a stored API key. The key itself is never returned;
+// MaskedKey shows its prefix only.
+type APIKeyInfoDTO struct {
+	ID        uint          `json:"id"`
+	Name      string        `json:"name"`
+	KeyPrefix string        `json:"key_prefix"`
+	MaskedKey string        `json:"masked_key"`
+	IsActive  bool          `json:"is_active"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	RateLimit *RateLimitDTO `json:"rate_limit,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// RouteDTO describes an onboarded API. Keys are listed only for a single route.
+type RouteDTO struct {
+	ID                   uint                `json:"id"`
+	Path                 string              `json:"path"`
+	Upstream             string              `json:"upstream"`
+	RequiredSubscription string              `json:"required_subscription"`
+	Methods              []string            `json:"methods"`
+	RequiredHeaders      []string            `json:"required_headers"`
+	Parameters           []ParameterDTO      `json:"parameters"`
+	RateLimit            *RateLimitDTO       `json:"rate_limit,omitempty"`
+	Upstreams            []UpstreamTargetDTO `json:"upstreams,omitempty"`
+	LoadBalancing        *LoadBalancingDTO   `json:"load_balancing,omitempty"`
+	HealthChecks         *HealthChecksDTO    `json:"health_checks,omitempty"`
+	Canary               *CanaryDTO          `json:"canary,omitempty"`
+	TLS                  *UpstreamTLSDTO     `json:"tls,omitempty"`
+	UpstreamAuth         *UpstreamAuthDTO    `json:"upstream_auth,omitempty"`
+	RequestHeaders       *HeaderPolicyDTO    `json:"request_headers,omitempty"`
+	Transforms           *TransformsDTO      `json:"transforms,omitempty"`
+	Spec                 string              `json:"spec,omitempty"`
+	ResponseValidation   string              `json:"response_validation,omitempty"`
+	LastAccessed         *time.Time          `json:"last_accessed,omitempty"`
+	RequestCount         int64               `json:"request_count"`
+	KeyCount             int                 `json:"key_count"`
+	APIKeys              []APIKeyInfoDTO     `json:"api_keys,omitempty"`
+	CreatedAt            time.Time           `json:"created_at"`
+	UpdatedAt            time.Time           `json:"updated_at"`
+}
+
+// RouteListDTO is the response of GET /veil/api/routes
+type RouteListDTO struct {
+	Status string     `json:"status"`
+	Routes []RouteDTO `json:"routes"`
+	Page   PageDTO    `json:"page"`
+}
+
+// RouteDetailDTO is the response of GET /veil/api/routes/{path}
+type RouteDetailDTO struct {
+	Status string   `json:"status"`
+	Route  RouteDTO `json:"route"`
+}
+
+// APIKeyListDTO is the response of GET /veil/api/keys
+type APIKeyListDTO struct {
+	Status string          `json:"status"`
+	Path   string          `json:"path"`
+	Keys   []APIKeyInfoDTO `json:"keys"`
+	Page   PageDTO         `json:"page"`
+}
+
+// CatalogVersion is the version of the catalog document format
+const CatalogVersion = 1
+
+// CatalogDTO is the document exported by GET /veil/api/export and applied by
+// POST /veil/api/import
+type CatalogDTO struct {
+	Version    int             `json:"version" yaml:"version"`
+	ExportedAt *time.Time      `json:"exported_at,omitempty" yaml:"exported_at,omitempty"`
+	APIs       []CatalogAPIDTO `json:"apis" yaml:"apis"`
+}
+
+// CatalogAPIDTO is one API of a catalog
+type CatalogAPIDTO struct {
+	Path                 string              `json:"path" yaml:"path"`
+	Upstream             string              `json:"upstream" yaml:"upstream"`
+	RequiredSubscription string              `json:"required_subscription,omitempty" yaml:"required_subscription,omitempty"`
+	Methods              []string            `json:"methods" yaml:"methods"`
+	RequiredHeaders      []string            `json:"required_headers,omitempty" yaml:"required_headers,omitempty"`
+	Parameters           []ParameterDTO      `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RateLimit            *RateLimitDTO       `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	Upstreams            []UpstreamTargetDTO `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	LoadBalancing        *LoadBalancingDTO   `json:"load_balancing,omitempty" yaml:"load_balancing,omitempty"`
+	HealthChecks         *HealthChecksDTO    `json:"health_checks,omitempty" yaml:"health_checks,omitempty"`
+	Canary               *CanaryDTO          `json:"canary,omitempty" yaml:"canary,omitempty"`
+	TLS                  *UpstreamTLSDTO     `json:"tls,omitempty" yaml:"tls,omitempty"`
+	UpstreamAuth         *UpstreamAuthDTO    `json:"upstream_auth,omitempty" yaml:"upstream_auth,omitempty"`
+	RequestHeaders       *HeaderPolicyDTO    `json:"request_headers,omitempty" yaml:"request_headers,omitempty"`
+	Transforms           *TransformsDTO      `json:"transforms,omitempty" yaml:"transforms,omitempty"`
+	Spec                 string              `json:"spec,omitempty" yaml:"spec,omitempty"`
+	ResponseValidation   string              `json:"response_validation,omitempty" yaml:"response_validation,omitempty"`
+	APIKeys              []CatalogKeyDTO     `json:"api_keys,omitempty" yaml:"api_keys,omitempty"`
+}
+
+// CatalogKeyDTO is a key of a catalog API. Exports carry the key digest;
+// imports accept either the digest or the plaintext key.
+type CatalogKeyDTO struct {
+	Name      string        `json:"name" yaml:"name"`
+	Key       string        `json:"key,omitempty" yaml:"key,omitempty"`
+	KeyHash   string        `json:"key_hash,omitempty" yaml:"key_hash,omitempty"`
+	KeyPrefix string        `json:"key_prefix,omitempty" yaml:"key_prefix,omitempty"`
+	IsActive  *bool         `json:"is_active,omitempty" yaml:"is_active,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+	RateLimit *RateLimitDTO `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+}
+
+// CatalogImportDTO reports the outcome of a catalog import
+type CatalogImportDTO struct {
+	Status    string   `json:"status"`
+	Mode      string   `json:"mode"`
+	DryRun    bool     `json:"dry_run"`
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	Deleted   []string `json:"deleted"`
+	// RoutesApplied is set when the route table was regenerated
+	RoutesApplied bool `json:"routes_applied"`
+}
+
+// OpenAPIImportDTO reports the APIs derived from an OpenAPI document by
+// POST /veil/api/openapi
+type OpenAPIImportDTO struct {
+	Status   string            `json:"status"`
+	DryRun   bool              `json:"dry_run"`
+	APIs     []OpenAPIRouteDTO `json:"apis"`
+	Warnings []string          `json:"warnings,omitempty"`
+	// RoutesApplied is set when the route table was regenerated
+	RoutesApplied bool `json:"routes_applied"`
+}
+
+// OpenAPIRouteDTO is an API derived from an OpenAPI document with its changes
+// against the stored configuration
+type OpenAPIRouteDTO struct {
+	Path     string            `json:"path"`
+	Upstream string            `json:"upstream"`
+	Status   string            `json:"status"` // created, updated or unchanged
+	Changes  []ConfigChangeDTO `json:"changes,omitempty"`
+}
+
+// ConfigChangeDTO is a change of one field of an API configuration. Scalar
+// fields report From and To, list fields the Added and Removed entries.
+type ConfigChangeDTO struct {
+	Field   string   `json:"field"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// SpecDTO describes a stored OpenAPI document. The document itself is only
+// returned for a single spec.
+type SpecDTO struct {
+	Name      string    `json:"name"`
+	Document  string    `json:"document,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SpecListDTO is the response of GET /veil/api/specs
+type SpecListDTO struct {
+	Status string    `json:"status"`
+	Specs  []SpecDTO `json:"specs"`
+}
+
+// SpecDetailDTO is the response of GET and PUT /veil/api/specs/{name}
+type SpecDetailDTO struct {
+	Status string  `json:"status"`
+	Spec   SpecDTO `json:"spec"`
+}
+
+// CertificateRequestDTO is the request body of PUT /veil/api/certificates/{name}:
+// a PEM bundle of CA certificates, or a client certificate chain with its key
+type CertificateRequestDTO struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key,omitempty"`
+}
+
+// CertificateDTO describes a stored upstream certificate. The PEM bundle is
+// only returned for a single certificate; the private key never is.
+type CertificateDTO struct {
+	Name          string    `json:"name"`
+	Subject       string    `json:"subject"`
+	NotAfter      time.Time `json:"not_after"`
+	Fingerprint   string    `json:"fingerprint"`
+	HasPrivateKey bool      `json:"private_key"`
+	Certificate   string    `json:"certificate,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// CertificateListDTO is the response of GET /veil/api/certificates
+type CertificateListDTO struct {
+	Status       string           `json:"status"`
+	Certificates []CertificateDTO `json:"certificates"`
+}
+
+// CertificateDetailDTO is the response of GET and PUT /veil/api/certificates/{name}
+type CertificateDetailDTO struct {
+	Status      string         `json:"status"`
+	Certificate CertificateDTO `json:"certificate"`
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Queue types selectable with Config.Queue
+const (
+	QueueMemory = "memory"
+	QueueDisk   = "disk"
+)
+
+// Config configures usage event streaming for a handler instance
+type Config struct {
+	// Disabled turns event streaming off even if ENABLE_EVENT_STREAMING is set
+	Disabled bool `json:"disabled,omitempty"`
+	// Endpoint receives event batches over HTTP; events are logged to stdout when empty
+	Endpoint string `json:"endpoint,omitempty"`
+	// Queue is "memory" (default) or "disk" for at-least-once delivery
+	Queue string `json:"queue,omitempty"`
+	// Dir, MaxSize, SegmentSize and Overflow configure the disk queue
+	Dir         string         `json:"dir,omitempty"`
+	MaxSize     int64          `json:"max_size,omitempty"`
+	SegmentSize int64          `json:"segment_size,omitempty"`
+	Overflow    OverflowPolicy `json:"overflow,omitempty"`
+	// BatchSize is the maximum number of events sent in one request
+	BatchSize int `json:"batch_size,omitempty"`
+	// FlushInterval, Senders, MaxAttempts and DeadLetterFile configure
+	// delivery of the memory queue to an endpoint
+	FlushInterval  caddy.Duration `json:"flush_interval,omitempty"`
+	Senders        int            `json:"senders,omitempty"`
+	MaxAttempts    int            `json:"max_attempts,omitempty"`
+	DeadLetterFile string         `json:"dead_letter_file,omitempty"`
+}
+
+// Validate checks the event streaming configuration
+func (c *Config) Validate() error {
+	if c == nil || c.Disabled {
+		return nil
+	}
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("events endpoint must be an http or https URL, got %q", c.Endpoint)
+		}
+	}
+	switch c.Queue {
+	case "", QueueMemory, QueueDisk:
+	default:
+		return fmt.Errorf("unknown events queue %q (expected memory or disk)", c.Queue)
+	}
+	switch c.Overflow {
+	case "", OverflowDropNewest, OverflowDropOldest:
+	default:
+		return fmt.Errorf("unknown events overflow policy %q (expected drop_newest or drop_oldest)", c.Overflow)
+	}
+	if c.MaxSize < 0 || c.SegmentSize < 0 {
+		return fmt.Errorf("events max_size and segment_size must not be negative")
+	}
+	if c.BatchSize < 0 || c.FlushInterval < 0 || c.Senders < 0 || c.MaxAttempts < 0 {
+		return fmt.Errorf("events batch_size, flush_interval, senders and max_attempts must not be negative")
+	}
+	return nil
+}
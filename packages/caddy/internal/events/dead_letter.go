@@ -0,0 +1,221 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrReplayInProgress is returned when a dead-letter replay is already running
+var ErrReplayInProgress = errors.New("dead-letter replay already in progress")
+
+// ErrNoDeadLetters is returned by queues that do not keep a dead-letter file
+var ErrNoDeadLetters = errors.New("dead-lettering is not configured")
+
+// DeadLetter is a batch that could not be delivered, stored as one JSON line
+// of the dead-letter file
+type DeadLetter struct {
+	FailedAt time.Time    `json:"failed_at"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Events   []UsageEvent `json:"events"`
+}
+
+// ReplayResult summarizes a dead-letter replay
+type ReplayResult struct {
+	Batches   int `json:"batches"`
+	Events    int `json:"events"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+// Replayer is implemented by queues that keep undeliverable batches for replay
+type Replayer interface {
+	ReplayDeadLetters(ctx context.Context) (ReplayResult, error)
+}
+
+// deadLetterFile is an append-only JSON lines file of undeliverable batches
+type deadLetterFile struct {
+	path     string
+	refs     int
+	mu       sync.Mutex
+	replayMu sync.Mutex
+}
+
+// deadLetterFiles holds one deadLetterFile per path, so queues sharing a file
+// (e.g. the handlers of every generated route) serialize their writes and
+// replays
+var (
+	deadLetterFilesMu sync.Mutex
+	deadLetterFiles   = make(map[string]*deadLetterFile)
+)
+
+// openDeadLetterFile returns the dead-letter file of the path, shared with
+// every other queue using it until released
+func openDeadLetterFile(path string) *deadLetterFile {
+	deadLetterFilesMu.Lock()
+	defer deadLetterFilesMu.Unlock()
+
+	f, ok := deadLetterFiles[path]
+	if !ok {
+		f = &deadLetterFile{path: path}
+		deadLetterFiles[path] = f
+	}
+	f.refs++
+	return f
+}
+
+// release drops a queue's use of the file
+func (f *deadLetterFile) release() {
+	deadLetterFilesMu.Lock()
+	defer deadLetterFilesMu.Unlock()
+
+	f.refs--
+	if f.refs == 0 && deadLetterFiles[f.path] == f {
+		delete(deadLetterFiles, f.path)
+	}
+}
+
+// add appends a failed batch to the file
+func (f *deadLetterFile) add(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.appendLines([][]byte{line})
+}
+
+// appendLines writes lines to the end of the file in a single write; the
+// caller holds mu
+func (f *deadLetterFile) appendLines(lines [][]byte) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %v", err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write dead-letter file: %v", err)
+	}
+	return file.Sync()
+}
+
+// replay sends every stored batch once. Delivered batches are removed from
+// the file; failed and unreadable ones are kept for the next replay. Batches
+// dead-lettered while the replay runs are not part of it.
+func (f *deadLetterFile) replay(ctx context.Context, send Sink) (ReplayResult, error) {
+	var result ReplayResult
+	if !f.replayMu.TryLock() {
+		return result, ErrReplayInProgress
+	}
+	defer f.replayMu.Unlock()
+
+	// Move the file aside so new dead letters keep going to a fresh file. A
+	// file left over by an interrupted replay is replayed as well.
+	pending := f.path + ".replay"
+	if err := f.claim(pending); err != nil {
+		return result, err
+	}
+
+	data, err := os.ReadFile(pending)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return result, fmt.Errorf("failed to read dead-letter file: %v", err)
+	}
+
+	var keep [][]byte
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(line, &letter); err != nil {
+			// Keep lines we cannot parse rather than lose them
+			keep = append(keep, line)
+			continue
+		}
+
+		result.Batches++
+		result.Events += len(letter.Events)
+
+		sendErr := ctx.Err()
+		if sendErr == nil {
+			sendErr = send(ctx, letter.Events)
+		}
+		if sendErr == nil {
+			result.Delivered += len(letter.Events)
+			continue
+		}
+
+		result.Failed += len(letter.Events)
+		letter.Attempts++
+		letter.FailedAt = time.Now().UTC()
+		letter.Error = sendErr.Error()
+		if updated, err := json.Marshal(letter); err == nil {
+			line = updated
+		}
+		keep = append(keep, line)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(keep) > 0 {
+		if err := f.appendLines(keep); err != nil {
+			return result, err
+		}
+	}
+	if err := os.Remove(pending); err != nil {
+		return result, fmt.Errorf("failed to remove replayed dead letters: %v", err)
+	}
+	return result, nil
+}
+
+// claim moves the current dead letters to pending, appending them if pending
+// already exists
+func (f *deadLetterFile) claim(pending string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := os.Stat(f.path); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(pending); os.IsNotExist(err) {
+		if err := os.Rename(f.path, pending); err != nil {
+			return fmt.Errorf("failed to move dead-letter file: %v", err)
+		}
+		return nil
+	}
+
+	src, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %v", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(pending, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %v", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to move dead-letter file: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to move dead-letter file: %v", err)
+	}
+	return os.Remove(f.path)
+}
@@ -0,0 +1,706 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OverflowPolicy decides what happens to new events once the disk queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest rejects new events while the queue is full
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest deletes the oldest undelivered segment to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+// Defaults for DiskQueueConfig fields left at zero
+const (
+	DefaultDiskQueueMaxBytes     int64 = 512 << 20
+	DefaultDiskQueueSegmentBytes int64 = 8 << 20
+	defaultDiskQueueBatchSize          = 100
+	defaultRetryInitial                = time.Second
+	defaultRetryMax                    = time.Minute
+	defaultSyncInterval                = time.Second
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	cursorFile    = "cursor.json"
+
+	// recordHeaderSize is the length and CRC32 prefix of every record
+	recordHeaderSize = 8
+	// maxRecordSize bounds an encoded event, so a corrupt length prefix
+	// cannot make a read allocate more
+	maxRecordSize = 1 << 20
+)
+
+// ErrQueueFull is returned by Enqueue when the disk queue is at capacity and
+// the overflow policy is drop_newest
+var ErrQueueFull = errors.New("event queue is full")
+
+// Sink delivers a batch of events. A returned error means the batch was not
+// delivered and is retried later; the whole batch may be delivered again.
+type Sink func(ctx context.Context, events []UsageEvent) error
+
+// DiskQueueConfig configures a DiskEventQueue
+type DiskQueueConfig struct {
+	// Dir holds the segment files and the delivery cursor
+	Dir string
+	// MaxBytes caps the disk space used by undelivered events
+	MaxBytes int64
+	// SegmentBytes is the size at which a new segment file is started
+	SegmentBytes int64
+	// Overflow is applied when an event does not fit within MaxBytes
+	Overflow OverflowPolicy
+	// BatchSize is the maximum number of events handed to the sink at once
+	BatchSize int
+	// RetryInitial and RetryMax bound the exponential backoff between failed deliveries
+	RetryInitial time.Duration
+	RetryMax     time.Duration
+	// SyncInterval is how often appended events are flushed to stable storage
+	SyncInterval time.Duration
+}
+
+// QueueStats are the delivery counters of an event queue
+type QueueStats struct {
+	Enqueued     uint64 `json:"enqueued"`
+	Delivered    uint64 `json:"delivered"`
+	Retried      uint64 `json:"retried"`
+	Dropped      uint64 `json:"dropped"`
+	DeadLettered uint64 `json:"dead_lettered"`
+	Pending      int    `json:"pending"`
+	DiskBytes    int64  `json:"disk_bytes"`
+}
+
+// StatsProvider is implemented by queues that expose delivery counters
+type StatsProvider interface {
+	Stats() QueueStats
+}
+
+// segment is one append-only log file of the queue
+type segment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+// cursor is the position of the next undelivered record
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	// Records counts the records before Offset in the segment
+	Records int `json:"records"`
+}
+
+// DiskEventQueue implements UsageEventQueue on top of an append-only segment
+// log. Events are written to disk before Enqueue returns and are removed only
+// after the sink accepted them, giving at-least-once delivery across restarts.
+type DiskEventQueue struct {
+	cfg    DiskQueueConfig
+	sink   Sink
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	segments []*segment // oldest first; the last one is the active segment
+	active   *os.File
+	read     cursor
+	dirty    bool
+
+	notify chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	enqueued  atomic.Uint64
+	delivered atomic.Uint64
+	retried   atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// NewDiskEventQueue creates a disk-backed event queue delivering to sink.
+// Existing segments in cfg.Dir are picked up when the queue starts.
+func NewDiskEventQueue(cfg DiskQueueConfig, sink Sink, logger *zap.Logger) *DiskEventQueue {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultDiskQueueMaxBytes
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = DefaultDiskQueueSegmentBytes
+	}
+	if cfg.SegmentBytes > cfg.MaxBytes {
+		cfg.SegmentBytes = cfg.MaxBytes
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowDropNewest
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultDiskQueueBatchSize
+	}
+	if cfg.RetryInitial <= 0 {
+		cfg.RetryInitial = defaultRetryInitial
+	}
+	if cfg.RetryMax < cfg.RetryInitial {
+		cfg.RetryMax = max(defaultRetryMax, cfg.RetryInitial)
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultSyncInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DiskEventQueue{
+		cfg:    cfg,
+		sink:   sink,
+		logger: logger,
+		notify: make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start recovers the queue from disk and begins delivering events
+func (q *DiskEventQueue) Start() error {
+	if err := os.MkdirAll(q.cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create event queue directory: %v", err)
+	}
+	if err := q.recover(); err != nil {
+		return err
+	}
+
+	q.wg.Add(2)
+	go q.deliverLoop()
+	go q.syncLoop()
+
+	stats := q.Stats()
+	q.logger.Info("disk event queue started",
+		zap.String("dir", q.cfg.Dir),
+		zap.Int("pending", stats.Pending),
+		zap.Int64("disk_bytes", stats.DiskBytes),
+		zap.Int64("max_bytes", q.cfg.MaxBytes),
+		zap.String("overflow", string(q.cfg.Overflow)))
+	return nil
+}
+
+// Stop stops delivery and flushes appended events to disk. Undelivered events
+// stay on disk and are delivered after the next Start.
+func (q *DiskEventQueue) Stop() error {
+	q.logger.Info("stopping disk event queue")
+
+	q.cancel()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var err error
+	if q.active != nil {
+		if syncErr := q.active.Sync(); syncErr != nil {
+			err = fmt.Errorf("failed to sync event queue: %v", syncErr)
+		}
+		q.active.Close()
+		q.active = nil
+	}
+
+	stats := q.statsLocked()
+	q.logger.Info("disk event queue stopped",
+		zap.Uint64("delivered", stats.Delivered),
+		zap.Uint64("retried", stats.Retried),
+		zap.Uint64("dropped", stats.Dropped),
+		zap.Int("pending", stats.Pending))
+	return err
+}
+
+// Destruct implements caddy.Destructor so the queue can be shared through a UsagePool
+func (q *DiskEventQueue) Destruct() error {
+	return q.Stop()
+}
+
+// ProcessEvents is kept for interface compatibility but not used in this implementation
+func (q *DiskEventQueue) ProcessEvents() error {
+	return nil
+}
+
+// Stats returns the queue's delivery counters
+func (q *DiskEventQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statsLocked()
+}
+
+func (q *DiskEventQueue) statsLocked() QueueStats {
+	stats := QueueStats{
+		Enqueued:  q.enqueued.Load(),
+		Delivered: q.delivered.Load(),
+		Retried:   q.retried.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+	for _, seg := range q.segments {
+		stats.Pending += seg.records
+		stats.DiskBytes += seg.size
+	}
+	stats.Pending -= q.read.Records
+	return stats
+}
+
+// Enqueue appends the event to the active segment
+func (q *DiskEventQueue) Enqueue(event UsageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage event: %v", err)
+	}
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("usage event of %d bytes exceeds the %d byte record limit", len(data), maxRecordSize)
+	}
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active == nil {
+		return fmt.Errorf("event queue is stopped")
+	}
+
+	if !q.makeRoom(int64(len(record))) {
+		q.dropped.Add(1)
+		q.logger.Warn("event queue is full, dropping event",
+			zap.String("api_path", event.APIPath),
+			zap.String("method", event.Method))
+		return ErrQueueFull
+	}
+
+	tail := q.segments[len(q.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(record)) > q.cfg.SegmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		tail = q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.active.Write(record); err != nil {
+		// Cut off a partially written record so the segment stays readable
+		q.active.Truncate(tail.size)
+		q.active.Seek(tail.size, io.SeekStart)
+		return fmt.Errorf("failed to write usage event: %v", err)
+	}
+	tail.size += int64(len(record))
+	tail.records++
+	q.dirty = true
+	q.enqueued.Add(1)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// makeRoom applies the overflow policy and reports whether n more bytes fit
+func (q *DiskEventQueue) makeRoom(n int64) bool {
+	if n > q.cfg.MaxBytes {
+		return false
+	}
+	for q.diskBytes()+n > q.cfg.MaxBytes {
+		if q.cfg.Overflow != OverflowDropOldest {
+			return false
+		}
+		if len(q.segments) == 1 {
+			// Only the active segment is left; start a new one so it can be dropped
+			if err := q.rotate(); err != nil {
+				return false
+			}
+		}
+		q.dropOldest()
+	}
+	return true
+}
+
+// dropOldest deletes the oldest segment along with its undelivered events
+func (q *DiskEventQueue) dropOldest() {
+	oldest := q.segments[0]
+	lost := oldest.records
+	if oldest.id == q.read.Segment {
+		lost -= q.read.Records
+	}
+	q.segments = q.segments[1:]
+	os.Remove(q.segmentPath(oldest.id))
+	q.read = cursor{Segment: q.segments[0].id}
+	q.writeCursor()
+	q.dropped.Add(uint64(lost))
+
+	q.logger.Warn("event queue is full, dropped oldest segment",
+		zap.Uint64("segment", oldest.id),
+		zap.Int("events", lost))
+}
+
+// diskBytes returns the size of all segments
+func (q *DiskEventQueue) diskBytes() int64 {
+	var total int64
+	for _, seg := range q.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// rotate closes the active segment and starts a new one
+func (q *DiskEventQueue) rotate() error {
+	next := q.segments[len(q.segments)-1].id + 1
+	file, err := os.OpenFile(q.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create event queue segment: %v", err)
+	}
+	q.active.Sync()
+	q.active.Close()
+	q.active = file
+	q.segments = append(q.segments, &segment{id: next})
+	return nil
+}
+
+// deliverLoop hands batches to the sink until the queue is stopped, retrying
+// failed batches with exponential backoff or after the requested Retry-After
+func (q *DiskEventQueue) deliverLoop() {
+	defer q.wg.Done()
+
+	backoff := q.cfg.RetryInitial
+	for {
+		batch, start, next := q.readBatch()
+
+		if len(batch) == 0 {
+			if next != start {
+				// Only corrupt or exhausted segments were passed over
+				q.advance(next)
+				continue
+			}
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.notify:
+			case <-time.After(q.cfg.SyncInterval):
+			}
+			continue
+		}
+
+		if err := q.sink(q.ctx, batch); err != nil {
+			if q.ctx.Err() != nil {
+				return
+			}
+			q.retried.Add(uint64(len(batch)))
+			wait := max(jitter(backoff), retryAfter(err))
+			q.logger.Warn("failed to deliver usage events, retrying",
+				zap.Error(err),
+				zap.Int("events_count", len(batch)),
+				zap.Duration("retry_in", wait))
+			backoff = min(backoff*2, q.cfg.RetryMax)
+
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		backoff = q.cfg.RetryInitial
+		q.delivered.Add(uint64(len(batch)))
+		q.advance(next)
+	}
+}
+
+// jitter spreads retries over [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// readBatch reads up to BatchSize events from the cursor and returns them with
+// the cursor they were read from and the position following the last one
+func (q *DiskEventQueue) readBatch() ([]UsageEvent, cursor, cursor) {
+	q.mu.Lock()
+	start := q.read
+	pos := start
+	var segs []segment
+	for _, seg := range q.segments {
+		if seg.id >= pos.Segment {
+			segs = append(segs, *seg)
+		}
+	}
+	q.mu.Unlock()
+
+	var batch []UsageEvent
+	for i, seg := range segs {
+		if seg.id != pos.Segment {
+			continue
+		}
+		if pos.Offset >= seg.size {
+			// Move past a fully read segment unless it is still being written
+			if i+1 < len(segs) {
+				pos = cursor{Segment: segs[i+1].id}
+			}
+			continue
+		}
+
+		events, next, err := q.readSegment(seg, pos, q.cfg.BatchSize-len(batch))
+		batch = append(batch, events...)
+		if err != nil {
+			// Skip the unreadable rest of the segment rather than stalling delivery
+			q.logger.Error("skipping corrupt event queue segment",
+				zap.Uint64("segment", seg.id),
+				zap.Int64("offset", next.Offset),
+				zap.Error(err))
+			q.dropped.Add(uint64(seg.records - next.Records))
+			next = cursor{Segment: seg.id, Offset: seg.size, Records: seg.records}
+		}
+		pos = next
+		if len(batch) >= q.cfg.BatchSize {
+			break
+		}
+		if pos.Offset >= seg.size && i+1 < len(segs) {
+			pos = cursor{Segment: segs[i+1].id}
+		}
+	}
+	return batch, start, pos
+}
+
+// readSegment reads up to limit records of seg starting at pos
+func (q *DiskEventQueue) readSegment(seg segment, pos cursor, limit int) ([]UsageEvent, cursor, error) {
+	file, err := os.Open(q.segmentPath(seg.id))
+	if err != nil {
+		return nil, pos, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, seg.size-pos.Offset))
+
+	var events []UsageEvent
+	for len(events) < limit && pos.Offset < seg.size {
+		data, err := readRecord(reader, seg.size-pos.Offset)
+		if err != nil {
+			return events, pos, err
+		}
+		var event UsageEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return events, pos, fmt.Errorf("failed to decode usage event: %v", err)
+		}
+		events = append(events, event)
+		pos.Offset += int64(recordHeaderSize + len(data))
+		pos.Records++
+	}
+	return events, pos, nil
+}
+
+// readRecord reads one length-prefixed, checksummed record from at most
+// remaining bytes
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize || int64(length) > remaining-recordHeaderSize {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return data, nil
+}
+
+// advance moves the cursor past delivered events and deletes segments that
+// no longer hold undelivered events
+func (q *DiskEventQueue) advance(next cursor) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The segment may have been dropped by the overflow policy meanwhile
+	if len(q.segments) == 0 || next.Segment < q.segments[0].id {
+		return
+	}
+	q.read = next
+	for len(q.segments) > 1 && q.segments[0].id < q.read.Segment {
+		os.Remove(q.segmentPath(q.segments[0].id))
+		q.segments = q.segments[1:]
+	}
+	q.writeCursor()
+}
+
+// writeCursor persists the cursor atomically
+func (q *DiskEventQueue) writeCursor() {
+	data, _ := json.Marshal(q.read)
+	path := filepath.Join(q.cfg.Dir, cursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		q.logger.Error("failed to write event queue cursor", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		q.logger.Error("failed to write event queue cursor", zap.Error(err))
+	}
+}
+
+// syncLoop periodically flushes the active segment to stable storage
+func (q *DiskEventQueue) syncLoop() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			if q.dirty && q.active != nil {
+				if err := q.active.Sync(); err != nil {
+					q.logger.Error("failed to sync event queue", zap.Error(err))
+				}
+				q.dirty = false
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// recover loads the segments and cursor left by a previous run. A record torn
+// by a crash at the end of the last segment is truncated away.
+func (q *DiskEventQueue) recover() error {
+	entries, err := os.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read event queue directory: %v", err)
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var saved cursor
+	if data, err := os.ReadFile(filepath.Join(q.cfg.Dir, cursorFile)); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			q.logger.Warn("ignoring unreadable event queue cursor", zap.Error(err))
+			saved = cursor{}
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.segments = nil
+	for i, id := range ids {
+		if id < saved.Segment {
+			// Fully delivered before the previous run stopped
+			os.Remove(q.segmentPath(id))
+			continue
+		}
+		seg, err := q.scanSegment(id, i == len(ids)-1)
+		if err != nil {
+			return err
+		}
+		q.segments = append(q.segments, seg)
+	}
+
+	if len(q.segments) == 0 {
+		first := max(saved.Segment, 1)
+		q.segments = []*segment{{id: first}}
+	}
+
+	head := q.segments[0]
+	if saved.Segment == head.id && saved.Offset <= head.size && saved.Records <= head.records {
+		q.read = saved
+	} else {
+		q.read = cursor{Segment: head.id}
+	}
+
+	tail := q.segments[len(q.segments)-1]
+	q.active, err = os.OpenFile(q.segmentPath(tail.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open event queue segment: %v", err)
+	}
+	return nil
+}
+
+// scanSegment counts the valid records of a segment. Invalid data is cut off
+// the last segment, which may end in a torn write; earlier segments are kept
+// as they are and their unreadable tail is skipped during delivery.
+func (q *DiskEventQueue) scanSegment(id uint64, last bool) (*segment, error) {
+	path := q.segmentPath(id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event queue segment: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat event queue segment: %v", err)
+	}
+
+	seg := &segment{id: id}
+	reader := bufio.NewReader(file)
+	for {
+		data, err := readRecord(reader, info.Size()-seg.size)
+		if err != nil {
+			break
+		}
+		seg.size += int64(recordHeaderSize + len(data))
+		seg.records++
+	}
+
+	if seg.size < info.Size() {
+		if last {
+			q.logger.Warn("truncating torn write in event queue segment",
+				zap.Uint64("segment", id),
+				zap.Int64("valid_bytes", seg.size),
+				zap.Int64("file_bytes", info.Size()))
+			if err := os.Truncate(path, seg.size); err != nil {
+				return nil, fmt.Errorf("failed to truncate event queue segment: %v", err)
+			}
+		} else {
+			seg.size = info.Size()
+		}
+	}
+	return seg, nil
+}
+
+// segmentPath returns the file name of a segment
+func (q *DiskEventQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.cfg.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, id, segmentSuffix))
+}
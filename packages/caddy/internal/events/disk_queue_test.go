@@ -0,0 +1,248 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordingSink collects delivered events and fails while failing is set
+type recordingSink struct {
+	mu        sync.Mutex
+	failures  int
+	failing   bool
+	delivered []string
+}
+
+func (s *recordingSink) deliver(ctx context.Context, events []UsageEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing || s.failures > 0 {
+		if s.failures > 0 {
+			s.failures--
+		}
+		return errors.New("sink unavailable")
+	}
+	for _, event := range events {
+		s.delivered = append(s.delivered, event.ID)
+	}
+	return nil
+}
+
+func (s *recordingSink) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.delivered...)
+}
+
+// newTestDiskQueue starts a queue with fast retries in dir
+func newTestDiskQueue(t *testing.T, cfg DiskQueueConfig, sink Sink) *DiskEventQueue {
+	t.Helper()
+	cfg.RetryInitial = 5 * time.Millisecond
+	cfg.RetryMax = 20 * time.Millisecond
+	cfg.SyncInterval = 10 * time.Millisecond
+	q := NewDiskEventQueue(cfg, sink, zap.NewNop())
+	require.NoError(t, q.Start())
+	return q
+}
+
+func testEvent(i int) UsageEvent {
+	return UsageEvent{
+		ID:              fmt.Sprintf("event-%03d", i),
+		APIPath:         "/weather/*",
+		SubscriptionKey: "test-key",
+		Method:          "GET",
+		StatusCode:      200,
+		Success:         true,
+		Timestamp:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func eventIDs(from, to int) []string {
+	var ids []string
+	for i := from; i < to; i++ {
+		ids = append(ids, testEvent(i).ID)
+	}
+	return ids
+}
+
+// recordSize returns the on-disk size of one test event
+func recordSize(t *testing.T) int64 {
+	q := newTestDiskQueue(t, DiskQueueConfig{Dir: t.TempDir()}, (&recordingSink{failing: true}).deliver)
+	defer q.Stop()
+	require.NoError(t, q.Enqueue(testEvent(0)))
+	return q.Stats().DiskBytes
+}
+
+func TestDiskEventQueue_RetriesUntilDelivered(t *testing.T) {
+	sink := &recordingSink{failures: 2}
+	q := newTestDiskQueue(t, DiskQueueConfig{Dir: t.TempDir()}, sink.deliver)
+	defer q.Stop()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Enqueue(testEvent(i)))
+	}
+
+	assert.Eventually(t, func() bool { return q.Stats().Delivered == 3 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, eventIDs(0, 3), sink.ids())
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(3), stats.Enqueued)
+	assert.NotZero(t, stats.Retried)
+	assert.Zero(t, stats.Dropped)
+	assert.Zero(t, stats.Pending)
+}
+
+func TestDiskEventQueue_ResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	size := recordSize(t)
+
+	// Small segments spread the events over several files
+	cfg := DiskQueueConfig{Dir: dir, SegmentBytes: 2 * size, BatchSize: 2}
+	down := &recordingSink{failing: true}
+	q := newTestDiskQueue(t, cfg, down.deliver)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, q.Enqueue(testEvent(i)))
+	}
+	assert.Equal(t, 5, q.Stats().Pending)
+	require.NoError(t, q.Stop())
+
+	// Deliver part of the backlog and stop again
+	partial := &recordingSink{}
+	cfg.BatchSize = 3
+	q = newTestDiskQueue(t, cfg, partial.deliver)
+	assert.Eventually(t, func() bool { return len(partial.ids()) >= 3 }, 2*time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Stop())
+
+	up := &recordingSink{}
+	q = newTestDiskQueue(t, cfg, up.deliver)
+	defer q.Stop()
+	require.NoError(t, q.Enqueue(testEvent(5)))
+
+	assert.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, eventIDs(0, 6), append(partial.ids(), up.ids()...))
+
+	// Delivered segments are removed
+	segments, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestDiskEventQueue_Overflow(t *testing.T) {
+	size := recordSize(t)
+
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		wantErr  error
+		want     []string
+	}{
+		{
+			name:     "drop newest rejects new events",
+			overflow: OverflowDropNewest,
+			wantErr:  ErrQueueFull,
+			want:     eventIDs(0, 4),
+		},
+		{
+			name:     "drop oldest discards the oldest segment",
+			overflow: OverflowDropOldest,
+			want:     eventIDs(2, 6),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := DiskQueueConfig{Dir: dir, MaxBytes: 4 * size, SegmentBytes: 2 * size, Overflow: tt.overflow}
+
+			q := newTestDiskQueue(t, cfg, (&recordingSink{failing: true}).deliver)
+			for i := 0; i < 4; i++ {
+				require.NoError(t, q.Enqueue(testEvent(i)))
+			}
+			for i := 4; i < 6; i++ {
+				assert.Equal(t, tt.wantErr, q.Enqueue(testEvent(i)))
+			}
+
+			stats := q.Stats()
+			assert.Equal(t, uint64(2), stats.Dropped)
+			assert.Equal(t, 4, stats.Pending)
+			assert.LessOrEqual(t, stats.DiskBytes, cfg.MaxBytes)
+			require.NoError(t, q.Stop())
+
+			sink := &recordingSink{}
+			q = newTestDiskQueue(t, cfg, sink.deliver)
+			defer q.Stop()
+			assert.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 2*time.Second, 5*time.Millisecond)
+			assert.Equal(t, tt.want, sink.ids())
+		})
+	}
+}
+
+func TestDiskEventQueue_TruncatesTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	q := newTestDiskQueue(t, DiskQueueConfig{Dir: dir}, (&recordingSink{failing: true}).deliver)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, q.Enqueue(testEvent(i)))
+	}
+	size := q.Stats().DiskBytes
+	require.NoError(t, q.Stop())
+
+	// Simulate a crash in the middle of appending a record
+	segments, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 0xde, 0xad, '{', '"'})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	sink := &recordingSink{}
+	q = newTestDiskQueue(t, DiskQueueConfig{Dir: dir}, sink.deliver)
+	defer q.Stop()
+
+	info, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+
+	require.NoError(t, q.Enqueue(testEvent(2)))
+	assert.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, eventIDs(0, 3), sink.ids())
+	assert.Zero(t, q.Stats().Dropped)
+}
+
+func TestReadRecord_RejectsCorruptLength(t *testing.T) {
+	record := func(length uint32) []byte {
+		data := make([]byte, recordHeaderSize+4)
+		binary.BigEndian.PutUint32(data[0:4], length)
+		return data
+	}
+
+	tests := []struct {
+		name      string
+		record    []byte
+		remaining int64
+	}{
+		{name: "longer than the segment", record: record(5), remaining: recordHeaderSize + 4},
+		{name: "longer than a record can be", record: record(maxRecordSize + 1), remaining: 1 << 30},
+		{name: "huge length", record: record(0xffffffff), remaining: 1 << 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRecord(bytes.NewReader(tt.record), tt.remaining)
+			assert.ErrorContains(t, err, "invalid record length")
+		})
+	}
+}
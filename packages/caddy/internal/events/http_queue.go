@@ -1,62 +1,128 @@
 package events
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// Defaults for HTTPQueueConfig fields left at zero
+const (
+	defaultHTTPBatchSize     = 10
+	defaultHTTPFlushInterval = 5 * time.Second
+	defaultHTTPSenders       = 4
+	defaultHTTPMaxAttempts   = 5
+)
+
+// HTTPQueueConfig configures an HTTPEventQueue
+type HTTPQueueConfig struct {
+	// BatchSize is the number of events that triggers a send
+	BatchSize int
+	// FlushInterval is how often a partial batch is sent
+	FlushInterval time.Duration
+	// Senders bounds the number of batches delivered concurrently
+	Senders int
+	// MaxAttempts is how often a batch is sent before it is dead-lettered
+	MaxAttempts int
+	// RetryInitial and RetryMax bound the exponential backoff between attempts
+	RetryInitial time.Duration
+	RetryMax     time.Duration
+	// DeadLetterFile receives batches that could not be delivered. Failed
+	// batches are discarded when it is empty.
+	DeadLetterFile string
+}
+
 // HTTPEventQueue implements UsageEventQueue using HTTP POST to the Elysia server
 type HTTPEventQueue struct {
-	events         chan UsageEvent
-	endpointURL    string
-	client         *http.Client
-	batchSize      int
-	flushInterval  time.Duration
-	logger         *zap.Logger
-	ctx            context.Context
-	cancel         context.CancelFunc
-	wg             sync.WaitGroup
-	buffer         []UsageEvent
-	bufferMutex    sync.Mutex
+	events      chan UsageEvent
+	batches     chan []UsageEvent
+	endpointURL string
+	client      *http.Client
+	cfg         HTTPQueueConfig
+	deadLetters *deadLetterFile
+	logger      *zap.Logger
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	senders     sync.WaitGroup
+	buffer      []UsageEvent
+	bufferMutex sync.Mutex
+	stopMutex   sync.RWMutex
+	stopped     bool
+
+	enqueued     atomic.Uint64
+	delivered    atomic.Uint64
+	retried      atomic.Uint64
+	dropped      atomic.Uint64
+	deadLettered atomic.Uint64
 }
 
 // NewHTTPEventQueue creates a new HTTP-based event queue
-func NewHTTPEventQueue(endpointURL string, logger *zap.Logger) *HTTPEventQueue {
+func NewHTTPEventQueue(endpointURL string, cfg HTTPQueueConfig, logger *zap.Logger) *HTTPEventQueue {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultHTTPBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultHTTPFlushInterval
+	}
+	if cfg.Senders <= 0 {
+		cfg.Senders = defaultHTTPSenders
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultHTTPMaxAttempts
+	}
+	if cfg.RetryInitial <= 0 {
+		cfg.RetryInitial = defaultRetryInitial
+	}
+	if cfg.RetryMax < cfg.RetryInitial {
+		cfg.RetryMax = max(defaultRetryMax, cfg.RetryInitial)
+	}
+
+	var deadLetters *deadLetterFile
+	if cfg.DeadLetterFile != "" {
+		deadLetters = openDeadLetterFile(cfg.DeadLetterFile)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &HTTPEventQueue{
-		events:        make(chan UsageEvent, 1000), // Buffer up to 1000 events
-		endpointURL:   endpointURL,
-		client:        &http.Client{Timeout: 30 * time.Second},
-		batchSize:     10,  // Send events in batches of 10
-		flushInterval: 5 * time.Second, // Flush every 5 seconds
-		logger:        logger,
-		ctx:           ctx,
-		cancel:        cancel,
-		buffer:        make([]UsageEvent, 0, 10),
+		events:      make(chan UsageEvent, 1000), // Buffer up to 1000 events
+		batches:     make(chan []UsageEvent, cfg.Senders),
+		endpointURL: endpointURL,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		cfg:         cfg,
+		deadLetters: deadLetters,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+		buffer:      make([]UsageEvent, 0, cfg.BatchSize),
 	}
 }
 
 // Enqueue adds a usage event to the queue
 func (q *HTTPEventQueue) Enqueue(event UsageEvent) error {
+	q.stopMutex.RLock()
+	defer q.stopMutex.RUnlock()
+	if q.stopped {
+		return fmt.Errorf("event queue is stopped")
+	}
+
 	select {
 	case q.events <- event:
+		q.enqueued.Add(1)
 		return nil
-	case <-q.ctx.Done():
-		return fmt.Errorf("event queue is stopped")
 	default:
 		// Queue is full, log warning and drop event
+		q.dropped.Add(1)
 		q.logger.Warn("event queue is full, dropping event",
 			zap.String("api_path", event.APIPath),
 			zap.String("method", event.Method))
-		return fmt.Errorf("event queue is full")
+		return ErrQueueFull
 	}
 }
 
@@ -70,30 +136,69 @@ func (q *HTTPEventQueue) Start() error {
 	// Start periodic flusher goroutine
 	go q.periodicFlush()
 
+	// Start a fixed pool of senders
+	q.senders.Add(q.cfg.Senders)
+	for i := 0; i < q.cfg.Senders; i++ {
+		go q.sendBatches()
+	}
+
 	q.logger.Info("event queue started",
 		zap.String("endpoint", q.endpointURL),
-		zap.Int("batch_size", q.batchSize),
-		zap.Duration("flush_interval", q.flushInterval))
+		zap.Int("batch_size", q.cfg.BatchSize),
+		zap.Duration("flush_interval", q.cfg.FlushInterval),
+		zap.Int("senders", q.cfg.Senders),
+		zap.Int("max_attempts", q.cfg.MaxAttempts),
+		zap.String("dead_letter_file", q.cfg.DeadLetterFile))
 
 	return nil
 }
 
-// Stop gracefully stops the event queue
+// Stop gracefully stops the event queue. Queued events get one delivery
+// attempt and are dead-lettered if it fails.
 func (q *HTTPEventQueue) Stop() error {
+	q.stopMutex.Lock()
+	if q.stopped {
+		q.stopMutex.Unlock()
+		return nil
+	}
+	q.stopped = true
+	q.stopMutex.Unlock()
+
 	q.logger.Info("stopping event queue")
 
 	q.cancel()
-	close(q.events)
 	q.wg.Wait()
 
 	// Flush any remaining events
 	q.bufferMutex.Lock()
-	if len(q.buffer) > 0 {
-		q.sendBatch(q.buffer)
+	for drained := false; !drained; {
+		select {
+		case event := <-q.events:
+			q.buffer = append(q.buffer, event)
+		default:
+			drained = true
+		}
 	}
+	remaining := q.buffer
+	q.buffer = nil
 	q.bufferMutex.Unlock()
 
-	q.logger.Info("event queue stopped")
+	for len(remaining) > 0 {
+		n := min(len(remaining), q.cfg.BatchSize)
+		q.batches <- remaining[:n]
+		remaining = remaining[n:]
+	}
+	close(q.batches)
+	q.senders.Wait()
+	if q.deadLetters != nil {
+		q.deadLetters.release()
+	}
+
+	stats := q.Stats()
+	q.logger.Info("event queue stopped",
+		zap.Uint64("delivered", stats.Delivered),
+		zap.Uint64("dead_lettered", stats.DeadLettered),
+		zap.Uint64("dropped", stats.Dropped))
 	return nil
 }
 
@@ -102,29 +207,55 @@ func (q *HTTPEventQueue) ProcessEvents() error {
 	return nil
 }
 
+// Stats returns the queue's delivery counters
+func (q *HTTPEventQueue) Stats() QueueStats {
+	q.bufferMutex.Lock()
+	pending := len(q.buffer)
+	q.bufferMutex.Unlock()
+
+	return QueueStats{
+		Enqueued:     q.enqueued.Load(),
+		Delivered:    q.delivered.Load(),
+		Retried:      q.retried.Load(),
+		Dropped:      q.dropped.Load(),
+		DeadLettered: q.deadLettered.Load(),
+		Pending:      pending + len(q.events),
+	}
+}
+
+// ReplayDeadLetters sends the dead-lettered batches to the endpoint again
+func (q *HTTPEventQueue) ReplayDeadLetters(ctx context.Context) (ReplayResult, error) {
+	if q.deadLetters == nil {
+		return ReplayResult{}, ErrNoDeadLetters
+	}
+	result, err := q.deadLetters.replay(ctx, func(ctx context.Context, events []UsageEvent) error {
+		return postEvents(ctx, q.client, q.endpointURL, events)
+	})
+	if result.Batches > 0 {
+		q.logger.Info("replayed dead-lettered events",
+			zap.Int("batches", result.Batches),
+			zap.Int("delivered", result.Delivered),
+			zap.Int("failed", result.Failed))
+	}
+	return result, err
+}
+
 // collectEvents collects events from the channel and batches them
 func (q *HTTPEventQueue) collectEvents() {
 	defer q.wg.Done()
 
 	for {
 		select {
-		case event, ok := <-q.events:
-			if !ok {
-				// Channel closed, flush remaining buffer and exit
-				return
-			}
-
+		case event := <-q.events:
 			q.bufferMutex.Lock()
 			q.buffer = append(q.buffer, event)
 
 			// Send batch if we've reached batch size
-			if len(q.buffer) >= q.batchSize {
-				batch := make([]UsageEvent, len(q.buffer))
-				copy(batch, q.buffer)
-				q.buffer = q.buffer[:0] // Clear buffer
+			if len(q.buffer) >= q.cfg.BatchSize {
+				batch := q.takeBuffer()
 				q.bufferMutex.Unlock()
 
-				go q.sendBatch(batch)
+				q.dispatch(batch)
 			} else {
 				q.bufferMutex.Unlock()
 			}
@@ -139,7 +270,7 @@ func (q *HTTPEventQueue) collectEvents() {
 func (q *HTTPEventQueue) periodicFlush() {
 	defer q.wg.Done()
 
-	ticker := time.NewTicker(q.flushInterval)
+	ticker := time.NewTicker(q.cfg.FlushInterval)
 	defer ticker.Stop()
 
 	for {
@@ -147,12 +278,10 @@ func (q *HTTPEventQueue) periodicFlush() {
 		case <-ticker.C:
 			q.bufferMutex.Lock()
 			if len(q.buffer) > 0 {
-				batch := make([]UsageEvent, len(q.buffer))
-				copy(batch, q.buffer)
-				q.buffer = q.buffer[:0] // Clear buffer
+				batch := q.takeBuffer()
 				q.bufferMutex.Unlock()
 
-				go q.sendBatch(batch)
+				q.dispatch(batch)
 			} else {
 				q.bufferMutex.Unlock()
 			}
@@ -163,52 +292,108 @@ func (q *HTTPEventQueue) periodicFlush() {
 	}
 }
 
-// sendBatch sends a batch of events to the Elysia server
+// takeBuffer returns a copy of the buffered events and clears the buffer;
+// the caller holds bufferMutex
+func (q *HTTPEventQueue) takeBuffer() []UsageEvent {
+	batch := make([]UsageEvent, len(q.buffer))
+	copy(batch, q.buffer)
+	q.buffer = q.buffer[:0] // Clear buffer
+	return batch
+}
+
+// dispatch hands a batch to the senders, waiting while all of them are busy.
+// On shutdown the batch is put back into the buffer for Stop to flush.
+func (q *HTTPEventQueue) dispatch(batch []UsageEvent) {
+	select {
+	case q.batches <- batch:
+	case <-q.ctx.Done():
+		q.bufferMutex.Lock()
+		q.buffer = append(batch, q.buffer...)
+		q.bufferMutex.Unlock()
+	}
+}
+
+// sendBatches delivers batches until the queue is stopped
+func (q *HTTPEventQueue) sendBatches() {
+	defer q.senders.Done()
+
+	for batch := range q.batches {
+		q.sendBatch(batch)
+	}
+}
+
+// sendBatch sends a batch of events to the Elysia server, retrying with
+// jittered exponential backoff or after the requested Retry-After. Batches
+// that still fail are dead-lettered.
 func (q *HTTPEventQueue) sendBatch(events []UsageEvent) {
 	if len(events) == 0 {
 		return
 	}
 
-	payload := map[string]interface{}{
-		"events": events,
-	}
+	backoff := q.cfg.RetryInitial
+	for attempt := 1; ; attempt++ {
+		err := postEvents(context.Background(), q.client, q.endpointURL, events)
+		if err == nil {
+			q.delivered.Add(uint64(len(events)))
+			q.logger.Debug("successfully sent events",
+				zap.Int("events_count", len(events)))
+			return
+		}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		q.logger.Error("failed to marshal events",
+		if attempt >= q.cfg.MaxAttempts || isPermanent(err) || q.ctx.Err() != nil {
+			q.deadLetter(events, attempt, err)
+			return
+		}
+
+		q.retried.Add(uint64(len(events)))
+		wait := max(jitter(backoff), retryAfter(err))
+		q.logger.Warn("failed to send events, retrying",
 			zap.Error(err),
-			zap.Int("events_count", len(events)))
-		return
+			zap.Int("events_count", len(events)),
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", wait))
+		backoff = min(backoff*2, q.cfg.RetryMax)
+
+		select {
+		case <-q.ctx.Done():
+			q.deadLetter(events, attempt, err)
+			return
+		case <-time.After(wait):
+		}
 	}
+}
 
-	req, err := http.NewRequest("POST", q.endpointURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		q.logger.Error("failed to create request",
-			zap.Error(err),
-			zap.Int("events_count", len(events)))
+// deadLetter stores a batch that could not be delivered
+func (q *HTTPEventQueue) deadLetter(events []UsageEvent, attempts int, cause error) {
+	if q.deadLetters == nil {
+		q.dropped.Add(uint64(len(events)))
+		q.logger.Error("failed to send events, discarding batch",
+			zap.Error(cause),
+			zap.Int("events_count", len(events)),
+			zap.Int("attempts", attempts),
+			zap.String("endpoint", q.endpointURL))
 		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := q.client.Do(req)
+	err := q.deadLetters.add(DeadLetter{
+		FailedAt: time.Now().UTC(),
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Events:   events,
+	})
 	if err != nil {
-		q.logger.Error("failed to send events",
+		q.dropped.Add(uint64(len(events)))
+		q.logger.Error("failed to dead-letter events, discarding batch",
 			zap.Error(err),
-			zap.Int("events_count", len(events)),
-			zap.String("endpoint", q.endpointURL))
+			zap.NamedError("cause", cause),
+			zap.Int("events_count", len(events)))
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		q.logger.Debug("successfully sent events",
-			zap.Int("events_count", len(events)),
-			zap.Int("status_code", resp.StatusCode))
-	} else {
-		q.logger.Error("failed to send events - bad status",
-			zap.Int("events_count", len(events)),
-			zap.Int("status_code", resp.StatusCode),
-			zap.String("endpoint", q.endpointURL))
-	}
-}
\ No newline at end of file
+	q.deadLettered.Add(uint64(len(events)))
+	q.logger.Warn("failed to send events, batch dead-lettered",
+		zap.Error(cause),
+		zap.Int("events_count", len(events)),
+		zap.Int("attempts", attempts),
+		zap.String("dead_letter_file", q.cfg.DeadLetterFile))
+}
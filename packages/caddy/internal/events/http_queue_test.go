@@ -0,0 +1,268 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// eventServer is a test events endpoint answering with the next scripted
+// status, 200 once the script is exhausted
+type eventServer struct {
+	mu       sync.Mutex
+	statuses []int
+	received []string
+	requests atomic.Int32
+	inFlight atomic.Int32
+	peak     atomic.Int32
+	delay    time.Duration
+}
+
+func (s *eventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	var payload struct {
+		Events []UsageEvent `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, event := range payload.Events {
+		s.received = append(s.received, event.ID)
+	}
+}
+
+func (s *eventServer) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// newTestHTTPQueue starts a queue with fast retries against server
+func newTestHTTPQueue(t *testing.T, server *httptest.Server, cfg HTTPQueueConfig) *HTTPEventQueue {
+	t.Helper()
+	cfg.RetryInitial = 5 * time.Millisecond
+	cfg.RetryMax = 20 * time.Millisecond
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = 10 * time.Millisecond
+	}
+	q := NewHTTPEventQueue(server.URL, cfg, zap.NewNop())
+	require.NoError(t, q.Start())
+	return q
+}
+
+func TestHTTPEventQueue_RetriesUntilDelivered(t *testing.T) {
+	handler := &eventServer{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	q := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 3})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Enqueue(testEvent(i)))
+	}
+
+	assert.Eventually(t, func() bool { return q.Stats().Delivered == 3 }, 2*time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Stop())
+
+	assert.Equal(t, eventIDs(0, 3), handler.ids())
+	assert.Equal(t, int32(3), handler.requests.Load())
+	stats := q.Stats()
+	assert.Equal(t, uint64(6), stats.Retried)
+	assert.Zero(t, stats.DeadLettered)
+}
+
+func TestHTTPEventQueue_DeadLettersAndReplays(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int32
+	}{
+		{
+			name:         "gives up after max attempts",
+			statuses:     []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			wantRequests: 3,
+		},
+		{
+			name:         "does not retry client errors",
+			statuses:     []int{http.StatusUnprocessableEntity},
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &eventServer{statuses: tt.statuses}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+			q := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 2, MaxAttempts: 3, DeadLetterFile: path})
+			defer q.Stop()
+
+			for i := 0; i < 2; i++ {
+				require.NoError(t, q.Enqueue(testEvent(i)))
+			}
+			assert.Eventually(t, func() bool { return q.Stats().DeadLettered == 2 }, 2*time.Second, 5*time.Millisecond)
+			assert.Equal(t, tt.wantRequests, handler.requests.Load())
+			assert.Empty(t, handler.ids())
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			var letter DeadLetter
+			require.NoError(t, json.Unmarshal(data, &letter))
+			assert.Equal(t, int(tt.wantRequests), letter.Attempts)
+			assert.Len(t, letter.Events, 2)
+
+			result, err := q.ReplayDeadLetters(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, ReplayResult{Batches: 1, Events: 2, Delivered: 2}, result)
+			assert.Equal(t, eventIDs(0, 2), handler.ids())
+
+			_, err = os.Stat(path)
+			assert.True(t, os.IsNotExist(err), "replayed batches should be removed")
+		})
+	}
+}
+
+func TestHTTPEventQueue_ReplayKeepsFailedBatches(t *testing.T) {
+	handler := &eventServer{statuses: []int{http.StatusBadRequest, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	q := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 1, Senders: 1, DeadLetterFile: path})
+	defer q.Stop()
+
+	require.NoError(t, q.Enqueue(testEvent(0)))
+	assert.Eventually(t, func() bool { return q.Stats().DeadLettered == 1 }, 2*time.Second, 5*time.Millisecond)
+
+	result, err := q.ReplayDeadLetters(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ReplayResult{Batches: 1, Events: 1, Failed: 1}, result)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var letter DeadLetter
+	require.NoError(t, json.Unmarshal(data, &letter))
+	assert.Equal(t, 2, letter.Attempts)
+	assert.Contains(t, letter.Error, "503")
+
+	result, err = q.ReplayDeadLetters(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Delivered)
+	assert.Equal(t, eventIDs(0, 1), handler.ids())
+}
+
+func TestHTTPEventQueue_SharesDeadLetterFile(t *testing.T) {
+	handler := &eventServer{statuses: make([]int, 40)}
+	for i := range handler.statuses {
+		handler.statuses[i] = http.StatusBadRequest
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Queues writing to the same file share it and its locks
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	first := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 1, Senders: 4, DeadLetterFile: path})
+	second := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 1, Senders: 4, DeadLetterFile: path})
+	assert.Same(t, first.deadLetters, second.deadLetters)
+
+	// Letters larger than a write buffer are not interleaved
+	for i := 0; i < 20; i++ {
+		for _, q := range []*HTTPEventQueue{first, second} {
+			event := testEvent(i)
+			event.APIPath = "/" + strings.Repeat("x", 8<<10)
+			require.NoError(t, q.Enqueue(event))
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return first.Stats().DeadLettered+second.Stats().DeadLettered == 40
+	}, 2*time.Second, 5*time.Millisecond)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 40)
+	for _, line := range lines {
+		var letter DeadLetter
+		assert.NoError(t, json.Unmarshal([]byte(line), &letter))
+	}
+
+	require.NoError(t, first.Stop())
+	require.NoError(t, second.Stop())
+	assert.NotContains(t, deadLetterFiles, path)
+}
+
+func TestHTTPEventQueue_BoundsConcurrentSenders(t *testing.T) {
+	handler := &eventServer{delay: 20 * time.Millisecond}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	q := newTestHTTPQueue(t, server, HTTPQueueConfig{BatchSize: 1, Senders: 2})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Enqueue(testEvent(i)))
+	}
+	require.NoError(t, q.Stop())
+
+	assert.Len(t, handler.ids(), 10)
+	assert.LessOrEqual(t, handler.peak.Load(), int32(2))
+	assert.Equal(t, uint64(10), q.Stats().Delivered)
+
+	assert.Error(t, q.Enqueue(testEvent(10)), "enqueue after stop should fail")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "empty", value: "", want: 0},
+		{name: "seconds", value: "120", want: 2 * time.Minute},
+		{name: "negative seconds", value: "-5", want: 0},
+		{name: "http date", value: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second},
+		{name: "date in the past", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "garbage", value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.value, now))
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewHTTPSink returns a sink that POSTs batches as {"events": [...]} to the
+// endpoint and fails on any non-2xx response
+func NewHTTPSink(endpointURL string, client *http.Client) Sink {
+	return func(ctx context.Context, events []UsageEvent) error {
+		return postEvents(ctx, client, endpointURL, events)
+	}
+}
+
+// NewSlogSink returns a sink that writes events as structured JSON logs to stdout
+func NewSlogSink() Sink {
+	eventLogger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	return func(ctx context.Context, events []UsageEvent) error {
+		for _, event := range events {
+			logUsageEvent(eventLogger, event)
+		}
+		return nil
+	}
+}
+
+// postEvents sends a batch of events to an HTTP endpoint
+func postEvents(ctx context.Context, client *http.Client, endpointURL string, events []UsageEvent) error {
+	payload := map[string]interface{}{
+		"events": events,
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal events: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return nil
+}
+
+// StatusError is returned by HTTP sinks when the endpoint answers with a
+// non-2xx status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay requested by a Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to send events: endpoint returned %s", e.Status)
+}
+
+// Permanent reports whether retrying the same batch cannot succeed. Client
+// errors other than timeouts and rate limiting are not retried.
+func (e *StatusError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// retryAfter returns the delay requested by the endpoint for a failed
+// delivery, or zero
+func retryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// isPermanent reports whether a failed delivery should not be retried
+func isPermanent(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Permanent()
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// logUsageEvent writes a usage event as a structured log record
+func logUsageEvent(eventLogger *slog.Logger, event UsageEvent) {
+	attrs := []any{
+		slog.String("event_type", "api_usage"),
+		slog.String("id", event.ID),
+		slog.String("api_path", event.APIPath),
+		slog.String("subscription_key", event.SubscriptionKey),
+		slog.String("method", event.Method),
+		slog.Int64("response_time_ms", event.ResponseTime),
+		slog.Int("status_code", event.StatusCode),
+		slog.Bool("success", event.Success),
+		slog.Time("timestamp", event.Timestamp),
+		slog.Int64("request_size", event.RequestSize),
+		slog.Int64("response_size", event.ResponseSize),
+	}
+	if event.TraceID != "" {
+		attrs = append(attrs,
+			slog.String("trace_id", event.TraceID),
+			slog.String("span_id", event.SpanID))
+	}
+	if event.UpstreamVersion != "" {
+		attrs = append(attrs,
+			slog.String("upstream_version", event.UpstreamVersion),
+			slog.String("version_selection", event.VersionSelection))
+	}
+	eventLogger.Info("usage_event", attrs...)
+}
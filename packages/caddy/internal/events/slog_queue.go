@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 )
@@ -19,6 +20,10 @@ type SlogEventQueue struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
+
+	enqueued  atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
 }
 
 // NewSlogEventQueue creates a new structured logging-based event queue
@@ -43,16 +48,29 @@ func NewSlogEventQueue(logger *zap.Logger) *SlogEventQueue {
 func (q *SlogEventQueue) Enqueue(event UsageEvent) error {
 	select {
 	case q.events <- event:
+		q.enqueued.Add(1)
 		return nil
 	case <-q.ctx.Done():
+		q.dropped.Add(1)
 		return nil // Silently drop on shutdown
 	default:
 		// Queue is full, drop event silently (fire-and-forget pattern)
 		// This is intentional per RFC - we never block the proxy
+		q.dropped.Add(1)
 		return nil
 	}
 }
 
+// Stats returns the queue's counters
+func (q *SlogEventQueue) Stats() QueueStats {
+	return QueueStats{
+		Enqueued:  q.enqueued.Load(),
+		Delivered: q.delivered.Load(),
+		Dropped:   q.dropped.Load(),
+		Pending:   len(q.events),
+	}
+}
+
 // Start begins processing events
 func (q *SlogEventQueue) Start() error {
 	q.wg.Add(1)
@@ -66,9 +84,19 @@ func (q *SlogEventQueue) Start() error {
 func (q *SlogEventQueue) Stop() error {
 	q.logger.Info("stopping slog event queue")
 
+	// The events channel stays open so that late Enqueue calls from requests
+	// still in flight cannot panic; whatever they left behind is logged here
 	q.cancel()
-	close(q.events)
 	q.wg.Wait()
+	for drained := false; !drained; {
+		select {
+		case event := <-q.events:
+			logUsageEvent(q.eventLogger, event)
+			q.delivered.Add(1)
+		default:
+			drained = true
+		}
+	}
 
 	q.logger.Info("slog event queue stopped")
 	return nil
@@ -93,19 +121,8 @@ func (q *SlogEventQueue) processEvents() {
 
 			// Write event as structured JSON log to stdout
 			// This is a fire-and-forget operation - no blocking, no error handling needed
-			q.eventLogger.Info("usage_event",
-				slog.String("event_type", "api_usage"),
-				slog.String("id", event.ID),
-				slog.String("api_path", event.APIPath),
-				slog.String("subscription_key", event.SubscriptionKey),
-				slog.String("method", event.Method),
-				slog.Int64("response_time_ms", event.ResponseTime),
-				slog.Int("status_code", event.StatusCode),
-				slog.Bool("success", event.Success),
-				slog.Time("timestamp", event.Timestamp),
-				slog.Int64("request_size", event.RequestSize),
-				slog.Int64("response_size", event.ResponseSize),
-			)
+			logUsageEvent(q.eventLogger, event)
+			q.delivered.Add(1)
 
 		case <-q.ctx.Done():
 			return
@@ -16,6 +16,14 @@ type UsageEvent struct {
 	Timestamp      time.Time `json:"timestamp"`
 	RequestSize    int64     `json:"request_size"`
 	ResponseSize   int64     `json:"response_size"`
+	// TraceID and SpanID identify the request span, joining the event to its trace
+	TraceID        string    `json:"trace_id,omitempty"`
+	SpanID         string    `json:"span_id,omitempty"`
+	// UpstreamVersion is "stable" or "canary" for APIs with a canary, and
+	// VersionSelection how it was chosen: by a pinned "key", "sticky" by
+	// subscription key, or by "weight"
+	UpstreamVersion  string `json:"upstream_version,omitempty"`
+	VersionSelection string `json:"version_selection,omitempty"`
 }
 
 // UsageEventQueue handles queuing of usage events
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	veil_handler [<db> [<key_header> [<events_endpoint>]]] {
+//		db         <path>
+//		key_header <header>
+//		key_query  <param>
+//		key_pepper <secret>
+//		secret_key <secret>
+//		identity_secret <secret>
+//		events [off] {
+//			endpoint     <url>
+//			queue        memory|disk
+//			dir          <path>
+//			max_size     <size>
+//			segment_size <size>
+//			overflow     drop_newest|drop_oldest
+//			batch_size       <n>
+//			flush_interval   <duration>
+//			senders          <n>
+//			max_attempts     <n>
+//			dead_letter_file <path>
+//		}
+//		nats [off] {
+//			url              <url>
+//			credit_subject   <subject>
+//			key_sync_subject <subject>
+//			reconnect_wait     <duration>
+//			max_reconnect_wait <duration>
+//			jetstream          [<stream>]
+//			ack_timeout        <duration>
+//			max_pending        <n>
+//			sync_secret        <secret>
+//			sync_public_keys   <nkeys...>
+//			snapshot_subject   <subject>
+//			snapshot_timeout   <duration>
+//		}
+//		admin {
+//			token          <name> <role> <token>
+//			hmac           <key_id> <role> <secret>
+//			client_cert    cn|fingerprint <value> <role>
+//			max_clock_skew <duration>
+//			insecure_open
+//		}
+//		rate_limit {
+//			requests_per_second <n>
+//			burst               <n>
+//			requests_per_minute <n>
+//			requests_per_day    <n>
+//		}
+//		tracing [off] {
+//			endpoint     <url>
+//			header       <name> <value>
+//			service_name <name>
+//			sample_ratio <0..1>
+//			timeout      <duration>
+//		}
+//		admin_address      <address>
+//		route_server       <name>
+//		route_listen       <addresses...>
+//		reconcile_interval <duration>
+//	}
+//
+// The positional arguments are kept for existing Caddyfiles and are equivalent
+// to db, key_header and events { endpoint }.
+func (h *VeilHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// The directive name is already consumed when UnmarshalCaddyfile is called,
+	// but we use a for loop with d.Next() to handle multiple occurrences
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) > 3 {
+			return d.Errf("expected at most 3 arguments (db_path, subscription_key, events_endpoint), got %d", len(args))
+		}
+		if len(args) >= 1 {
+			h.DBPath = args[0]
+		}
+		if len(args) >= 2 {
+			h.SubscriptionKey = args[1]
+		}
+		if len(args) >= 3 {
+			h.EventsEndpoint = args[2]
+		}
+
+		for d.NextBlock(0) {
+			option := d.Val()
+			var err error
+			switch option {
+			case "db":
+				err = parseSingleArg(d, &h.DBPath)
+			case "key_header":
+				err = parseSingleArg(d, &h.SubscriptionKey)
+			case "key_query":
+				err = parseSingleArg(d, &h.SubscriptionQuery)
+			case "key_pepper":
+				err = parseSingleArg(d, &h.KeyPepper)
+			case "secret_key":
+				err = parseSingleArg(d, &h.SecretKey)
+			case "identity_secret":
+				err = parseSingleArg(d, &h.IdentitySecret)
+			case "events":
+				h.Events, err = parseEvents(d)
+			case "nats":
+				h.NATS, err = parseNATS(d)
+			case "admin":
+				h.Admin, err = parseAdmin(d)
+			case "rate_limit":
+				h.RateLimit, err = parseRateLimit(d)
+			case "tracing":
+				h.Tracing, err = parseTracing(d)
+			case "admin_address":
+				err = parseSingleArg(d, &h.AdminAddress)
+			case "route_server":
+				err = parseSingleArg(d, &h.RouteServer)
+			case "route_listen":
+				h.RouteListen = d.RemainingArgs()
+				if len(h.RouteListen) == 0 {
+					err = d.ArgErr()
+				}
+			case "reconcile_interval":
+				err = parseDuration(d, &h.ReconcileInterval)
+			default:
+				err = d.Errf("unrecognized veil_handler option %q", option)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseSingleArg reads exactly one argument into dst
+func parseSingleArg(d *caddyfile.Dispenser, dst *string) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	*dst = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseDuration reads exactly one duration argument into dst
+func parseDuration(d *caddyfile.Dispenser, dst *caddy.Duration) error {
+	option := d.Val()
+	var value string
+	if err := parseSingleArg(d, &value); err != nil {
+		return err
+	}
+	dur, err := caddy.ParseDuration(value)
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", option, value, err)
+	}
+	*dst = caddy.Duration(dur)
+	return nil
+}
+
+// parseInt reads exactly one non-negative integer argument into dst
+func parseInt(d *caddyfile.Dispenser, dst *int) error {
+	option := d.Val()
+	var value string
+	if err := parseSingleArg(d, &value); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return d.Errf("%s must be a non-negative integer, got %q", option, value)
+	}
+	*dst = n
+	return nil
+}
+
+// parseSize reads exactly one byte size argument such as "512MiB" into dst
+func parseSize(d *caddyfile.Dispenser, dst *int64) error {
+	option := d.Val()
+	var value string
+	if err := parseSingleArg(d, &value); err != nil {
+		return err
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", option, value, err)
+	}
+	*dst = int64(size)
+	return nil
+}
+
+// parseOff consumes an optional "off" argument after a block option name
+func parseOff(d *caddyfile.Dispenser) (bool, error) {
+	if !d.NextArg() {
+		return false, nil
+	}
+	if d.Val() != "off" {
+		return false, d.Errf("unexpected argument %q (only \"off\" is allowed)", d.Val())
+	}
+	if d.NextArg() {
+		return false, d.ArgErr()
+	}
+	return true, nil
+}
+
+// parseEvents parses the events block. Its presence enables event streaming.
+func parseEvents(d *caddyfile.Dispenser) (*events.Config, error) {
+	off, err := parseOff(d)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &events.Config{Disabled: off}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "endpoint":
+			err = parseSingleArg(d, &cfg.Endpoint)
+		case "queue":
+			err = parseSingleArg(d, &cfg.Queue)
+		case "dir":
+			err = parseSingleArg(d, &cfg.Dir)
+		case "max_size":
+			err = parseSize(d, &cfg.MaxSize)
+		case "segment_size":
+			err = parseSize(d, &cfg.SegmentSize)
+		case "overflow":
+			var policy string
+			err = parseSingleArg(d, &policy)
+			cfg.Overflow = events.OverflowPolicy(policy)
+		case "batch_size":
+			err = parseInt(d, &cfg.BatchSize)
+		case "flush_interval":
+			err = parseDuration(d, &cfg.FlushInterval)
+		case "senders":
+			err = parseInt(d, &cfg.Senders)
+		case "max_attempts":
+			err = parseInt(d, &cfg.MaxAttempts)
+		case "dead_letter_file":
+			err = parseSingleArg(d, &cfg.DeadLetterFile)
+		default:
+			err = d.Errf("unrecognized events option %q", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// parseNATS parses the nats block. Its presence enables NATS.
+func parseNATS(d *caddyfile.Dispenser) (*NATSConfig, error) {
+	off, err := parseOff(d)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &NATSConfig{Disabled: off}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			err = parseSingleArg(d, &cfg.URL)
+		case "credit_subject":
+			err = parseSingleArg(d, &cfg.CreditSubject)
+		case "key_sync_subject":
+			err = parseSingleArg(d, &cfg.KeySyncSubject)
+		case "reconnect_wait":
+			err = parseDuration(d, &cfg.ReconnectWait)
+		case "max_reconnect_wait":
+			err = parseDuration(d, &cfg.MaxReconnectWait)
+		case "jetstream":
+			cfg.JetStream = true
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 0:
+			case 1:
+				cfg.Stream = args[0]
+			default:
+				err = d.ArgErr()
+			}
+		case "ack_timeout":
+			err = parseDuration(d, &cfg.AckTimeout)
+		case "max_pending":
+			err = parseInt(d, &cfg.MaxPending)
+		case "sync_secret":
+			err = parseSingleArg(d, &cfg.SyncSecret)
+		case "sync_public_keys":
+			cfg.SyncPublicKeys = append(cfg.SyncPublicKeys, d.RemainingArgs()...)
+			if len(cfg.SyncPublicKeys) == 0 {
+				err = d.ArgErr()
+			}
+		case "snapshot_subject":
+			err = parseSingleArg(d, &cfg.SnapshotSubject)
+		case "snapshot_timeout":
+			err = parseDuration(d, &cfg.SnapshotTimeout)
+		default:
+			err = d.Errf("unrecognized nats option %q", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// parseAdmin parses the management API credentials block
+func parseAdmin(d *caddyfile.Dispenser) (*auth.AdminConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	cfg := &auth.AdminConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		args := d.RemainingArgs()
+		switch option {
+		case "token":
+			if len(args) != 3 {
+				return nil, d.Errf("expected: token <name> <role> <token>")
+			}
+			cfg.Tokens = append(cfg.Tokens, auth.TokenCredential{Name: args[0], Role: auth.Role(args[1]), Token: args[2]})
+		case "hmac":
+			if len(args) != 3 {
+				return nil, d.Errf("expected: hmac <key_id> <role> <secret>")
+			}
+			cfg.HMACKeys = append(cfg.HMACKeys, auth.HMACCredential{KeyID: args[0], Role: auth.Role(args[1]), Secret: args[2]})
+		case "client_cert":
+			if len(args) != 3 {
+				return nil, d.Errf("expected: client_cert cn|fingerprint <value> <role>")
+			}
+			identity := auth.ClientCertIdentity{Role: auth.Role(args[2])}
+			switch args[0] {
+			case "cn":
+				identity.CommonName = args[1]
+			case "fingerprint":
+				identity.Fingerprint = args[1]
+			default:
+				return nil, d.Errf("client_cert must match on cn or fingerprint, got %q", args[0])
+			}
+			cfg.ClientCerts = append(cfg.ClientCerts, identity)
+		case "insecure_open":
+			if len(args) != 0 {
+				return nil, d.ArgErr()
+			}
+			cfg.InsecureOpen = true
+		case "max_clock_skew":
+			if len(args) != 1 {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return nil, d.Errf("invalid max_clock_skew %q: %v", args[0], err)
+			}
+			cfg.MaxClockSkew = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized admin option %q", option)
+		}
+	}
+	return cfg, nil
+}
+
+// parseRateLimit parses the default rate limit block
+func parseRateLimit(d *caddyfile.Dispenser) (*models.RateLimit, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	limit := &models.RateLimit{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "requests_per_second":
+			var value string
+			if err = parseSingleArg(d, &value); err != nil {
+				return nil, err
+			}
+			limit.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+			if err != nil || limit.RequestsPerSecond < 0 {
+				return nil, d.Errf("requests_per_second must be a non-negative number, got %q", value)
+			}
+		case "burst":
+			err = parseInt(d, &limit.Burst)
+		case "requests_per_minute":
+			err = parseInt(d, &limit.RequestsPerMinute)
+		case "requests_per_day":
+			err = parseInt(d, &limit.RequestsPerDay)
+		default:
+			err = d.Errf("unrecognized rate_limit option %q", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return limit, nil
+}
+
+// parseTracing parses the tracing block. Its presence enables tracing.
+func parseTracing(d *caddyfile.Dispenser) (*TracingConfig, error) {
+	off, err := parseOff(d)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &TracingConfig{Disabled: off}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "endpoint":
+			err = parseSingleArg(d, &cfg.Endpoint)
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.Errf("expected: header <name> <value>")
+			}
+			if cfg.Headers == nil {
+				cfg.Headers = make(map[string]string)
+			}
+			cfg.Headers[args[0]] = args[1]
+		case "service_name":
+			err = parseSingleArg(d, &cfg.ServiceName)
+		case "sample_ratio":
+			var value string
+			if err = parseSingleArg(d, &value); err != nil {
+				return nil, err
+			}
+			cfg.SampleRatio, err = strconv.ParseFloat(value, 64)
+			if err != nil || cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+				return nil, d.Errf("sample_ratio must be a number between 0 and 1, got %q", value)
+			}
+		case "timeout":
+			err = parseDuration(d, &cfg.Timeout)
+		default:
+			err = d.Errf("unrecognized tracing option %q", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Upstream versions of an API with a canary
+const (
+	upstreamStable = "stable"
+	upstreamCanary = "canary"
+)
+
+// How the upstream version of a request was selected
+const (
+	selectedByKey    = "key"
+	selectedBySticky = "sticky"
+	selectedByWeight = "weight"
+)
+
+// upstreamVersionVar is the request variable the generated route matches to
+// send a request to the canary
+const upstreamVersionVar = "veil_upstream_version"
+
+// toCanary converts the canary of a request
+func toCanary(c *dto.CanaryDTO) *models.Canary {
+	if c == nil {
+		return nil
+	}
+	return &models.Canary{Upstream: c.Upstream, Weight: c.Weight, Sticky: c.Sticky, Keys: c.Keys}
+}
+
+// toCanaryDTO converts a stored canary for a response
+func toCanaryDTO(c *models.Canary) *dto.CanaryDTO {
+	if c == nil {
+		return nil
+	}
+	return &dto.CanaryDTO{Upstream: c.Upstream, Weight: c.Weight, Sticky: c.Sticky, Keys: c.Keys}
+}
+
+// prepareCanary validates the canary of an API and replaces its pinned
+// subscription keys with their digests
+func (h *VeilHandler) prepareCanary(api *models.APIConfig) error {
+	canary := api.Canary
+	if canary == nil {
+		return nil
+	}
+	u, err := url.Parse(canary.Upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("canary upstream %q must be an http or https URL", canary.Upstream)
+	}
+	for _, target := range api.Targets() {
+		if target.URL == canary.Upstream {
+			return fmt.Errorf("canary upstream %q is already an upstream of the API", canary.Upstream)
+		}
+	}
+	if canary.Weight < 0 || canary.Weight > 100 {
+		return fmt.Errorf("canary weight must be a percentage between 0 and 100, got %d", canary.Weight)
+	}
+
+	keys := make([]string, 0, len(canary.Keys))
+	for _, key := range canary.Keys {
+		if key == "" {
+			return fmt.Errorf("canary keys must not be empty")
+		}
+		if digest := h.store.KeyDigest(key); !slices.Contains(keys, digest) {
+			keys = append(keys, digest)
+		}
+	}
+	if len(keys) == 0 {
+		keys = nil
+	}
+	canary.Keys = keys
+	return nil
+}
+
+// selectUpstreamVersion decides whether a request to an API with a canary
+// goes to the canary and records the decision in the request variables the
+// generated route matches. It returns the version and how it was selected,
+// or empty strings for APIs without a canary.
+func (h *VeilHandler) selectUpstreamVersion(r *http.Request, api *models.APIConfig, key *models.APIKey) (string, string) {
+	canary := api.Canary
+	if canary == nil {
+		return "", ""
+	}
+
+	version, selection := upstreamStable, selectedByWeight
+	switch {
+	case key != nil && slices.Contains(canary.Keys, key.KeyHash):
+		version, selection = upstreamCanary, selectedByKey
+	case canary.Sticky && key != nil:
+		selection = selectedBySticky
+		if stickyBucket(api.Path, key.KeyHash) < canary.Weight {
+			version = upstreamCanary
+		}
+	case rand.IntN(100) < canary.Weight:
+		version = upstreamCanary
+	}
+
+	caddyhttp.SetVar(r.Context(), upstreamVersionVar, version)
+	return version, selection
+}
+
+// stickyBucket maps a subscription key to a fixed percentile of an API's
+// traffic, so a key stays on the canary while the weight only grows
+func stickyBucket(apiPath, keyHash string) int {
+	h := fnv.New32a()
+	h.Write([]byte(apiPath))
+	h.Write([]byte{0})
+	h.Write([]byte(keyHash))
+	return int(h.Sum32() % 100)
+}
+
+// canaryProxyConfig wraps the reverse_proxy handler of an API's stable
+// upstreams in a subroute that sends requests selected for the canary to
+// its upstream instead. The weight and pinned keys are not part of the
+// route, so shifting traffic does not reload it.
+func (h *VeilHandler) canaryProxyConfig(api models.APIConfig, stableConfig string) (string, error) {
+	canaryAPI := api
+	canaryAPI.Upstream = api.Canary.Upstream
+	canaryAPI.Upstreams = nil
+	canaryAPI.Canary = nil
+	canaryConfig, err := h.reverseProxyConfig(canaryAPI)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`{
+		"handler": "subroute",
+		"routes": [
+			{
+				"match": [{"vars": {%q: [%q]}}],
+				"handle": [%s],
+				"terminal": true
+			},
+			{
+				"handle": [%s]
+			}
+		]
+	}`, upstreamVersionVar, upstreamCanary, canaryConfig, stableConfig), nil
+}
+
+// handleCanary serves /veil/api/canary/{api path}: GET reports the canary of
+// an API, PUT sets it, PATCH shifts its weight and DELETE rolls all traffic
+// back to the stable upstreams
+func (h *VeilHandler) handleCanary(w http.ResponseWriter, r *http.Request, apiPath string) error {
+	if apiPath == "" || apiPath == "/" {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_path", "API path is required", nil)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	api, err := h.store.GetAPIWithKeys(apiPath)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return writeJSONError(w, http.StatusNotFound, "not_found", "API not found",
+			map[string]string{"path": apiPath})
+	}
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get API", nil)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if api.Canary == nil {
+			return writeJSONError(w, http.StatusNotFound, "not_found", "API has no canary",
+				map[string]string{"path": apiPath})
+		}
+	case http.MethodPut:
+		var req dto.CanaryDTO
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_canary", "invalid request body: "+err.Error(), nil)
+		}
+		api.Canary = toCanary(&req)
+		if err := h.prepareCanary(api); err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_canary", err.Error(), nil)
+		}
+		if err := h.storeCanary(api); err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error(), nil)
+		}
+	case http.MethodPatch:
+		if api.Canary == nil {
+			return writeJSONError(w, http.StatusNotFound, "not_found", "API has no canary",
+				map[string]string{"path": apiPath})
+		}
+		var req dto.CanaryWeightDTO
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_canary", "request body must set weight", nil)
+		}
+		if *req.Weight < 0 || *req.Weight > 100 {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_canary",
+				fmt.Sprintf("canary weight must be a percentage between 0 and 100, got %d", *req.Weight), nil)
+		}
+		// The route does not depend on the weight, so it takes effect as soon
+		// as it is stored
+		api.Canary.Weight = *req.Weight
+		if err := h.store.SetCanary(api.Path, api.Canary); err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to store canary", nil)
+		}
+	case http.MethodDelete:
+		// Requests go to the stable upstreams once the canary is removed from
+		// the database; the route reload only drops the unused proxy
+		api.Canary = nil
+		if err := h.storeCanary(api); err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error(), nil)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.CanaryResponseDTO{
+		Status: "success",
+		Path:   api.Path,
+		Canary: toCanaryDTO(api.Canary),
+	})
+}
+
+// storeCanary saves the canary of an API and regenerates its route
+func (h *VeilHandler) storeCanary(api *models.APIConfig) error {
+	if err := h.store.SetCanary(api.Path, api.Canary); err != nil {
+		h.logger.Error("failed to store canary",
+			zap.String("path", api.Path),
+			zap.Error(err))
+		return fmt.Errorf("failed to store canary")
+	}
+	if err := h.updateCaddyfile(*api); err != nil {
+		h.logger.Error("failed to update route for canary",
+			zap.String("path", api.Path),
+			zap.Error(err))
+		return fmt.Errorf("canary stored but its route could not be updated")
+	}
+
+	fields := []zap.Field{zap.String("path", api.Path)}
+	if api.Canary != nil {
+		fields = append(fields,
+			zap.String("upstream", api.Canary.Upstream),
+			zap.Int("weight", api.Canary.Weight),
+			zap.Int("pinned_keys", len(api.Canary.Keys)))
+	}
+	h.logger.Info("updated API canary", fields...)
+	return nil
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/mockey"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// canaryTestRequest returns a request carrying the variables and replacer of
+// a request served by Caddy
+func canaryTestRequest(w http.ResponseWriter, method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, nil)
+}
+
+func TestVeilHandler_buildRoute_canary(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	api := CreateAPI(t, "/orders/*", "http://orders-v1.internal:8085/v1", "basic", []string{"GET"}, nil, nil)
+	api.Canary = &models.Canary{Upstream: "https://orders-v2.example.com/v2", Weight: 10}
+	route, err := handler.buildRoute(*api)
+	require.NoError(t, err)
+
+	encoded, err := json.Marshal(route)
+	require.NoError(t, err)
+	var decoded struct {
+		Handle []struct {
+			Routes []struct {
+				Handle []json.RawMessage `json:"handle"`
+			} `json:"routes"`
+		} `json:"handle"`
+	}
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Len(t, decoded.Handle[0].Routes[0].Handle, 2)
+
+	var proxy struct {
+		Handler string `json:"handler"`
+		Routes  []struct {
+			Match    []map[string]json.RawMessage `json:"match"`
+			Handle   []reverseproxy.Handler       `json:"handle"`
+			Terminal bool                         `json:"terminal"`
+		} `json:"routes"`
+	}
+	require.NoError(t, json.Unmarshal(decoded.Handle[0].Routes[0].Handle[1], &proxy))
+	assert.Equal(t, "subroute", proxy.Handler)
+	require.Len(t, proxy.Routes, 2)
+
+	canary, stable := proxy.Routes[0], proxy.Routes[1]
+	require.Len(t, canary.Handle, 1)
+	assert.Equal(t, "orders-v2.example.com:443", canary.Handle[0].Upstreams[0].Dial)
+	assert.Equal(t, []string{"orders-v2.example.com"}, canary.Handle[0].Headers.Request.Set["Host"])
+	assert.Equal(t, "/v2$1", canary.Handle[0].Rewrite.PathRegexp[0].Replace)
+	assert.True(t, canary.Terminal)
+	require.Len(t, stable.Handle, 1)
+	assert.Empty(t, stable.Match)
+	assert.Equal(t, "orders-v1.internal:8085", stable.Handle[0].Upstreams[0].Dial)
+	assert.Equal(t, "/v1$1", stable.Handle[0].Rewrite.PathRegexp[0].Replace)
+
+	// Only requests selected for the canary match its route
+	require.Len(t, canary.Match, 1)
+	var matcher caddyhttp.VarsMatcher
+	require.NoError(t, json.Unmarshal(canary.Match[0]["vars"], &matcher))
+	for version, want := range map[string]bool{"": false, upstreamStable: false, upstreamCanary: true} {
+		r := canaryTestRequest(httptest.NewRecorder(), http.MethodGet, "/orders/items")
+		if version != "" {
+			caddyhttp.SetVar(r.Context(), upstreamVersionVar, version)
+		}
+		assert.Equal(t, want, matcher.Match(r), "version %q", version)
+	}
+}
+
+func TestVeilHandler_selectUpstreamVersion(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	pinned := &models.APIKey{KeyHash: handler.store.KeyDigest("pinned-key")}
+	other := &models.APIKey{KeyHash: handler.store.KeyDigest("other-key")}
+
+	selectVersion := func(api *models.APIConfig, key *models.APIKey) (string, string, interface{}) {
+		r := canaryTestRequest(httptest.NewRecorder(), http.MethodGet, "/orders/items")
+		version, selection := handler.selectUpstreamVersion(r, api, key)
+		return version, selection, caddyhttp.GetVar(r.Context(), upstreamVersionVar)
+	}
+
+	version, selection, variable := selectVersion(&models.APIConfig{Path: "/orders/*"}, other)
+	assert.Empty(t, version)
+	assert.Empty(t, selection)
+	assert.Nil(t, variable)
+
+	api := &models.APIConfig{Path: "/orders/*", Canary: &models.Canary{
+		Upstream: "http://orders-v2.internal", Keys: []string{pinned.KeyHash}}}
+	version, selection, variable = selectVersion(api, pinned)
+	assert.Equal(t, []interface{}{upstreamCanary, selectedByKey, upstreamCanary}, []interface{}{version, selection, variable})
+	version, selection, variable = selectVersion(api, other)
+	assert.Equal(t, []interface{}{upstreamStable, selectedByWeight, upstreamStable}, []interface{}{version, selection, variable})
+
+	api.Canary.Weight = 100
+	version, selection, _ = selectVersion(api, other)
+	assert.Equal(t, []string{upstreamCanary, selectedByWeight}, []string{version, selection})
+
+	// Sticky keys switch once the weight passes their bucket and stay there
+	api.Canary.Sticky = true
+	bucket := stickyBucket(api.Path, other.KeyHash)
+	for _, weight := range []int{0, bucket, bucket + 1, 100} {
+		api.Canary.Weight = weight
+		want := upstreamStable
+		if weight > bucket {
+			want = upstreamCanary
+		}
+		for range 5 {
+			version, selection, _ = selectVersion(api, other)
+			assert.Equal(t, []string{want, selectedBySticky}, []string{version, selection}, "weight %d", weight)
+		}
+	}
+}
+
+func TestVeilHandler_handleCanary(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	current := &caddy.Config{
+		AppsRaw: map[string]json.RawMessage{
+			"http": json.RawMessage(`{"servers": {"srv1": {"listen": [":2021"], "routes": []}}}`),
+		},
+	}
+	loads := 0
+	configMocker := mockey.Mock((*VeilHandler).getCurrentConfig).To(func(h *VeilHandler) (*caddy.Config, error) {
+		return current, nil
+	}).Build()
+	loadMocker := mockey.Mock(caddy.Load).To(func(cfgJSON []byte, forceReload bool) error {
+		loads++
+		var loaded caddy.Config
+		if err := json.Unmarshal(cfgJSON, &loaded); err != nil {
+			return err
+		}
+		current = &loaded
+		return nil
+	}).Build()
+	defer configMocker.Release()
+	defer loadMocker.Release()
+	defer os.RemoveAll("configs")
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/orders/*", "http://orders-v1.internal", "basic",
+		[]string{"GET"}, nil, []models.APIKey{{Key: "pinned-key", Name: "Tester", IsActive: &active}})))
+
+	manage := func(method, body string) (*httptest.ResponseRecorder, dto.CanaryResponseDTO) {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w,
+			httptest.NewRequest(method, "/veil/api/canary/orders/*", strings.NewReader(body))))
+		var resp dto.CanaryResponseDTO
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w, resp
+	}
+
+	w, _ := manage(http.MethodGet, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = manage(http.MethodPatch, `{"weight": 5}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = manage(http.MethodPut, `{"upstream": "http://orders-v1.internal", "weight": 5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w, _ = manage(http.MethodPut, `{"upstream": "http://orders-v2.internal", "weight": 101}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	// Keys are pinned by digest and the route gains the canary proxy
+	w, resp := manage(http.MethodPut, `{"upstream": "http://orders-v2.internal", "weight": 5, "keys": ["pinned-key"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	digest := handler.store.KeyDigest("pinned-key")
+	assert.Equal(t, &dto.CanaryDTO{Upstream: "http://orders-v2.internal", Weight: 5, Keys: []string{digest}}, resp.Canary)
+	assert.Equal(t, 1, loads)
+	assert.Contains(t, string(current.AppsRaw["http"]), upstreamVersionVar)
+
+	// Shifting the weight only updates the database
+	w, resp = manage(http.MethodPatch, `{"weight": 50}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 50, resp.Canary.Weight)
+	assert.Equal(t, 1, loads)
+	w, _ = manage(http.MethodPatch, `{"weight": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	api, err := handler.store.GetAPIByPath("/orders/items")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Canary{Upstream: "http://orders-v2.internal", Weight: 50, Keys: []string{digest}}, api.Canary)
+	w, resp = manage(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 50, resp.Canary.Weight)
+
+	// Rolling back removes the canary and its proxy
+	w, _ = manage(http.MethodDelete, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 2, loads)
+	assert.NotContains(t, string(current.AppsRaw["http"]), upstreamVersionVar)
+	api, err = handler.store.GetAPIByPath("/orders/items")
+	require.NoError(t, err)
+	assert.Nil(t, api.Canary)
+}
+
+func TestVeilHandler_canaryUsageEvents(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+	queue := &captureQueue{}
+	handler.eventQueue = queue
+
+	active := true
+	api := CreateAPI(t, "/orders/*", "http://orders-v1.internal", "basic", []string{"GET"}, nil,
+		[]models.APIKey{
+			{Key: "pinned-key", Name: "Tester", IsActive: &active},
+			{Key: "other-key", Name: "Customer", IsActive: &active},
+		})
+	api.Canary = &models.Canary{Upstream: "http://orders-v2.internal", Keys: []string{handler.store.KeyDigest("pinned-key")}}
+	require.NoError(t, handler.store.CreateAPI(api))
+
+	for _, key := range []string{"pinned-key", "other-key"} {
+		w := httptest.NewRecorder()
+		r := canaryTestRequest(w, http.MethodGet, "/orders/items")
+		r.Header.Set("X-Subscription-Key", key)
+		require.NoError(t, handler.ServeHTTP(w, r, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(caddyhttp.GetVar(r.Context(), upstreamVersionVar).(string)))
+		}}))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	require.Len(t, queue.events, 2)
+	assert.Equal(t, []string{upstreamCanary, selectedByKey},
+		[]string{queue.events[0].UpstreamVersion, queue.events[0].VersionSelection})
+	assert.Equal(t, []string{upstreamStable, selectedByWeight},
+		[]string{queue.events[1].UpstreamVersion, queue.events[1].VersionSelection})
+}
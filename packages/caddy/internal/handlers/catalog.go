@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// maxCatalogSize bounds the body of a catalog import
+const maxCatalogSize = 32 << 20
+
+// catalogYAML reports whether a catalog is exchanged as YAML rather than JSON,
+// from the format query parameter or the given header
+func catalogYAML(r *http.Request, header string) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "yaml"
+	}
+	return strings.Contains(r.Header.Get(header), "yaml")
+}
+
+// handleExport serves GET /veil/api/export with every API as a versioned
+// catalog. Keys are included as digests with keys=hashed.
+func (h *VeilHandler) handleExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	var withKeys bool
+	switch keys := r.URL.Query().Get("keys"); keys {
+	case "", "none":
+	case "hashed":
+		withKeys = true
+	default:
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query", "keys must be none or hashed",
+			map[string]string{"keys": keys})
+	}
+
+	apis, err := h.store.ExportAPIs()
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to export APIs", nil)
+	}
+
+	now := time.Now().UTC()
+	catalog := dto.CatalogDTO{
+		Version:    dto.CatalogVersion,
+		ExportedAt: &now,
+		APIs:       make([]dto.CatalogAPIDTO, 0, len(apis)),
+	}
+	for _, api := range apis {
+		catalog.APIs = append(catalog.APIs, toCatalogAPI(api, withKeys))
+	}
+
+	h.logger.Info("exported API catalog",
+		zap.Int("apis", len(catalog.APIs)),
+		zap.Bool("keys", withKeys))
+
+	if catalogYAML(r, "Accept") {
+		w.Header().Set("Content-Type", "application/yaml")
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(catalog); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(catalog)
+}
+
+// handleImport serves POST /veil/api/import. The catalog is applied in one
+// transaction in merge (default) or replace mode, or only checked with
+// dry_run=true, and the route table is regenerated once afterwards.
+func (h *VeilHandler) handleImport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	query := r.URL.Query()
+	mode := store.ImportMode(query.Get("mode"))
+	if mode == "" {
+		mode = store.ImportMerge
+	}
+	if mode != store.ImportMerge && mode != store.ImportReplace {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query", "mode must be merge or replace",
+			map[string]string{"mode": string(mode)})
+	}
+	var dryRun bool
+	if v := query.Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_query", "dry_run must be true or false",
+				map[string]string{"dry_run": v})
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCatalogSize))
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_catalog", "failed to read catalog: "+err.Error(), nil)
+	}
+	var catalog dto.CatalogDTO
+	if catalogYAML(r, "Content-Type") {
+		err = yaml.Unmarshal(body, &catalog)
+	} else {
+		err = json.Unmarshal(body, &catalog)
+	}
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_catalog", "failed to decode catalog: "+err.Error(), nil)
+	}
+	if catalog.Version != dto.CatalogVersion {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_catalog",
+			fmt.Sprintf("unsupported catalog version %d", catalog.Version),
+			map[string]int{"supported": dto.CatalogVersion})
+	}
+
+	apis := make([]models.APIConfig, 0, len(catalog.APIs))
+	for _, api := range catalog.APIs {
+		config, err := fromCatalogAPI(api)
+		if err == nil {
+			config.ResponseValidation, err = h.checkSpecReference(config.SpecName, config.ResponseValidation)
+		}
+		if err == nil {
+			err = h.prepareCanary(&config)
+		}
+		if err == nil {
+			err = h.checkUpstreamTLS(&config)
+		}
+		if err == nil {
+			err = h.prepareUpstreamAuth(&config)
+		}
+		if err == nil {
+			err = h.prepareHeaderPolicy(&config)
+		}
+		if err == nil {
+			err = prepareTransforms(&config)
+		}
+		if err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_catalog", err.Error(),
+				map[string]string{"path": api.Path})
+		}
+		apis = append(apis, config)
+	}
+
+	result, err := h.store.ImportAPIs(apis, mode, dryRun)
+	if errors.Is(err, store.ErrInvalidCatalog) {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_catalog", err.Error(), nil)
+	}
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "import_failed", "failed to import catalog: "+err.Error(), nil)
+	}
+
+	response := dto.CatalogImportDTO{
+		Status:    "success",
+		Mode:      string(mode),
+		DryRun:    dryRun,
+		Created:   result.Created,
+		Updated:   result.Updated,
+		Unchanged: result.Unchanged,
+		Deleted:   result.Deleted,
+	}
+
+	// Regenerate the route table once for the whole catalog
+	if !dryRun && result.Changed() {
+		report, err := h.reconcileRoutes(r.Context(), true)
+		if err != nil {
+			h.logger.Error("failed to update routes after import", zap.Error(err))
+			return writeJSONError(w, http.StatusInternalServerError, "reconcile_failed",
+				"catalog imported but routes could not be updated: "+err.Error(), response)
+		}
+		response.RoutesApplied = report.Applied
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// toCatalogAPI describes a stored API for export, with key digests if
+// withKeys is set
+func toCatalogAPI(api models.APIConfig, withKeys bool) dto.CatalogAPIDTO {
+	out := dto.CatalogAPIDTO{
+		Path:                 api.Path,
+		Upstream:             api.Upstream,
+		RequiredSubscription: api.RequiredSubscription,
+		Methods:              make([]string, 0, len(api.Methods)),
+		RequiredHeaders:      api.RequiredHeaders,
+		RateLimit:            toRateLimitDTO(api.RateLimit),
+		Upstreams:            toUpstreamTargetDTOs(api.Upstreams),
+		LoadBalancing:        toLoadBalancingDTO(api.LoadBalancing),
+		HealthChecks:         toHealthChecksDTO(api.HealthChecks),
+		Canary:               toCanaryDTO(api.Canary),
+		TLS:                  toUpstreamTLSDTO(api.TLS),
+		UpstreamAuth:         toUpstreamAuthDTO(api.UpstreamAuth, true),
+		RequestHeaders:       toHeaderPolicyDTO(api.RequestHeaders),
+		Transforms:           toTransformsDTO(api.Transforms),
+		Spec:                 api.SpecName,
+		ResponseValidation:   api.ResponseValidation,
+	}
+	for _, method := range api.Methods {
+		out.Methods = append(out.Methods, method.Method)
+	}
+	for _, param := range api.Parameters {
+		out.Parameters = append(out.Parameters, dto.ParameterDTO{
+			Name:       param.Name,
+			Type:       param.Type,
+			Required:   param.Required,
+			Validation: param.Validation,
+		})
+	}
+	if withKeys {
+		for _, key := range api.APIKeys {
+			out.APIKeys = append(out.APIKeys, dto.CatalogKeyDTO{
+				Name:      key.Name,
+				KeyHash:   key.KeyHash,
+				KeyPrefix: key.KeyPrefix,
+				IsActive:  key.IsActive,
+				ExpiresAt: key.ExpiresAt,
+				RateLimit: toRateLimitDTO(key.RateLimit),
+			})
+		}
+	}
+	return out
+}
+
+// fromCatalogAPI converts and validates an imported API
+func fromCatalogAPI(api dto.CatalogAPIDTO) (models.APIConfig, error) {
+	rateLimit, err := toRateLimit(api.RateLimit)
+	if err != nil {
+		return models.APIConfig{}, err
+	}
+	config := models.APIConfig{
+		Path:                 api.Path,
+		Upstream:             api.Upstream,
+		RequiredSubscription: api.RequiredSubscription,
+		RequiredHeaders:      api.RequiredHeaders,
+		RateLimit:            rateLimit,
+		Upstreams:            toUpstreamTargets(api.Upstreams),
+		LoadBalancing:        toLoadBalancing(api.LoadBalancing),
+		HealthChecks:         toHealthChecks(api.HealthChecks),
+		Canary:               toCanary(api.Canary),
+		TLS:                  toUpstreamTLS(api.TLS),
+		UpstreamAuth:         toUpstreamAuth(api.UpstreamAuth),
+		RequestHeaders:       toHeaderPolicy(api.RequestHeaders),
+		Transforms:           toTransforms(api.Transforms),
+		SpecName:             api.Spec,
+		ResponseValidation:   api.ResponseValidation,
+	}
+	if err := validateUpstreams(&config); err != nil {
+		return models.APIConfig{}, fmt.Errorf("invalid upstreams of %s: %v", api.Path, err)
+	}
+	for _, method := range api.Methods {
+		config.Methods = append(config.Methods, models.APIMethod{Method: method})
+	}
+	for _, param := range api.Parameters {
+		parameter := models.APIParameter{
+			Name:       param.Name,
+			Type:       param.Type,
+			Required:   param.Required,
+			Validation: param.Validation,
+		}
+		if err := validateParameterDefinition(parameter); err != nil {
+			return models.APIConfig{}, fmt.Errorf("invalid parameter of %s: %v", api.Path, err)
+		}
+		config.Parameters = append(config.Parameters, parameter)
+	}
+	for _, key := range api.APIKeys {
+		keyRateLimit, err := toRateLimit(key.RateLimit)
+		if err != nil {
+			return models.APIConfig{}, err
+		}
+		config.APIKeys = append(config.APIKeys, models.APIKey{
+			Key:       key.Key,
+			KeyHash:   key.KeyHash,
+			KeyPrefix: key.KeyPrefix,
+			Name:      key.Name,
+			IsActive:  key.IsActive,
+			ExpiresAt: key.ExpiresAt,
+			RateLimit: keyRateLimit,
+		})
+	}
+	return config, nil
+}
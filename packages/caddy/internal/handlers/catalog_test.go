@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/mockey"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+func TestVeilHandler_handleExport(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/weather/*", "http://localhost:8083", "basic",
+		[]string{"GET"}, []string{"X-Test-Header"}, []models.APIKey{
+			{Key: "weather-secret-key-1", Name: "Weather 1", IsActive: &active},
+		})))
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/news/*", "http://localhost:8084", "premium",
+		[]string{"GET", "POST"}, nil, nil)))
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		wantCode int
+		wantYAML bool
+		wantKeys bool
+	}{
+		{name: "json without keys", target: "/veil/api/export", wantCode: http.StatusOK},
+		{name: "json with hashed keys", target: "/veil/api/export?keys=hashed", wantCode: http.StatusOK, wantKeys: true},
+		{name: "yaml by query", target: "/veil/api/export?format=yaml&keys=hashed", wantCode: http.StatusOK, wantYAML: true, wantKeys: true},
+		{name: "yaml by accept header", target: "/veil/api/export", accept: "application/yaml", wantCode: http.StatusOK, wantYAML: true},
+		{name: "plaintext keys", target: "/veil/api/export?keys=plain", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			require.NoError(t, handler.handleManagementAPI(w, req))
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.NotContains(t, w.Body.String(), "weather-secret-key-1")
+
+			var catalog dto.CatalogDTO
+			if tt.wantYAML {
+				assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+				require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &catalog))
+			} else {
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &catalog))
+			}
+
+			assert.Equal(t, dto.CatalogVersion, catalog.Version)
+			require.Len(t, catalog.APIs, 2)
+			assert.Equal(t, "/news/*", catalog.APIs[0].Path)
+			assert.Equal(t, []string{"GET", "POST"}, catalog.APIs[0].Methods)
+			weather := catalog.APIs[1]
+			assert.Equal(t, "/weather/*", weather.Path)
+			assert.Equal(t, []string{"X-Test-Header"}, weather.RequiredHeaders)
+			if !tt.wantKeys {
+				assert.Empty(t, weather.APIKeys)
+				return
+			}
+			require.Len(t, weather.APIKeys, 1)
+			assert.Equal(t, "Weather 1", weather.APIKeys[0].Name)
+			assert.Empty(t, weather.APIKeys[0].Key)
+			assert.True(t, strings.HasPrefix(weather.APIKeys[0].KeyHash, "v1$"))
+		})
+	}
+}
+
+func TestVeilHandler_handleImport(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/news/*", "http://localhost:8084", "premium",
+		[]string{"GET"}, nil, nil)))
+
+	current := &caddy.Config{
+		AppsRaw: map[string]json.RawMessage{
+			"http": json.RawMessage(`{"servers": {"srv1": {"listen": [":2021"], "routes": []}}}`),
+		},
+	}
+	loads := 0
+	configMocker := mockey.Mock((*VeilHandler).getCurrentConfig).To(func(h *VeilHandler) (*caddy.Config, error) {
+		return current, nil
+	}).Build()
+	loadMocker := mockey.Mock(caddy.Load).To(func(cfgJSON []byte, forceReload bool) error {
+		loads++
+		var loaded caddy.Config
+		if err := json.Unmarshal(cfgJSON, &loaded); err != nil {
+			return err
+		}
+		current = &loaded
+		return nil
+	}).Build()
+	defer configMocker.Release()
+	defer loadMocker.Release()
+	defer os.RemoveAll("configs")
+
+	catalog := `version: 1
+apis:
+  - path: /weather/*
+    upstream: http://localhost:8083
+    required_subscription: basic
+    methods: [GET]
+    api_keys:
+      - name: Weather 1
+        key: weather-secret-key-1
+  - path: /orders/*
+    upstream: http://localhost:8085
+    methods: [GET, POST]
+    parameters:
+      - name: id
+        type: path
+        required: true
+`
+	post := func(target, contentType, body string) (*httptest.ResponseRecorder, dto.CatalogImportDTO) {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, req))
+		var resp dto.CatalogImportDTO
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w, resp
+	}
+
+	// A dry run reports the changes without applying them
+	w, resp := post("/veil/api/import?mode=replace&dry_run=true", "application/yaml", catalog)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, resp.DryRun)
+	assert.Equal(t, []string{"/weather/*", "/orders/*"}, resp.Created)
+	assert.Equal(t, []string{"/news/*"}, resp.Deleted)
+	assert.Equal(t, 0, loads)
+	_, err := handler.store.GetAPIWithKeys("/weather/*")
+	assert.Error(t, err)
+
+	// The import is applied and routes are regenerated once
+	w, resp = post("/veil/api/import?mode=replace", "application/yaml", catalog)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "replace", resp.Mode)
+	assert.True(t, resp.RoutesApplied)
+	assert.Equal(t, 1, loads)
+
+	table, err := handler.loadRouteTable()
+	require.NoError(t, err)
+	var paths []string
+	for _, route := range table.routes {
+		path, _ := routePath(route)
+		paths = append(paths, path)
+	}
+	assert.ElementsMatch(t, []string{"/orders/", "/weather/"}, paths)
+
+	api, err := handler.store.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+	assert.True(t, handler.store.ValidateAPIKey(api, "weather-secret-key-1"))
+
+	// Importing the exported catalog as JSON changes nothing
+	export := httptest.NewRecorder()
+	require.NoError(t, handler.handleManagementAPI(export, httptest.NewRequest(http.MethodGet, "/veil/api/export?keys=hashed", nil)))
+	w, resp = post("/veil/api/import?mode=replace", "application/json", export.Body.String())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"/orders/*", "/weather/*"}, resp.Unchanged)
+	assert.False(t, resp.RoutesApplied)
+	assert.Equal(t, 1, loads)
+
+	errorCases := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+	}{
+		{name: "unknown mode", target: "/veil/api/import?mode=upsert", contentType: "application/json", body: `{"version": 1}`},
+		{name: "invalid dry run", target: "/veil/api/import?dry_run=maybe", contentType: "application/json", body: `{"version": 1}`},
+		{name: "unsupported version", target: "/veil/api/import", contentType: "application/json", body: `{"version": 2}`},
+		{name: "malformed body", target: "/veil/api/import", contentType: "application/json", body: `{"version":`},
+		{name: "missing upstream", target: "/veil/api/import", contentType: "application/json", body: `{"version": 1, "apis": [{"path": "/a/*"}]}`},
+	}
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _ := post(tt.target, tt.contentType, tt.body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+	assert.Equal(t, 1, loads)
+}
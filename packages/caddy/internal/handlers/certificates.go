@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maxCertificateSize bounds the body of a certificate upload
+const maxCertificateSize = 1 << 20
+
+// handleCertificates serves /veil/api/certificates: GET lists the stored
+// upstream certificates, and GET, PUT and DELETE
+// /veil/api/certificates/{name} read, store and remove one. Private keys are
+// never returned.
+func (h *VeilHandler) handleCertificates(w http.ResponseWriter, r *http.Request, name string) error {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
+		return h.handleListCertificates(w)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cert, err := h.store.GetCertificate(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return writeJSONError(w, http.StatusNotFound, "not_found", "certificate not found", map[string]string{"name": name})
+		}
+		if err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get certificate", nil)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(dto.CertificateDetailDTO{Status: "success", Certificate: toCertificateDTO(*cert, true)})
+	case http.MethodPut:
+		return h.handlePutCertificate(w, r, name)
+	case http.MethodDelete:
+		return h.handleDeleteCertificate(w, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
+
+// handleListCertificates lists the stored certificates without their content
+func (h *VeilHandler) handleListCertificates(w http.ResponseWriter) error {
+	certs, err := h.store.ListCertificates()
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to list certificates", nil)
+	}
+	out := make([]dto.CertificateDTO, 0, len(certs))
+	for _, cert := range certs {
+		out = append(out, toCertificateDTO(cert, false))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.CertificateListDTO{Status: "success", Certificates: out})
+}
+
+// handlePutCertificate stores the PEM certificate bundle and optional private
+// key in the request body. Routes of APIs referencing the name are
+// regenerated, so their upstream connections use the new certificate.
+func (h *VeilHandler) handlePutCertificate(w http.ResponseWriter, r *http.Request, name string) error {
+	if !specNamePattern.MatchString(name) {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_certificate",
+			"certificate name may only contain letters, digits, '.', '_' and '-'", map[string]string{"name": name})
+	}
+	if !h.store.HasSecretKey() {
+		return writeJSONError(w, http.StatusBadRequest, "secret_key_required",
+			"certificates are encrypted at rest; configure secret_key or VEIL_SECRET_KEY to store them", nil)
+	}
+
+	var req dto.CertificateRequestDTO
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCertificateSize)).Decode(&req); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_certificate", "invalid request body: "+err.Error(), nil)
+	}
+	cert, err := parseCertificate(name, req.Certificate, req.PrivateKey)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_certificate", err.Error(), map[string]string{"name": name})
+	}
+
+	created, err := h.store.PutCertificate(cert)
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to store certificate", nil)
+	}
+	stored, err := h.store.GetCertificate(name)
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get certificate", nil)
+	}
+
+	h.logger.Info("stored upstream certificate",
+		zap.String("name", name),
+		zap.String("subject", cert.Subject),
+		zap.Time("not_after", cert.NotAfter),
+		zap.Bool("created", created))
+
+	if !created {
+		if err := h.reloadCertificateUsers(name); err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "reconcile_failed",
+				"certificate stored but routes could not be updated: "+err.Error(), map[string]string{"name": name})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return json.NewEncoder(w).Encode(dto.CertificateDetailDTO{Status: "success", Certificate: toCertificateDTO(*stored, false)})
+}
+
+// reloadCertificateUsers regenerates the routes of the APIs using a replaced
+// certificate
+func (h *VeilHandler) reloadCertificateUsers(name string) error {
+	users, err := h.store.CertificateUsers(name)
+	if err != nil {
+		return fmt.Errorf("failed to find APIs using the certificate: %v", err)
+	}
+	for _, api := range users {
+		if err := h.updateCaddyfile(api); err != nil {
+			h.logger.Error("failed to update route for certificate",
+				zap.String("path", api.Path),
+				zap.String("certificate", name),
+				zap.Error(err))
+			return fmt.Errorf("failed to update route of %s: %v", api.Path, err)
+		}
+	}
+	return nil
+}
+
+// handleDeleteCertificate removes a certificate no API references
+func (h *VeilHandler) handleDeleteCertificate(w http.ResponseWriter, name string) error {
+	err := h.store.DeleteCertificate(name)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return writeJSONError(w, http.StatusNotFound, "not_found", "certificate not found", map[string]string{"name": name})
+	case errors.Is(err, store.ErrCertificateInUse):
+		return writeJSONError(w, http.StatusConflict, "certificate_in_use", err.Error(), map[string]string{"name": name})
+	case err != nil:
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to delete certificate", nil)
+	}
+
+	h.logger.Info("deleted upstream certificate",
+		zap.String("name", name))
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// parseCertificate checks a PEM certificate bundle and, for client
+// certificates, that the private key matches its first certificate
+func parseCertificate(name, certificatePEM, privateKeyPEM string) (*models.TLSCertificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(certificatePEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("certificate must only contain CERTIFICATE blocks, found %s", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("certificate must contain at least one PEM certificate")
+	}
+
+	if privateKeyPEM != "" {
+		if _, err := tls.X509KeyPair([]byte(certificatePEM), []byte(privateKeyPEM)); err != nil {
+			return nil, fmt.Errorf("private key does not match the certificate: %v", err)
+		}
+	}
+
+	fingerprint := sha256.Sum256(certs[0].Raw)
+	return &models.TLSCertificate{
+		Name:        name,
+		Certificate: certificatePEM,
+		PrivateKey:  privateKeyPEM,
+		Subject:     certs[0].Subject.String(),
+		NotAfter:    certs[0].NotAfter,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}, nil
+}
+
+// toCertificateDTO describes a stored certificate, with its PEM bundle if
+// withCertificate is set
+func toCertificateDTO(cert models.TLSCertificate, withCertificate bool) dto.CertificateDTO {
+	out := dto.CertificateDTO{
+		Name:          cert.Name,
+		Subject:       cert.Subject,
+		NotAfter:      cert.NotAfter,
+		Fingerprint:   cert.Fingerprint,
+		HasPrivateKey: cert.HasPrivateKey,
+		CreatedAt:     cert.CreatedAt,
+		UpdatedAt:     cert.UpdatedAt,
+	}
+	if withCertificate {
+		out.Certificate = cert.Certificate
+	}
+	return out
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/openapi"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Contract violation directions
+const (
+	contractRequest  = "request"
+	contractResponse = "response"
+)
+
+// compiledContract is a compiled OpenAPI document with the version of the
+// stored spec it was compiled from
+type compiledContract struct {
+	specID    uint
+	updatedAt time.Time
+	contract  *openapi.Contract
+}
+
+// contracts caches compiled OpenAPI documents by spec name
+var contracts sync.Map
+
+// checkSpecReference validates the spec and response validation mode of an
+// API and returns the mode to store
+func (h *VeilHandler) checkSpecReference(spec, mode string) (string, error) {
+	switch mode {
+	case "", "off":
+		mode = ""
+	case models.ResponseValidationMonitor:
+	default:
+		return "", fmt.Errorf("response_validation must be off or monitor, got %q", mode)
+	}
+	if spec == "" {
+		if mode != "" {
+			return "", fmt.Errorf("response_validation requires a spec")
+		}
+		return "", nil
+	}
+	if _, err := h.store.GetSpec(spec); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("spec %q not found", spec)
+		}
+		return "", err
+	}
+	return mode, nil
+}
+
+// contract returns the compiled OpenAPI document stored under name,
+// compiling it again whenever the stored document changes
+func (h *VeilHandler) contract(name string) (*openapi.Contract, error) {
+	spec, err := h.store.GetSpec(name)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := contracts.Load(name); ok {
+		c := cached.(*compiledContract)
+		if c.specID == spec.ID && c.updatedAt.Equal(spec.UpdatedAt) {
+			return c.contract, nil
+		}
+	}
+	contract, err := openapi.Compile([]byte(spec.Document))
+	if err != nil {
+		return nil, err
+	}
+	contracts.Store(name, &compiledContract{specID: spec.ID, updatedAt: spec.UpdatedAt, contract: contract})
+	return contract, nil
+}
+
+// operationPath returns the request path below the API path prefix, which
+// is what the path templates of the API's spec describe
+func operationPath(requestPath, apiPath string) string {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(apiPath, "*"), "/")
+	path := strings.TrimPrefix(requestPath, prefix)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// checkContract validates the request against the operation of the API's
+// spec it targets. If the request must not be proxied the error response is
+// written and ok is false. The match is nil for APIs without a spec.
+func (h *VeilHandler) checkContract(w http.ResponseWriter, r *http.Request, api *models.APIConfig) (*openapi.Match, bool, error) {
+	if api.SpecName == "" {
+		return nil, true, nil
+	}
+
+	contract, err := h.contract(api.SpecName)
+	if err != nil {
+		h.logger.Error("failed to load OpenAPI document",
+			zap.String("api_path", api.Path),
+			zap.String("spec", api.SpecName),
+			zap.Error(err))
+		return nil, false, writeJSONError(w, http.StatusInternalServerError, "internal_error",
+			"API contract is not available", nil)
+	}
+
+	path := operationPath(r.URL.Path, api.Path)
+	match, err := contract.Match(r.Method, path)
+	switch {
+	case errors.Is(err, openapi.ErrUnknownPath):
+		h.countContractViolation(api.Path, contractRequest)
+		return nil, false, writeJSONError(w, http.StatusNotFound, "unknown_operation",
+			"no operation of the API matches the request path", map[string]string{"path": path})
+	case errors.Is(err, openapi.ErrUnknownMethod):
+		h.countContractViolation(api.Path, contractRequest)
+		return nil, false, writeJSONError(w, http.StatusMethodNotAllowed, "unknown_operation",
+			"the API does not support the method on this path", map[string]string{"path": path, "method": r.Method})
+	case err != nil:
+		return nil, false, err
+	}
+
+	body, complete, err := peekBody(r)
+	if err != nil {
+		h.logger.Error("failed to read request body for contract validation",
+			zap.Error(err))
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return nil, false, nil
+	}
+
+	if violations := match.ValidateRequest(r.URL.Query(), r.Header, body, complete); len(violations) > 0 {
+		h.logger.Debug("request violates API contract",
+			zap.String("path", r.URL.Path),
+			zap.String("operation", r.Method+" "+match.Template),
+			zap.Int("violations", len(violations)))
+		h.countContractViolation(api.Path, contractRequest)
+		return nil, false, writeJSONError(w, http.StatusBadRequest, "contract_violation",
+			"request does not match the API contract",
+			map[string]interface{}{"operation": r.Method + " " + match.Template, "violations": violations})
+	}
+	return match, true, nil
+}
+
+// peekBody buffers up to maxValidatedBodySize bytes of the request body and
+// restores r.Body so the upstream still receives all of it. complete is false
+// if the body was longer.
+func peekBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+	if len(data) > maxValidatedBodySize {
+		return data[:maxValidatedBodySize], false, nil
+	}
+	return data, true, nil
+}
+
+// monitorResponse checks a proxied response against the API's spec. It only
+// counts and logs violations; the response has already been sent.
+func (h *VeilHandler) monitorResponse(r *http.Request, api *models.APIConfig, match *openapi.Match, rec *responseCapture) {
+	if rec.status == 0 || rec.hijacked {
+		return
+	}
+	// Encoded bodies are only checked for status and content type
+	complete := !rec.truncated
+	if encoding := rec.header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		complete = false
+	}
+	violations := match.ValidateResponse(rec.status, rec.header, rec.body.Bytes(), complete)
+	if len(violations) == 0 {
+		return
+	}
+	h.logger.Warn("upstream response violates API contract",
+		zap.String("api_path", api.Path),
+		zap.String("operation", r.Method+" "+match.Template),
+		zap.Int("status", rec.status),
+		zap.Any("violations", violations))
+	h.countContractViolation(api.Path, contractResponse)
+}
+
+// responseCapture passes a response through while keeping its status, its
+// headers as the upstream sent them and up to maxValidatedBodySize bytes of
+// its body for contract validation
+type responseCapture struct {
+	http.ResponseWriter
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+	hijacked  bool
+}
+
+func newResponseCapture(w http.ResponseWriter) *responseCapture {
+	return &responseCapture{ResponseWriter: w}
+}
+
+// WriteHeader records the final status code
+func (rc *responseCapture) WriteHeader(statusCode int) {
+	if rc.status == 0 && statusCode >= http.StatusOK {
+		rc.status = statusCode
+		rc.header = rc.Header().Clone()
+	}
+	rc.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write keeps the start of the body and delegates to the underlying writer
+func (rc *responseCapture) Write(data []byte) (int, error) {
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+		rc.header = rc.Header().Clone()
+	}
+	if room := maxValidatedBodySize - rc.body.Len(); room < len(data) {
+		rc.body.Write(data[:room])
+		rc.truncated = true
+	} else {
+		rc.body.Write(data)
+	}
+	return rc.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher if the underlying writer supports it
+func (rc *responseCapture) Flush() {
+	if flusher, ok := rc.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer supports it
+func (rc *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rc.ResponseWriter.(http.Hijacker); ok {
+		rc.hijacked = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (rc *responseCapture) Unwrap() http.ResponseWriter {
+	return rc.ResponseWriter
+}
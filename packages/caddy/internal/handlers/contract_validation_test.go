@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+const inventorySpec = `
+openapi: 3.0.3
+paths:
+  /items/{id}:
+    get:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: integer
+      responses:
+        '200':
+          description: An item
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [id, name]
+                properties:
+                  id:
+                    type: integer
+                  name:
+                    type: string
+  /items:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+      responses:
+        '201':
+          description: Created
+`
+
+func TestVeilHandler_contractValidation(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	manage := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(method, target, strings.NewReader(body))))
+		return w
+	}
+
+	// Documents are compiled before they are stored
+	w := manage(http.MethodPut, "/veil/api/specs/inventory", `{"openapi": "3.0.3", "paths": {"/a": {"get": {"responses": {"200": {
+		"description": "ok", "content": {"application/json": {"schema": {"type": 5}}}}}}}}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = manage(http.MethodPut, "/veil/api/specs/inventory", inventorySpec)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = manage(http.MethodPut, "/veil/api/specs/inventory", inventorySpec)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = manage(http.MethodGet, "/veil/api/specs", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list dto.SpecListDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Specs, 1)
+	assert.Equal(t, "inventory", list.Specs[0].Name)
+	assert.Empty(t, list.Specs[0].Document)
+
+	w = manage(http.MethodGet, "/veil/api/specs/inventory", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var detail dto.SpecDetailDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&detail))
+	assert.Equal(t, inventorySpec, detail.Spec.Document)
+
+	// APIs can only reference stored documents
+	_, err := handler.checkSpecReference("missing", "")
+	assert.EqualError(t, err, `spec "missing" not found`)
+	_, err = handler.checkSpecReference("inventory", "enforce")
+	assert.Error(t, err)
+	_, err = handler.checkSpecReference("", models.ResponseValidationMonitor)
+	assert.Error(t, err)
+	mode, err := handler.checkSpecReference("inventory", "off")
+	require.NoError(t, err)
+	assert.Empty(t, mode)
+
+	active := true
+	api := CreateAPI(t, "/inventory/*", "http://localhost:8086", "basic", []string{"GET", "POST"}, nil,
+		[]models.APIKey{{Key: "inventory-key", Name: "Inventory", IsActive: &active}})
+	api.SpecName = "inventory"
+	api.ResponseValidation = models.ResponseValidationMonitor
+	require.NoError(t, handler.store.CreateAPI(api))
+
+	// A referenced document cannot be deleted
+	w = manage(http.MethodDelete, "/veil/api/specs/inventory", "")
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		upstreamBody string
+		wantStatus   int
+		wantCode     string
+		wantUpstream bool
+		wantRequest  float64
+		wantResponse float64
+	}{
+		{name: "valid", method: http.MethodGet, path: "/inventory/items/7",
+			upstreamBody: `{"id": 7, "name": "bolt"}`, wantStatus: http.StatusOK, wantUpstream: true},
+		{name: "invalid path parameter", method: http.MethodGet, path: "/inventory/items/bolt",
+			wantStatus: http.StatusBadRequest, wantCode: "contract_violation", wantRequest: 1},
+		{name: "unknown path", method: http.MethodGet, path: "/inventory/orders",
+			wantStatus: http.StatusNotFound, wantCode: "unknown_operation", wantRequest: 1},
+		{name: "unknown method", method: http.MethodPost, path: "/inventory/items/7",
+			wantStatus: http.StatusMethodNotAllowed, wantCode: "unknown_operation", wantRequest: 1},
+		{name: "invalid body", method: http.MethodPost, path: "/inventory/items", body: `{"title": "bolt"}`,
+			wantStatus: http.StatusBadRequest, wantCode: "contract_violation", wantRequest: 1},
+		// The upstream answers 200 where only 201 is documented
+		{name: "valid body", method: http.MethodPost, path: "/inventory/items", body: `{"name": "bolt"}`,
+			wantStatus: http.StatusOK, wantUpstream: true, wantResponse: 1},
+		// Response violations are counted but never blocked
+		{name: "invalid response", method: http.MethodGet, path: "/inventory/items/7",
+			upstreamBody: `{"id": 7}`, wantStatus: http.StatusOK, wantUpstream: true, wantResponse: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractRequest))
+			responses := testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractResponse))
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Subscription-Key", "inventory-key")
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			upstreamCalled := false
+			next := &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalled = true
+				if tt.upstreamBody != "" {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.Write([]byte(tt.upstreamBody))
+			}}
+
+			w := httptest.NewRecorder()
+			require.NoError(t, handler.ServeHTTP(w, req, next))
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantUpstream, upstreamCalled)
+			if tt.wantCode != "" {
+				var resp dto.ErrorResponseDTO
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.wantCode, resp.Code)
+			} else {
+				assert.Equal(t, tt.upstreamBody, w.Body.String())
+			}
+
+			assert.Equal(t, requests+tt.wantRequest,
+				testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractRequest)))
+			assert.Equal(t, responses+tt.wantResponse,
+				testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractResponse)))
+		})
+	}
+
+	// Responses are checked as the upstream sent them, before transforms
+	api.Transforms = &models.Transforms{Response: &models.ResponseTransform{RemoveFields: []string{"name"}}}
+	require.NoError(t, prepareTransforms(api))
+	require.NoError(t, handler.store.UpdateAPI(api))
+
+	responses := testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractResponse))
+	req := httptest.NewRequest(http.MethodGet, "/inventory/items/7", nil)
+	req.Header.Set("X-Subscription-Key", "inventory-key")
+	w = httptest.NewRecorder()
+	require.NoError(t, handler.ServeHTTP(w, req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 7, "name": "bolt"}`))
+	}}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"id": 7}`, w.Body.String())
+	assert.Equal(t, responses, testutil.ToFloat64(metrics().contractViolations.WithLabelValues(api.Path, contractResponse)))
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"go.uber.org/zap"
+)
+
+// creditFlushTimeout bounds how long closing a JetStream publisher waits for
+// outstanding acks
+const creditFlushTimeout = 5 * time.Second
+
+// errCreditBufferFull is returned when max_pending credit events await acks
+var errCreditBufferFull = errors.New("too many unacknowledged credit events")
+
+// creditPublisher publishes usage events to the credit subject
+type creditPublisher interface {
+	Publish(event events.UsageEvent) error
+	Close()
+}
+
+// corePublisher publishes with core NATS, which is fire-and-forget
+type corePublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *corePublisher) Publish(event events.UsageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage event: %v", err)
+	}
+	return p.conn.Publish(p.subject, data)
+}
+
+func (p *corePublisher) Close() {}
+
+// asyncPublisher is the part of jetstream.JetStream used for publishing
+type asyncPublisher interface {
+	PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error)
+}
+
+// jetStreamPublisher publishes credit events to a JetStream stream and keeps
+// each event in memory until the stream acknowledged it. Events whose publish
+// failed or timed out are republished with backoff; the event ID is sent as
+// Nats-Msg-Id so the stream drops duplicates within its duplicate window.
+type jetStreamPublisher struct {
+	js           asyncPublisher
+	connected    func() bool
+	subject      string
+	stream       string
+	maxPending   int
+	retryInitial time.Duration
+	retryMax     time.Duration
+	logger       *zap.Logger
+
+	mu      sync.Mutex
+	pending map[string][]byte // published or waiting for republish, not acked
+	retry   []string          // IDs waiting for republish, oldest first
+	backoff time.Duration
+	closed  bool
+	wake    chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	acked       atomic.Uint64
+	republished atomic.Uint64
+	dropped     atomic.Uint64
+}
+
+// newJetStreamPublisher creates a publisher and starts its republish loop
+func newJetStreamPublisher(js asyncPublisher, connected func() bool, cfg *NATSConfig, logger *zap.Logger) *jetStreamPublisher {
+	p := &jetStreamPublisher{
+		js:           js,
+		connected:    connected,
+		subject:      cfg.CreditSubject,
+		stream:       cfg.Stream,
+		maxPending:   cfg.MaxPending,
+		retryInitial: time.Duration(cfg.ReconnectWait),
+		retryMax:     time.Duration(cfg.MaxReconnectWait),
+		logger:       logger,
+		pending:      make(map[string][]byte),
+		backoff:      time.Duration(cfg.ReconnectWait),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.republishLoop()
+	return p
+}
+
+// Publish buffers the event and publishes it asynchronously
+func (p *jetStreamPublisher) Publish(event events.UsageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage event: %v", err)
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("credit publisher is closed")
+	}
+	if _, ok := p.pending[event.ID]; ok {
+		p.mu.Unlock()
+		return nil
+	}
+	if len(p.pending) >= p.maxPending {
+		p.mu.Unlock()
+		p.dropped.Add(1)
+		return errCreditBufferFull
+	}
+	p.pending[event.ID] = data
+	// Keep Close from waiting on the ack watchers before this one is added
+	p.wg.Add(1)
+	p.mu.Unlock()
+	defer p.wg.Done()
+
+	p.send(event.ID, data)
+	return nil
+}
+
+// send publishes one buffered event and watches for its ack
+func (p *jetStreamPublisher) send(id string, data []byte) {
+	opts := []jetstream.PublishOpt{jetstream.WithMsgID(id)}
+	if p.stream != "" {
+		opts = append(opts, jetstream.WithExpectStream(p.stream))
+	}
+
+	future, err := p.js.PublishMsgAsync(&nats.Msg{Subject: p.subject, Data: data}, opts...)
+	if err != nil {
+		p.scheduleRetry(id, err)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-future.Ok():
+			p.ack(id)
+		case err := <-future.Err():
+			p.scheduleRetry(id, err)
+		case <-p.stop:
+		}
+	}()
+}
+
+// ack removes an acknowledged event from the buffer
+func (p *jetStreamPublisher) ack(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+	p.backoff = p.retryInitial
+	p.acked.Add(1)
+}
+
+// scheduleRetry queues a buffered event for republishing
+func (p *jetStreamPublisher) scheduleRetry(id string, cause error) {
+	metrics().natsPublishFailures.WithLabelValues("unacknowledged").Inc()
+	p.logger.Debug("credit event not acknowledged, will republish",
+		zap.String("event_id", id),
+		zap.Error(cause))
+
+	p.mu.Lock()
+	if _, ok := p.pending[id]; ok {
+		p.retry = append(p.retry, id)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// republishLoop republishes failed events with jittered exponential backoff,
+// waiting while the connection is down
+func (p *jetStreamPublisher) republishLoop() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake:
+		}
+
+		for {
+			p.mu.Lock()
+			wait := p.backoff
+			p.backoff = min(p.backoff*2, p.retryMax)
+			p.mu.Unlock()
+
+			if half := wait / 2; half > 0 {
+				wait = half + time.Duration(rand.Int63n(int64(half)))
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(wait):
+			}
+			if !p.connected() {
+				continue
+			}
+
+			p.mu.Lock()
+			ids := p.retry
+			p.retry = nil
+			batch := make(map[string][]byte, len(ids))
+			for _, id := range ids {
+				if data, ok := p.pending[id]; ok {
+					batch[id] = data
+				}
+			}
+			p.mu.Unlock()
+
+			if len(ids) == 0 {
+				break
+			}
+			p.logger.Warn("republishing unacknowledged credit events",
+				zap.Int("events_count", len(batch)))
+			for _, id := range ids {
+				if data, ok := batch[id]; ok {
+					delete(batch, id)
+					p.republished.Add(1)
+					p.send(id, data)
+				}
+			}
+		}
+	}
+}
+
+// Close waits briefly for outstanding acks and stops the publisher. Events
+// still unacknowledged afterwards are lost.
+func (p *jetStreamPublisher) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	deadline := time.Now().Add(creditFlushTimeout)
+	for time.Now().Before(deadline) && p.pendingCount() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	close(p.stop)
+	p.wg.Wait()
+
+	fields := []zap.Field{
+		zap.Uint64("acked", p.acked.Load()),
+		zap.Uint64("republished", p.republished.Load()),
+		zap.Uint64("dropped", p.dropped.Load()),
+	}
+	if lost := p.pendingCount(); lost > 0 {
+		p.logger.Error("closing JetStream credit publisher with unacknowledged events",
+			append(fields, zap.Int("unacknowledged", lost))...)
+		return
+	}
+	p.logger.Info("JetStream credit publisher closed", fields...)
+}
+
+// pendingCount returns the number of unacknowledged events
+func (p *jetStreamPublisher) pendingCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+)
+
+// fakeFuture is a PubAckFuture resolved by the test
+type fakeFuture struct {
+	msg *nats.Msg
+	ok  chan *jetstream.PubAck
+	err chan error
+}
+
+func (f *fakeFuture) Ok() <-chan *jetstream.PubAck { return f.ok }
+func (f *fakeFuture) Err() <-chan error            { return f.err }
+func (f *fakeFuture) Msg() *nats.Msg               { return f.msg }
+
+// fakeJetStream records async publishes and resolves them with respond
+type fakeJetStream struct {
+	mu        sync.Mutex
+	published []string
+	respond   func(data string) error
+}
+
+func (js *fakeJetStream) PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error) {
+	js.mu.Lock()
+	js.published = append(js.published, string(msg.Data))
+	js.mu.Unlock()
+
+	future := &fakeFuture{msg: msg, ok: make(chan *jetstream.PubAck, 1), err: make(chan error, 1)}
+	if err := js.respond(string(msg.Data)); err != nil {
+		future.err <- err
+	} else {
+		future.ok <- &jetstream.PubAck{Stream: "CREDITS"}
+	}
+	return future, nil
+}
+
+func (js *fakeJetStream) count() int {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return len(js.published)
+}
+
+func newTestJetStreamPublisher(js asyncPublisher, connected func() bool, maxPending int) *jetStreamPublisher {
+	cfg := (&NATSConfig{
+		JetStream:        true,
+		ReconnectWait:    caddy.Duration(2 * time.Millisecond),
+		MaxReconnectWait: caddy.Duration(10 * time.Millisecond),
+		MaxPending:       maxPending,
+	}).withDefaults()
+	return newJetStreamPublisher(js, connected, cfg, zap.NewNop())
+}
+
+func TestJetStreamPublisher_RepublishesUntilAcked(t *testing.T) {
+	var failures atomic.Int32
+	failures.Store(3)
+	js := &fakeJetStream{respond: func(string) error {
+		if failures.Add(-1) >= 0 {
+			return errors.New("nats: timeout")
+		}
+		return nil
+	}}
+	var connected atomic.Bool
+	p := newTestJetStreamPublisher(js, connected.Load, 10)
+
+	require.NoError(t, p.Publish(events.UsageEvent{ID: "event-1"}))
+	assert.Equal(t, 1, js.count())
+
+	// Nothing is republished while the connection is down
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 1, js.count())
+	assert.Equal(t, 1, p.pendingCount())
+
+	connected.Store(true)
+	assert.Eventually(t, func() bool { return p.pendingCount() == 0 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, 4, js.count())
+	assert.Equal(t, uint64(3), p.republished.Load())
+	assert.Equal(t, uint64(1), p.acked.Load())
+
+	p.Close()
+	assert.Error(t, p.Publish(events.UsageEvent{ID: "event-2"}))
+}
+
+func TestJetStreamPublisher_BoundsPendingEvents(t *testing.T) {
+	js := &fakeJetStream{respond: func(string) error { return errors.New("nats: no responders available for request") }}
+	p := newTestJetStreamPublisher(js, func() bool { return false }, 2)
+
+	require.NoError(t, p.Publish(events.UsageEvent{ID: "event-1"}))
+	require.NoError(t, p.Publish(events.UsageEvent{ID: "event-2"}))
+	// Publishing an event that is already buffered does not take a slot
+	require.NoError(t, p.Publish(events.UsageEvent{ID: "event-1"}))
+	assert.ErrorIs(t, p.Publish(events.UsageEvent{ID: "event-3"}), errCreditBufferFull)
+
+	assert.Equal(t, 2, p.pendingCount())
+	assert.Equal(t, uint64(1), p.dropped.Load())
+	assert.Equal(t, 2, js.count())
+
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func TestReconnectDelay(t *testing.T) {
+	delay := reconnectDelay(time.Second, 8*time.Second)
+
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		10: 8 * time.Second,
+	} {
+		got := delay(attempts)
+		assert.GreaterOrEqual(t, got, want/2, "attempt %d", attempts)
+		assert.LessOrEqual(t, got, want, "attempt %d", attempts)
+	}
+}
+
+func TestVeilHandler_provisionNATSUnreachable(t *testing.T) {
+	// Reserve a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+		NATS:            &NATSConfig{URL: "nats://" + addr, JetStream: true},
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+
+	// The connection keeps retrying instead of disabling credit tracking
+	require.NotNil(t, handler.nats)
+	assert.False(t, handler.nats.conn.IsConnected())
+	assert.False(t, handler.nats.conn.IsClosed())
+	assert.IsType(t, &jetStreamPublisher{}, handler.nats.publisher)
+
+	conn := handler.nats.conn
+	require.NoError(t, handler.Cleanup())
+	assert.Nil(t, handler.nats)
+	assert.True(t, conn.IsClosed())
+}
+
+func TestVeilHandler_provisionNATSShared(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dbPath := filepath.Join(t.TempDir(), "veil.db")
+	provision := func(dbPath string, cfg NATSConfig) *VeilHandler {
+		cfg.URL = "nats://" + addr
+		h := &VeilHandler{DBPath: dbPath, SubscriptionKey: "X-Subscription-Key", NATS: &cfg}
+		require.NoError(t, h.Provision(caddy.Context{}))
+		t.Cleanup(func() { h.Cleanup() })
+		return h
+	}
+
+	first := provision(dbPath, NATSConfig{SyncSecret: "sync-secret"})
+	same := provision(dbPath, NATSConfig{SyncSecret: "sync-secret"})
+	otherSecret := provision(dbPath, NATSConfig{SyncSecret: "other-secret"})
+	otherDB := provision(filepath.Join(t.TempDir(), "other.db"), NATSConfig{SyncSecret: "sync-secret"})
+
+	// Only handlers with the same database and settings share a connection
+	assert.Same(t, first.nats, same.nats)
+	assert.NotSame(t, first.nats, otherSecret.nats)
+	assert.NotSame(t, first.nats, otherDB.nats)
+	assert.Equal(t, []byte("other-secret"), otherSecret.nats.verifier.secret)
+}
+
+// capturePublisher records published credit events
+type capturePublisher struct {
+	mu     sync.Mutex
+	events []events.UsageEvent
+}
+
+func (p *capturePublisher) Publish(event events.UsageEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *capturePublisher) Close() {}
+
+func TestVeilHandler_recordUsage(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/credits/*", "http://localhost:8082", "basic",
+		[]string{"POST"}, nil, []models.APIKey{{Key: "credits-key", Name: "Credits", IsActive: &active}})))
+
+	publisher := &capturePublisher{}
+	handler.nats = &natsClient{publisher: publisher}
+	defer func() { handler.nats = nil }()
+
+	send := func() {
+		req := httptest.NewRequest(http.MethodPost, "/credits/items", strings.NewReader(`{"n":1}`))
+		req.Header.Set("X-Subscription-Key", "credits-key")
+		require.NoError(t, handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		}}))
+	}
+
+	// Usage is published to NATS without an event queue
+	send()
+	require.Len(t, publisher.events, 1)
+	event := publisher.events[0]
+	assert.Equal(t, "/credits/items", event.APIPath)
+	assert.Equal(t, "credits-key", event.SubscriptionKey)
+	assert.Equal(t, http.MethodPost, event.Method)
+	assert.Equal(t, http.StatusCreated, event.StatusCode)
+	assert.True(t, event.Success)
+	assert.Equal(t, int64(7), event.RequestSize)
+	assert.Equal(t, int64(7), event.ResponseSize)
+	assert.NotEmpty(t, event.ID)
+
+	// With an event queue, the same event is enqueued and published
+	queue := &captureQueue{}
+	handler.eventQueue = queue
+	send()
+	require.Len(t, publisher.events, 2)
+	require.Len(t, queue.events, 1)
+	assert.Equal(t, publisher.events[1], queue.events[0])
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// eventSinkTimeout bounds a single delivery attempt of the disk queue
+const eventSinkTimeout = 30 * time.Second
+
+// eventQueues holds one disk queue per directory so that undelivered events
+// are not handed between queue instances on every config reload
+var eventQueues = caddy.NewUsagePool()
+
+// provisionEventQueue creates and starts the event queue selected by the
+// events block. Failures are logged and disable event streaming.
+func (h *VeilHandler) provisionEventQueue() {
+	// Event streaming is configured by the events block, falling back to
+	// ENABLE_EVENT_STREAMING for handlers without one
+	if h.Events == nil && envEnabled("ENABLE_EVENT_STREAMING") {
+		h.Events = &events.Config{}
+	}
+	if h.Events == nil || h.Events.Disabled {
+		h.logger.Info("event streaming disabled (add an events block or set ENABLE_EVENT_STREAMING=true to enable)")
+		h.eventQueue = nil
+		return
+	}
+
+	endpoint := h.Events.Endpoint
+	if endpoint == "" {
+		endpoint = h.EventsEndpoint
+	}
+
+	if h.Events.Queue == events.QueueDisk {
+		if err := h.provisionDiskQueue(endpoint); err != nil {
+			h.logger.Warn("failed to start disk event queue, disabling event streaming",
+				zap.Error(err))
+			h.eventQueue = nil
+		}
+		return
+	}
+
+	// Determine which event queue implementation to use
+	if endpoint != "" {
+		// Use HTTP event queue if endpoint is explicitly configured
+		h.eventQueue = events.NewHTTPEventQueue(endpoint, events.HTTPQueueConfig{
+			BatchSize:      h.Events.BatchSize,
+			FlushInterval:  time.Duration(h.Events.FlushInterval),
+			Senders:        h.Events.Senders,
+			MaxAttempts:    h.Events.MaxAttempts,
+			DeadLetterFile: h.deadLetterFile(),
+		}, h.logger)
+		h.logger.Info("initializing HTTP event queue",
+			zap.String("endpoint", endpoint))
+	} else {
+		// Use slog-based event queue (RFC recommended pattern)
+		h.eventQueue = events.NewSlogEventQueue(h.logger)
+		h.logger.Info("initializing structured logging event queue (stdout)")
+	}
+
+	// Start the event queue - errors are non-fatal
+	if err := h.eventQueue.Start(); err != nil {
+		h.logger.Warn("failed to start event queue, disabling event streaming",
+			zap.Error(err))
+		h.eventQueue = nil
+		return
+	}
+	metrics().eventQueues.track(h.eventQueue, events.QueueMemory)
+}
+
+// eventQueueDir returns the disk queue directory, defaulting to veil-events
+// next to the database
+func (h *VeilHandler) eventQueueDir() string {
+	if h.Events.Dir != "" {
+		return h.Events.Dir
+	}
+	return filepath.Join(filepath.Dir(h.DBPath), "veil-events")
+}
+
+// deadLetterFile returns the dead-letter file of the HTTP queue, defaulting
+// to veil-events-dead-letter.jsonl next to the database
+func (h *VeilHandler) deadLetterFile() string {
+	if h.Events.DeadLetterFile != "" {
+		return h.Events.DeadLetterFile
+	}
+	return filepath.Join(filepath.Dir(h.DBPath), "veil-events-dead-letter.jsonl")
+}
+
+// provisionDiskQueue attaches the handler to the disk queue of its directory,
+// starting the queue if this is the first handler using it. Handlers sharing
+// a directory share the queue and the sink of the handler that created it.
+func (h *VeilHandler) provisionDiskQueue(endpoint string) error {
+	dir := h.eventQueueDir()
+	key := "veil_events:" + dir
+
+	value, loaded, err := eventQueues.LoadOrNew(key, func() (caddy.Destructor, error) {
+		sink := events.NewSlogSink()
+		if endpoint != "" {
+			sink = events.NewHTTPSink(endpoint, &http.Client{Timeout: eventSinkTimeout})
+		}
+		queue := events.NewDiskEventQueue(events.DiskQueueConfig{
+			Dir:          dir,
+			MaxBytes:     h.Events.MaxSize,
+			SegmentBytes: h.Events.SegmentSize,
+			Overflow:     h.Events.Overflow,
+			BatchSize:    h.Events.BatchSize,
+		}, sink, h.logger.Named("events"))
+		if err := queue.Start(); err != nil {
+			return nil, err
+		}
+		return queue, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create disk event queue: %v", err)
+	}
+
+	h.eventQueue = value.(*events.DiskEventQueue)
+	h.eventQueueKey = key
+	metrics().eventQueues.track(h.eventQueue, events.QueueDisk)
+	if !loaded {
+		h.logger.Info("initializing disk event queue",
+			zap.String("dir", dir),
+			zap.String("endpoint", endpoint))
+	}
+	return nil
+}
+
+// releaseEventQueue stops the handler's own event queue or releases its
+// reference to a shared disk queue
+func (h *VeilHandler) releaseEventQueue() {
+	if h.eventQueue == nil {
+		return
+	}
+	if h.eventQueueKey != "" {
+		if _, err := eventQueues.Delete(h.eventQueueKey); err != nil {
+			h.logger.Error("failed to release event queue", zap.Error(err))
+		}
+	} else if err := h.eventQueue.Stop(); err != nil {
+		h.logger.Error("failed to stop event queue", zap.Error(err))
+	}
+	// Untracked after stopping, so events dropped while stopping are counted
+	metrics().eventQueues.untrack(h.eventQueue)
+	h.eventQueue = nil
+	h.eventQueueKey = ""
+}
+
+// handleEventStats serves GET /veil/api/events with the delivery counters of
+// the usage event queue
+func (h *VeilHandler) handleEventStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	report := dto.EventQueueStatsDTO{Status: "success"}
+	if h.eventQueue != nil {
+		report.Enabled = true
+		report.Queue = h.Events.Queue
+		if report.Queue == "" {
+			report.Queue = events.QueueMemory
+		}
+		if provider, ok := h.eventQueue.(events.StatsProvider); ok {
+			stats := provider.Stats()
+			report.Stats = &stats
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// handleReplayDeadLetters serves POST /veil/api/events/replay, which sends the
+// dead-lettered event batches to the events endpoint again
+func (h *VeilHandler) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	replayer, ok := h.eventQueue.(events.Replayer)
+	if !ok {
+		return writeJSONError(w, http.StatusConflict, "replay_unavailable",
+			"The configured event queue does not keep dead letters", nil)
+	}
+
+	result, err := replayer.ReplayDeadLetters(r.Context())
+	switch {
+	case errors.Is(err, events.ErrReplayInProgress):
+		return writeJSONError(w, http.StatusConflict, "replay_in_progress", err.Error(), nil)
+	case errors.Is(err, events.ErrNoDeadLetters):
+		return writeJSONError(w, http.StatusConflict, "replay_unavailable", err.Error(), nil)
+	case err != nil:
+		h.logger.Error("failed to replay dead-lettered events", zap.Error(err))
+		return writeJSONError(w, http.StatusInternalServerError, "replay_failed",
+			"Failed to replay dead-lettered events: "+err.Error(), nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.DeadLetterReplayDTO{Status: "success", ReplayResult: result})
+}
+
+// recordUsage completes the usage event of a served request with its recorded
+// response, then enqueues it and publishes it to NATS for credit tracking.
+// Failures are logged and never affect the response.
+func (h *VeilHandler) recordUsage(r *http.Request, event events.UsageEvent, recorder *events.ResponseRecorder) {
+	event.ResponseTime = recorder.GetResponseTime().Milliseconds()
+	event.StatusCode = recorder.StatusCode
+	event.Success = recorder.IsSuccess()
+	event.ResponseSize = recorder.ResponseSize
+	event.Timestamp = time.Now()
+	event.TraceID, event.SpanID = traceIDs(r.Context())
+
+	if h.eventQueue != nil {
+		_, span := h.tracer.Start(r.Context(), "veil.events.enqueue")
+		err := h.eventQueue.Enqueue(event)
+		endSpan(span, err)
+		if err != nil {
+			h.logger.Debug("failed to enqueue usage event",
+				zap.Error(err),
+				zap.String("api_path", event.APIPath))
+		}
+	}
+
+	// With JetStream the event is buffered until acknowledged
+	if h.nats != nil {
+		_, span := h.tracer.Start(r.Context(), "veil.nats.publish", trace.WithSpanKind(trace.SpanKindProducer))
+		err := h.nats.publisher.Publish(event)
+		endSpan(span, err)
+		if err != nil {
+			metrics().natsPublishFailures.WithLabelValues("rejected").Inc()
+			h.logger.Debug("failed to publish usage event to NATS",
+				zap.Error(err),
+				zap.String("api_path", event.APIPath))
+			return
+		}
+		h.logger.Debug("published usage event to NATS",
+			zap.String("event_id", event.ID),
+			zap.Int("status_code", event.StatusCode))
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// Identity headers the gateway sends upstream. They are signed, together
+// with auth.HeaderTimestamp, in auth.HeaderSignature.
+const (
+	headerConsumer  = "X-Veil-Consumer"
+	headerKeyName   = "X-Veil-Key-Name"
+	headerRequestID = "X-Veil-Request-Id"
+)
+
+// reservedHeaderPrefix marks the headers only the gateway sets upstream;
+// callers' headers with the prefix are dropped
+const reservedHeaderPrefix = "X-Veil-"
+
+// toHeaderPolicy converts the request header policy of a request
+func toHeaderPolicy(p *dto.HeaderPolicyDTO) *models.HeaderPolicy {
+	if p == nil {
+		return nil
+	}
+	return &models.HeaderPolicy{
+		Remove:          p.Remove,
+		Rename:          p.Rename,
+		Set:             p.Set,
+		Append:          p.Append,
+		DisableIdentity: p.DisableIdentity,
+	}
+}
+
+// toHeaderPolicyDTO converts a stored request header policy for a response
+func toHeaderPolicyDTO(p *models.HeaderPolicy) *dto.HeaderPolicyDTO {
+	if p == nil {
+		return nil
+	}
+	return &dto.HeaderPolicyDTO{
+		Remove:          p.Remove,
+		Rename:          p.Rename,
+		Set:             p.Set,
+		Append:          p.Append,
+		DisableIdentity: p.DisableIdentity,
+	}
+}
+
+// prepareHeaderPolicy validates the request header policy of an API and
+// canonicalizes its header names
+func (h *VeilHandler) prepareHeaderPolicy(api *models.APIConfig) error {
+	p := api.RequestHeaders
+	if p == nil {
+		return nil
+	}
+
+	prepared := &models.HeaderPolicy{DisableIdentity: p.DisableIdentity}
+	for _, name := range p.Remove {
+		header, err := h.policyHeader("remove", name)
+		if err != nil {
+			return err
+		}
+		prepared.Remove = append(prepared.Remove, header)
+	}
+	var err error
+	if prepared.Rename, err = h.policyHeaderMap("rename", p.Rename, true); err != nil {
+		return err
+	}
+	if prepared.Set, err = h.policyHeaderMap("set", p.Set, false); err != nil {
+		return err
+	}
+	if prepared.Append, err = h.policyHeaderMap("append", p.Append, false); err != nil {
+		return err
+	}
+
+	if len(prepared.Remove) == 0 && prepared.Rename == nil && prepared.Set == nil && prepared.Append == nil && !prepared.DisableIdentity {
+		prepared = nil
+	}
+	api.RequestHeaders = prepared
+	return nil
+}
+
+// policyHeaderMap canonicalizes the header names of a policy operation, and
+// its values too if they are header names
+func (h *VeilHandler) policyHeaderMap(operation string, headers map[string]string, valuesAreNames bool) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		header, err := h.policyHeader(operation, name)
+		if err != nil {
+			return nil, err
+		}
+		if valuesAreNames {
+			if value, err = h.policyHeader(operation, value); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := out[header]; ok {
+			return nil, fmt.Errorf("request_headers %s lists %s twice", operation, header)
+		}
+		out[header] = value
+	}
+	return out, nil
+}
+
+// policyHeader canonicalizes a header name of a policy. The headers the
+// gateway controls cannot be changed by policies.
+func (h *VeilHandler) policyHeader(operation, name string) (string, error) {
+	header := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+	if header == "" || strings.ContainsAny(header, " :") {
+		return "", fmt.Errorf("request_headers %s has invalid header name %q", operation, name)
+	}
+	if header == "Host" || strings.EqualFold(header, h.SubscriptionKey) || strings.HasPrefix(header, reservedHeaderPrefix) {
+		return "", fmt.Errorf("request_headers %s must not change %s", operation, header)
+	}
+	return header, nil
+}
+
+// applyHeaderPolicy prepares the request headers sent to an API's upstream:
+// it drops the subscription key query parameter and callers' X-Veil headers,
+// applies the API's policy and adds the signed identity headers
+func (h *VeilHandler) applyHeaderPolicy(r *http.Request, api *models.APIConfig, key *models.APIKey, requestID string) {
+	if h.SubscriptionQuery != "" {
+		r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, h.SubscriptionQuery)
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(name, reservedHeaderPrefix) {
+			r.Header.Del(name)
+		}
+	}
+
+	p := api.RequestHeaders
+	if p == nil {
+		p = &models.HeaderPolicy{}
+	}
+	for _, name := range p.Remove {
+		r.Header.Del(name)
+	}
+	for from, to := range p.Rename {
+		values := r.Header.Values(from)
+		r.Header.Del(from)
+		for _, value := range values {
+			r.Header.Add(to, value)
+		}
+	}
+	for name, value := range p.Set {
+		r.Header.Set(name, value)
+	}
+	for name, value := range p.Append {
+		r.Header.Add(name, value)
+	}
+
+	if p.DisableIdentity {
+		return
+	}
+	// The consumer is the key's ID, which identifies it without revealing
+	// anything that could be used as or to find the key
+	var consumer, keyName string
+	if key != nil {
+		consumer, keyName = strconv.FormatUint(uint64(key.ID), 10), key.Name
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(headerConsumer, consumer)
+	r.Header.Set(headerKeyName, keyName)
+	r.Header.Set(headerRequestID, requestID)
+	r.Header.Set(auth.HeaderTimestamp, timestamp)
+	if h.IdentitySecret != "" {
+		r.Header.Set(auth.HeaderSignature, signIdentity(h.IdentitySecret, timestamp, requestID, consumer, keyName))
+	}
+}
+
+// signIdentity returns hex(HMAC-SHA256(secret, timestamp \n request id \n
+// consumer \n key name)), which upstreams recompute to trust the identity
+// headers
+func signIdentity(secret, timestamp, requestID, consumer, keyName string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{timestamp, requestID, consumer, keyName}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// removeQueryParam drops a parameter from a raw query string, keeping the
+// order and encoding of the others
+func removeQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
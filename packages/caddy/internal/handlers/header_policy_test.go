@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestVeilHandler_prepareHeaderPolicy(t *testing.T) {
+	handler := &VeilHandler{SubscriptionKey: "X-Subscription-Key"}
+
+	tests := []struct {
+		name    string
+		policy  *models.HeaderPolicy
+		want    *models.HeaderPolicy
+		wantErr string
+	}{
+		{name: "none", policy: nil, want: nil},
+		{name: "empty", policy: &models.HeaderPolicy{Set: map[string]string{}}, want: nil},
+		{name: "canonical names",
+			policy: &models.HeaderPolicy{Remove: []string{"cookie"}, Rename: map[string]string{"x-user": "x-partner-user"},
+				Set: map[string]string{"x-partner": "veil"}, Append: map[string]string{"via": "veil"}},
+			want: &models.HeaderPolicy{Remove: []string{"Cookie"}, Rename: map[string]string{"X-User": "X-Partner-User"},
+				Set: map[string]string{"X-Partner": "veil"}, Append: map[string]string{"Via": "veil"}}},
+		{name: "disable identity", policy: &models.HeaderPolicy{DisableIdentity: true},
+			want: &models.HeaderPolicy{DisableIdentity: true}},
+		{name: "invalid name", policy: &models.HeaderPolicy{Remove: []string{"X Bad"}}, wantErr: "invalid header name"},
+		{name: "host", policy: &models.HeaderPolicy{Set: map[string]string{"host": "example.com"}}, wantErr: "must not change Host"},
+		{name: "subscription key", policy: &models.HeaderPolicy{Rename: map[string]string{"X-User": "x-subscription-key"}},
+			wantErr: "must not change X-Subscription-Key"},
+		{name: "identity header", policy: &models.HeaderPolicy{Set: map[string]string{"x-veil-consumer": "admin"}},
+			wantErr: "must not change X-Veil-Consumer"},
+		{name: "duplicate", policy: &models.HeaderPolicy{Set: map[string]string{"x-a": "1", "X-A": "2"}}, wantErr: "twice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &models.APIConfig{RequestHeaders: tt.policy}
+			err := handler.prepareHeaderPolicy(api)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, api.RequestHeaders)
+		})
+	}
+}
+
+func TestVeilHandler_applyHeaderPolicy(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:            filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey:   "X-Subscription-Key",
+		SubscriptionQuery: "key",
+		IdentitySecret:    "identity-secret",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	queue := &captureQueue{}
+	handler.eventQueue = queue
+
+	active := true
+	onboard := func(path string, policy *models.HeaderPolicy) {
+		api := CreateAPI(t, path, "http://localhost:8085", "basic", []string{"GET"}, nil,
+			[]models.APIKey{{Key: "key-" + path[1:len(path)-2], Name: "Partner", IsActive: &active}})
+		api.RequestHeaders = policy
+		require.NoError(t, handler.prepareHeaderPolicy(api))
+		require.NoError(t, handler.store.CreateAPI(api))
+	}
+	onboard("/policy/*", &models.HeaderPolicy{
+		Remove: []string{"cookie"},
+		Rename: map[string]string{"x-user": "x-partner-user"},
+		Set:    map[string]string{"x-partner": "veil", "x-partner-user": "overridden"},
+		Append: map[string]string{"via": "veil"},
+	})
+	onboard("/anonymous/*", &models.HeaderPolicy{DisableIdentity: true})
+
+	send := func(target string, header http.Header) (*http.Request, int) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		var upstream *http.Request
+		next := &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+			upstream = r.Clone(r.Context())
+		}}
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.ServeHTTP(w, req, next))
+		return upstream, w.Code
+	}
+
+	upstream, code := send("/policy/items?page=2&key=key-policy&sort=name", http.Header{
+		"Cookie":          {"session=1"},
+		"X-User":          {"alice"},
+		"Via":             {"1.1 proxy"},
+		"X-Veil-Consumer": {"spoofed"},
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	// The policy is applied in order: remove, rename, set, append
+	assert.Empty(t, upstream.Header.Get("Cookie"))
+	assert.Empty(t, upstream.Header.Get("X-User"))
+	assert.Equal(t, []string{"overridden"}, upstream.Header.Values("X-Partner-User"))
+	assert.Equal(t, "veil", upstream.Header.Get("X-Partner"))
+	assert.Equal(t, []string{"1.1 proxy", "veil"}, upstream.Header.Values("Via"))
+
+	// The subscription key is not forwarded
+	assert.Equal(t, "page=2&sort=name", upstream.URL.RawQuery)
+
+	// Identity headers replace the caller's and are signed
+	consumer := upstream.Header.Get(headerConsumer)
+	requestID := upstream.Header.Get(headerRequestID)
+	timestamp := upstream.Header.Get(auth.HeaderTimestamp)
+	stored, err := handler.store.GetAPIWithKeys("/policy/*")
+	require.NoError(t, err)
+	require.Len(t, stored.APIKeys, 1)
+	assert.Equal(t, strconv.FormatUint(uint64(stored.APIKeys[0].ID), 10), consumer)
+	assert.Equal(t, "Partner", upstream.Header.Get(headerKeyName))
+	assert.NotEmpty(t, requestID)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(sent, 0), 5*time.Second)
+	assert.Equal(t, signIdentity("identity-secret", timestamp, requestID, consumer, "Partner"),
+		upstream.Header.Get(auth.HeaderSignature))
+
+	// The usage event shares the request ID
+	queue.mu.Lock()
+	require.Len(t, queue.events, 1)
+	assert.Equal(t, requestID, queue.events[0].ID)
+	queue.mu.Unlock()
+
+	// APIs can opt out of identity headers, spoofed ones are still dropped
+	upstream, code = send("/anonymous/items", http.Header{
+		"X-Subscription-Key": {"key-anonymous"},
+		"X-Veil-Consumer":    {"spoofed"},
+	})
+	require.Equal(t, http.StatusOK, code)
+	for _, name := range []string{headerConsumer, headerKeyName, headerRequestID, auth.HeaderTimestamp, auth.HeaderSignature} {
+		assert.Empty(t, upstream.Header.Get(name), name)
+	}
+}
+
+func TestRemoveQueryParam(t *testing.T) {
+	assert.Equal(t, "", removeQueryParam("", "key"))
+	assert.Equal(t, "", removeQueryParam("key=abc", "key"))
+	assert.Equal(t, "a=1&b=%2F", removeQueryParam("a=1&key=abc&b=%2F&k%65y=def", "key"))
+	assert.Equal(t, "keys=1", removeQueryParam("keys=1", "key"))
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+)
+
+// keySyncSignatureHeader carries the signature of a key.sync message or
+// snapshot reply as "<scheme>=<base64 signature>", where the scheme is
+// hmac-sha256 (shared sync_secret) or ed25519 (NKey listed in sync_public_keys)
+const keySyncSignatureHeader = "Veil-Signature"
+
+// snapshotAttempts is how many times a snapshot request is tried before the
+// gateway waits for the next reconnect
+const snapshotAttempts = 3
+
+var (
+	errKeySyncUnsigned         = errors.New("key sync message is not signed")
+	errKeySyncInvalidSignature = errors.New("invalid key sync signature")
+	errKeySyncUnsignedOp       = errors.New("key sync operation requires sync_secret or sync_public_keys")
+)
+
+// KeySyncEvent represents a key synchronization event from platform-api.
+// Without an operation it is a status change, which matches the event
+// structure published by the credit worker.
+type KeySyncEvent struct {
+	// Operation is status (default), create, delete, expire, rename or move
+	Operation store.KeyOperation `json:"operation,omitempty"`
+	KeyValue  string             `json:"key_value"`
+	IsActive  *bool              `json:"is_active,omitempty"`
+	// APIPath is the API a created or moved key belongs to, e.g. /weather/*
+	APIPath string `json:"api_path,omitempty"`
+	// Name is the name of a created or renamed key
+	Name string `json:"name,omitempty"`
+	// ExpiresAt is the expiry of a created key or the new expiry of an
+	// expire operation; null removes it
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Timestamp string     `json:"timestamp"`
+	Reason    string     `json:"reason"`
+	// Version increases with every change of the key; changes with a version
+	// not newer than the applied one are ignored
+	Version uint64 `json:"version,omitempty"`
+}
+
+// change converts the event to a store key change
+func (e KeySyncEvent) change() store.KeyChange {
+	operation := e.Operation
+	if operation == "" {
+		operation = store.KeyOpStatus
+	}
+	return store.KeyChange{
+		Operation: operation,
+		KeyValue:  e.KeyValue,
+		Version:   e.Version,
+		APIPath:   e.APIPath,
+		Name:      e.Name,
+		IsActive:  e.IsActive,
+		ExpiresAt: e.ExpiresAt,
+	}
+}
+
+// KeySnapshot is the reply to a snapshot request with the status of every key
+type KeySnapshot struct {
+	// Version is used for keys that carry no version of their own
+	Version uint64         `json:"version"`
+	Keys    []KeySyncEvent `json:"keys"`
+}
+
+// keySyncVerifier checks key sync signatures. Without a secret or public keys
+// configured every message is accepted, but only status changes are applied.
+type keySyncVerifier struct {
+	secret     []byte
+	publicKeys []nkeys.KeyPair
+}
+
+// newKeySyncVerifier creates the verifier for the configured keys
+func newKeySyncVerifier(cfg *NATSConfig) (*keySyncVerifier, error) {
+	v := &keySyncVerifier{}
+	if cfg.SyncSecret != "" {
+		v.secret = []byte(cfg.SyncSecret)
+	}
+	for _, key := range cfg.SyncPublicKeys {
+		kp, err := nkeys.FromPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key sync public key %q: %v", key, err)
+		}
+		v.publicKeys = append(v.publicKeys, kp)
+	}
+	return v, nil
+}
+
+// required reports whether messages must be signed
+func (v *keySyncVerifier) required() bool {
+	return len(v.secret) > 0 || len(v.publicKeys) > 0
+}
+
+// allows reports whether a change with the operation may be applied. Without
+// signatures only status changes are, as published by the credit worker;
+// anyone able to publish could otherwise create, move or delete keys.
+func (v *keySyncVerifier) allows(operation store.KeyOperation) error {
+	if v.required() || operation == store.KeyOpStatus {
+		return nil
+	}
+	return errKeySyncUnsignedOp
+}
+
+// verify checks the signature header of msg against its payload
+func (v *keySyncVerifier) verify(msg *nats.Msg) error {
+	if !v.required() {
+		return nil
+	}
+
+	header := msg.Header.Get(keySyncSignatureHeader)
+	if header == "" {
+		return errKeySyncUnsigned
+	}
+	scheme, encoded, ok := strings.Cut(header, "=")
+	if !ok {
+		return errKeySyncInvalidSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errKeySyncInvalidSignature
+	}
+
+	switch scheme {
+	case "hmac-sha256":
+		if len(v.secret) == 0 {
+			return errKeySyncInvalidSignature
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(msg.Data)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return nil
+		}
+	case "ed25519":
+		for _, kp := range v.publicKeys {
+			if kp.Verify(msg.Data, signature) == nil {
+				return nil
+			}
+		}
+	}
+	return errKeySyncInvalidSignature
+}
+
+// handleKeySync verifies a key.sync message and applies it through the
+// current handler
+func (c *natsClient) handleKeySync(msg *nats.Msg) {
+	if err := c.verifier.verify(msg); err != nil {
+		c.logger.Warn("rejected key sync event",
+			zap.Error(err),
+			zap.String("subject", msg.Subject))
+		countKeySync("unknown", keySyncRejected)
+		return
+	}
+
+	var syncEvent KeySyncEvent
+	if err := json.Unmarshal(msg.Data, &syncEvent); err != nil {
+		c.logger.Error("failed to decode key sync event",
+			zap.Error(err),
+			zap.String("data", string(msg.Data)))
+		countKeySync("unknown", keySyncRejected)
+		return
+	}
+
+	operation := syncEvent.change().Operation
+	if err := c.verifier.allows(operation); err != nil {
+		c.logger.Warn("rejected key sync event",
+			zap.Error(err),
+			zap.String("operation", string(operation)),
+			zap.String("key_prefix", store.KeyPrefix(syncEvent.KeyValue)))
+		countKeySync(operation, keySyncRejected)
+		return
+	}
+
+	if h := c.current(); h != nil {
+		h.handleKeySyncEvent(syncEvent)
+	}
+}
+
+// handleKeySyncEvent applies a key.sync event to the API keys in the database
+// This allows platform-api to drive key state (like quota exhaustion) without the management API
+func (h *VeilHandler) handleKeySyncEvent(syncEvent KeySyncEvent) {
+	change := syncEvent.change()
+	fields := []zap.Field{
+		zap.String("operation", string(change.Operation)),
+		zap.String("key_prefix", store.KeyPrefix(syncEvent.KeyValue)),
+		zap.Uint64("version", syncEvent.Version),
+		zap.String("reason", syncEvent.Reason),
+		zap.String("timestamp", syncEvent.Timestamp),
+	}
+
+	applied, err := h.store.ApplyKeyChange(change)
+	switch {
+	case err != nil:
+		countKeySync(change.Operation, keySyncFailed)
+		h.logger.Error("failed to apply key sync event", append(fields, zap.Error(err))...)
+	case !applied:
+		countKeySync(change.Operation, keySyncIgnored)
+		h.logger.Debug("ignored stale or redundant key sync event", fields...)
+	default:
+		countKeySync(change.Operation, keySyncApplied)
+		h.logger.Info("synchronized key from platform-api", fields...)
+	}
+}
+
+// requestResync schedules a snapshot request once a handler is attached to
+// apply it. It is called whenever the connection is (re)established.
+func (c *natsClient) requestResync() {
+	if c.snapshotSubject == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.handlers) == 0 {
+		c.resyncPending = true
+		return
+	}
+	go c.resync()
+}
+
+// resync requests a key state snapshot, retrying with backoff, and applies it
+// through the current handler. Entries are applied like key.sync events, so a
+// snapshot can also create and delete keys; entries that fail are skipped.
+func (c *natsClient) resync() {
+	c.resyncMu.Lock()
+	defer c.resyncMu.Unlock()
+
+	var snapshot KeySnapshot
+	var err error
+	wait := c.snapshotTimeout / 4
+	for attempt := 1; attempt <= snapshotAttempts; attempt++ {
+		if snapshot, err = c.requestSnapshot(); err == nil {
+			break
+		}
+		c.logger.Warn("key state snapshot request failed",
+			zap.Error(err),
+			zap.Int("attempt", attempt))
+		if attempt == snapshotAttempts || c.conn.IsClosed() {
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	h := c.current()
+	if h == nil {
+		return
+	}
+
+	var applied, stale, failed, rejected int
+	for _, syncEvent := range snapshot.Keys {
+		if syncEvent.Version == 0 {
+			syncEvent.Version = snapshot.Version
+		}
+		change := syncEvent.change()
+		if c.verifier.allows(change.Operation) != nil {
+			countKeySync(change.Operation, keySyncRejected)
+			rejected++
+			continue
+		}
+		ok, err := h.store.ApplyKeyChange(change)
+		switch {
+		case err != nil:
+			countKeySync(change.Operation, keySyncFailed)
+			failed++
+		case ok:
+			countKeySync(change.Operation, keySyncApplied)
+			applied++
+		default:
+			countKeySync(change.Operation, keySyncIgnored)
+			stale++
+		}
+	}
+
+	c.logger.Info("applied key state snapshot",
+		zap.Uint64("version", snapshot.Version),
+		zap.Int("keys", len(snapshot.Keys)),
+		zap.Int("applied", applied),
+		zap.Int("stale", stale),
+		zap.Int("failed", failed),
+		zap.Int("rejected", rejected))
+}
+
+// requestSnapshot sends one snapshot request and verifies the reply
+func (c *natsClient) requestSnapshot() (KeySnapshot, error) {
+	var snapshot KeySnapshot
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.snapshotTimeout)
+	defer cancel()
+	reply, err := c.conn.RequestWithContext(ctx, c.snapshotSubject, nil)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := c.verifier.verify(reply); err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(reply.Data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("failed to decode key state snapshot: %v", err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+)
+
+func TestKeySyncVerifier(t *testing.T) {
+	data := []byte(`{"key_value":"test-key","is_active":false,"version":3}`)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(data)
+	hmacSignature := "hmac-sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	publicKey, err := user.PublicKey()
+	require.NoError(t, err)
+	sig, err := user.Sign(data)
+	require.NoError(t, err)
+	nkeySignature := "ed25519=" + base64.StdEncoding.EncodeToString(sig)
+
+	other, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	otherSig, err := other.Sign(data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		cfg       NATSConfig
+		signature string
+		data      []byte
+		wantErr   error
+	}{
+		{name: "unsigned without keys", cfg: NATSConfig{}},
+		{name: "unsigned with secret", cfg: NATSConfig{SyncSecret: "s3cret"}, wantErr: errKeySyncUnsigned},
+		{name: "valid hmac", cfg: NATSConfig{SyncSecret: "s3cret"}, signature: hmacSignature},
+		{name: "hmac with wrong secret", cfg: NATSConfig{SyncSecret: "other"}, signature: hmacSignature, wantErr: errKeySyncInvalidSignature},
+		{name: "hmac over modified payload", cfg: NATSConfig{SyncSecret: "s3cret"}, signature: hmacSignature, data: []byte(`{"key_value":"test-key","is_active":true,"version":3}`), wantErr: errKeySyncInvalidSignature},
+		{name: "valid nkey", cfg: NATSConfig{SyncPublicKeys: []string{publicKey}}, signature: nkeySignature},
+		{name: "nkey of another signer", cfg: NATSConfig{SyncPublicKeys: []string{publicKey}}, signature: "ed25519=" + base64.StdEncoding.EncodeToString(otherSig), wantErr: errKeySyncInvalidSignature},
+		{name: "hmac without secret configured", cfg: NATSConfig{SyncPublicKeys: []string{publicKey}}, signature: hmacSignature, wantErr: errKeySyncInvalidSignature},
+		{name: "unknown scheme", cfg: NATSConfig{SyncSecret: "s3cret"}, signature: "rsa=AAAA", wantErr: errKeySyncInvalidSignature},
+		{name: "malformed signature", cfg: NATSConfig{SyncSecret: "s3cret"}, signature: "hmac-sha256=%%%", wantErr: errKeySyncInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newKeySyncVerifier(&tt.cfg)
+			require.NoError(t, err)
+
+			msg := nats.NewMsg(defaultKeySyncSubject)
+			msg.Data = data
+			if tt.data != nil {
+				msg.Data = tt.data
+			}
+			if tt.signature != "" {
+				msg.Header.Set(keySyncSignatureHeader, tt.signature)
+			}
+
+			err = v.verify(msg)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKeySyncEvent_change(t *testing.T) {
+	inactive := false
+	expiry := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		data string
+		want store.KeyChange
+	}{
+		{
+			name: "credit worker status event",
+			data: `{"key_value":"test-key","is_active":false,"reason":"quota_exhausted","timestamp":"2026-01-01T00:00:00Z"}`,
+			want: store.KeyChange{Operation: store.KeyOpStatus, KeyValue: "test-key", IsActive: &inactive},
+		},
+		{
+			name: "create",
+			data: `{"operation":"create","key_value":"test-key","api_path":"/weather/*","name":"Weather","expires_at":"2026-06-01T00:00:00Z","version":4}`,
+			want: store.KeyChange{Operation: store.KeyOpCreate, KeyValue: "test-key", APIPath: "/weather/*", Name: "Weather", ExpiresAt: &expiry, Version: 4},
+		},
+		{
+			name: "expire without expiry clears it",
+			data: `{"operation":"expire","key_value":"test-key","expires_at":null,"version":5}`,
+			want: store.KeyChange{Operation: store.KeyOpExpire, KeyValue: "test-key", Version: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event KeySyncEvent
+			require.NoError(t, json.Unmarshal([]byte(tt.data), &event))
+			assert.Equal(t, tt.want, event.change())
+		})
+	}
+}
+
+func TestNATSClient_handleKeySyncUnsigned(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	api := CreateAPI(t, "/weather/*", "http://localhost:8083", "weather", nil, nil,
+		[]models.APIKey{{Key: "test-key", Name: "Test"}})
+	require.NoError(t, handler.store.CreateAPI(api))
+
+	verifier, err := newKeySyncVerifier(&NATSConfig{})
+	require.NoError(t, err)
+	client := &natsClient{verifier: verifier, logger: zap.NewNop(), handlers: []*VeilHandler{handler}}
+	publish := func(data string) {
+		msg := nats.NewMsg(defaultKeySyncSubject)
+		msg.Data = []byte(data)
+		client.handleKeySync(msg)
+	}
+
+	// Without sync_secret or sync_public_keys, only status changes apply
+	publish(`{"operation":"create","key_value":"forged-key","api_path":"/weather/*","name":"Forged","version":1}`)
+	publish(`{"operation":"delete","key_value":"test-key","version":1}`)
+	forged, err := handler.store.FindAPIKey(api, "forged-key")
+	require.NoError(t, err)
+	assert.Nil(t, forged)
+	key, err := handler.store.FindAPIKey(api, "test-key")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.True(t, *key.IsActive)
+
+	publish(`{"key_value":"test-key","is_active":false,"version":2}`)
+	key, err = handler.store.FindAPIKey(api, "test-key")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.False(t, *key.IsActive)
+}
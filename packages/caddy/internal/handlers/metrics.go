@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// unmatchedAPIPath labels requests that match no onboarded API, so that
+// metric cardinality is bounded by the configured API paths
+const unmatchedAPIPath = "unmatched"
+
+// Auth failure reasons
+const (
+	authFailureInvalid       = "invalid"
+	authFailureInactive      = "inactive"
+	authFailureExpired       = "expired"
+	authFailureMethod        = "method"
+	authFailureMissingHeader = "missing_header"
+)
+
+// Key sync results
+const (
+	keySyncApplied  = "applied"
+	keySyncIgnored  = "ignored"
+	keySyncFailed   = "failed"
+	keySyncRejected = "rejected"
+)
+
+// veilCollectors are the gateway's Prometheus collectors. They are
+// registered with the default registry, which Caddy serves on the admin
+// /metrics endpoint and through the metrics handler.
+type veilCollectors struct {
+	requests            *prometheus.CounterVec
+	upstreamDuration    *prometheus.HistogramVec
+	authFailures        *prometheus.CounterVec
+	natsPublishFailures *prometheus.CounterVec
+	keySync             *prometheus.CounterVec
+	contractViolations  *prometheus.CounterVec
+	eventQueues         *eventQueueCollector
+}
+
+var (
+	veilMetrics     veilCollectors
+	veilMetricsInit sync.Once
+)
+
+func initVeilMetrics() {
+	const ns, sub = "caddy", "veil"
+
+	veilMetrics.requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Counter of requests to onboarded APIs by API path, method and status class.",
+	}, []string{"api_path", "method", "code"})
+	veilMetrics.upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "upstream_duration_seconds",
+		Help:      "Histogram of the time authorized requests spent in the upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api_path"})
+	veilMetrics.authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_failures_total",
+		Help:      "Counter of rejected requests by API path and reason.",
+	}, []string{"api_path", "reason"})
+	veilMetrics.natsPublishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "nats_publish_failures_total",
+		Help:      "Counter of credit events that could not be published (rejected) or were not acknowledged by JetStream.",
+	}, []string{"kind"})
+	veilMetrics.keySync = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "key_sync_total",
+		Help:      "Counter of key sync changes by operation and result.",
+	}, []string{"operation", "result"})
+	veilMetrics.contractViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "contract_violations_total",
+		Help:      "Counter of requests and upstream responses that did not match the API's OpenAPI document, by API path and direction.",
+	}, []string{"api_path", "direction"})
+	veilMetrics.eventQueues = newEventQueueCollector()
+	prometheus.MustRegister(veilMetrics.eventQueues)
+}
+
+// metrics returns the collectors, registering them on first use
+func metrics() *veilCollectors {
+	veilMetricsInit.Do(initVeilMetrics)
+	return &veilMetrics
+}
+
+// metricsAPIPath returns the configured path of the API serving path
+func (h *VeilHandler) metricsAPIPath(path string) string {
+	if api, err := h.store.GetAPIByPath(path); err == nil && api != nil {
+		return api.Path
+	}
+	return unmatchedAPIPath
+}
+
+// countAuthFailure records a request rejected for reason
+func (h *VeilHandler) countAuthFailure(r *http.Request, reason string) {
+	metrics().authFailures.WithLabelValues(h.metricsAPIPath(r.URL.Path), reason).Inc()
+}
+
+// countContractViolation records a request or response that did not match
+// the API's spec
+func (h *VeilHandler) countContractViolation(apiPath, direction string) {
+	metrics().contractViolations.WithLabelValues(apiPath, direction).Inc()
+}
+
+// authFailureReason classifies an API key validation error
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoAPIKey):
+		return authFailureMissingHeader
+	case errors.Is(err, ErrKeyInactive):
+		return authFailureInactive
+	case errors.Is(err, ErrKeyExpired):
+		return authFailureExpired
+	default:
+		return authFailureInvalid
+	}
+}
+
+// responseStatus returns the status written by rec, or the status of the
+// handler error
+func responseStatus(rec caddyhttp.ResponseRecorder, err error) int {
+	var handlerErr caddyhttp.HandlerError
+	switch {
+	case errors.As(err, &handlerErr) && handlerErr.StatusCode != 0:
+		return handlerErr.StatusCode
+	case err != nil:
+		return http.StatusInternalServerError
+	case rec.Status() == 0:
+		return http.StatusOK
+	}
+	return rec.Status()
+}
+
+// observeRequest records a finished request
+func (h *VeilHandler) observeRequest(r *http.Request, apiPath string, status int) {
+	metrics().requests.WithLabelValues(
+		apiPath,
+		metricsMethod(r.Method),
+		strconv.Itoa(status/100)+"xx",
+	).Inc()
+}
+
+// serveUpstream passes an authorized request to the upstream handler with
+// the trace context in its traceparent header, and records how long it took
+func (h *VeilHandler) serveUpstream(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, apiPath string) error {
+	ctx, span := h.tracer.Start(r.Context(), "veil.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("veil.api_path", apiPath)))
+	injectTraceContext(ctx, r)
+
+	start := time.Now()
+	err := next.ServeHTTP(w, r.WithContext(ctx))
+	metrics().upstreamDuration.WithLabelValues(apiPath).Observe(time.Since(start).Seconds())
+
+	endSpan(span, err)
+	return err
+}
+
+// metricsMethod bounds the method label to the standard methods
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// countKeySync records the result of applying a key sync change
+func countKeySync(operation store.KeyOperation, result string) {
+	switch operation {
+	case "":
+		operation = store.KeyOpStatus
+	case store.KeyOpStatus, store.KeyOpCreate, store.KeyOpDelete, store.KeyOpExpire, store.KeyOpRename, store.KeyOpMove:
+	default:
+		operation = "unknown"
+	}
+	metrics().keySync.WithLabelValues(string(operation), result).Inc()
+}
+
+// trackedQueue is an event queue reported by the collector, with the number
+// of handlers using it
+type trackedQueue struct {
+	kind string
+	refs int
+}
+
+// eventQueueCollector reports the depth and drop counters of the event queues
+// in use. Queues are summed by kind, since a config reload briefly runs the
+// old and new queues side by side. The counters of released queues are kept
+// so that the totals do not go down when a reload replaces a queue.
+type eventQueueCollector struct {
+	mu       sync.Mutex
+	queues   map[events.StatsProvider]*trackedQueue
+	released map[string]events.QueueStats
+}
+
+// newEventQueueCollector creates a collector tracking no queues
+func newEventQueueCollector() *eventQueueCollector {
+	return &eventQueueCollector{
+		queues:   make(map[events.StatsProvider]*trackedQueue),
+		released: make(map[string]events.QueueStats),
+	}
+}
+
+var (
+	eventQueuePendingDesc = prometheus.NewDesc("caddy_veil_event_queue_pending",
+		"Number of usage events waiting for delivery.", []string{"queue"}, nil)
+	eventQueueDroppedDesc = prometheus.NewDesc("caddy_veil_event_queue_dropped_total",
+		"Counter of usage events dropped by the event queue.", []string{"queue"}, nil)
+	eventQueueDeadLetteredDesc = prometheus.NewDesc("caddy_veil_event_queue_dead_lettered_total",
+		"Counter of usage events written to the dead-letter file.", []string{"queue"}, nil)
+)
+
+func (c *eventQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventQueuePendingDesc
+	ch <- eventQueueDroppedDesc
+	ch <- eventQueueDeadLetteredDesc
+}
+
+func (c *eventQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	totals := make(map[string]events.QueueStats, len(c.released))
+	for kind, released := range c.released {
+		totals[kind] = released
+	}
+	for provider, tracked := range c.queues {
+		stats := provider.Stats()
+		total := totals[tracked.kind]
+		total.Pending += stats.Pending
+		total.Dropped += stats.Dropped
+		total.DeadLettered += stats.DeadLettered
+		totals[tracked.kind] = total
+	}
+	c.mu.Unlock()
+
+	for kind, total := range totals {
+		ch <- prometheus.MustNewConstMetric(eventQueuePendingDesc, prometheus.GaugeValue, float64(total.Pending), kind)
+		ch <- prometheus.MustNewConstMetric(eventQueueDroppedDesc, prometheus.CounterValue, float64(total.Dropped), kind)
+		ch <- prometheus.MustNewConstMetric(eventQueueDeadLetteredDesc, prometheus.CounterValue, float64(total.DeadLettered), kind)
+	}
+}
+
+// track starts reporting a queue that exposes stats
+func (c *eventQueueCollector) track(queue events.UsageEventQueue, kind string) {
+	provider, ok := queue.(events.StatsProvider)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tracked, ok := c.queues[provider]; ok {
+		tracked.refs++
+		return
+	}
+	c.queues[provider] = &trackedQueue{kind: kind, refs: 1}
+}
+
+// untrack stops reporting a queue once no handler uses it, adding its final
+// counters to those of the queues released before
+func (c *eventQueueCollector) untrack(queue events.UsageEventQueue) {
+	provider, ok := queue.(events.StatsProvider)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tracked, ok := c.queues[provider]
+	if !ok {
+		return
+	}
+	if tracked.refs--; tracked.refs > 0 {
+		return
+	}
+	delete(c.queues, provider)
+
+	stats := provider.Stats()
+	released := c.released[tracked.kind]
+	released.Dropped += stats.Dropped
+	released.DeadLettered += stats.DeadLettered
+	c.released[tracked.kind] = released
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promdto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestVeilHandler_metrics(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active, inactive := true, false
+	expired := time.Now().Add(-time.Hour)
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/metrics-test/*", "http://localhost:8082", "test-subscription",
+		[]string{"GET"}, nil, []models.APIKey{
+			{Key: "active-key", Name: "Active", IsActive: &active},
+			{Key: "inactive-key", Name: "Inactive", IsActive: &inactive},
+			{Key: "expired-key", Name: "Expired", IsActive: &active, ExpiresAt: &expired},
+		})))
+
+	const apiPath = "/metrics-test/*"
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		wantPath   string
+		wantCode   string
+		wantReason string
+	}{
+		{name: "authorized", method: http.MethodGet, path: "/metrics-test/items/42", key: "active-key", wantPath: apiPath, wantCode: "2xx"},
+		{name: "missing key", method: http.MethodGet, path: "/metrics-test/items", wantPath: apiPath, wantCode: "4xx", wantReason: authFailureMissingHeader},
+		{name: "invalid key", method: http.MethodGet, path: "/metrics-test/items", key: "wrong-key", wantPath: apiPath, wantCode: "4xx", wantReason: authFailureInvalid},
+		{name: "inactive key", method: http.MethodGet, path: "/metrics-test/items", key: "inactive-key", wantPath: apiPath, wantCode: "4xx", wantReason: authFailureInactive},
+		{name: "expired key", method: http.MethodGet, path: "/metrics-test/items", key: "expired-key", wantPath: apiPath, wantCode: "4xx", wantReason: authFailureExpired},
+		{name: "method not allowed", method: http.MethodDelete, path: "/metrics-test/items", key: "active-key", wantPath: apiPath, wantCode: "4xx", wantReason: authFailureMethod},
+		{name: "unmatched path", method: "PURGE", path: "/elsewhere/123", key: "active-key", wantPath: unmatchedAPIPath, wantCode: "4xx", wantReason: authFailureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := metrics().requests.WithLabelValues(tt.wantPath, metricsMethod(tt.method), tt.wantCode)
+			before := testutil.ToFloat64(requests)
+			upstream := upstreamSamples(t, tt.wantPath)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("X-Subscription-Key", tt.key)
+			}
+			var failures float64
+			if tt.wantReason != "" {
+				failures = testutil.ToFloat64(metrics().authFailures.WithLabelValues(tt.wantPath, tt.wantReason))
+			}
+
+			err := handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {}})
+			require.NoError(t, err)
+
+			assert.Equal(t, before+1, testutil.ToFloat64(requests))
+			if tt.wantReason != "" {
+				assert.Equal(t, failures+1, testutil.ToFloat64(metrics().authFailures.WithLabelValues(tt.wantPath, tt.wantReason)))
+				assert.Equal(t, upstream, upstreamSamples(t, tt.wantPath))
+			} else {
+				assert.Equal(t, upstream+1, upstreamSamples(t, tt.wantPath))
+			}
+		})
+	}
+}
+
+func TestVeilHandler_metricsPathAfterTransforms(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	// The rewritten path belongs to another API; requests are still counted
+	// under the API the caller reached
+	active := true
+	api := CreateAPI(t, "/relabel/*", "http://localhost:8082", "test-subscription", nil, nil,
+		[]models.APIKey{{Key: "relabel-key", Name: "Relabel", IsActive: &active}})
+	api.Transforms = &models.Transforms{Request: &models.RequestTransform{
+		Paths: []models.PathRewrite{{From: "/v1/*", To: "/v2/*"}},
+	}}
+	require.NoError(t, prepareTransforms(api))
+	require.NoError(t, handler.store.CreateAPI(api))
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/relabel/v2/*", "http://localhost:8083", "test-subscription", nil, nil, nil)))
+
+	requests := metrics().requests.WithLabelValues("/relabel/*", metricsMethod(http.MethodGet), "2xx")
+	before := testutil.ToFloat64(requests)
+	upstream := upstreamSamples(t, "/relabel/*")
+
+	req := httptest.NewRequest(http.MethodGet, "/relabel/v1/items", nil)
+	req.Header.Set("X-Subscription-Key", "relabel-key")
+	var rewritten string
+	require.NoError(t, handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+		rewritten = r.URL.Path
+	}}))
+
+	assert.Equal(t, "/relabel/v2/items", rewritten)
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+	assert.Equal(t, upstream+1, upstreamSamples(t, "/relabel/*"))
+}
+
+// upstreamSamples returns the number of upstream latencies observed for apiPath
+func upstreamSamples(t *testing.T, apiPath string) uint64 {
+	t.Helper()
+	var m promdto.Metric
+	require.NoError(t, metrics().upstreamDuration.WithLabelValues(apiPath).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// fakeStatsQueue is an event queue reporting fixed stats
+type fakeStatsQueue struct {
+	events.UsageEventQueue
+	stats events.QueueStats
+}
+
+func (q *fakeStatsQueue) Stats() events.QueueStats { return q.stats }
+
+func TestEventQueueCollector(t *testing.T) {
+	collector := newEventQueueCollector()
+	disk := &fakeStatsQueue{stats: events.QueueStats{Pending: 5, Dropped: 2}}
+	oldMemory := &fakeStatsQueue{stats: events.QueueStats{Pending: 1, Dropped: 3, DeadLettered: 1}}
+	newMemory := &fakeStatsQueue{stats: events.QueueStats{Pending: 4}}
+
+	// Two handlers share the disk queue; a reload runs two memory queues
+	collector.track(disk, events.QueueDisk)
+	collector.track(disk, events.QueueDisk)
+	collector.track(oldMemory, events.QueueMemory)
+	collector.track(newMemory, events.QueueMemory)
+	collector.untrack(disk)
+
+	expected := `
+# HELP caddy_veil_event_queue_dead_lettered_total Counter of usage events written to the dead-letter file.
+# TYPE caddy_veil_event_queue_dead_lettered_total counter
+caddy_veil_event_queue_dead_lettered_total{queue="disk"} 0
+caddy_veil_event_queue_dead_lettered_total{queue="memory"} 1
+# HELP caddy_veil_event_queue_dropped_total Counter of usage events dropped by the event queue.
+# TYPE caddy_veil_event_queue_dropped_total counter
+caddy_veil_event_queue_dropped_total{queue="disk"} 2
+caddy_veil_event_queue_dropped_total{queue="memory"} 3
+# HELP caddy_veil_event_queue_pending Number of usage events waiting for delivery.
+# TYPE caddy_veil_event_queue_pending gauge
+caddy_veil_event_queue_pending{queue="disk"} 5
+caddy_veil_event_queue_pending{queue="memory"} 5
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+
+	// Counters keep the counts of released queues, so they do not go down
+	// when the reload finishes
+	collector.untrack(oldMemory)
+	newMemory.stats.Dropped = 1
+	expected = `
+# HELP caddy_veil_event_queue_dropped_total Counter of usage events dropped by the event queue.
+# TYPE caddy_veil_event_queue_dropped_total counter
+caddy_veil_event_queue_dropped_total{queue="disk"} 2
+caddy_veil_event_queue_dropped_total{queue="memory"} 4
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "caddy_veil_event_queue_dropped_total"))
+
+	collector.untrack(disk)
+	collector.untrack(newMemory)
+	expected = `
+# HELP caddy_veil_event_queue_dead_lettered_total Counter of usage events written to the dead-letter file.
+# TYPE caddy_veil_event_queue_dead_lettered_total counter
+caddy_veil_event_queue_dead_lettered_total{queue="disk"} 0
+caddy_veil_event_queue_dead_lettered_total{queue="memory"} 1
+# HELP caddy_veil_event_queue_dropped_total Counter of usage events dropped by the event queue.
+# TYPE caddy_veil_event_queue_dropped_total counter
+caddy_veil_event_queue_dropped_total{queue="disk"} 2
+caddy_veil_event_queue_dropped_total{queue="memory"} 4
+# HELP caddy_veil_event_queue_pending Number of usage events waiting for delivery.
+# TYPE caddy_veil_event_queue_pending gauge
+caddy_veil_event_queue_pending{queue="disk"} 0
+caddy_veil_event_queue_pending{queue="memory"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
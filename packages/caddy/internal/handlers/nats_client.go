@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+)
+
+// natsClients holds one connection per database and NATS configuration so
+// that config reloads neither leak connections nor drop unacknowledged credit
+// events
+var natsClients = caddy.NewUsagePool()
+
+// natsClient is a NATS connection shared by the handlers with the same
+// database and nats settings. Key sync events are applied through the most recently
+// provisioned handler, like route reconciliation.
+type natsClient struct {
+	conn      *nats.Conn
+	publisher creditPublisher
+	verifier  *keySyncVerifier
+	logger    *zap.Logger
+
+	snapshotSubject string
+	snapshotTimeout time.Duration
+	resyncMu        sync.Mutex
+
+	mu            sync.Mutex
+	handlers      []*VeilHandler
+	resyncPending bool
+}
+
+// newNATSClient connects to NATS, subscribes to key sync events and sets up
+// credit publishing. A server that is down does not fail the connection; it
+// is retried in the background with exponential backoff. Every (re)connect
+// requests a key state snapshot if snapshot_subject is set.
+func newNATSClient(cfg *NATSConfig, logger *zap.Logger) (*natsClient, error) {
+	verifier, err := newKeySyncVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsClient{
+		verifier:        verifier,
+		logger:          logger,
+		snapshotSubject: cfg.SnapshotSubject,
+		snapshotTimeout: time.Duration(cfg.SnapshotTimeout),
+	}
+
+	conn, err := nats.Connect(cfg.URL,
+		nats.Name("veil"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(reconnectDelay(time.Duration(cfg.ReconnectWait), time.Duration(cfg.MaxReconnectWait))),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if !nc.IsClosed() {
+				logger.Warn("disconnected from NATS, reconnecting", zap.Error(err))
+			}
+		}),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			logger.Info("connected to NATS", zap.String("url", nc.ConnectedUrlRedacted()))
+			c.requestResync()
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("reconnected to NATS", zap.String("url", nc.ConnectedUrlRedacted()))
+			c.requestResync()
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	c.conn = conn
+
+	if cfg.JetStream {
+		js, err := jetstream.New(conn,
+			jetstream.WithPublishAsyncTimeout(time.Duration(cfg.AckTimeout)),
+			jetstream.WithPublishAsyncMaxPending(cfg.MaxPending))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+		}
+		c.publisher = newJetStreamPublisher(js, conn.IsConnected, cfg, logger.Named("credits"))
+	} else {
+		c.publisher = &corePublisher{conn: conn, subject: cfg.CreditSubject}
+	}
+
+	// Subscriptions made while reconnecting are sent once the connection is up
+	if _, err := conn.Subscribe(cfg.KeySyncSubject, c.handleKeySync); err != nil {
+		c.Destruct()
+		return nil, fmt.Errorf("failed to subscribe to key sync events: %v", err)
+	}
+
+	if !verifier.required() {
+		logger.Warn("key sync messages are not authenticated, only status changes are applied; set sync_secret or sync_public_keys")
+	}
+	logger.Info("NATS client started",
+		zap.String("nats_url", cfg.URL),
+		zap.String("status", conn.Status().String()),
+		zap.Bool("jetstream", cfg.JetStream),
+		zap.String("key_sync_subject", cfg.KeySyncSubject),
+		zap.String("snapshot_subject", cfg.SnapshotSubject))
+	return c, nil
+}
+
+// reconnectDelay returns a reconnect delay callback that doubles the wait on
+// every attempt from initial up to maxWait, with jitter
+func reconnectDelay(initial, maxWait time.Duration) nats.ReconnectDelayHandler {
+	return func(attempts int) time.Duration {
+		wait := initial
+		for i := 1; i < attempts && wait < maxWait; i++ {
+			wait *= 2
+		}
+		wait = min(wait, maxWait)
+		return wait/2 + time.Duration(float64(wait/2)*rand.Float64())
+	}
+}
+
+// Destruct implements caddy.Destructor. It flushes credit events and closes
+// the connection.
+func (c *natsClient) Destruct() error {
+	c.publisher.Close()
+	if err := c.conn.Drain(); err != nil {
+		c.conn.Close()
+	}
+	c.logger.Info("NATS connection closed")
+	return nil
+}
+
+// attach registers a provisioned handler for key sync events and runs a
+// snapshot resync that was waiting for one
+func (c *natsClient) attach(h *VeilHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, h)
+	if c.resyncPending {
+		c.resyncPending = false
+		go c.resync()
+	}
+}
+
+// detach removes a handler that is being cleaned up
+func (c *natsClient) detach(h *VeilHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, attached := range c.handlers {
+		if attached == h {
+			c.handlers = append(c.handlers[:i], c.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// current returns the most recently provisioned handler, if any
+func (c *natsClient) current() *VeilHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.handlers) == 0 {
+		return nil
+	}
+	return c.handlers[len(c.handlers)-1]
+}
+
+// natsKey returns the usage pool key of the handler's NATS client. It covers
+// every connection setting, including the credentials in the URL and the key
+// sync keys, and the database key sync events are applied to, so handlers
+// never share a connection set up with another handler's settings.
+func (h *VeilHandler) natsKey() string {
+	settings, _ := json.Marshal(struct {
+		DBPath string      `json:"db_path"`
+		NATS   *NATSConfig `json:"nats"`
+	}{h.DBPath, h.NATS})
+	return "veil_nats:" + string(settings)
+}
+
+// provisionNATS attaches the handler to the NATS client of its configuration,
+// connecting if this is the first handler using it
+func (h *VeilHandler) provisionNATS() error {
+	value, _, err := natsClients.LoadOrNew(h.natsKey(), func() (caddy.Destructor, error) {
+		return newNATSClient(h.NATS, h.logger.Named("nats"))
+	})
+	if err != nil {
+		return err
+	}
+
+	h.nats = value.(*natsClient)
+	h.nats.attach(h)
+	return nil
+}
+
+// releaseNATS detaches the handler from its NATS client, closing the
+// connection once no handler uses it
+func (h *VeilHandler) releaseNATS() {
+	if h.nats == nil {
+		return
+	}
+	h.nats.detach(h)
+	if _, err := natsClients.Delete(h.natsKey()); err != nil {
+		h.logger.Error("failed to release NATS connection", zap.Error(err))
+	}
+	h.nats = nil
+}
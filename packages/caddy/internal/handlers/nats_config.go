@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// Default NATS settings, used when the nats block or NATS_URL leave them unset
+const (
+	defaultNATSURL        = "nats://localhost:4222"
+	defaultCreditSubject  = "credit.events"
+	defaultKeySyncSubject = "key.sync"
+
+	defaultNATSReconnectWait    = time.Second
+	defaultNATSMaxReconnectWait = 30 * time.Second
+	defaultJetStreamAckTimeout  = 5 * time.Second
+	defaultJetStreamMaxPending  = 10000
+	defaultKeySnapshotTimeout   = 10 * time.Second
+)
+
+// NATSConfig configures credit event publishing and key status sync over NATS
+type NATSConfig struct {
+	// Disabled turns NATS off even if ENABLE_NATS_EVENTS is set
+	Disabled       bool   `json:"disabled,omitempty"`
+	URL            string `json:"url,omitempty"`
+	CreditSubject  string `json:"credit_subject,omitempty"`
+	KeySyncSubject string `json:"key_sync_subject,omitempty"`
+	// ReconnectWait and MaxReconnectWait bound the exponential backoff between
+	// connection attempts, including when NATS is down at startup
+	ReconnectWait    caddy.Duration `json:"reconnect_wait,omitempty"`
+	MaxReconnectWait caddy.Duration `json:"max_reconnect_wait,omitempty"`
+	// JetStream publishes credit events to a stream and waits for acks instead
+	// of the fire-and-forget core NATS publish
+	JetStream bool `json:"jetstream,omitempty"`
+	// Stream is the stream credit events are expected to land in
+	Stream string `json:"stream,omitempty"`
+	// AckTimeout is how long to wait for an ack before republishing
+	AckTimeout caddy.Duration `json:"ack_timeout,omitempty"`
+	// MaxPending caps the unacknowledged credit events kept for republishing
+	MaxPending int `json:"max_pending,omitempty"`
+	// SyncSecret and SyncPublicKeys authenticate key sync messages with an
+	// HMAC-SHA256 shared secret or NKey (ed25519) signatures. If either is
+	// set, unsigned messages are rejected.
+	SyncSecret     string   `json:"sync_secret,omitempty"`
+	SyncPublicKeys []string `json:"sync_public_keys,omitempty"`
+	// SnapshotSubject is requested for the status of all keys whenever the
+	// connection is established, catching up on missed key sync messages
+	SnapshotSubject string `json:"snapshot_subject,omitempty"`
+	// SnapshotTimeout bounds a snapshot request
+	SnapshotTimeout caddy.Duration `json:"snapshot_timeout,omitempty"`
+}
+
+// Validate checks the NATS configuration
+func (c *NATSConfig) Validate() error {
+	if c == nil || c.Disabled {
+		return nil
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid NATS url %q", c.URL)
+		}
+		switch u.Scheme {
+		case "nats", "tls", "ws", "wss":
+		default:
+			return fmt.Errorf("NATS url %q must use the nats, tls, ws or wss scheme", c.URL)
+		}
+	}
+	if c.ReconnectWait < 0 || c.MaxReconnectWait < 0 || c.AckTimeout < 0 || c.MaxPending < 0 || c.SnapshotTimeout < 0 {
+		return fmt.Errorf("NATS reconnect_wait, max_reconnect_wait, ack_timeout, max_pending and snapshot_timeout must not be negative")
+	}
+	if c.MaxReconnectWait > 0 && c.MaxReconnectWait < c.ReconnectWait {
+		return fmt.Errorf("NATS max_reconnect_wait must not be shorter than reconnect_wait")
+	}
+	if c.Stream != "" && !c.JetStream {
+		return fmt.Errorf("NATS stream requires jetstream to be enabled")
+	}
+	for _, key := range c.SyncPublicKeys {
+		if !nkeys.IsValidPublicKey(key) {
+			return fmt.Errorf("invalid NATS sync public key %q", key)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the configuration with unset fields defaulted
+func (c NATSConfig) withDefaults() *NATSConfig {
+	if c.URL == "" {
+		c.URL = defaultNATSURL
+	}
+	if c.CreditSubject == "" {
+		c.CreditSubject = defaultCreditSubject
+	}
+	if c.KeySyncSubject == "" {
+		c.KeySyncSubject = defaultKeySyncSubject
+	}
+	if c.ReconnectWait == 0 {
+		c.ReconnectWait = caddy.Duration(defaultNATSReconnectWait)
+	}
+	if c.MaxReconnectWait == 0 {
+		c.MaxReconnectWait = caddy.Duration(max(defaultNATSMaxReconnectWait, time.Duration(c.ReconnectWait)))
+	}
+	if c.AckTimeout == 0 {
+		c.AckTimeout = caddy.Duration(defaultJetStreamAckTimeout)
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = defaultJetStreamMaxPending
+	}
+	if c.SnapshotTimeout == 0 {
+		c.SnapshotTimeout = caddy.Duration(defaultKeySnapshotTimeout)
+	}
+	return &c
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/openapi"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+)
+
+// handleOpenAPIImport serves POST /veil/api/openapi. It onboards one API per
+// server path prefix of an OpenAPI 3 document, or reports the changes against
+// the stored APIs with dry_run=true. Keys, rate limits, attached specs,
+// upstream settings and, unless given, the subscription of existing APIs are
+// kept.
+func (h *VeilHandler) handleOpenAPIImport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	query := r.URL.Query()
+	var dryRun bool
+	if v := query.Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid_query", "dry_run must be true or false",
+				map[string]string{"dry_run": v})
+		}
+	}
+	subscription := query.Get("subscription")
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCatalogSize))
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", "failed to read OpenAPI document: "+err.Error(), nil)
+	}
+	doc, err := openapi.Parse(body)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", err.Error(), nil)
+	}
+	derived, err := doc.Configs(openapi.Options{
+		Upstream:           query.Get("upstream"),
+		Prefix:             query.Get("prefix"),
+		SubscriptionHeader: h.SubscriptionKey,
+	})
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", err.Error(), nil)
+	}
+
+	stored, err := h.store.ExportAPIs()
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to load APIs", nil)
+	}
+	existing := make(map[string]*models.APIConfig, len(stored))
+	for i := range stored {
+		existing[stored[i].Path] = &stored[i]
+	}
+
+	changes := make(map[string][]dto.ConfigChangeDTO, len(derived.APIs))
+	for i := range derived.APIs {
+		api := &derived.APIs[i]
+		for _, param := range api.Parameters {
+			if err := validateParameterDefinition(param); err != nil {
+				return writeJSONError(w, http.StatusBadRequest, "invalid_spec", err.Error(),
+					map[string]string{"path": api.Path})
+			}
+		}
+		api.RequiredSubscription = subscription
+		if current, ok := existing[api.Path]; ok {
+			api.RateLimit = current.RateLimit
+			api.SpecName = current.SpecName
+			api.LoadBalancing = current.LoadBalancing
+			api.HealthChecks = current.HealthChecks
+			api.Canary = current.Canary
+			api.TLS = current.TLS
+			api.UpstreamAuth = current.UpstreamAuth
+			api.RequestHeaders = current.RequestHeaders
+			api.Transforms = current.Transforms
+			// Further targets are kept while the document's server is the first
+			if api.Upstream == current.Upstream {
+				api.Upstreams = current.Upstreams
+			}
+			api.ResponseValidation = current.ResponseValidation
+			if subscription == "" {
+				api.RequiredSubscription = current.RequiredSubscription
+			}
+			changes[api.Path] = diffAPI(current, api)
+		}
+	}
+
+	result, err := h.store.ImportAPIs(derived.APIs, store.ImportMerge, dryRun)
+	if errors.Is(err, store.ErrInvalidCatalog) {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", err.Error(), nil)
+	}
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "import_failed", "failed to import OpenAPI document: "+err.Error(), nil)
+	}
+
+	status := make(map[string]string, len(derived.APIs))
+	for name, paths := range map[string][]string{"created": result.Created, "updated": result.Updated, "unchanged": result.Unchanged} {
+		for _, path := range paths {
+			status[path] = name
+		}
+	}
+	response := dto.OpenAPIImportDTO{
+		Status:   "success",
+		DryRun:   dryRun,
+		APIs:     make([]dto.OpenAPIRouteDTO, 0, len(derived.APIs)),
+		Warnings: derived.Warnings,
+	}
+	for _, api := range derived.APIs {
+		response.APIs = append(response.APIs, dto.OpenAPIRouteDTO{
+			Path:     api.Path,
+			Upstream: api.Upstream,
+			Status:   status[api.Path],
+			Changes:  changes[api.Path],
+		})
+	}
+
+	h.logger.Info("imported OpenAPI document",
+		zap.Bool("dry_run", dryRun),
+		zap.Int("apis", len(derived.APIs)),
+		zap.Int("warnings", len(derived.Warnings)))
+
+	if !dryRun && result.Changed() {
+		report, err := h.reconcileRoutes(r.Context(), true)
+		if err != nil {
+			h.logger.Error("failed to update routes after OpenAPI import", zap.Error(err))
+			return writeJSONError(w, http.StatusInternalServerError, "reconcile_failed",
+				"OpenAPI document imported but routes could not be updated: "+err.Error(), response)
+		}
+		response.RoutesApplied = report.Applied
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// diffAPI lists the changes from the stored configuration of an API to the
+// one derived from an OpenAPI document
+func diffAPI(current, next *models.APIConfig) []dto.ConfigChangeDTO {
+	var changes []dto.ConfigChangeDTO
+	if current.Upstream != next.Upstream {
+		changes = append(changes, dto.ConfigChangeDTO{Field: "upstream", From: current.Upstream, To: next.Upstream})
+	}
+	if current.RequiredSubscription != next.RequiredSubscription {
+		changes = append(changes, dto.ConfigChangeDTO{Field: "required_subscription", From: current.RequiredSubscription, To: next.RequiredSubscription})
+	}
+
+	methods := func(ms []models.APIMethod) map[string]string {
+		out := make(map[string]string, len(ms))
+		for _, m := range ms {
+			out[m.Method] = m.Method
+		}
+		return out
+	}
+	if change, ok := diffSet("methods", methods(current.Methods), methods(next.Methods)); ok {
+		changes = append(changes, change)
+	}
+
+	headers := func(hs []string) map[string]string {
+		out := make(map[string]string, len(hs))
+		for _, header := range hs {
+			out[strings.ToLower(header)] = header
+		}
+		return out
+	}
+	if change, ok := diffSet("required_headers", headers(current.RequiredHeaders), headers(next.RequiredHeaders)); ok {
+		changes = append(changes, change)
+	}
+
+	params := func(ps []models.APIParameter) map[string]string {
+		out := make(map[string]string, len(ps))
+		for _, p := range ps {
+			out[p.Type+":"+p.Name] = p.Type + ":" + p.Name
+		}
+		return out
+	}
+	if change, ok := diffSet("parameters", params(current.Parameters), params(next.Parameters)); ok {
+		changes = append(changes, change)
+	}
+	rules := make(map[string]models.APIParameter, len(current.Parameters))
+	for _, p := range current.Parameters {
+		rules[p.Type+":"+p.Name] = p
+	}
+	for _, p := range next.Parameters {
+		key := p.Type + ":" + p.Name
+		if old, ok := rules[key]; ok && (old.Required != p.Required || old.Validation != p.Validation) {
+			changes = append(changes, dto.ConfigChangeDTO{Field: "parameters." + key, From: describeParameter(old), To: describeParameter(p)})
+		}
+	}
+	return changes
+}
+
+// diffSet compares two sets, given as keys mapped to display values, and
+// returns the added and removed values in order
+func diffSet(field string, from, to map[string]string) (dto.ConfigChangeDTO, bool) {
+	change := dto.ConfigChangeDTO{Field: field}
+	for key, value := range to {
+		if _, ok := from[key]; !ok {
+			change.Added = append(change.Added, value)
+		}
+	}
+	for key, value := range from {
+		if _, ok := to[key]; !ok {
+			change.Removed = append(change.Removed, value)
+		}
+	}
+	sort.Strings(change.Added)
+	sort.Strings(change.Removed)
+	return change, len(change.Added) > 0 || len(change.Removed) > 0
+}
+
+// describeParameter summarizes the validation rule of a parameter
+func describeParameter(p models.APIParameter) string {
+	rule := "optional"
+	if p.Required {
+		rule = "required"
+	}
+	if p.Validation != "" {
+		rule = fmt.Sprintf("%s, pattern %s", rule, p.Validation)
+	}
+	return rule
+}
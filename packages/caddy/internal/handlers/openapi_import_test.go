@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/mockey"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+const ordersSpec = `
+openapi: 3.0.3
+servers:
+  - url: https://orders.example.com/v1
+security:
+  - tenant: []
+paths:
+  /orders:
+    get:
+      parameters:
+        - name: status
+          in: query
+          schema:
+            type: string
+            enum: [open, closed]
+    post: {}
+  /customers:
+    get: {}
+components:
+  securitySchemes:
+    tenant:
+      type: apiKey
+      in: header
+      name: X-Tenant
+`
+
+func TestVeilHandler_handleOpenAPIImport(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	// The API was onboarded by hand before the provider published a spec
+	active := true
+	existing := CreateAPI(t, "/shop/v1/*", "http://localhost:8085/v1", "premium", []string{"GET"}, nil,
+		[]models.APIKey{{Key: "orders-key", Name: "Orders", IsActive: &active}})
+	existing.RateLimit = &models.RateLimit{RequestsPerMinute: 60}
+	require.NoError(t, handler.store.CreateAPI(existing))
+
+	current := &caddy.Config{
+		AppsRaw: map[string]json.RawMessage{
+			"http": json.RawMessage(`{"servers": {"srv1": {"listen": [":2021"], "routes": []}}}`),
+		},
+	}
+	loads := 0
+	configMocker := mockey.Mock((*VeilHandler).getCurrentConfig).To(func(h *VeilHandler) (*caddy.Config, error) {
+		return current, nil
+	}).Build()
+	loadMocker := mockey.Mock(caddy.Load).To(func(cfgJSON []byte, forceReload bool) error {
+		loads++
+		var loaded caddy.Config
+		if err := json.Unmarshal(cfgJSON, &loaded); err != nil {
+			return err
+		}
+		current = &loaded
+		return nil
+	}).Build()
+	defer configMocker.Release()
+	defer loadMocker.Release()
+	defer os.RemoveAll("configs")
+
+	post := func(target, spec string) (*httptest.ResponseRecorder, dto.OpenAPIImportDTO) {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader(spec))))
+		var resp dto.OpenAPIImportDTO
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w, resp
+	}
+	target := "/veil/api/openapi?prefix=/shop&upstream=http://localhost:8085"
+
+	// A dry run reports the diff without changing anything
+	w, resp := post(target+"&dry_run=true", ordersSpec)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Len(t, resp.APIs, 1)
+	assert.Equal(t, "/shop/v1/*", resp.APIs[0].Path)
+	assert.Equal(t, "updated", resp.APIs[0].Status)
+	assert.Equal(t, []dto.ConfigChangeDTO{
+		{Field: "methods", Added: []string{"POST"}},
+		{Field: "required_headers", Added: []string{"X-Tenant"}},
+		{Field: "parameters", Added: []string{"query:status"}},
+	}, resp.APIs[0].Changes)
+	assert.Equal(t, 0, loads)
+
+	api, err := handler.store.GetAPIWithKeys("/shop/v1/*")
+	require.NoError(t, err)
+	assert.Len(t, api.Methods, 1)
+
+	// The import keeps keys, rate limit and subscription and reloads routes once
+	w, resp = post(target, ordersSpec)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, resp.RoutesApplied)
+	assert.Equal(t, 1, loads)
+
+	api, err = handler.store.GetAPIWithKeys("/shop/v1/*")
+	require.NoError(t, err)
+	assert.Equal(t, "premium", api.RequiredSubscription)
+	assert.Equal(t, []string{"X-Tenant"}, api.RequiredHeaders)
+	require.NotNil(t, api.RateLimit)
+	assert.Equal(t, 60, api.RateLimit.RequestsPerMinute)
+	require.Len(t, api.Parameters, 1)
+	assert.Equal(t, "^(?:open|closed)$", api.Parameters[0].Validation)
+	matched, err := handler.store.GetAPIByPath("/shop/v1/orders")
+	require.NoError(t, err)
+	assert.True(t, handler.store.ValidateAPIKey(matched, "orders-key"))
+
+	// Re-importing the same document changes nothing
+	w, resp = post(target, ordersSpec)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "unchanged", resp.APIs[0].Status)
+	assert.Empty(t, resp.APIs[0].Changes)
+	assert.False(t, resp.RoutesApplied)
+	assert.Equal(t, 1, loads)
+
+	// A changed document reports the removed operation and the new rule
+	changed := strings.Replace(ordersSpec, "enum: [open, closed]", "enum: [open, closed, cancelled]", 1)
+	changed = strings.Replace(changed, "    post: {}\n", "", 1)
+	w, resp = post(target+"&dry_run=true", changed)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []dto.ConfigChangeDTO{
+		{Field: "methods", Removed: []string{"POST"}},
+		{Field: "parameters.query:status", From: "optional, pattern ^(?:open|closed)$", To: "optional, pattern ^(?:open|closed|cancelled)$"},
+	}, resp.APIs[0].Changes)
+
+	errorCases := []struct {
+		name   string
+		target string
+		spec   string
+	}{
+		{name: "swagger 2", target: target, spec: `{"swagger": "2.0", "paths": {"/a": {"get": {}}}}`},
+		{name: "no base path", target: "/veil/api/openapi?upstream=http://localhost:8085", spec: strings.Replace(ordersSpec, "/v1", "", 1)},
+		{name: "invalid dry run", target: target + "&dry_run=maybe", spec: ordersSpec},
+	}
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _ := post(tt.target, tt.spec)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+}
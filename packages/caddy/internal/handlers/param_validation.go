@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// maxValidatedBodySize caps how much of a JSON body is buffered for validation
+const maxValidatedBodySize = 10 << 20
+
+// Parameter locations supported by APIParameter.Type
+const (
+	paramInQuery  = "query"
+	paramInPath   = "path"
+	paramInHeader = "header"
+	paramInBody   = "body"
+)
+
+// ParameterViolation describes a single request parameter that failed validation
+type ParameterViolation struct {
+	Name   string `json:"name"`
+	In     string `json:"in"`
+	Reason string `json:"reason"`
+}
+
+// validationPatterns caches compiled APIParameter.Validation expressions
+var validationPatterns sync.Map
+
+// compilePattern returns the cached compiled form of a validation regex
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := validationPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	validationPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// validateParameterDefinition checks an APIParameter at onboarding time
+func validateParameterDefinition(param models.APIParameter) error {
+	if param.Name == "" {
+		return fmt.Errorf("parameter name is required")
+	}
+	switch param.Type {
+	case paramInQuery, paramInPath, paramInHeader, paramInBody:
+	default:
+		return fmt.Errorf("parameter %q has unknown type %q (expected query, path, header or body)", param.Name, param.Type)
+	}
+	if param.Validation != "" {
+		if _, err := compilePattern(param.Validation); err != nil {
+			return fmt.Errorf("parameter %q has invalid validation pattern: %v", param.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateParameters checks the request against the API's parameter rules and
+// returns every violation found. Path parameters are matched positionally to
+// the path segments following the API path prefix.
+func validateParameters(r *http.Request, api *models.APIConfig) ([]ParameterViolation, error) {
+	if len(api.Parameters) == 0 {
+		return nil, nil
+	}
+
+	var violations []ParameterViolation
+	check := func(param models.APIParameter, value string, present bool) {
+		if !present || value == "" {
+			if param.Required {
+				violations = append(violations, ParameterViolation{Name: param.Name, In: param.Type, Reason: "missing required parameter"})
+			}
+			return
+		}
+		if param.Validation == "" {
+			return
+		}
+		re, err := compilePattern(param.Validation)
+		if err != nil {
+			violations = append(violations, ParameterViolation{Name: param.Name, In: param.Type, Reason: "invalid validation pattern"})
+			return
+		}
+		if !re.MatchString(value) {
+			violations = append(violations, ParameterViolation{Name: param.Name, In: param.Type, Reason: fmt.Sprintf("value does not match pattern %s", param.Validation)})
+		}
+	}
+
+	query := r.URL.Query()
+	pathSegments := pathParameterSegments(r.URL.Path, api.Path)
+	pathIndex := 0
+
+	var body map[string]interface{}
+	var bodyErr *ParameterViolation
+	bodyLoaded := false
+
+	for _, param := range api.Parameters {
+		switch param.Type {
+		case paramInQuery:
+			values, ok := query[param.Name]
+			value := ""
+			if ok && len(values) > 0 {
+				value = values[0]
+			}
+			check(param, value, ok)
+
+		case paramInHeader:
+			values := r.Header.Values(param.Name)
+			value := ""
+			if len(values) > 0 {
+				value = values[0]
+			}
+			check(param, value, len(values) > 0)
+
+		case paramInPath:
+			value := ""
+			if pathIndex < len(pathSegments) {
+				value = pathSegments[pathIndex]
+			}
+			pathIndex++
+			check(param, value, value != "")
+
+		case paramInBody:
+			if !bodyLoaded {
+				bodyLoaded = true
+				var err error
+				body, bodyErr, err = readJSONBody(r)
+				if err != nil {
+					return nil, err
+				}
+				if bodyErr != nil {
+					violations = append(violations, *bodyErr)
+				}
+			}
+			if bodyErr != nil {
+				continue
+			}
+			value, ok := lookupBodyField(body, param.Name)
+			check(param, value, ok)
+		}
+	}
+
+	return violations, nil
+}
+
+// pathParameterSegments returns the request path segments after the API prefix
+func pathParameterSegments(requestPath, apiPath string) []string {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(apiPath, "*"), "/")
+	rest := strings.TrimPrefix(requestPath, prefix)
+	return strings.FieldsFunc(rest, func(c rune) bool { return c == '/' })
+}
+
+// readJSONBody buffers and decodes a JSON object body, restoring r.Body so the
+// upstream still receives it. A body that cannot be validated is reported as a
+// violation rather than an error.
+func readJSONBody(r *http.Request) (map[string]interface{}, *ParameterViolation, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return map[string]interface{}{}, nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, &ParameterViolation{Name: "body", In: paramInBody, Reason: "body parameters require a JSON content type"}, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBodySize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+	if len(data) > maxValidatedBodySize {
+		return nil, &ParameterViolation{Name: "body", In: paramInBody, Reason: "body too large to validate"}, nil
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return map[string]interface{}{}, nil, nil
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, &ParameterViolation{Name: "body", In: paramInBody, Reason: "body is not a JSON object"}, nil
+	}
+	return body, nil, nil
+}
+
+// lookupBodyField resolves a dotted field name (e.g. "user.email") in a JSON
+// object and returns its value as a string for pattern matching
+func lookupBodyField(body map[string]interface{}, name string) (string, bool) {
+	var current interface{} = body
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		current, ok = obj[part]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch v := current.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(encoded), true
+	}
+}
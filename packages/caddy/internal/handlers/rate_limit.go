@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/ratelimit"
+	"go.uber.org/zap"
+)
+
+// rateLimiters holds one limiter per database and default rate limit so
+// request counts survive Caddy config reloads (which happen on every API
+// onboarding)
+var rateLimiters = caddy.NewUsagePool()
+
+// rateLimiterKey returns the usage pool key of the handler's limiter. Handlers
+// on the same database with different default limits count separately.
+func (h *VeilHandler) rateLimiterKey() string {
+	settings, _ := json.Marshal(struct {
+		DBPath    string            `json:"db_path"`
+		RateLimit *models.RateLimit `json:"rate_limit"`
+	}{h.DBPath, h.RateLimit})
+	return "veil_ratelimit:" + string(settings)
+}
+
+// provisionRateLimiter loads or creates the limiter shared by handlers with
+// the same database and default rate limit
+func (h *VeilHandler) provisionRateLimiter() error {
+	limiter, _, err := rateLimiters.LoadOrNew(h.rateLimiterKey(), func() (caddy.Destructor, error) {
+		return ratelimit.NewLimiter(), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create rate limiter: %v", err)
+	}
+	h.limiter = limiter.(*ratelimit.Limiter)
+	return nil
+}
+
+// effectiveRateLimit returns the key override, the API limit or the handler default
+func (h *VeilHandler) effectiveRateLimit(api *models.APIConfig, key *models.APIKey) *models.RateLimit {
+	if key != nil && key.RateLimit.Enabled() {
+		return key.RateLimit
+	}
+	if api.RateLimit.Enabled() {
+		return api.RateLimit
+	}
+	return h.RateLimit
+}
+
+// enforceRateLimit applies the effective rate limit to the request and sets the
+// RateLimit-* headers. It writes a 429 response and returns false when the
+// request is over the limit.
+func (h *VeilHandler) enforceRateLimit(w http.ResponseWriter, r *http.Request, api *models.APIConfig, key *models.APIKey) (bool, error) {
+	limit := h.effectiveRateLimit(api, key)
+	if h.limiter == nil || !limit.Enabled() || key == nil {
+		return true, nil
+	}
+
+	// Keys are counted by digest, which survives API updates and key sync
+	decision := h.limiter.Allow(key.KeyHash, limit)
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+	if decision.Allowed {
+		return true, nil
+	}
+
+	h.logger.Debug("rate limit exceeded",
+		zap.String("path", r.URL.Path),
+		zap.String("key_name", key.Name),
+		zap.Duration("retry_after", decision.RetryAfter))
+
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+	return false, writeJSONError(w, http.StatusTooManyRequests, "rate_limited",
+		"Too Many Requests: rate limit exceeded",
+		map[string]int{
+			"limit":       decision.Limit,
+			"retry_after": ceilSeconds(decision.RetryAfter),
+		})
+}
+
+// ceilSeconds rounds a duration up to whole seconds, as used by HTTP headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// toRateLimit converts a request DTO to a model rate limit
+func toRateLimit(limit *dto.RateLimitDTO) (*models.RateLimit, error) {
+	if limit == nil {
+		return nil, nil
+	}
+	if limit.RequestsPerSecond < 0 || limit.Burst < 0 || limit.RequestsPerMinute < 0 || limit.RequestsPerDay < 0 {
+		return nil, fmt.Errorf("rate limit values must not be negative")
+	}
+	return &models.RateLimit{
+		RequestsPerSecond: limit.RequestsPerSecond,
+		Burst:             limit.Burst,
+		RequestsPerMinute: limit.RequestsPerMinute,
+		RequestsPerDay:    limit.RequestsPerDay,
+	}, nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestVeilHandler_enforceRateLimit(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	newAPI := func() *models.APIConfig {
+		api := CreateAPI(t, "/limited/*", "http://localhost:8085", "basic", []string{"GET"}, nil,
+			[]models.APIKey{{Key: "limited-key", Name: "Partner", IsActive: &active}})
+		api.RateLimit = &models.RateLimit{RequestsPerMinute: 1}
+		return api
+	}
+	api := newAPI()
+	require.NoError(t, handler.store.CreateAPI(api))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/limited/items", nil)
+		req.Header.Set("X-Subscription-Key", "limited-key")
+		w := httptest.NewRecorder()
+		next := &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {}}
+		require.NoError(t, handler.ServeHTTP(w, req, next))
+		return w
+	}
+
+	w := send()
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// Updating the API keeps the key's count
+	updated := newAPI()
+	updated.ID = api.ID
+	require.NoError(t, handler.store.UpdateAPI(updated))
+
+	w = send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
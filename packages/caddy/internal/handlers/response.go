@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+)
+
+// writeJSONError writes a structured error response with the given status code
+func writeJSONError(w http.ResponseWriter, statusCode int, code, message string, details interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	return json.NewEncoder(w).Encode(dto.ErrorResponseDTO{
+		Status:  "error",
+		Code:    code,
+		Error:   message,
+		Details: details,
+	})
+}
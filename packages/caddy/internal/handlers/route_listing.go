@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maskedKeySuffix replaces the secret part of a key in listings
+const maskedKeySuffix = "****"
+
+// handleGetRoutes serves GET /veil/api/routes and GET /veil/api/routes/{path}
+func (h *VeilHandler) handleGetRoutes(w http.ResponseWriter, r *http.Request, apiPath string) error {
+	if apiPath != "" && apiPath != "/" {
+		return h.handleGetRoute(w, apiPath)
+	}
+
+	query := r.URL.Query()
+	limit, offset, err := pageParams(query)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query", err.Error(), nil)
+	}
+
+	apis, page, err := h.store.QueryAPIs(store.APIQuery{
+		PathPrefix:   query.Get("path_prefix"),
+		Upstream:     query.Get("upstream"),
+		Subscription: query.Get("subscription"),
+		Sort:         query.Get("sort"),
+		Limit:        limit,
+		Offset:       offset,
+	})
+	if errors.Is(err, store.ErrInvalidSort) {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query",
+			"sort must be one of path, upstream, subscription, created_at, last_accessed or request_count, optionally prefixed with -",
+			map[string]string{"sort": query.Get("sort")})
+	}
+	if err != nil {
+		h.logger.Error("failed to list APIs", zap.Error(err))
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to list APIs", nil)
+	}
+
+	routes := make([]dto.RouteDTO, 0, len(apis))
+	for _, api := range apis {
+		routes = append(routes, toRouteDTO(api, false))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.RouteListDTO{
+		Status: "success",
+		Routes: routes,
+		Page:   toPageDTO(page),
+	})
+}
+
+// handleGetRoute serves a single API with its masked keys
+func (h *VeilHandler) handleGetRoute(w http.ResponseWriter, apiPath string) error {
+	api, err := h.store.GetAPIWithKeys(apiPath)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return writeJSONError(w, http.StatusNotFound, "not_found", "API not found",
+			map[string]string{"path": apiPath})
+	}
+	if err != nil {
+		h.logger.Error("failed to get API", zap.Error(err), zap.String("path", apiPath))
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get API", nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.RouteDetailDTO{
+		Status: "success",
+		Route:  toRouteDTO(*api, true),
+	})
+}
+
+// handleListAPIKeys serves GET /veil/api/keys?path= with the masked keys of
+// an API
+func (h *VeilHandler) handleListAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	apiPath := query.Get("path")
+	if apiPath == "" {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query", "path is required", nil)
+	}
+	limit, offset, err := pageParams(query)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_query", err.Error(), nil)
+	}
+
+	keys, page, err := h.store.QueryAPIKeys(apiPath, limit, offset)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return writeJSONError(w, http.StatusNotFound, "not_found", "API not found",
+			map[string]string{"path": apiPath})
+	}
+	if err != nil {
+		h.logger.Error("failed to list API keys", zap.Error(err), zap.String("path", apiPath))
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to list API keys", nil)
+	}
+
+	infos := make([]dto.APIKeyInfoDTO, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, toAPIKeyInfoDTO(key))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.APIKeyListDTO{
+		Status: "success",
+		Path:   apiPath,
+		Keys:   infos,
+		Page:   toPageDTO(page),
+	})
+}
+
+// pageParams reads the limit and offset query parameters. Zero values leave
+// the defaults to the store.
+func pageParams(query url.Values) (limit, offset int, err error) {
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// toRouteDTO describes an API, with its masked keys if withKeys is set
+func toRouteDTO(api models.APIConfig, withKeys bool) dto.RouteDTO {
+	route := dto.RouteDTO{
+		ID:                   api.ID,
+		Path:                 api.Path,
+		Upstream:             api.Upstream,
+		RequiredSubscription: api.RequiredSubscription,
+		Methods:              make([]string, 0, len(api.Methods)),
+		RequiredHeaders:      api.RequiredHeaders,
+		Parameters:           make([]dto.ParameterDTO, 0, len(api.Parameters)),
+		RateLimit:            toRateLimitDTO(api.RateLimit),
+		Upstreams:            toUpstreamTargetDTOs(api.Upstreams),
+		LoadBalancing:        toLoadBalancingDTO(api.LoadBalancing),
+		HealthChecks:         toHealthChecksDTO(api.HealthChecks),
+		Canary:               toCanaryDTO(api.Canary),
+		TLS:                  toUpstreamTLSDTO(api.TLS),
+		UpstreamAuth:         toUpstreamAuthDTO(api.UpstreamAuth, false),
+		RequestHeaders:       toHeaderPolicyDTO(api.RequestHeaders),
+		Transforms:           toTransformsDTO(api.Transforms),
+		Spec:                 api.SpecName,
+		ResponseValidation:   api.ResponseValidation,
+		RequestCount:         api.RequestCount,
+		KeyCount:             len(api.APIKeys),
+		CreatedAt:            api.CreatedAt,
+		UpdatedAt:            api.UpdatedAt,
+	}
+	if route.RequiredHeaders == nil {
+		route.RequiredHeaders = []string{}
+	}
+	if !api.LastAccessed.IsZero() {
+		lastAccessed := api.LastAccessed
+		route.LastAccessed = &lastAccessed
+	}
+	for _, method := range api.Methods {
+		route.Methods = append(route.Methods, strings.ToUpper(method.Method))
+	}
+	for _, param := range api.Parameters {
+		route.Parameters = append(route.Parameters, dto.ParameterDTO{
+			Name:       param.Name,
+			Type:       param.Type,
+			Required:   param.Required,
+			Validation: param.Validation,
+		})
+	}
+	if withKeys {
+		for _, key := range api.APIKeys {
+			route.APIKeys = append(route.APIKeys, toAPIKeyInfoDTO(key))
+		}
+	}
+	return route
+}
+
+// toAPIKeyInfoDTO describes a stored key without its value
+func toAPIKeyInfoDTO(key models.APIKey) dto.APIKeyInfoDTO {
+	return dto.APIKeyInfoDTO{
+		ID:        key.ID,
+		Name:      key.Name,
+		KeyPrefix: key.KeyPrefix,
+		MaskedKey: key.KeyPrefix + maskedKeySuffix,
+		IsActive:  key.IsActive != nil && *key.IsActive,
+		ExpiresAt: key.ExpiresAt,
+		RateLimit: toRateLimitDTO(key.RateLimit),
+		CreatedAt: key.CreatedAt,
+		UpdatedAt: key.UpdatedAt,
+	}
+}
+
+// toRateLimitDTO converts a stored rate limit for a response
+func toRateLimitDTO(limit *models.RateLimit) *dto.RateLimitDTO {
+	if limit == nil {
+		return nil
+	}
+	return &dto.RateLimitDTO{
+		RequestsPerSecond: limit.RequestsPerSecond,
+		Burst:             limit.Burst,
+		RequestsPerMinute: limit.RequestsPerMinute,
+		RequestsPerDay:    limit.RequestsPerDay,
+	}
+}
+
+// toPageDTO converts a listing page for a response
+func toPageDTO(page store.Page) dto.PageDTO {
+	return dto.PageDTO{Total: page.Total, Limit: page.Limit, Offset: page.Offset}
+}
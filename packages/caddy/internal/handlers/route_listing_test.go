@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestVeilHandler_handleGetRoutes(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/weather/*", "http://localhost:8083", "basic",
+		[]string{"GET"}, []string{"X-Test-Header"}, []models.APIKey{
+			{Key: "weather-secret-key-1", Name: "Weather 1", IsActive: &active},
+			{Key: "veil_live_0123456789abcdef", Name: "Weather 2", IsActive: &active},
+		})))
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/news/*", "http://localhost:8084", "premium",
+		[]string{"GET", "POST"}, nil, nil)))
+
+	tests := []struct {
+		name       string
+		target     string
+		wantCode   int
+		wantPaths  []string
+		wantTotal  int64
+		wantErrKey string
+	}{
+		{name: "all routes", target: "/veil/api/routes", wantCode: http.StatusOK, wantPaths: []string{"/news/*", "/weather/*"}, wantTotal: 2},
+		{name: "filtered by subscription", target: "/veil/api/routes?subscription=basic", wantCode: http.StatusOK, wantPaths: []string{"/weather/*"}, wantTotal: 1},
+		{name: "filtered by path prefix", target: "/veil/api/routes?path_prefix=/news", wantCode: http.StatusOK, wantPaths: []string{"/news/*"}, wantTotal: 1},
+		{name: "filtered by upstream", target: "/veil/api/routes?upstream=:8083", wantCode: http.StatusOK, wantPaths: []string{"/weather/*"}, wantTotal: 1},
+		{name: "sorted and paged", target: "/veil/api/routes?sort=-path&limit=1", wantCode: http.StatusOK, wantPaths: []string{"/weather/*"}, wantTotal: 2},
+		{name: "invalid sort", target: "/veil/api/routes?sort=secret", wantCode: http.StatusBadRequest, wantErrKey: "invalid_query"},
+		{name: "invalid limit", target: "/veil/api/routes?limit=0", wantCode: http.StatusBadRequest, wantErrKey: "invalid_query"},
+		{name: "invalid offset", target: "/veil/api/routes?offset=-1", wantCode: http.StatusBadRequest, wantErrKey: "invalid_query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodGet, tt.target, nil)))
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantErrKey != "" {
+				var resp dto.ErrorResponseDTO
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.wantErrKey, resp.Code)
+				return
+			}
+
+			var resp dto.RouteListDTO
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			var paths []string
+			for _, route := range resp.Routes {
+				paths = append(paths, route.Path)
+				assert.Empty(t, route.APIKeys, "keys are not listed with routes")
+			}
+			assert.Equal(t, tt.wantPaths, paths)
+			assert.Equal(t, tt.wantTotal, resp.Page.Total)
+		})
+	}
+
+	t.Run("single route", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodGet, "/veil/api/routes/weather/*", nil)))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "weather-secret-key-1")
+		assert.NotContains(t, w.Body.String(), "0123456789abcdef")
+
+		var resp dto.RouteDetailDTO
+		require.NoError(t, json.NewDecoder(strings.NewReader(w.Body.String())).Decode(&resp))
+		assert.Equal(t, "/weather/*", resp.Route.Path)
+		assert.Equal(t, []string{"GET"}, resp.Route.Methods)
+		assert.Equal(t, []string{"X-Test-Header"}, resp.Route.RequiredHeaders)
+		assert.Equal(t, 2, resp.Route.KeyCount)
+		require.Len(t, resp.Route.APIKeys, 2)
+		assert.Equal(t, "weathe****", resp.Route.APIKeys[0].MaskedKey)
+		assert.Equal(t, "veil_live_0123****", resp.Route.APIKeys[1].MaskedKey)
+		assert.True(t, resp.Route.APIKeys[1].IsActive)
+	})
+
+	t.Run("unknown route", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodGet, "/veil/api/routes/missing/*", nil)))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestVeilHandler_handleListAPIKeys(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active, inactive := true, false
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/weather/*", "http://localhost:8083", "basic",
+		[]string{"GET"}, nil, []models.APIKey{
+			{Key: "weather-secret-key-1", Name: "Weather 1", IsActive: &active},
+			{Key: "weather-secret-key-2", Name: "Weather 2", IsActive: &inactive},
+			{Key: "weather-secret-key-3", Name: "Weather 3", IsActive: &active},
+		})))
+
+	tests := []struct {
+		name      string
+		target    string
+		wantCode  int
+		wantNames []string
+	}{
+		{name: "all keys", target: "/veil/api/keys?path=/weather/*", wantCode: http.StatusOK, wantNames: []string{"Weather 1", "Weather 2", "Weather 3"}},
+		{name: "second page", target: "/veil/api/keys?path=/weather/*&limit=2&offset=2", wantCode: http.StatusOK, wantNames: []string{"Weather 3"}},
+		{name: "missing path", target: "/veil/api/keys", wantCode: http.StatusBadRequest},
+		{name: "unknown API", target: "/veil/api/keys?path=/news/*", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodGet, tt.target, nil)))
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.NotContains(t, w.Body.String(), "weather-secret-key")
+
+			var resp dto.APIKeyListDTO
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			var names []string
+			for _, key := range resp.Keys {
+				names = append(names, key.Name)
+				assert.Equal(t, "weathe****", key.MaskedKey)
+			}
+			assert.Equal(t, tt.wantNames, names)
+			assert.Equal(t, int64(3), resp.Page.Total)
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"go.uber.org/zap"
+)
+
+// defaultReconcileInterval is how often routes are reconciled when
+// reconcile_interval is not configured
+const defaultReconcileInterval = 5 * time.Minute
+
+var (
+	// reconcileStartupDelay gives the admin endpoint time to come up before
+	// the first reconciliation after Caddy starts
+	reconcileStartupDelay = 2 * time.Second
+
+	// reconcileRetryDelay and reconcileStartupAttempts control how often the
+	// startup reconciliation is retried while the admin endpoint is unreachable
+	reconcileRetryDelay      = 10 * time.Second
+	reconcileStartupAttempts = 5
+)
+
+// routeReconcilers holds one reconciler per database and route server so that
+// periodic reconciliation keeps running across the config reloads it causes
+var routeReconcilers = caddy.NewUsagePool()
+
+// routeUpdateMu serializes read-modify-load cycles of the route table
+var routeUpdateMu sync.Mutex
+
+// routeReconciler rebuilds the route server's routes from the store on startup
+// and at a fixed interval. Each pass runs through whichever handler sharing it
+// was provisioned last, taken when the pass starts, since handlers are
+// replaced on every config reload.
+type routeReconciler struct {
+	mu       sync.Mutex
+	handlers []*VeilHandler
+	interval time.Duration
+	logger   *zap.Logger
+
+	// ctx is cancelled when the reconciler is destroyed, aborting a pass
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Destruct implements caddy.Destructor and stops the reconcile loop. A running
+// pass is cancelled rather than waited for, so the config reload destroying
+// the reconciler is not held up by it.
+func (rr *routeReconciler) Destruct() error {
+	rr.cancel()
+	return nil
+}
+
+// attach registers a provisioned handler that the loop may reconcile through
+func (rr *routeReconciler) attach(h *VeilHandler) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.handlers = append(rr.handlers, h)
+}
+
+// detach removes a handler that is being cleaned up
+func (rr *routeReconciler) detach(h *VeilHandler) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for i, attached := range rr.handlers {
+		if attached == h {
+			rr.handlers = append(rr.handlers[:i], rr.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// current returns the most recently provisioned handler, if any
+func (rr *routeReconciler) current() *VeilHandler {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.handlers) == 0 {
+		return nil
+	}
+	return rr.handlers[len(rr.handlers)-1]
+}
+
+// run reconciles once Caddy has started and then every interval. A negative
+// interval limits it to the startup pass.
+func (rr *routeReconciler) run() {
+	delay := reconcileStartupDelay
+	attempts := 0
+	started := false
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-rr.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		err := fmt.Errorf("no handler available")
+		if h := rr.current(); h != nil {
+			_, err = h.reconcileRoutes(rr.ctx, true)
+		}
+		if rr.ctx.Err() != nil {
+			return
+		}
+
+		if !started {
+			attempts++
+			if err != nil && attempts < reconcileStartupAttempts {
+				rr.logger.Warn("startup route reconciliation failed, retrying",
+					zap.Error(err),
+					zap.Int("attempt", attempts),
+					zap.Duration("retry_in", reconcileRetryDelay))
+				timer.Reset(reconcileRetryDelay)
+				continue
+			}
+			started = true
+		}
+		if err != nil {
+			rr.logger.Error("route reconciliation failed", zap.Error(err))
+		}
+
+		if rr.interval <= 0 {
+			return
+		}
+		timer.Reset(rr.interval)
+	}
+}
+
+// reconcilerKey returns the usage pool key of the handler's reconciler.
+// Handlers on the same database that generate routes on different servers,
+// or reconcile at different intervals, get reconcilers of their own.
+func (h *VeilHandler) reconcilerKey() string {
+	settings, _ := json.Marshal(struct {
+		DBPath            string         `json:"db_path"`
+		RouteServer       string         `json:"route_server"`
+		ReconcileInterval caddy.Duration `json:"reconcile_interval"`
+	}{h.DBPath, h.RouteServer, h.ReconcileInterval})
+	return "veil_reconciler:" + string(settings)
+}
+
+// provisionReconciler attaches the handler to the reconciler of its database,
+// starting the reconcile loop if this is the first handler on it
+func (h *VeilHandler) provisionReconciler() error {
+	interval := time.Duration(h.ReconcileInterval)
+	if interval == 0 {
+		interval = defaultReconcileInterval
+	}
+
+	value, loaded, err := routeReconcilers.LoadOrNew(h.reconcilerKey(), func() (caddy.Destructor, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &routeReconciler{
+			interval: interval,
+			logger:   h.logger.Named("reconciler"),
+			ctx:      ctx,
+			cancel:   cancel,
+		}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create route reconciler: %v", err)
+	}
+
+	h.reconciler = value.(*routeReconciler)
+	h.reconciler.attach(h)
+	if !loaded {
+		go h.reconciler.run()
+	}
+	return nil
+}
+
+// releaseReconciler detaches the handler from its reconciler
+func (h *VeilHandler) releaseReconciler() {
+	if h.reconciler == nil {
+		return
+	}
+	h.reconciler.detach(h)
+	if _, err := routeReconcilers.Delete(h.reconcilerKey()); err != nil {
+		h.logger.Error("failed to release route reconciler", zap.Error(err))
+	}
+}
+
+// reconcileRoutes compares the route server's routes in the running config
+// with the APIs in the store. When apply is set and they differ, missing and
+// outdated routes are rebuilt and routes of deleted APIs are removed. Routes
+// that were not generated by veil are left untouched. Once ctx is done, the
+// pass stops before its next step and returns the context's error.
+func (h *VeilHandler) reconcileRoutes(ctx context.Context, apply bool) (*dto.RouteDriftDTO, error) {
+	routeUpdateMu.Lock()
+	defer routeUpdateMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	table, err := h.loadRouteTable()
+	if err != nil {
+		return nil, err
+	}
+
+	report, routes, err := h.routeDrift(table.routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if report.InSync {
+		h.logger.Debug("routes in sync with database",
+			zap.Int("routes", len(table.routes)))
+		return report, nil
+	}
+
+	h.logger.Info("route drift detected",
+		zap.Strings("missing", report.Missing),
+		zap.Strings("orphaned", report.Orphaned),
+		zap.Strings("changed", report.Changed),
+		zap.Bool("apply", apply))
+
+	if !apply {
+		return report, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	table.routes = routes
+	if err := h.saveRouteTable(table); err != nil {
+		return nil, err
+	}
+	report.Applied = true
+
+	h.logger.Info("routes reconciled from database",
+		zap.Int("routes", len(routes)))
+
+	return report, nil
+}
+
+// routeDrift diffs the current routes against the stored APIs and returns the
+// drift report along with the reconciled route list. Existing routes keep
+// their position; routes for missing APIs are appended most specific first.
+func (h *VeilHandler) routeDrift(current []interface{}) (*dto.RouteDriftDTO, []interface{}, error) {
+	apis, err := h.store.ListAPIs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list APIs: %v", err)
+	}
+
+	desired := make(map[string]map[string]interface{}, len(apis))
+	paths := make(map[string]string, len(apis))
+	for _, api := range apis {
+		route, err := h.buildRoute(api)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build route for %s: %v", api.Path, err)
+		}
+		key := strings.TrimSuffix(api.Path, "*")
+		desired[key] = route
+		paths[key] = api.Path
+	}
+
+	report := &dto.RouteDriftDTO{
+		Status:    "success",
+		Missing:   []string{},
+		Orphaned:  []string{},
+		Changed:   []string{},
+		CheckedAt: time.Now().UTC(),
+	}
+
+	reconciled := make([]interface{}, 0, len(current))
+	seen := make(map[string]bool, len(desired))
+	for _, route := range current {
+		if !isVeilRoute(route) {
+			reconciled = append(reconciled, route)
+			continue
+		}
+
+		key, _ := routePath(route)
+		want, ok := desired[key]
+		if !ok || seen[key] {
+			// Route of a deleted API, or a duplicate shadowed by an earlier route
+			report.Orphaned = append(report.Orphaned, key+"*")
+			continue
+		}
+		seen[key] = true
+
+		if !sameRoute(route, want) {
+			report.Changed = append(report.Changed, paths[key])
+		}
+		reconciled = append(reconciled, want)
+	}
+
+	var missing []string
+	for key := range desired {
+		if !seen[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if len(missing[i]) != len(missing[j]) {
+			return len(missing[i]) > len(missing[j])
+		}
+		return missing[i] < missing[j]
+	})
+	for _, key := range missing {
+		report.Missing = append(report.Missing, paths[key])
+		reconciled = append(reconciled, desired[key])
+	}
+
+	report.InSync = len(report.Missing) == 0 && len(report.Orphaned) == 0 && len(report.Changed) == 0
+	return report, reconciled, nil
+}
+
+// routePath returns the first path matcher of a route without its wildcard
+func routePath(route interface{}) (string, bool) {
+	routeMap, ok := route.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	matchers, ok := routeMap["match"].([]interface{})
+	if !ok || len(matchers) == 0 {
+		return "", false
+	}
+	matcher, ok := matchers[0].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	paths, ok := matcher["path"].([]interface{})
+	if !ok || len(paths) == 0 {
+		return "", false
+	}
+	path, ok := paths[0].(string)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(path, "*"), true
+}
+
+// isVeilRoute reports whether a route was generated for an onboarded API,
+// i.e. it has a path matcher and runs veil_handler inside its subroute
+func isVeilRoute(route interface{}) bool {
+	if _, ok := routePath(route); !ok {
+		return false
+	}
+	routeMap := route.(map[string]interface{})
+	handlers, _ := routeMap["handle"].([]interface{})
+	for _, handler := range handlers {
+		handlerMap, ok := handler.(map[string]interface{})
+		if !ok || handlerMap["handler"] != "subroute" {
+			continue
+		}
+		subroutes, _ := handlerMap["routes"].([]interface{})
+		for _, subroute := range subroutes {
+			subrouteMap, ok := subroute.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			inner, _ := subrouteMap["handle"].([]interface{})
+			for _, h := range inner {
+				if hm, ok := h.(map[string]interface{}); ok && hm["handler"] == "veil_handler" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sameRoute compares two routes by their canonical JSON encoding
+func sameRoute(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// handleReconcile serves /veil/api/reconcile: GET reports route drift and
+// POST rebuilds the route table from the database
+func (h *VeilHandler) handleReconcile(w http.ResponseWriter, r *http.Request) error {
+	var apply bool
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		apply = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	report, err := h.reconcileRoutes(r.Context(), apply)
+	if err != nil {
+		h.logger.Error("failed to reconcile routes", zap.Error(err))
+		return writeJSONError(w, http.StatusInternalServerError, "reconcile_failed",
+			"Failed to reconcile routes: "+err.Error(), nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
+	"go.uber.org/zap"
+)
+
+// handlerSecrets are the settings left out of the veil_handler JSON of
+// generated routes, so they do not end up in the running config served by
+// the Caddy admin API or in the saved config files
+type handlerSecrets struct {
+	keyPepper      string
+	secretKey      string
+	identitySecret string
+	admin          *auth.AdminConfig
+	syncSecret     string
+	tracingHeaders map[string]string
+}
+
+// routeSecrets holds the secrets of the handlers that generate routes, by
+// database and route server, which the handlers of generated routes share
+// with the handler generating them. Entries are kept across config reloads,
+// during which the handlers of the new routes may be provisioned before the
+// handler generating them.
+var (
+	routeSecretsMu sync.Mutex
+	routeSecrets   = make(map[string]handlerSecrets)
+)
+
+// secretSettings are the JSON fields of the handler settings holding secrets
+var secretSettings = []string{"key_pepper", "secret_key", "identity_secret", "admin"}
+
+// routeSecretsKey returns the key of the secrets shared by the handler's routes
+func (h *VeilHandler) routeSecretsKey() string {
+	return h.DBPath + "\x00" + h.RouteServer
+}
+
+// stripSecrets removes the secrets from encoded handler settings
+func stripSecrets(handler map[string]interface{}) {
+	for _, name := range secretSettings {
+		delete(handler, name)
+	}
+	if nats, ok := handler["nats"].(map[string]interface{}); ok {
+		delete(nats, "sync_secret")
+	}
+	// Exporter headers usually carry the collector's credentials
+	if tracing, ok := handler["tracing"].(map[string]interface{}); ok {
+		delete(tracing, "headers")
+	}
+}
+
+// registerSecrets makes the handler's secrets available to the handlers of
+// the routes it generates
+func (h *VeilHandler) registerSecrets() {
+	secrets := handlerSecrets{
+		keyPepper:      h.KeyPepper,
+		secretKey:      h.SecretKey,
+		identitySecret: h.IdentitySecret,
+		admin:          h.Admin,
+	}
+	if h.NATS != nil {
+		secrets.syncSecret = h.NATS.SyncSecret
+	}
+	if h.Tracing != nil {
+		secrets.tracingHeaders = h.Tracing.Headers
+	}
+
+	routeSecretsMu.Lock()
+	defer routeSecretsMu.Unlock()
+	routeSecrets[h.routeSecretsKey()] = secrets
+}
+
+// inheritSecrets takes the secrets of the handler that generated the route,
+// for handlers with inherit_secrets set. Without one in this process, the
+// secrets fall back to the environment.
+func (h *VeilHandler) inheritSecrets() {
+	routeSecretsMu.Lock()
+	secrets, ok := routeSecrets[h.routeSecretsKey()]
+	routeSecretsMu.Unlock()
+	if !ok {
+		h.logger.Warn("no handler to inherit secrets from on this database and route server, using the environment",
+			zap.String("db_path", h.DBPath),
+			zap.String("route_server", h.RouteServer))
+		return
+	}
+
+	h.KeyPepper = secrets.keyPepper
+	h.SecretKey = secrets.secretKey
+	h.IdentitySecret = secrets.identitySecret
+	h.Admin = secrets.admin
+	if h.NATS != nil {
+		h.NATS.SyncSecret = secrets.syncSecret
+	}
+	if h.Tracing != nil {
+		h.Tracing.Headers = secrets.tracingHeaders
+	}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/openapi"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// specNamePattern restricts spec names to a single URL path segment
+var specNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+
+// handleSpecs serves /veil/api/specs: GET lists the stored OpenAPI documents,
+// and GET, PUT and DELETE /veil/api/specs/{name} read, store and remove one
+func (h *VeilHandler) handleSpecs(w http.ResponseWriter, r *http.Request, name string) error {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
+		return h.handleListSpecs(w)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		spec, err := h.store.GetSpec(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return writeJSONError(w, http.StatusNotFound, "not_found", "spec not found", map[string]string{"name": name})
+		}
+		if err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get spec", nil)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(dto.SpecDetailDTO{Status: "success", Spec: toSpecDTO(*spec, true)})
+	case http.MethodPut:
+		return h.handlePutSpec(w, r, name)
+	case http.MethodDelete:
+		return h.handleDeleteSpec(w, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
+
+// handleListSpecs lists the stored OpenAPI documents without their content
+func (h *VeilHandler) handleListSpecs(w http.ResponseWriter) error {
+	specs, err := h.store.ListSpecs()
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to list specs", nil)
+	}
+	out := make([]dto.SpecDTO, 0, len(specs))
+	for _, spec := range specs {
+		out = append(out, toSpecDTO(spec, false))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(dto.SpecListDTO{Status: "success", Specs: out})
+}
+
+// handlePutSpec stores the JSON or YAML OpenAPI document in the request body.
+// APIs referencing the name validate against the new document right away.
+func (h *VeilHandler) handlePutSpec(w http.ResponseWriter, r *http.Request, name string) error {
+	if !specNamePattern.MatchString(name) {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec",
+			"spec name may only contain letters, digits, '.', '_' and '-'", map[string]string{"name": name})
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCatalogSize))
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", "failed to read OpenAPI document: "+err.Error(), nil)
+	}
+	// Only documents every schema of which compiles are accepted
+	if _, err := openapi.Compile(body); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid_spec", err.Error(), nil)
+	}
+
+	created, err := h.store.PutSpec(name, string(body))
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to store spec", nil)
+	}
+	spec, err := h.store.GetSpec(name)
+	if err != nil {
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to get spec", nil)
+	}
+
+	h.logger.Info("stored OpenAPI document",
+		zap.String("name", name),
+		zap.Bool("created", created))
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return json.NewEncoder(w).Encode(dto.SpecDetailDTO{Status: "success", Spec: toSpecDTO(*spec, false)})
+}
+
+// handleDeleteSpec removes an OpenAPI document no API references
+func (h *VeilHandler) handleDeleteSpec(w http.ResponseWriter, name string) error {
+	err := h.store.DeleteSpec(name)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return writeJSONError(w, http.StatusNotFound, "not_found", "spec not found", map[string]string{"name": name})
+	case errors.Is(err, store.ErrSpecInUse):
+		return writeJSONError(w, http.StatusConflict, "spec_in_use", err.Error(), map[string]string{"name": name})
+	case err != nil:
+		return writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to delete spec", nil)
+	}
+	contracts.Delete(name)
+
+	h.logger.Info("deleted OpenAPI document",
+		zap.String("name", name))
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// toSpecDTO describes a stored spec, with its document if withDocument is set
+func toSpecDTO(spec models.APISpec, withDocument bool) dto.SpecDTO {
+	out := dto.SpecDTO{
+		Name:      spec.Name,
+		CreatedAt: spec.CreatedAt,
+		UpdatedAt: spec.UpdatedAt,
+	}
+	if withDocument {
+		out.Document = spec.Document
+	}
+	return out
+}
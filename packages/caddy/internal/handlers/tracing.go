@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+// Default tracing settings
+const (
+	defaultTracingServiceName = "veil"
+	defaultTracingURLPath     = "/v1/traces"
+	defaultTracingTimeout     = 10 * time.Second
+
+	// tracingShutdownTimeout bounds flushing buffered spans on shutdown
+	tracingShutdownTimeout = 5 * time.Second
+
+	tracerName = "github.com/try-veil/veil/packages/caddy"
+)
+
+// tracingProviders holds one tracer provider per tracing configuration so
+// that config reloads do not drop buffered spans
+var tracingProviders = caddy.NewUsagePool()
+
+// tracePropagator reads and writes W3C traceparent and tracestate headers
+var tracePropagator = propagation.TraceContext{}
+
+// TracingConfig configures OpenTelemetry tracing of gateway requests
+type TracingConfig struct {
+	// Disabled turns tracing off
+	Disabled bool `json:"disabled,omitempty"`
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318.
+	// Spans are posted to /v1/traces unless the URL has a path.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, e.g. for collector authentication
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is reported as service.name, veil by default
+	ServiceName string `json:"service_name,omitempty"`
+	// SampleRatio is the fraction of new traces that are sampled, 1 by
+	// default. Requests with a sampled traceparent are always traced.
+	SampleRatio float64 `json:"sample_ratio,omitempty"`
+	// Timeout bounds a single export
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// Validate checks the tracing configuration
+func (c *TracingConfig) Validate() error {
+	if c == nil || c.Disabled {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("tracing endpoint %q must be an http or https URL", c.Endpoint)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample_ratio must be between 0 and 1")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("tracing timeout must not be negative")
+	}
+	return nil
+}
+
+// tracingProvider is a tracer provider exporting over OTLP/HTTP
+type tracingProvider struct {
+	provider *sdktrace.TracerProvider
+	logger   *zap.Logger
+}
+
+// newTracingProvider creates a provider with a batching OTLP/HTTP exporter.
+// The exporter connects lazily, so an unreachable collector does not fail
+// provisioning.
+func newTracingProvider(cfg *TracingConfig, logger *zap.Logger) (*tracingProvider, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing endpoint: %v", err)
+	}
+	urlPath := u.Path
+	if urlPath == "" || urlPath == "/" {
+		urlPath = defaultTracingURLPath
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = defaultTracingTimeout
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(urlPath),
+		otlptracehttp.WithTimeout(timeout),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	logger.Info("tracing enabled",
+		zap.String("endpoint", u.Scheme+"://"+u.Host+urlPath),
+		zap.String("service_name", serviceName),
+		zap.Float64("sample_ratio", ratio))
+	return &tracingProvider{
+		provider: sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+			sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+				semconv.ServiceName(serviceName))),
+		),
+		logger: logger,
+	}, nil
+}
+
+// Destruct implements caddy.Destructor. It flushes buffered spans.
+func (p *tracingProvider) Destruct() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := p.provider.Shutdown(ctx); err != nil {
+		p.logger.Warn("failed to flush spans", zap.Error(err))
+	}
+	return nil
+}
+
+// tracingKey returns the usage pool key of the handler's tracer provider
+func (h *VeilHandler) tracingKey() string {
+	settings, _ := json.Marshal(h.Tracing)
+	return "veil_tracing:" + string(settings)
+}
+
+// provisionTracing sets up the handler's tracer. Without a tracing block the
+// tracer records nothing, but an incoming traceparent is still passed to the
+// upstream and into usage events.
+func (h *VeilHandler) provisionTracing() error {
+	if h.Tracing == nil || h.Tracing.Disabled {
+		h.tracer = noop.NewTracerProvider().Tracer(tracerName)
+		return nil
+	}
+
+	value, _, err := tracingProviders.LoadOrNew(h.tracingKey(), func() (caddy.Destructor, error) {
+		return newTracingProvider(h.Tracing, h.logger.Named("tracing"))
+	})
+	if err != nil {
+		return err
+	}
+	h.tracingProvider = value.(*tracingProvider)
+	h.tracer = h.tracingProvider.provider.Tracer(tracerName)
+	return nil
+}
+
+// releaseTracing releases the handler's tracer provider, flushing it once no
+// handler uses it
+func (h *VeilHandler) releaseTracing() {
+	if h.tracingProvider == nil {
+		return
+	}
+	if _, err := tracingProviders.Delete(h.tracingKey()); err != nil {
+		h.logger.Error("failed to release tracer provider", zap.Error(err))
+	}
+	h.tracingProvider = nil
+}
+
+// startRequestSpan starts the server span of a gateway request, continuing
+// the trace of an incoming traceparent
+func (h *VeilHandler) startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := h.tracer.Start(ctx, "veil.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the outcome of a request on its span
+func endRequestSpan(span trace.Span, apiPath string, status int, err error) {
+	span.SetAttributes(
+		attribute.String("veil.api_path", apiPath),
+		semconv.HTTPStatusCode(status),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// injectTraceContext sets the traceparent of ctx on the upstream request
+func injectTraceContext(ctx context.Context, r *http.Request) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// traceIDs returns the trace and span ID of the span in ctx, if any
+func traceIDs(ctx context.Context) (traceID, spanID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", ""
+	}
+	return sc.TraceID().String(), sc.SpanID().String()
+}
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
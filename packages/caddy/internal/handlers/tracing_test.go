@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// captureQueue is an event queue that keeps enqueued events
+type captureQueue struct {
+	mu     sync.Mutex
+	events []events.UsageEvent
+}
+
+func (q *captureQueue) Enqueue(event events.UsageEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events = append(q.events, event)
+	return nil
+}
+
+func (q *captureQueue) ProcessEvents() error { return nil }
+func (q *captureQueue) Start() error         { return nil }
+func (q *captureQueue) Stop() error          { return nil }
+
+func TestVeilHandler_tracing(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/tracing-test/*", "http://localhost:8082", "test-subscription",
+		[]string{"GET"}, nil, []models.APIKey{{Key: "active-key", Name: "Active", IsActive: &active}})))
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+	handler.tracer = provider.Tracer(tracerName)
+
+	handler.releaseEventQueue()
+	queue := &captureQueue{}
+	handler.eventQueue = queue
+
+	const incomingTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/tracing-test/items", nil)
+	req.Header.Set("X-Subscription-Key", "active-key")
+	req.Header.Set("traceparent", "00-"+incomingTraceID+"-00f067aa0ba902b7-01")
+
+	var upstreamTraceparent string
+	err := handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}})
+	require.NoError(t, err)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		assert.Equal(t, incomingTraceID, span.SpanContext.TraceID().String(), span.Name)
+		spans[span.Name] = span
+	}
+	parents := map[string]string{
+		"veil.validate_api_key": "veil.request",
+		"veil.store.lookup":     "veil.validate_api_key",
+		"veil.upstream":         "veil.request",
+		"veil.events.enqueue":   "veil.request",
+	}
+	for name, parent := range parents {
+		require.Contains(t, spans, name)
+		assert.Equal(t, spans[parent].SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+	}
+	request := spans["veil.request"]
+	assert.Equal(t, "00f067aa0ba902b7", request.Parent.SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, request.SpanKind)
+	assert.Equal(t, trace.SpanKindClient, spans["veil.upstream"].SpanKind)
+
+	// The upstream continues the trace from the upstream span
+	upstream := spans["veil.upstream"].SpanContext
+	assert.Equal(t, "00-"+incomingTraceID+"-"+upstream.SpanID().String()+"-01", upstreamTraceparent)
+
+	require.Len(t, queue.events, 1)
+	assert.Equal(t, incomingTraceID, queue.events[0].TraceID)
+	assert.Equal(t, request.SpanContext.SpanID().String(), queue.events[0].SpanID)
+}
+
+func TestVeilHandler_tracingDisabled(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	active := true
+	require.NoError(t, handler.store.CreateAPI(CreateAPI(t, "/tracing-test/*", "http://localhost:8082", "test-subscription",
+		[]string{"GET"}, nil, []models.APIKey{{Key: "active-key", Name: "Active", IsActive: &active}})))
+
+	tests := []struct {
+		name        string
+		traceparent string
+	}{
+		{name: "incoming trace is passed on", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "no incoming trace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tracing-test/items", nil)
+			req.Header.Set("X-Subscription-Key", "active-key")
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+
+			var upstreamTraceparent string
+			err := handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+				upstreamTraceparent = r.Header.Get("traceparent")
+			}})
+			require.NoError(t, err)
+			assert.Equal(t, tt.traceparent, upstreamTraceparent)
+		})
+	}
+}
+
+func TestVeilHandler_tracingExport(t *testing.T) {
+	type export struct {
+		path   string
+		token  string
+		length int
+	}
+	exports := make(chan export, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exports <- export{path: r.URL.Path, token: r.Header.Get("Authorization"), length: len(body)}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+		Tracing: &TracingConfig{
+			Endpoint: collector.URL,
+			Headers:  map[string]string{"Authorization": "Bearer collector-token"},
+		},
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/unknown/items", nil)
+	req.Header.Set("X-Subscription-Key", "some-key")
+	require.NoError(t, handler.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {}}))
+
+	// Releasing the last handler flushes the batched spans
+	require.NoError(t, handler.Cleanup())
+
+	select {
+	case got := <-exports:
+		assert.Equal(t, defaultTracingURLPath, got.path)
+		assert.Equal(t, "Bearer collector-token", got.token)
+		assert.NotZero(t, got.length)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans exported to the collector")
+	}
+}
+
+func TestTracingConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *TracingConfig
+		wantErr bool
+	}{
+		{name: "not configured"},
+		{name: "disabled without endpoint", cfg: &TracingConfig{Disabled: true}},
+		{name: "http endpoint", cfg: &TracingConfig{Endpoint: "http://localhost:4318", SampleRatio: 0.5}},
+		{name: "https endpoint with path", cfg: &TracingConfig{Endpoint: "https://otel.example.com/otlp/v1/traces"}},
+		{name: "missing endpoint", cfg: &TracingConfig{}, wantErr: true},
+		{name: "grpc endpoint", cfg: &TracingConfig{Endpoint: "grpc://localhost:4317"}, wantErr: true},
+		{name: "sample ratio above 1", cfg: &TracingConfig{Endpoint: "http://localhost:4318", SampleRatio: 1.5}, wantErr: true},
+		{name: "negative timeout", cfg: &TracingConfig{Endpoint: "http://localhost:4318", Timeout: caddy.Duration(-time.Second)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,575 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+)
+
+// pathParamPattern matches the {name} segments of path rewrite rules
+var pathParamPattern = regexp.MustCompile(`^\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// toTransforms converts the transforms of a request
+func toTransforms(t *dto.TransformsDTO) *models.Transforms {
+	if t == nil {
+		return nil
+	}
+	out := &models.Transforms{}
+	if req := t.Request; req != nil {
+		out.Request = &models.RequestTransform{
+			SetQuery:     req.SetQuery,
+			RemoveQuery:  req.RemoveQuery,
+			RenameFields: req.RenameFields,
+		}
+		for _, rule := range req.Paths {
+			out.Request.Paths = append(out.Request.Paths, models.PathRewrite{From: rule.From, To: rule.To})
+		}
+	}
+	if resp := t.Response; resp != nil {
+		out.Response = &models.ResponseTransform{
+			SetHeaders:    resp.SetHeaders,
+			RemoveHeaders: resp.RemoveHeaders,
+			RenameFields:  resp.RenameFields,
+			RemoveFields:  resp.RemoveFields,
+		}
+	}
+	return out
+}
+
+// toTransformsDTO converts stored transforms for a response
+func toTransformsDTO(t *models.Transforms) *dto.TransformsDTO {
+	if t == nil {
+		return nil
+	}
+	out := &dto.TransformsDTO{}
+	if req := t.Request; req != nil {
+		out.Request = &dto.RequestTransformDTO{
+			SetQuery:     req.SetQuery,
+			RemoveQuery:  req.RemoveQuery,
+			RenameFields: req.RenameFields,
+		}
+		for _, rule := range req.Paths {
+			out.Request.Paths = append(out.Request.Paths, dto.PathRewriteDTO{From: rule.From, To: rule.To})
+		}
+	}
+	if resp := t.Response; resp != nil {
+		out.Response = &dto.ResponseTransformDTO{
+			SetHeaders:    resp.SetHeaders,
+			RemoveHeaders: resp.RemoveHeaders,
+			RenameFields:  resp.RenameFields,
+			RemoveFields:  resp.RemoveFields,
+		}
+	}
+	return out
+}
+
+// prepareTransforms validates the transforms of an API, canonicalizes their
+// header names and drops empty rule sets
+func prepareTransforms(api *models.APIConfig) error {
+	t := api.Transforms
+	if t == nil {
+		return nil
+	}
+
+	prepared := &models.Transforms{}
+	if req := t.Request; req != nil {
+		for _, rule := range req.Paths {
+			if err := checkPathRewrite(rule); err != nil {
+				return err
+			}
+		}
+		for name := range req.SetQuery {
+			if name == "" {
+				return fmt.Errorf("transforms request set_query has an empty parameter name")
+			}
+		}
+		for _, name := range req.RemoveQuery {
+			if name == "" {
+				return fmt.Errorf("transforms request remove_query has an empty parameter name")
+			}
+		}
+		if err := checkFieldRenames("request", req.RenameFields); err != nil {
+			return err
+		}
+		if len(req.Paths) > 0 || len(req.SetQuery) > 0 || len(req.RemoveQuery) > 0 || len(req.RenameFields) > 0 {
+			prepared.Request = &models.RequestTransform{
+				Paths:        req.Paths,
+				SetQuery:     nonEmptyMap(req.SetQuery),
+				RemoveQuery:  req.RemoveQuery,
+				RenameFields: nonEmptyMap(req.RenameFields),
+			}
+		}
+	}
+
+	if resp := t.Response; resp != nil {
+		rules := &models.ResponseTransform{RenameFields: nonEmptyMap(resp.RenameFields), RemoveFields: resp.RemoveFields}
+		for _, name := range resp.RemoveHeaders {
+			header, err := responseHeader("remove_headers", name)
+			if err != nil {
+				return err
+			}
+			rules.RemoveHeaders = append(rules.RemoveHeaders, header)
+		}
+		for name, value := range resp.SetHeaders {
+			header, err := responseHeader("set_headers", name)
+			if err != nil {
+				return err
+			}
+			if _, ok := rules.SetHeaders[header]; ok {
+				return fmt.Errorf("transforms response set_headers lists %s twice", header)
+			}
+			if rules.SetHeaders == nil {
+				rules.SetHeaders = make(map[string]string, len(resp.SetHeaders))
+			}
+			rules.SetHeaders[header] = value
+		}
+		if err := checkFieldRenames("response", resp.RenameFields); err != nil {
+			return err
+		}
+		for _, field := range resp.RemoveFields {
+			if _, ok := fieldPath(field); !ok {
+				return fmt.Errorf("transforms response remove_fields has invalid field path %q", field)
+			}
+		}
+		if len(rules.SetHeaders) > 0 || len(rules.RemoveHeaders) > 0 || len(rules.RenameFields) > 0 || len(rules.RemoveFields) > 0 {
+			prepared.Response = rules
+		}
+	}
+
+	if prepared.Request == nil && prepared.Response == nil {
+		prepared = nil
+	}
+	api.Transforms = prepared
+	return nil
+}
+
+// nonEmptyMap returns nil for empty maps so unused rules are not stored
+func nonEmptyMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// checkPathRewrite validates a path rewrite rule: every parameter of To must
+// be captured by From, and * may only be the last segment
+func checkPathRewrite(rule models.PathRewrite) error {
+	from, err := pathSegments(rule.From)
+	if err != nil {
+		return fmt.Errorf("transforms request path rule from %q: %v", rule.From, err)
+	}
+	to, err := pathSegments(rule.To)
+	if err != nil {
+		return fmt.Errorf("transforms request path rule to %q: %v", rule.To, err)
+	}
+
+	captured := map[string]bool{}
+	for _, segment := range from {
+		if m := pathParamPattern.FindStringSubmatch(segment); m != nil {
+			if captured[m[1]] {
+				return fmt.Errorf("transforms request path rule from %q captures {%s} twice", rule.From, m[1])
+			}
+			captured[m[1]] = true
+		}
+	}
+	wildcard := len(from) > 0 && from[len(from)-1] == "*"
+	for _, segment := range to {
+		if m := pathParamPattern.FindStringSubmatch(segment); m != nil && !captured[m[1]] {
+			return fmt.Errorf("transforms request path rule to %q uses {%s}, which from does not capture", rule.To, m[1])
+		}
+		if segment == "*" && !wildcard {
+			return fmt.Errorf("transforms request path rule to %q uses *, which from does not capture", rule.To)
+		}
+	}
+	return nil
+}
+
+// pathSegments splits a rule path into its segments
+func pathSegments(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("must start with /")
+	}
+	if path == "/" {
+		return nil, nil
+	}
+	segments := strings.Split(path[1:], "/")
+	for i, segment := range segments {
+		if segment == "*" && i != len(segments)-1 {
+			return nil, fmt.Errorf("* must be the last segment")
+		}
+		if strings.ContainsAny(segment, "{}") && !pathParamPattern.MatchString(segment) {
+			return nil, fmt.Errorf("invalid parameter segment %q", segment)
+		}
+	}
+	return segments, nil
+}
+
+// checkFieldRenames validates the JSON field renames of a request or response
+func checkFieldRenames(direction string, renames map[string]string) error {
+	for field, name := range renames {
+		if _, ok := fieldPath(field); !ok {
+			return fmt.Errorf("transforms %s rename_fields has invalid field path %q", direction, field)
+		}
+		if name == "" || strings.Contains(name, ".") {
+			return fmt.Errorf("transforms %s rename_fields must rename %q to a field name without dots", direction, field)
+		}
+	}
+	return nil
+}
+
+// fieldPath splits a dot separated JSON field path
+func fieldPath(field string) ([]string, bool) {
+	path := strings.Split(field, ".")
+	for _, name := range path {
+		if name == "" {
+			return nil, false
+		}
+	}
+	return path, true
+}
+
+// responseHeader canonicalizes a response header name of a transform. The
+// framing headers of the response cannot be changed.
+func responseHeader(operation, name string) (string, error) {
+	header := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+	if header == "" || strings.ContainsAny(header, " :") {
+		return "", fmt.Errorf("transforms response %s has invalid header name %q", operation, name)
+	}
+	if header == "Content-Length" || header == "Transfer-Encoding" {
+		return "", fmt.Errorf("transforms response %s must not change %s", operation, header)
+	}
+	return header, nil
+}
+
+// transformRequest applies the request transforms of an API. It writes an
+// error response and returns false when the body cannot be transformed.
+func (h *VeilHandler) transformRequest(w http.ResponseWriter, r *http.Request, api *models.APIConfig) (bool, error) {
+	if api.Transforms == nil || api.Transforms.Request == nil {
+		return true, nil
+	}
+	rules := api.Transforms.Request
+
+	if path, ok := rewritePath(r.URL.EscapedPath(), api.Path, rules.Paths); ok {
+		r.URL.RawPath = path
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			r.URL.Path = unescaped
+		}
+		if r.URL.RawPath == r.URL.Path {
+			r.URL.RawPath = ""
+		}
+	}
+
+	for _, name := range rules.RemoveQuery {
+		r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, name)
+	}
+	for name, value := range rules.SetQuery {
+		query := removeQueryParam(r.URL.RawQuery, name)
+		if query != "" {
+			query += "&"
+		}
+		r.URL.RawQuery = query + url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	}
+
+	if len(rules.RenameFields) == 0 || !jsonContent(r.Header) || contentEncoded(r.Header) {
+		return true, nil
+	}
+	body, complete, err := peekBody(r)
+	if err != nil {
+		h.logger.Error("failed to read request body for transforms",
+			zap.Error(err))
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return false, nil
+	}
+	if !complete {
+		return false, writeJSONError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("request bodies of this API are limited to %d bytes", maxValidatedBodySize), nil)
+	}
+	if len(body) == 0 {
+		return true, nil
+	}
+	transformed, err := transformJSON(body, rules.RenameFields, nil)
+	if err != nil {
+		return false, writeJSONError(w, http.StatusBadRequest, "invalid_body",
+			"request body is not valid JSON", nil)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(transformed))
+	r.ContentLength = int64(len(transformed))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+	return true, nil
+}
+
+// rewritePath applies the first path rule matching the escaped request path
+// below the API path prefix. Captured segments stay escaped.
+func rewritePath(escapedPath, apiPath string, rules []models.PathRewrite) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+	prefix := strings.TrimSuffix(strings.TrimSuffix(apiPath, "*"), "/")
+	if !strings.HasPrefix(escapedPath, prefix) {
+		return "", false
+	}
+	var segments []string
+	if rest := strings.TrimPrefix(escapedPath, prefix); rest != "" && rest != "/" {
+		segments = strings.Split(strings.TrimPrefix(rest, "/"), "/")
+	}
+
+	for _, rule := range rules {
+		from, _ := pathSegments(rule.From)
+		params, rest, ok := matchSegments(from, segments)
+		if !ok {
+			continue
+		}
+		to, _ := pathSegments(rule.To)
+		out := make([]string, 0, len(to))
+		for _, segment := range to {
+			switch m := pathParamPattern.FindStringSubmatch(segment); {
+			case m != nil:
+				out = append(out, params[m[1]])
+			case segment == "*":
+				if rest != "" {
+					out = append(out, rest)
+				}
+			default:
+				out = append(out, segment)
+			}
+		}
+		return prefix + "/" + strings.Join(out, "/"), true
+	}
+	return "", false
+}
+
+// matchSegments matches path segments against the segments of a rule's From
+// and returns the captured parameters and the rest captured by *
+func matchSegments(pattern, segments []string) (map[string]string, string, bool) {
+	params := map[string]string{}
+	for i, p := range pattern {
+		if p == "*" {
+			return params, strings.Join(segments[i:], "/"), true
+		}
+		if i >= len(segments) {
+			return nil, "", false
+		}
+		if m := pathParamPattern.FindStringSubmatch(p); m != nil {
+			if segments[i] == "" {
+				return nil, "", false
+			}
+			params[m[1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, "", false
+		}
+	}
+	return params, "", len(pattern) == len(segments)
+}
+
+// jsonContent reports whether headers describe a JSON body
+func jsonContent(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// contentEncoded reports whether headers describe a compressed body
+func contentEncoded(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && encoding != "identity"
+}
+
+// transformJSON removes and then renames fields of a JSON document. Numbers
+// keep their precision; object keys are re-encoded in sorted order.
+func transformJSON(body []byte, renames map[string]string, removals []string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON document")
+	}
+
+	for _, field := range removals {
+		path, _ := fieldPath(field)
+		walkField(doc, path, func(obj map[string]interface{}, name string) {
+			delete(obj, name)
+		})
+	}
+	for field, newName := range renames {
+		path, _ := fieldPath(field)
+		walkField(doc, path, func(obj map[string]interface{}, name string) {
+			if value, ok := obj[name]; ok {
+				delete(obj, name)
+				obj[newName] = value
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// walkField calls fn with every object holding the field at path, descending
+// into each element of the arrays on the way
+func walkField(v interface{}, path []string, fn func(obj map[string]interface{}, name string)) {
+	switch value := v.(type) {
+	case []interface{}:
+		for _, element := range value {
+			walkField(element, path, fn)
+		}
+	case map[string]interface{}:
+		if len(path) == 1 {
+			fn(value, path[0])
+			return
+		}
+		if child, ok := value[path[0]]; ok {
+			walkField(child, path[1:], fn)
+		}
+	}
+}
+
+// responseTransformer applies the response transforms of an API. Headers are
+// rewritten as they are written; JSON bodies with field rules are buffered
+// and written by finish.
+type responseTransformer struct {
+	http.ResponseWriter
+	rules     *models.ResponseTransform
+	head      bool
+	status    int
+	buffering bool
+	body      bytes.Buffer
+	tooLarge  bool
+	encoded   bool
+}
+
+func newResponseTransformer(w http.ResponseWriter, rules *models.ResponseTransform, method string) *responseTransformer {
+	return &responseTransformer{ResponseWriter: w, rules: rules, head: method == http.MethodHead}
+}
+
+// WriteHeader rewrites the response headers and decides whether the body is
+// buffered
+func (rt *responseTransformer) WriteHeader(statusCode int) {
+	if rt.status != 0 {
+		return
+	}
+	if statusCode < http.StatusOK {
+		rt.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	rt.status = statusCode
+
+	header := rt.Header()
+	for _, name := range rt.rules.RemoveHeaders {
+		header.Del(name)
+	}
+	for name, value := range rt.rules.SetHeaders {
+		header.Set(name, value)
+	}
+
+	fieldRules := len(rt.rules.RenameFields) > 0 || len(rt.rules.RemoveFields) > 0
+	bodyless := rt.head || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified
+	if fieldRules && !bodyless && jsonContent(header) {
+		rt.buffering = true
+		rt.encoded = contentEncoded(header)
+		header.Del("Content-Length")
+		return
+	}
+	rt.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write buffers the body when it is transformed and passes it through
+// otherwise
+func (rt *responseTransformer) Write(data []byte) (int, error) {
+	if rt.status == 0 {
+		rt.WriteHeader(http.StatusOK)
+	}
+	if !rt.buffering {
+		return rt.ResponseWriter.Write(data)
+	}
+	if rt.encoded {
+		return len(data), nil
+	}
+	if rt.tooLarge || rt.body.Len()+len(data) > maxValidatedBodySize {
+		rt.tooLarge = true
+		rt.body.Reset()
+		return len(data), nil
+	}
+	return rt.body.Write(data)
+}
+
+// finish writes a buffered body after transforming it. Bodies that cannot
+// be transformed are not returned, so fields meant to be removed never leak.
+func (rt *responseTransformer) finish() error {
+	if !rt.buffering {
+		return nil
+	}
+	rt.buffering = false
+
+	var body []byte
+	var err error
+	switch {
+	case rt.encoded:
+		err = fmt.Errorf("upstream response is %s encoded", rt.Header().Get("Content-Encoding"))
+	case rt.tooLarge:
+		err = fmt.Errorf("upstream response exceeds %d bytes", maxValidatedBodySize)
+	case rt.body.Len() == 0:
+		rt.ResponseWriter.WriteHeader(rt.status)
+		return nil
+	default:
+		body, err = transformJSON(rt.body.Bytes(), rt.rules.RenameFields, rt.rules.RemoveFields)
+	}
+	if err != nil {
+		for name := range rt.Header() {
+			rt.Header().Del(name)
+		}
+		writeJSONError(rt.ResponseWriter, http.StatusBadGateway, "response_transform_failed",
+			"the upstream response could not be transformed", nil)
+		return err
+	}
+
+	rt.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rt.ResponseWriter.WriteHeader(rt.status)
+	_, err = rt.ResponseWriter.Write(body)
+	return err
+}
+
+// Flush implements http.Flusher if the underlying writer supports it. Buffered
+// bodies are only written by finish.
+func (rt *responseTransformer) Flush() {
+	if rt.buffering {
+		return
+	}
+	if flusher, ok := rt.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer supports it
+func (rt *responseTransformer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rt.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (rt *responseTransformer) Unwrap() http.ResponseWriter {
+	return rt.ResponseWriter
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestPrepareTransforms(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms *models.Transforms
+		want       *models.Transforms
+		wantErr    string
+	}{
+		{name: "none", transforms: nil, want: nil},
+		{name: "empty", transforms: &models.Transforms{Request: &models.RequestTransform{}, Response: &models.ResponseTransform{}}, want: nil},
+		{name: "canonical headers",
+			transforms: &models.Transforms{Response: &models.ResponseTransform{
+				SetHeaders: map[string]string{"x-served-by": "veil"}, RemoveHeaders: []string{"server"}}},
+			want: &models.Transforms{Response: &models.ResponseTransform{
+				SetHeaders: map[string]string{"X-Served-By": "veil"}, RemoveHeaders: []string{"Server"}}}},
+		{name: "path rules",
+			transforms: &models.Transforms{Request: &models.RequestTransform{Paths: []models.PathRewrite{
+				{From: "/users/{id}/orders", To: "/customers/{id}/orders"}, {From: "/v1/*", To: "/v2/*"}}}},
+			want: &models.Transforms{Request: &models.RequestTransform{Paths: []models.PathRewrite{
+				{From: "/users/{id}/orders", To: "/customers/{id}/orders"}, {From: "/v1/*", To: "/v2/*"}}}}},
+		{name: "relative path", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "users", To: "/customers"}}}}, wantErr: "must start with /"},
+		{name: "uncaptured parameter", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "/users/{id}", To: "/customers/{user}"}}}}, wantErr: "from does not capture"},
+		{name: "uncaptured rest", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "/v1", To: "/v2/*"}}}}, wantErr: "from does not capture"},
+		{name: "wildcard in the middle", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "/v1/*/items", To: "/v2"}}}}, wantErr: "last segment"},
+		{name: "invalid parameter", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "/users/{user id}", To: "/customers"}}}}, wantErr: "invalid parameter segment"},
+		{name: "parameter captured twice", transforms: &models.Transforms{Request: &models.RequestTransform{
+			Paths: []models.PathRewrite{{From: "/{id}/{id}", To: "/{id}"}}}}, wantErr: "twice"},
+		{name: "empty query parameter", transforms: &models.Transforms{Request: &models.RequestTransform{
+			SetQuery: map[string]string{"": "1"}}}, wantErr: "empty parameter name"},
+		{name: "dotted rename", transforms: &models.Transforms{Request: &models.RequestTransform{
+			RenameFields: map[string]string{"user.name": "profile.name"}}}, wantErr: "without dots"},
+		{name: "invalid field path", transforms: &models.Transforms{Response: &models.ResponseTransform{
+			RemoveFields: []string{"data..internal"}}}, wantErr: "invalid field path"},
+		{name: "content length", transforms: &models.Transforms{Response: &models.ResponseTransform{
+			SetHeaders: map[string]string{"content-length": "0"}}}, wantErr: "must not change Content-Length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &models.APIConfig{Transforms: tt.transforms}
+			err := prepareTransforms(api)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, api.Transforms)
+		})
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	rules := []models.PathRewrite{
+		{From: "/users/{id}/orders/{order}", To: "/customers/{id}/purchases/{order}"},
+		{From: "/v1/*", To: "/v2/*"},
+		{From: "/", To: "/index"},
+	}
+
+	tests := []struct {
+		path      string
+		apiPath   string
+		want      string
+		rewritten bool
+	}{
+		{path: "/shop/users/42/orders/7", apiPath: "/shop/*", want: "/shop/customers/42/purchases/7", rewritten: true},
+		{path: "/shop/users/a%2Fb/orders/7", apiPath: "/shop/*", want: "/shop/customers/a%2Fb/purchases/7", rewritten: true},
+		{path: "/shop/v1/items/3", apiPath: "/shop/*", want: "/shop/v2/items/3", rewritten: true},
+		{path: "/shop/v1", apiPath: "/shop/*", want: "/shop/v2", rewritten: true},
+		{path: "/shop", apiPath: "/shop/*", want: "/shop/index", rewritten: true},
+		{path: "/users/42/orders/7", apiPath: "/*", want: "/customers/42/purchases/7", rewritten: true},
+		{path: "/shop/users/42/orders", apiPath: "/shop/*"},
+		{path: "/shop/users/42/orders/7/items", apiPath: "/shop/*"},
+		{path: "/shop/users//orders/7", apiPath: "/shop/*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := rewritePath(tt.path, tt.apiPath, rules)
+			assert.Equal(t, tt.rewritten, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTransformJSON(t *testing.T) {
+	body := `{"id": 9007199254740993, "secret": "s", "items": [{"sku": "a", "cost": 1}, {"sku": "b", "cost": 2}],
+		"owner": {"name": "<alice>", "internal": true}}`
+
+	out, err := transformJSON([]byte(body), map[string]string{"items.sku": "code", "owner.name": "display_name"},
+		[]string{"secret", "items.cost", "owner.internal", "missing.field"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": 9007199254740993, "items": [{"code": "a"}, {"code": "b"}], "owner": {"display_name": "<alice>"}}`,
+		string(out))
+	assert.Contains(t, string(out), "9007199254740993", "numbers keep their precision")
+	assert.Contains(t, string(out), "<alice>", "HTML characters are not escaped")
+
+	// Top-level arrays apply the rules to each element
+	out, err = transformJSON([]byte(`[{"a": 1, "b": 2}, {"a": 3}]`), map[string]string{"a": "c"}, []string{"b"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"c": 1}, {"c": 3}]`, string(out))
+
+	_, err = transformJSON([]byte(`{"a": 1`), nil, nil)
+	assert.Error(t, err)
+	_, err = transformJSON([]byte(`{"a": 1} {"b": 2}`), nil, nil)
+	assert.Error(t, err)
+}
+
+func TestVeilHandler_transforms(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	queue := &captureQueue{}
+	handler.eventQueue = queue
+
+	active := true
+	api := CreateAPI(t, "/shop/*", "http://localhost:8085", "basic", []string{"GET", "POST"}, nil,
+		[]models.APIKey{{Key: "shop-key", Name: "Shop", IsActive: &active}})
+	api.Transforms = &models.Transforms{
+		Request: &models.RequestTransform{
+			Paths:        []models.PathRewrite{{From: "/users/{id}", To: "/customers/{id}"}},
+			SetQuery:     map[string]string{"version": "2"},
+			RemoveQuery:  []string{"debug"},
+			RenameFields: map[string]string{"fullName": "full_name"},
+		},
+		Response: &models.ResponseTransform{
+			SetHeaders:    map[string]string{"x-served-by": "veil"},
+			RemoveHeaders: []string{"x-powered-by"},
+			RenameFields:  map[string]string{"full_name": "fullName"},
+			RemoveFields:  []string{"internal_id"},
+		},
+	}
+	require.NoError(t, prepareTransforms(api))
+	require.NoError(t, handler.store.CreateAPI(api))
+
+	// upstreamBody is what the stand-in upstream returns
+	upstreamType, upstreamBody := "application/json", `{"full_name": "Ada", "internal_id": 7}`
+	upstreamEncoding := ""
+	send := func(method, target, body string) (*httptest.ResponseRecorder, *http.Request, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Subscription-Key", "shop-key")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", "gzip")
+		var upstream *http.Request
+		var received string
+		next := &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+			upstream = r.Clone(r.Context())
+			data, _ := io.ReadAll(r.Body)
+			received = string(data)
+			w.Header().Set("Content-Type", upstreamType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(upstreamBody)))
+			w.Header().Set("X-Powered-By", "partner")
+			if upstreamEncoding != "" {
+				w.Header().Set("Content-Encoding", upstreamEncoding)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(upstreamBody))
+		}}
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.ServeHTTP(w, req, next))
+		return w, upstream, received
+	}
+
+	w, upstream, received := send(http.MethodPost, "/shop/users/42?debug=1&page=2&version=1", `{"fullName": "Ada"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The request is rewritten below the API path
+	assert.Equal(t, http.MethodPost, upstream.Method)
+	assert.Equal(t, "/shop/customers/42", upstream.URL.Path)
+	assert.Equal(t, "page=2&version=2", upstream.URL.RawQuery)
+	assert.JSONEq(t, `{"full_name": "Ada"}`, received)
+	assert.Equal(t, int64(len(received)), upstream.ContentLength)
+	assert.Empty(t, upstream.Header.Get("Accept-Encoding"), "filtered responses are requested uncompressed")
+
+	// The response fields and headers are rewritten
+	assert.JSONEq(t, `{"fullName": "Ada"}`, w.Body.String())
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, "veil", w.Header().Get("X-Served-By"))
+	assert.Empty(t, w.Header().Get("X-Powered-By"))
+
+	// Usage is recorded under the requested path
+	queue.mu.Lock()
+	require.Len(t, queue.events, 1)
+	assert.Equal(t, "/shop/users/42", queue.events[0].APIPath)
+	assert.Equal(t, int64(w.Body.Len()), queue.events[0].ResponseSize)
+	queue.mu.Unlock()
+
+	// Other content types only get the header rules
+	upstreamType, upstreamBody = "text/plain", "internal_id: 7"
+	w, _, _ = send(http.MethodGet, "/shop/orders", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "internal_id: 7", w.Body.String())
+	assert.Equal(t, "veil", w.Header().Get("X-Served-By"))
+
+	// Responses that cannot be filtered are not returned
+	upstreamType, upstreamBody = "application/json", `{"internal_id": 7`
+	w, _, _ = send(http.MethodGet, "/shop/orders", "")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.NotContains(t, w.Body.String(), "internal_id")
+	var resp dto.ErrorResponseDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "response_transform_failed", resp.Code)
+
+	// Usage records the response the caller got, not the upstream's
+	queue.mu.Lock()
+	failed := queue.events[len(queue.events)-1]
+	queue.mu.Unlock()
+	assert.Equal(t, http.StatusBadGateway, failed.StatusCode)
+	assert.False(t, failed.Success)
+
+	upstreamBody, upstreamEncoding = `{"internal_id": 7}`, "br"
+	w, _, _ = send(http.MethodGet, "/shop/orders", "")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.NotContains(t, w.Body.String(), "internal_id")
+	upstreamEncoding = ""
+
+	// Invalid request bodies are rejected before they are proxied
+	w, upstream, _ = send(http.MethodPost, "/shop/users/42", `{"fullName": `)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Nil(t, upstream)
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+)
+
+// OAuth2 access tokens are refreshed tokenRefreshMargin before they expire.
+// Tokens without an expiry are kept for defaultTokenLifetime.
+const (
+	tokenRefreshMargin   = 30 * time.Second
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+// tokenClient requests OAuth2 access tokens
+var tokenClient = &http.Client{Timeout: 10 * time.Second}
+
+// upstreamTokens caches one *cachedToken per database and API path
+var upstreamTokens sync.Map
+
+// cachedToken is the OAuth2 access token of an API's upstream credentials
+type cachedToken struct {
+	mu sync.Mutex
+	// credentials identifies the credentials the token was issued for
+	credentials string
+	token       string
+	expiry      time.Time
+}
+
+// toUpstreamAuth converts the upstream credentials of a request
+func toUpstreamAuth(auth *dto.UpstreamAuthDTO) *models.UpstreamAuth {
+	if auth == nil {
+		return nil
+	}
+	return &models.UpstreamAuth{
+		Type:         auth.Type,
+		Header:       auth.Header,
+		Value:        auth.Value,
+		Username:     auth.Username,
+		Password:     auth.Password,
+		TokenURL:     auth.TokenURL,
+		ClientID:     auth.ClientID,
+		ClientSecret: auth.ClientSecret,
+		Scopes:       auth.Scopes,
+	}
+}
+
+// toUpstreamAuthDTO converts stored upstream credentials for a response,
+// with their encrypted secrets if withSecrets is set
+func toUpstreamAuthDTO(auth *models.UpstreamAuth, withSecrets bool) *dto.UpstreamAuthDTO {
+	if auth == nil {
+		return nil
+	}
+	out := &dto.UpstreamAuthDTO{
+		Type:     auth.Type,
+		Header:   auth.Header,
+		Username: auth.Username,
+		TokenURL: auth.TokenURL,
+		ClientID: auth.ClientID,
+		Scopes:   auth.Scopes,
+	}
+	if withSecrets {
+		out.Value = auth.Value
+		out.Password = auth.Password
+		out.ClientSecret = auth.ClientSecret
+	}
+	return out
+}
+
+// prepareUpstreamAuth validates the upstream credentials of an API, drops the
+// fields its type does not use and encrypts its secrets
+func (h *VeilHandler) prepareUpstreamAuth(api *models.APIConfig) error {
+	auth := api.UpstreamAuth
+	if auth == nil {
+		return nil
+	}
+
+	var prepared models.UpstreamAuth
+	switch auth.Type {
+	case models.UpstreamAuthHeader:
+		header := textproto.CanonicalMIMEHeaderKey(auth.Header)
+		if header == "" || strings.ContainsAny(header, " :") {
+			return fmt.Errorf("upstream_auth header must be a header name")
+		}
+		if header == "Host" || strings.EqualFold(header, h.SubscriptionKey) {
+			return fmt.Errorf("upstream_auth header must not be %s", header)
+		}
+		if auth.Value == "" {
+			return fmt.Errorf("upstream_auth value is required")
+		}
+		prepared = models.UpstreamAuth{Type: auth.Type, Header: header, Value: auth.Value}
+	case models.UpstreamAuthBasic:
+		if auth.Username == "" || strings.Contains(auth.Username, ":") {
+			return fmt.Errorf("upstream_auth username is required and must not contain ':'")
+		}
+		prepared = models.UpstreamAuth{Type: auth.Type, Username: auth.Username, Password: auth.Password}
+	case models.UpstreamAuthOAuth2:
+		u, err := url.Parse(auth.TokenURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upstream_auth token_url must be an http or https URL")
+		}
+		if auth.ClientID == "" || auth.ClientSecret == "" {
+			return fmt.Errorf("upstream_auth client_id and client_secret are required")
+		}
+		prepared = models.UpstreamAuth{Type: auth.Type, TokenURL: auth.TokenURL, ClientID: auth.ClientID,
+			ClientSecret: auth.ClientSecret, Scopes: auth.Scopes}
+	default:
+		return fmt.Errorf("upstream_auth type must be %s, %s or %s, got %q",
+			models.UpstreamAuthHeader, models.UpstreamAuthBasic, models.UpstreamAuthOAuth2, auth.Type)
+	}
+
+	if !h.store.HasSecretKey() {
+		return fmt.Errorf("upstream credentials are encrypted at rest; configure secret_key or VEIL_SECRET_KEY to store them")
+	}
+	if err := h.store.SealUpstreamAuth(&prepared); err != nil {
+		return fmt.Errorf("failed to encrypt upstream credentials: %v", err)
+	}
+	api.UpstreamAuth = &prepared
+	return nil
+}
+
+// injectUpstreamAuth sets the credentials of an API's upstream on the
+// request. It writes a 502 response and returns false when they cannot be
+// obtained.
+func (h *VeilHandler) injectUpstreamAuth(w http.ResponseWriter, r *http.Request, api *models.APIConfig) (bool, error) {
+	if api.UpstreamAuth == nil {
+		return true, nil
+	}
+
+	auth, err := h.store.OpenUpstreamAuth(api.UpstreamAuth)
+	if err == nil {
+		switch auth.Type {
+		case models.UpstreamAuthHeader:
+			r.Header.Set(auth.Header, auth.Value)
+		case models.UpstreamAuthBasic:
+			r.SetBasicAuth(auth.Username, auth.Password)
+		case models.UpstreamAuthOAuth2:
+			var token string
+			token, err = h.upstreamToken(r.Context(), api.Path, api.UpstreamAuth, auth)
+			if err == nil {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+	}
+	if err == nil {
+		return true, nil
+	}
+
+	h.logger.Error("failed to authenticate to upstream",
+		zap.String("path", api.Path),
+		zap.String("type", api.UpstreamAuth.Type),
+		zap.Error(err))
+	return false, writeJSONError(w, http.StatusBadGateway, "upstream_auth_failed",
+		"failed to authenticate to the upstream", nil)
+}
+
+// upstreamToken returns a cached OAuth2 access token for an API's upstream,
+// requesting a new one when it is about to expire. Concurrent requests wait
+// for a single token request.
+func (h *VeilHandler) upstreamToken(ctx context.Context, apiPath string, stored, auth *models.UpstreamAuth) (string, error) {
+	value, _ := upstreamTokens.LoadOrStore(h.DBPath+"\x00"+apiPath, &cachedToken{})
+	cached := value.(*cachedToken)
+
+	// The encrypted credentials change whenever the API's credentials are
+	// stored again
+	credentials := stored.TokenURL + "\x00" + stored.ClientID + "\x00" + stored.ClientSecret + "\x00" + strings.Join(stored.Scopes, " ")
+
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.credentials == credentials && time.Now().Before(cached.expiry) {
+		return cached.token, nil
+	}
+
+	token, lifetime, err := requestToken(ctx, auth)
+	if err != nil {
+		return "", err
+	}
+	cached.credentials = credentials
+	cached.token = token
+	cached.expiry = time.Now().Add(lifetime - min(tokenRefreshMargin, lifetime/2))
+
+	h.logger.Debug("requested upstream access token",
+		zap.String("path", apiPath),
+		zap.String("token_url", auth.TokenURL),
+		zap.Duration("lifetime", lifetime))
+	return token, nil
+}
+
+// requestToken requests an access token with the OAuth2 client credentials
+// grant, authenticating the client with HTTP basic authentication
+func requestToken(ctx context.Context, auth *models.UpstreamAuth) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret))
+
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return token.AccessToken, lifetime, nil
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestVeilHandler_prepareUpstreamAuth(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	// Credentials are only stored encrypted
+	api := &models.APIConfig{UpstreamAuth: &models.UpstreamAuth{Type: "header", Header: "X-Api-Key", Value: "secret"}}
+	assert.ErrorContains(t, handler.prepareUpstreamAuth(api), "secret_key")
+	require.NoError(t, handler.store.SetSecretKey("veil-secret"))
+
+	tests := []struct {
+		name    string
+		auth    models.UpstreamAuth
+		want    models.UpstreamAuth
+		wantErr string
+	}{
+		{name: "header", auth: models.UpstreamAuth{Type: "header", Header: "x-api-key", Value: "secret", Username: "unused"},
+			want: models.UpstreamAuth{Type: "header", Header: "X-Api-Key", Value: "secret"}},
+		{name: "basic", auth: models.UpstreamAuth{Type: "basic", Username: "veil", Password: "secret"},
+			want: models.UpstreamAuth{Type: "basic", Username: "veil", Password: "secret"}},
+		{name: "oauth2", auth: models.UpstreamAuth{Type: "oauth2", TokenURL: "https://auth.example.com/token",
+			ClientID: "veil", ClientSecret: "secret", Scopes: []string{"read"}},
+			want: models.UpstreamAuth{Type: "oauth2", TokenURL: "https://auth.example.com/token",
+				ClientID: "veil", ClientSecret: "secret", Scopes: []string{"read"}}},
+		{name: "unknown type", auth: models.UpstreamAuth{Type: "digest"}, wantErr: "type must be"},
+		{name: "subscription header", auth: models.UpstreamAuth{Type: "header", Header: "x-subscription-key", Value: "secret"},
+			wantErr: "must not be X-Subscription-Key"},
+		{name: "header without value", auth: models.UpstreamAuth{Type: "header", Header: "X-Api-Key"}, wantErr: "value is required"},
+		{name: "basic without username", auth: models.UpstreamAuth{Type: "basic", Password: "secret"}, wantErr: "username is required"},
+		{name: "oauth2 without secret", auth: models.UpstreamAuth{Type: "oauth2", TokenURL: "https://auth.example.com/token",
+			ClientID: "veil"}, wantErr: "client_secret are required"},
+		{name: "oauth2 token URL", auth: models.UpstreamAuth{Type: "oauth2", TokenURL: "auth.example.com",
+			ClientID: "veil", ClientSecret: "secret"}, wantErr: "token_url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := tt.auth
+			api := &models.APIConfig{UpstreamAuth: &auth}
+			err := handler.prepareUpstreamAuth(api)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			for _, secret := range []string{api.UpstreamAuth.Value, api.UpstreamAuth.Password, api.UpstreamAuth.ClientSecret} {
+				assert.NotContains(t, secret, "secret")
+			}
+
+			// Encrypted secrets are kept, so exported catalogs import again
+			sealed := *api.UpstreamAuth
+			require.NoError(t, handler.prepareUpstreamAuth(api))
+			assert.Equal(t, sealed, *api.UpstreamAuth)
+
+			opened, err := handler.store.OpenUpstreamAuth(api.UpstreamAuth)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *opened)
+
+			// Responses omit the secrets
+			out := toUpstreamAuthDTO(api.UpstreamAuth, false)
+			assert.Empty(t, out.Value)
+			assert.Empty(t, out.Password)
+			assert.Empty(t, out.ClientSecret)
+		})
+	}
+}
+
+func TestVeilHandler_injectUpstreamAuth(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+	require.NoError(t, handler.store.SetSecretKey("veil-secret"))
+
+	// A stand-in for the provider's token endpoint
+	var tokenRequests atomic.Int32
+	var expiresIn atomic.Int32
+	expiresIn.Store(3600)
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "veil" || clientSecret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+			return
+		}
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "read write", r.FormValue("scope"))
+		n := tokenRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %d}`, n, expiresIn.Load())
+	}))
+	defer tokenServer.Close()
+
+	active := true
+	onboard := func(path string, auth models.UpstreamAuth) {
+		api := CreateAPI(t, path, "http://localhost:8085", "basic", []string{"GET"}, nil,
+			[]models.APIKey{{Key: "key-" + strings.Trim(path, "/*"), Name: path, IsActive: &active}})
+		api.UpstreamAuth = &auth
+		require.NoError(t, handler.prepareUpstreamAuth(api))
+		require.NoError(t, handler.store.CreateAPI(api))
+	}
+	onboard("/static/*", models.UpstreamAuth{Type: "header", Header: "X-Api-Key", Value: "provider-key"})
+	onboard("/basic/*", models.UpstreamAuth{Type: "basic", Username: "veil", Password: "p@ss"})
+	onboard("/oauth/*", models.UpstreamAuth{Type: "oauth2", TokenURL: tokenServer.URL, ClientID: "veil",
+		ClientSecret: "client-secret", Scopes: []string{"read", "write"}})
+	onboard("/broken/*", models.UpstreamAuth{Type: "oauth2", TokenURL: tokenServer.URL, ClientID: "veil",
+		ClientSecret: "wrong-secret"})
+
+	send := func(path, key string) (*httptest.ResponseRecorder, http.Header) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Subscription-Key", key)
+		req.Header.Set("Authorization", "Bearer caller-token")
+		var upstreamHeaders http.Header
+		next := &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {
+			upstreamHeaders = r.Header.Clone()
+		}}
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.ServeHTTP(w, req, next))
+		return w, upstreamHeaders
+	}
+
+	w, headers := send("/static/items", "key-static")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "provider-key", headers.Get("X-Api-Key"))
+
+	w, headers = send("/basic/items", "key-basic")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	req := &http.Request{Header: headers}
+	username, password, ok := req.BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, "veil", username)
+	assert.Equal(t, "p@ss", password)
+
+	// Tokens are cached until they are about to expire
+	for range 3 {
+		w, headers = send("/oauth/items", "key-oauth")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "Bearer token-1", headers.Get("Authorization"))
+	}
+	assert.Equal(t, int32(1), tokenRequests.Load())
+
+	value, ok := upstreamTokens.Load(handler.DBPath + "\x00/oauth/*")
+	require.True(t, ok)
+	cached := value.(*cachedToken)
+	cached.mu.Lock()
+	cached.expiry = time.Now().Add(-time.Second)
+	cached.mu.Unlock()
+	w, headers = send("/oauth/items", "key-oauth")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "Bearer token-2", headers.Get("Authorization"))
+
+	// Short-lived tokens are refreshed ahead of their expiry
+	expiresIn.Store(1)
+	cached.mu.Lock()
+	cached.expiry = time.Time{}
+	cached.mu.Unlock()
+	send("/oauth/items", "key-oauth")
+	cached.mu.Lock()
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), cached.expiry, 200*time.Millisecond)
+	cached.mu.Unlock()
+
+	// Requests fail when no token can be obtained
+	w, headers = send("/broken/items", "key-broken")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Nil(t, headers)
+	var resp dto.ErrorResponseDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "upstream_auth_failed", resp.Code)
+	assert.NotContains(t, resp.Error, "client-secret")
+}
+
+func TestVeilHandler_buildRoute_stripsSubscriptionKey(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	config, err := handler.reverseProxyConfig(models.APIConfig{Path: "/orders/*", Upstream: "http://localhost:8082"})
+	require.NoError(t, err)
+
+	var proxy struct {
+		Headers struct {
+			Request struct {
+				Set    map[string][]string `json:"set"`
+				Delete []string            `json:"delete"`
+			} `json:"request"`
+		} `json:"headers"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(config), &proxy))
+	assert.Equal(t, []string{"localhost:8082"}, proxy.Headers.Request.Set["Host"])
+	assert.Equal(t, []string{"X-Subscription-Key"}, proxy.Headers.Request.Delete)
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/store"
+	"gorm.io/gorm"
+)
+
+// upstreamStores holds the most recently provisioned store of each database,
+// from which upstream transports load the certificates of generated routes.
+// Certificates are never written to the Caddy config.
+var upstreamStores sync.Map
+
+// provisionUpstreamTLS makes the handler's store available to the upstream
+// transports provisioned after it
+func (h *VeilHandler) provisionUpstreamTLS() {
+	upstreamStores.Store(h.DBPath, h.store)
+}
+
+// releaseUpstreamTLS removes the handler's store unless a newer handler on
+// the same database has replaced it
+func (h *VeilHandler) releaseUpstreamTLS() {
+	if h.store != nil {
+		upstreamStores.CompareAndDelete(h.DBPath, h.store)
+	}
+}
+
+// toUpstreamTLS converts the upstream TLS settings of a request
+func toUpstreamTLS(t *dto.UpstreamTLSDTO) *models.UpstreamTLS {
+	if t == nil {
+		return nil
+	}
+	return &models.UpstreamTLS{
+		CA:                 t.CA,
+		ServerName:         t.ServerName,
+		PinnedSHA256:       t.PinnedSHA256,
+		ClientCertificate:  t.ClientCertificate,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+}
+
+// toUpstreamTLSDTO converts stored upstream TLS settings for a response
+func toUpstreamTLSDTO(t *models.UpstreamTLS) *dto.UpstreamTLSDTO {
+	if t == nil {
+		return nil
+	}
+	return &dto.UpstreamTLSDTO{
+		CA:                 t.CA,
+		ServerName:         t.ServerName,
+		PinnedSHA256:       t.PinnedSHA256,
+		ClientCertificate:  t.ClientCertificate,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+}
+
+// checkUpstreamTLS validates the upstream TLS settings of an API. Settings
+// without any option are dropped, as verification is the default.
+func (h *VeilHandler) checkUpstreamTLS(api *models.APIConfig) error {
+	t := api.TLS
+	if t == nil {
+		return nil
+	}
+	if t.CA == "" && t.ServerName == "" && len(t.PinnedSHA256) == 0 && t.ClientCertificate == "" && !t.InsecureSkipVerify {
+		api.TLS = nil
+		return nil
+	}
+
+	if u, err := url.Parse(api.Upstream); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("tls settings require an https upstream")
+	}
+	if len(t.PinnedSHA256) > 0 {
+		if _, err := decodePins(t.PinnedSHA256); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range t.Certificates() {
+		cert, err := h.store.GetCertificate(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("certificate %q not found", name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %q: %v", name, err)
+		}
+		if name == t.ClientCertificate && cert.PrivateKey == "" {
+			return fmt.Errorf("client certificate %q has no private key", name)
+		}
+	}
+	return nil
+}
+
+// decodePins decodes base64 SHA-256 digests of subject public keys
+func decodePins(pins []string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("pin %q must be a base64 SHA-256 digest", pin)
+		}
+		decoded = append(decoded, digest)
+	}
+	return decoded, nil
+}
+
+// transportConfig renders the transport of an API's reverse_proxy handler as
+// a JSON object member with a trailing comma. Certificates of https upstreams
+// are verified unless the API opts out. Stored certificates and pins need the
+// veil transport, which loads them from the database when it is provisioned.
+func (h *VeilHandler) transportConfig(api models.APIConfig) (string, error) {
+	transport := map[string]interface{}{"protocol": "http"}
+
+	if u, err := url.Parse(api.Upstream); err == nil && u.Scheme == "https" {
+		t := api.TLS
+		if t == nil {
+			t = &models.UpstreamTLS{}
+		}
+		tlsConfig := map[string]interface{}{}
+		if t.ServerName != "" {
+			tlsConfig["server_name"] = t.ServerName
+		}
+		if t.InsecureSkipVerify {
+			tlsConfig["insecure_skip_verify"] = true
+		}
+		transport["tls"] = tlsConfig
+
+		if len(t.Certificates()) > 0 || len(t.PinnedSHA256) > 0 {
+			transport["protocol"] = "veil"
+			transport["db_path"] = h.DBPath
+			if t.CA != "" {
+				transport["ca"] = t.CA
+			}
+			if t.ClientCertificate != "" {
+				transport["client_certificate"] = t.ClientCertificate
+			}
+			if len(t.PinnedSHA256) > 0 {
+				transport["pinned_sha256"] = t.PinnedSHA256
+			}
+			if names := t.Certificates(); len(names) > 0 {
+				revision, err := h.certificateRevision(names)
+				if err != nil {
+					return "", err
+				}
+				transport["revision"] = revision
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(transport)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode transport: %v", err)
+	}
+	return fmt.Sprintf(`"transport": %s,`, encoded), nil
+}
+
+// certificateRevision identifies the stored versions of the named
+// certificates, so replacing one of them changes the routes using it and
+// their transports are provisioned again
+func (h *VeilHandler) certificateRevision(names []string) (string, error) {
+	certs, err := h.store.ListCertificates()
+	if err != nil {
+		return "", fmt.Errorf("failed to list certificates: %v", err)
+	}
+	digest := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(digest, "%s\x00", name)
+		i := slices.IndexFunc(certs, func(cert models.TLSCertificate) bool { return cert.Name == name })
+		if i >= 0 {
+			fmt.Fprintf(digest, "%s\x00%d\x00", certs[i].Fingerprint, certs[i].UpdatedAt.UnixNano())
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil))[:16], nil
+}
+
+// UpstreamTransport is Caddy's HTTP transport with the stored CA bundle,
+// client certificate and public key pins of an API. Routes generated for APIs
+// with such TLS settings use it as the "veil" transport.
+type UpstreamTransport struct {
+	reverseproxy.HTTPTransport
+
+	// DBPath is the database of the veil_handler the certificates are
+	// loaded from
+	DBPath string `json:"db_path,omitempty"`
+	// CA names the stored bundle upstream certificates must chain to
+	CA string `json:"ca,omitempty"`
+	// ClientCertificate names the stored certificate and key presented to
+	// the upstream
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	// PinnedSHA256 are base64 SHA-256 digests of subject public keys, one of
+	// which the upstream's chain must contain
+	PinnedSHA256 []string `json:"pinned_sha256,omitempty"`
+	// Revision changes when a referenced certificate is replaced
+	Revision string `json:"revision,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (UpstreamTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.veil",
+		New: func() caddy.Module { return new(UpstreamTransport) },
+	}
+}
+
+// Provision implements caddy.Provisioner. It sets up the HTTP transport, then
+// adds the stored certificates and pins to its TLS configuration.
+func (t *UpstreamTransport) Provision(ctx caddy.Context) error {
+	if err := t.HTTPTransport.Provision(ctx); err != nil {
+		return err
+	}
+	if t.Transport.TLSClientConfig == nil {
+		t.Transport.TLSClientConfig = new(tls.Config)
+	}
+	return t.configureTLS(t.Transport.TLSClientConfig)
+}
+
+// configureTLS adds the stored certificates and pins to cfg
+func (t *UpstreamTransport) configureTLS(cfg *tls.Config) error {
+	if t.CA != "" || t.ClientCertificate != "" {
+		value, ok := upstreamStores.Load(t.DBPath)
+		if !ok {
+			return fmt.Errorf("no veil_handler with db_path %q to load upstream certificates from", t.DBPath)
+		}
+		s := value.(*store.APIStore)
+
+		if t.CA != "" {
+			ca, err := s.GetCertificate(t.CA)
+			if err != nil {
+				return fmt.Errorf("failed to load CA certificate %q: %v", t.CA, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(ca.Certificate)) {
+				return fmt.Errorf("CA certificate %q contains no certificates", t.CA)
+			}
+			cfg.RootCAs = pool
+		}
+
+		if t.ClientCertificate != "" {
+			cert, err := s.GetCertificate(t.ClientCertificate)
+			if err != nil {
+				return fmt.Errorf("failed to load client certificate %q: %v", t.ClientCertificate, err)
+			}
+			pair, err := tls.X509KeyPair([]byte(cert.Certificate), []byte(cert.PrivateKey))
+			if err != nil {
+				return fmt.Errorf("failed to load client certificate %q: %v", t.ClientCertificate, err)
+			}
+			cfg.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	if len(t.PinnedSHA256) > 0 {
+		pins, err := decodePins(t.PinnedSHA256)
+		if err != nil {
+			return err
+		}
+		// VerifyConnection also runs with insecure_skip_verify, so pins alone
+		// can secure upstreams with self-signed certificates. Only verified
+		// chains count, or the leaf without verification: anything else the
+		// upstream sends is unauthenticated and could be any certificate.
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			chains := cs.VerifiedChains
+			if len(chains) == 0 && len(cs.PeerCertificates) > 0 {
+				chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+			}
+			return verifyPins(chains, pins)
+		}
+	}
+	return nil
+}
+
+// verifyPins checks that a certificate of the chains has a pinned public key
+func verifyPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("upstream certificate chain matches no pinned public key")
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner         = (*UpstreamTransport)(nil)
+	_ caddy.CleanerUpper        = (*UpstreamTransport)(nil)
+	_ http.RoundTripper         = (*UpstreamTransport)(nil)
+	_ reverseproxy.TLSTransport = (*UpstreamTransport)(nil)
+)
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// testCertificate is a certificate issued for a test with its PEM encoding
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+// issueTestCertificate issues a certificate signed by parent, or a self-signed
+// CA if parent is nil
+func issueTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// pin returns the base64 SHA-256 digest of the certificate's public key
+func (c *testCertificate) pin() string {
+	digest := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestVeilHandler_transportConfig(t *testing.T) {
+	handler := &VeilHandler{DBPath: "veil.db"}
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name string
+		api  models.APIConfig
+		want map[string]interface{}
+	}{
+		{
+			name: "http upstream",
+			api:  models.APIConfig{Upstream: "http://localhost:8080"},
+			want: map[string]interface{}{"protocol": "http"},
+		},
+		{
+			name: "https upstreams are verified",
+			api:  models.APIConfig{Upstream: "https://api.example.com"},
+			want: map[string]interface{}{"protocol": "http", "tls": map[string]interface{}{}},
+		},
+		{
+			name: "server name and opt-out",
+			api: models.APIConfig{Upstream: "https://10.0.0.5", TLS: &models.UpstreamTLS{
+				ServerName: "api.internal", InsecureSkipVerify: true}},
+			want: map[string]interface{}{"protocol": "http", "tls": map[string]interface{}{
+				"server_name": "api.internal", "insecure_skip_verify": true}},
+		},
+		{
+			name: "pins",
+			api:  models.APIConfig{Upstream: "https://api.example.com", TLS: &models.UpstreamTLS{PinnedSHA256: []string{pin}}},
+			want: map[string]interface{}{"protocol": "veil", "db_path": "veil.db", "tls": map[string]interface{}{},
+				"pinned_sha256": []interface{}{pin}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := handler.transportConfig(tt.api)
+			require.NoError(t, err)
+			var got map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte("{"+strings.TrimSuffix(config, ",")+"}"), &got))
+			assert.Equal(t, tt.want, got["transport"])
+		})
+	}
+}
+
+func TestVeilHandler_upstreamTLS(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	ca := issueTestCertificate(t, "Partner CA", nil)
+	server := issueTestCertificate(t, "partner.internal", ca)
+	client := issueTestCertificate(t, "veil", ca)
+	other := issueTestCertificate(t, "Other CA", nil)
+
+	// The upstream requires a client certificate issued by its CA
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// An impostor presents its own certificate followed by the partner's
+	impostorCert := issueTestCertificate(t, "partner.internal", other)
+	impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	impostor.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{impostorCert.cert.Raw, server.cert.Raw, ca.cert.Raw},
+			PrivateKey:  impostorCert.key,
+		}},
+	}
+	impostor.StartTLS()
+	defer impostor.Close()
+
+	manage := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(method, target, strings.NewReader(body))))
+		return w
+	}
+	putCertificate := func(name string, cert *testCertificate, withKey bool) *httptest.ResponseRecorder {
+		req := dto.CertificateRequestDTO{Certificate: cert.certPEM}
+		if withKey {
+			req.PrivateKey = cert.keyPEM
+		}
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		return manage(http.MethodPut, "/veil/api/certificates/"+name, string(body))
+	}
+
+	// Certificates are only stored with a secret key
+	w := putCertificate("partner-ca", ca, false)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	require.NoError(t, handler.store.SetSecretKey("veil-secret"))
+
+	w = manage(http.MethodPut, "/veil/api/certificates/partner-ca", `{"certificate": "not a certificate"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	wrongKey := *client
+	wrongKey.keyPEM = other.keyPEM
+	w = putCertificate("veil-client", &wrongKey, true)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = putCertificate("partner-ca", ca, false)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = putCertificate("veil-client", client, true)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var detail dto.CertificateDetailDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&detail))
+	assert.Equal(t, "CN=veil", detail.Certificate.Subject)
+	assert.True(t, detail.Certificate.HasPrivateKey)
+	assert.Empty(t, detail.Certificate.Certificate)
+	w = putCertificate("other-ca", other, false)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = manage(http.MethodGet, "/veil/api/certificates/veil-client", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "BEGIN CERTIFICATE")
+	assert.NotContains(t, w.Body.String(), "PRIVATE KEY")
+
+	w = manage(http.MethodGet, "/veil/api/certificates", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list dto.CertificateListDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Certificates, 3)
+	assert.Equal(t, "other-ca", list.Certificates[0].Name)
+	assert.Empty(t, list.Certificates[0].Certificate)
+
+	// APIs can only reference stored certificates, and client certificates
+	// need their key
+	api := &models.APIConfig{Path: "/partner/*", Upstream: "http://partner.internal"}
+	api.TLS = &models.UpstreamTLS{CA: "partner-ca"}
+	assert.EqualError(t, handler.checkUpstreamTLS(api), "tls settings require an https upstream")
+	api.Upstream = upstream.URL
+	require.NoError(t, handler.checkUpstreamTLS(api))
+	api.TLS = &models.UpstreamTLS{CA: "missing"}
+	assert.EqualError(t, handler.checkUpstreamTLS(api), `certificate "missing" not found`)
+	api.TLS = &models.UpstreamTLS{ClientCertificate: "partner-ca"}
+	assert.EqualError(t, handler.checkUpstreamTLS(api), `client certificate "partner-ca" has no private key`)
+	api.TLS = &models.UpstreamTLS{PinnedSHA256: []string{"c2hvcnQ="}}
+	assert.Error(t, handler.checkUpstreamTLS(api))
+	api.TLS = &models.UpstreamTLS{}
+	require.NoError(t, handler.checkUpstreamTLS(api))
+	assert.Nil(t, api.TLS)
+
+	tests := []struct {
+		name     string
+		tls      *models.UpstreamTLS
+		impostor bool
+		wantErr  string
+	}{
+		{name: "default roots reject the private CA", wantErr: "failed to verify certificate"},
+		{name: "client certificate required", tls: &models.UpstreamTLS{CA: "partner-ca", ServerName: "partner.internal"},
+			wantErr: "certificate required"},
+		{name: "wrong server name", tls: &models.UpstreamTLS{CA: "partner-ca", ClientCertificate: "veil-client"},
+			wantErr: "failed to verify certificate"},
+		{name: "mutual TLS", tls: &models.UpstreamTLS{CA: "partner-ca", ClientCertificate: "veil-client",
+			ServerName: "partner.internal"}},
+		{name: "pinned CA", tls: &models.UpstreamTLS{CA: "partner-ca", ClientCertificate: "veil-client",
+			ServerName: "partner.internal", PinnedSHA256: []string{other.pin(), ca.pin()}}},
+		{name: "pin mismatch", tls: &models.UpstreamTLS{CA: "partner-ca", ClientCertificate: "veil-client",
+			ServerName: "partner.internal", PinnedSHA256: []string{other.pin()}}, wantErr: "matches no pinned public key"},
+		{name: "pins without verification", tls: &models.UpstreamTLS{ClientCertificate: "veil-client",
+			InsecureSkipVerify: true, PinnedSHA256: []string{server.pin()}}},
+		{name: "pinned certificate appended to a verified chain", tls: &models.UpstreamTLS{CA: "other-ca",
+			ServerName: "partner.internal", PinnedSHA256: []string{ca.pin()}},
+			impostor: true, wantErr: "matches no pinned public key"},
+		{name: "pinned certificate appended without verification", tls: &models.UpstreamTLS{
+			InsecureSkipVerify: true, PinnedSHA256: []string{server.pin(), ca.pin()}},
+			impostor: true, wantErr: "matches no pinned public key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := upstream.Listener.Addr().String()
+			if tt.impostor {
+				addr = impostor.Listener.Addr().String()
+			}
+			api := models.APIConfig{Path: "/partner/*", Upstream: "https://" + addr, TLS: tt.tls}
+			config, err := handler.transportConfig(api)
+			require.NoError(t, err)
+			var route struct {
+				Transport UpstreamTransport `json:"transport"`
+			}
+			require.NoError(t, json.Unmarshal([]byte("{"+strings.TrimSuffix(config, ",")+"}"), &route))
+			transport := &route.Transport
+			require.NoError(t, transport.Provision(caddy.Context{Context: context.Background()}))
+
+			repl := caddy.NewReplacer()
+			req := httptest.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			req.RequestURI = ""
+			resp, err := transport.RoundTrip(req)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+
+	// A referenced certificate cannot be deleted
+	stored := CreateAPI(t, "/partner/*", "https://"+upstream.Listener.Addr().String(), "basic", []string{"GET"}, nil, nil)
+	stored.TLS = &models.UpstreamTLS{CA: "partner-ca", ClientCertificate: "veil-client", ServerName: "partner.internal"}
+	require.NoError(t, handler.store.CreateAPI(stored))
+	w = manage(http.MethodDelete, "/veil/api/certificates/partner-ca", "")
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = manage(http.MethodDelete, "/veil/api/certificates/missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// Replacing a certificate changes the routes using it
+	before, err := handler.transportConfig(*stored)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = handler.store.PutCertificate(&models.TLSCertificate{Name: "partner-ca", Certificate: ca.certPEM})
+	require.NoError(t, err)
+	after, err := handler.transportConfig(*stored)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
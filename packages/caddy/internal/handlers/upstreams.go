@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// toUpstreamTargets converts the upstream targets of a request
+func toUpstreamTargets(targets []dto.UpstreamTargetDTO) []models.UpstreamTarget {
+	if len(targets) == 0 {
+		return nil
+	}
+	out := make([]models.UpstreamTarget, 0, len(targets))
+	for _, target := range targets {
+		out = append(out, models.UpstreamTarget{URL: target.URL, Weight: target.Weight})
+	}
+	return out
+}
+
+// toLoadBalancing converts the load balancing settings of a request
+func toLoadBalancing(lb *dto.LoadBalancingDTO) *models.LoadBalancing {
+	if lb == nil {
+		return nil
+	}
+	return &models.LoadBalancing{Policy: lb.Policy, Retries: lb.Retries, TryDuration: lb.TryDuration}
+}
+
+// toHealthChecks converts the health checks of a request
+func toHealthChecks(hc *dto.HealthChecksDTO) *models.HealthChecks {
+	if hc == nil {
+		return nil
+	}
+	out := &models.HealthChecks{}
+	if hc.Active != nil {
+		out.Active = &models.ActiveHealthCheck{
+			Path:         hc.Active.Path,
+			Interval:     hc.Active.Interval,
+			Timeout:      hc.Active.Timeout,
+			ExpectStatus: hc.Active.ExpectStatus,
+		}
+	}
+	if hc.Passive != nil {
+		out.Passive = &models.PassiveHealthCheck{
+			FailDuration:     hc.Passive.FailDuration,
+			MaxFails:         hc.Passive.MaxFails,
+			UnhealthyStatus:  hc.Passive.UnhealthyStatus,
+			UnhealthyLatency: hc.Passive.UnhealthyLatency,
+		}
+	}
+	return out
+}
+
+// toUpstreamTargetDTOs converts stored upstream targets for a response
+func toUpstreamTargetDTOs(targets []models.UpstreamTarget) []dto.UpstreamTargetDTO {
+	if len(targets) == 0 {
+		return nil
+	}
+	out := make([]dto.UpstreamTargetDTO, 0, len(targets))
+	for _, target := range targets {
+		out = append(out, dto.UpstreamTargetDTO{URL: target.URL, Weight: target.Weight})
+	}
+	return out
+}
+
+// toLoadBalancingDTO converts stored load balancing settings for a response
+func toLoadBalancingDTO(lb *models.LoadBalancing) *dto.LoadBalancingDTO {
+	if lb == nil {
+		return nil
+	}
+	return &dto.LoadBalancingDTO{Policy: lb.Policy, Retries: lb.Retries, TryDuration: lb.TryDuration}
+}
+
+// toHealthChecksDTO converts stored health checks for a response
+func toHealthChecksDTO(hc *models.HealthChecks) *dto.HealthChecksDTO {
+	if hc == nil {
+		return nil
+	}
+	out := &dto.HealthChecksDTO{}
+	if hc.Active != nil {
+		out.Active = &dto.ActiveHealthCheckDTO{
+			Path:         hc.Active.Path,
+			Interval:     hc.Active.Interval,
+			Timeout:      hc.Active.Timeout,
+			ExpectStatus: hc.Active.ExpectStatus,
+		}
+	}
+	if hc.Passive != nil {
+		out.Passive = &dto.PassiveHealthCheckDTO{
+			FailDuration:     hc.Passive.FailDuration,
+			MaxFails:         hc.Passive.MaxFails,
+			UnhealthyStatus:  hc.Passive.UnhealthyStatus,
+			UnhealthyLatency: hc.Passive.UnhealthyLatency,
+		}
+	}
+	return out
+}
+
+// validateUpstreams checks the upstream targets, load balancing and health
+// checks of an API. With several targets Upstream is set to the first one.
+// Targets share one transport and path rewrite, so they must have the same
+// scheme and path.
+func validateUpstreams(api *models.APIConfig) error {
+	if len(api.Upstreams) > 0 {
+		if api.Upstream != "" && api.Upstream != api.Upstreams[0].URL {
+			return fmt.Errorf("upstream must be omitted or equal the first of upstreams")
+		}
+		api.Upstream = api.Upstreams[0].URL
+	}
+
+	var first *url.URL
+	seen := make(map[string]bool, len(api.Upstreams))
+	for _, target := range api.Upstreams {
+		u, err := url.Parse(target.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upstream %q must be an http or https URL", target.URL)
+		}
+		if first == nil {
+			first = u
+		} else if u.Scheme != first.Scheme || strings.TrimSuffix(u.Path, "/") != strings.TrimSuffix(first.Path, "/") {
+			return fmt.Errorf("upstream %q must have the scheme and path of %q", target.URL, api.Upstream)
+		}
+		if seen[u.Host] {
+			return fmt.Errorf("upstream %q is listed twice", target.URL)
+		}
+		seen[u.Host] = true
+		if target.Weight < 0 {
+			return fmt.Errorf("weight of upstream %q must not be negative", target.URL)
+		}
+	}
+
+	if lb := api.LoadBalancing; lb != nil {
+		switch lb.Policy {
+		case "", models.LoadBalanceRoundRobin:
+		case models.LoadBalanceLeastConn, models.LoadBalanceHeaderHash:
+			if weighted(api.Upstreams) {
+				return fmt.Errorf("upstream weights require the %s policy", models.LoadBalanceRoundRobin)
+			}
+		default:
+			return fmt.Errorf("load balancing policy must be %s, %s or %s, got %q",
+				models.LoadBalanceRoundRobin, models.LoadBalanceLeastConn, models.LoadBalanceHeaderHash, lb.Policy)
+		}
+		if lb.Retries < 0 {
+			return fmt.Errorf("load balancing retries must not be negative")
+		}
+		if err := validateDuration("try_duration", lb.TryDuration); err != nil {
+			return err
+		}
+	}
+
+	if hc := api.HealthChecks; hc != nil {
+		if active := hc.Active; active != nil {
+			if !strings.HasPrefix(active.Path, "/") {
+				return fmt.Errorf("active health check path must start with /")
+			}
+			if active.ExpectStatus != 0 && (active.ExpectStatus < 100 || active.ExpectStatus > 599) {
+				return fmt.Errorf("active health check expect_status must be an HTTP status code")
+			}
+			if err := validateDuration("interval", active.Interval); err != nil {
+				return err
+			}
+			if err := validateDuration("timeout", active.Timeout); err != nil {
+				return err
+			}
+		}
+		if passive := hc.Passive; passive != nil {
+			// Caddy only counts failures for a positive fail_duration
+			if passive.FailDuration == "" {
+				return fmt.Errorf("passive health check fail_duration is required")
+			}
+			if err := validateDuration("fail_duration", passive.FailDuration); err != nil {
+				return err
+			}
+			if err := validateDuration("unhealthy_latency", passive.UnhealthyLatency); err != nil {
+				return err
+			}
+			if passive.MaxFails < 0 {
+				return fmt.Errorf("passive health check max_fails must not be negative")
+			}
+			for _, status := range passive.UnhealthyStatus {
+				if status < 100 || status > 599 {
+					return fmt.Errorf("passive health check unhealthy_status %d is not an HTTP status code", status)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateDuration checks an optional positive duration in Caddy's syntax
+func validateDuration(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	d, err := caddy.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%s must be a positive duration such as 10s, got %q", field, value)
+	}
+	return nil
+}
+
+// weighted reports whether any target has a weight other than the default
+func weighted(targets []models.UpstreamTarget) bool {
+	for _, target := range targets {
+		if target.Weight > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamsConfig renders the upstreams, load balancing and health checks of
+// an API's reverse_proxy handler as JSON object members with a trailing comma
+func (h *VeilHandler) upstreamsConfig(api models.APIConfig) (string, error) {
+	targets := api.Targets()
+	upstreams := make([]map[string]string, 0, len(targets))
+	for _, target := range targets {
+		upstreams = append(upstreams, map[string]string{"dial": h.getUpstreamDialAddress(target.URL)})
+	}
+
+	var b strings.Builder
+	add := func(name string, value interface{}) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %v", name, err)
+		}
+		fmt.Fprintf(&b, "%q: %s,", name, encoded)
+		return nil
+	}
+
+	if err := add("upstreams", upstreams); err != nil {
+		return "", err
+	}
+	if lb := h.loadBalancingConfig(api); lb != nil {
+		if err := add("load_balancing", lb); err != nil {
+			return "", err
+		}
+	}
+	// The health check settings use the names of Caddy's reverse_proxy
+	if hc := api.HealthChecks; hc != nil && (hc.Active != nil || hc.Passive != nil) {
+		if err := add("health_checks", hc); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// loadBalancingConfig returns the reverse_proxy load_balancing of an API, or
+// nil if Caddy's defaults apply. Several targets are balanced round robin
+// unless another policy is set.
+func (h *VeilHandler) loadBalancingConfig(api models.APIConfig) map[string]interface{} {
+	lb := api.LoadBalancing
+	if lb == nil {
+		lb = &models.LoadBalancing{}
+	}
+	config := make(map[string]interface{})
+
+	if len(api.Upstreams) > 1 {
+		switch lb.Policy {
+		case models.LoadBalanceLeastConn:
+			config["selection_policy"] = map[string]interface{}{"policy": "least_conn"}
+		case models.LoadBalanceHeaderHash:
+			config["selection_policy"] = map[string]interface{}{"policy": "header", "field": h.SubscriptionKey}
+		default:
+			if weighted(api.Upstreams) {
+				weights := make([]int, 0, len(api.Upstreams))
+				for _, target := range api.Upstreams {
+					weights = append(weights, max(target.Weight, 1))
+				}
+				config["selection_policy"] = map[string]interface{}{"policy": "weighted_round_robin", "weights": weights}
+			} else {
+				config["selection_policy"] = map[string]interface{}{"policy": "round_robin"}
+			}
+		}
+	}
+	if lb.Retries > 0 {
+		config["retries"] = lb.Retries
+	}
+	if lb.TryDuration != "" {
+		config["try_duration"] = lb.TryDuration
+	}
+
+	if len(config) == 0 {
+		return nil
+	}
+	return config
+}
+
+// upstreamHostHeader returns the Host header sent to the upstream: the
+// upstream's host, or the selected target's when there are several
+func (h *VeilHandler) upstreamHostHeader(api models.APIConfig) string {
+	targets := api.Targets()
+	if len(targets) == 1 {
+		return h.getUpstreamHost(targets[0].URL)
+	}
+	if strings.HasPrefix(targets[0].URL, "https://") {
+		return "{http.reverse_proxy.upstream.host}"
+	}
+	return "{http.reverse_proxy.upstream.hostport}"
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestValidateUpstreams(t *testing.T) {
+	targets := func(urls ...string) []models.UpstreamTarget {
+		out := make([]models.UpstreamTarget, 0, len(urls))
+		for _, u := range urls {
+			out = append(out, models.UpstreamTarget{URL: u})
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		api     models.APIConfig
+		wantErr string
+	}{
+		{name: "single upstream", api: models.APIConfig{Upstream: "http://localhost:8083"}},
+		{name: "several upstreams", api: models.APIConfig{
+			Upstreams:     []models.UpstreamTarget{{URL: "http://a.internal:8083/v1", Weight: 3}, {URL: "http://b.internal:8083/v1/"}},
+			LoadBalancing: &models.LoadBalancing{Retries: 2, TryDuration: "5s"},
+			HealthChecks: &models.HealthChecks{
+				Active:  &models.ActiveHealthCheck{Path: "/health", Interval: "10s", Timeout: "2s", ExpectStatus: 200},
+				Passive: &models.PassiveHealthCheck{FailDuration: "30s", MaxFails: 3, UnhealthyStatus: []int{502, 503}, UnhealthyLatency: "1s"},
+			},
+		}},
+		{name: "upstream is the first target", api: models.APIConfig{Upstream: "http://a.internal", Upstreams: targets("http://a.internal", "http://b.internal")}},
+		{name: "upstream differs from the first target", api: models.APIConfig{Upstream: "http://b.internal", Upstreams: targets("http://a.internal", "http://b.internal")},
+			wantErr: "upstream must be omitted or equal the first of upstreams"},
+		{name: "not a URL", api: models.APIConfig{Upstreams: targets("a.internal:8083")},
+			wantErr: `upstream "a.internal:8083" must be an http or https URL`},
+		{name: "mixed schemes", api: models.APIConfig{Upstreams: targets("http://a.internal", "https://b.internal")},
+			wantErr: `upstream "https://b.internal" must have the scheme and path of "http://a.internal"`},
+		{name: "different paths", api: models.APIConfig{Upstreams: targets("http://a.internal/v1", "http://b.internal/v2")},
+			wantErr: `upstream "http://b.internal/v2" must have the scheme and path of "http://a.internal/v1"`},
+		{name: "duplicate target", api: models.APIConfig{Upstreams: targets("http://a.internal", "http://a.internal/")},
+			wantErr: `upstream "http://a.internal/" is listed twice`},
+		{name: "negative weight", api: models.APIConfig{Upstreams: []models.UpstreamTarget{{URL: "http://a.internal", Weight: -1}}},
+			wantErr: `weight of upstream "http://a.internal" must not be negative`},
+		{name: "unknown policy", api: models.APIConfig{Upstream: "http://a.internal", LoadBalancing: &models.LoadBalancing{Policy: "random"}},
+			wantErr: `load balancing policy must be round_robin, least_conn or header_hash, got "random"`},
+		{name: "weights with least_conn", api: models.APIConfig{
+			Upstreams:     []models.UpstreamTarget{{URL: "http://a.internal", Weight: 2}, {URL: "http://b.internal"}},
+			LoadBalancing: &models.LoadBalancing{Policy: models.LoadBalanceLeastConn}},
+			wantErr: "upstream weights require the round_robin policy"},
+		{name: "invalid try duration", api: models.APIConfig{Upstream: "http://a.internal", LoadBalancing: &models.LoadBalancing{TryDuration: "soon"}},
+			wantErr: `try_duration must be a positive duration such as 10s, got "soon"`},
+		{name: "relative health check path", api: models.APIConfig{Upstream: "http://a.internal",
+			HealthChecks: &models.HealthChecks{Active: &models.ActiveHealthCheck{Path: "health"}}},
+			wantErr: "active health check path must start with /"},
+		{name: "invalid expected status", api: models.APIConfig{Upstream: "http://a.internal",
+			HealthChecks: &models.HealthChecks{Active: &models.ActiveHealthCheck{Path: "/health", ExpectStatus: 2000}}},
+			wantErr: "active health check expect_status must be an HTTP status code"},
+		{name: "missing fail duration", api: models.APIConfig{Upstream: "http://a.internal",
+			HealthChecks: &models.HealthChecks{Passive: &models.PassiveHealthCheck{MaxFails: 3}}},
+			wantErr: "passive health check fail_duration is required"},
+		{name: "invalid unhealthy status", api: models.APIConfig{Upstream: "http://a.internal",
+			HealthChecks: &models.HealthChecks{Passive: &models.PassiveHealthCheck{FailDuration: "30s", UnhealthyStatus: []int{5}}}},
+			wantErr: "passive health check unhealthy_status 5 is not an HTTP status code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := tt.api
+			err := validateUpstreams(&api)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, api.Targets()[0].URL, api.Upstream)
+		})
+	}
+}
+
+func TestVeilHandler_buildRoute_upstreams(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Api-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	// proxy returns the reverse_proxy handler of the route generated for api
+	proxy := func(t *testing.T, api models.APIConfig) (reverseproxy.Handler, map[string]interface{}) {
+		route, err := handler.buildRoute(api)
+		require.NoError(t, err)
+		encoded, err := json.Marshal(route)
+		require.NoError(t, err)
+		var decoded struct {
+			Handle []struct {
+				Routes []struct {
+					Handle []json.RawMessage `json:"handle"`
+				} `json:"routes"`
+			} `json:"handle"`
+		}
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		raw := decoded.Handle[0].Routes[0].Handle[1]
+
+		var rp reverseproxy.Handler
+		require.NoError(t, json.Unmarshal(raw, &rp))
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(raw, &fields))
+		return rp, fields
+	}
+	policy := func(t *testing.T, rp reverseproxy.Handler) map[string]interface{} {
+		require.NotNil(t, rp.LoadBalancing)
+		var selection map[string]interface{}
+		require.NoError(t, json.Unmarshal(rp.LoadBalancing.SelectionPolicyRaw, &selection))
+		return selection
+	}
+
+	t.Run("single upstream", func(t *testing.T) {
+		rp, fields := proxy(t, models.APIConfig{Path: "/weather/*", Upstream: "http://localhost:8083"})
+		require.Len(t, rp.Upstreams, 1)
+		assert.Equal(t, "localhost:8083", rp.Upstreams[0].Dial)
+		assert.Nil(t, rp.LoadBalancing)
+		assert.Nil(t, rp.HealthChecks)
+		assert.Equal(t, []string{"localhost:8083"}, rp.Headers.Request.Set["Host"])
+		assert.NotContains(t, fields, "load_balancing")
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		rp, _ := proxy(t, models.APIConfig{Path: "/weather/*", Upstreams: []models.UpstreamTarget{
+			{URL: "http://a.internal:8083"}, {URL: "http://b.internal:8083"},
+		}})
+		require.Len(t, rp.Upstreams, 2)
+		assert.Equal(t, "a.internal:8083", rp.Upstreams[0].Dial)
+		assert.Equal(t, "b.internal:8083", rp.Upstreams[1].Dial)
+		assert.Equal(t, map[string]interface{}{"policy": "round_robin"}, policy(t, rp))
+		assert.Equal(t, []string{"{http.reverse_proxy.upstream.hostport}"}, rp.Headers.Request.Set["Host"])
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		rp, _ := proxy(t, models.APIConfig{Path: "/weather/*", Upstreams: []models.UpstreamTarget{
+			{URL: "https://a.example.com", Weight: 3}, {URL: "https://b.example.com"},
+		}, LoadBalancing: &models.LoadBalancing{Retries: 2, TryDuration: "5s"}})
+		assert.Equal(t, map[string]interface{}{"policy": "weighted_round_robin", "weights": []interface{}{3.0, 1.0}}, policy(t, rp))
+		assert.Equal(t, 2, rp.LoadBalancing.Retries)
+		assert.Equal(t, caddy.Duration(5e9), rp.LoadBalancing.TryDuration)
+		assert.Equal(t, "a.example.com:443", rp.Upstreams[0].Dial)
+		assert.Equal(t, []string{"{http.reverse_proxy.upstream.host}"}, rp.Headers.Request.Set["Host"])
+	})
+
+	t.Run("least connections and header hash", func(t *testing.T) {
+		targets := []models.UpstreamTarget{{URL: "http://a.internal"}, {URL: "http://b.internal"}}
+		rp, _ := proxy(t, models.APIConfig{Path: "/weather/*", Upstreams: targets,
+			LoadBalancing: &models.LoadBalancing{Policy: models.LoadBalanceLeastConn}})
+		assert.Equal(t, map[string]interface{}{"policy": "least_conn"}, policy(t, rp))
+
+		rp, _ = proxy(t, models.APIConfig{Path: "/weather/*", Upstreams: targets,
+			LoadBalancing: &models.LoadBalancing{Policy: models.LoadBalanceHeaderHash}})
+		assert.Equal(t, map[string]interface{}{"policy": "header", "field": "X-Api-Key"}, policy(t, rp))
+	})
+
+	t.Run("health checks", func(t *testing.T) {
+		rp, _ := proxy(t, models.APIConfig{Path: "/weather/*", Upstream: "http://localhost:8083",
+			HealthChecks: &models.HealthChecks{
+				Active:  &models.ActiveHealthCheck{Path: "/health", Interval: "10s", Timeout: "2s", ExpectStatus: 200},
+				Passive: &models.PassiveHealthCheck{FailDuration: "30s", MaxFails: 3, UnhealthyStatus: []int{502, 503}, UnhealthyLatency: "1s"},
+			}})
+		require.NotNil(t, rp.HealthChecks)
+		require.NotNil(t, rp.HealthChecks.Active)
+		assert.Equal(t, "/health", rp.HealthChecks.Active.Path)
+		assert.Equal(t, caddy.Duration(10e9), rp.HealthChecks.Active.Interval)
+		assert.Equal(t, caddy.Duration(2e9), rp.HealthChecks.Active.Timeout)
+		assert.Equal(t, 200, rp.HealthChecks.Active.ExpectStatus)
+		require.NotNil(t, rp.HealthChecks.Passive)
+		assert.Equal(t, caddy.Duration(30e9), rp.HealthChecks.Passive.FailDuration)
+		assert.Equal(t, 3, rp.HealthChecks.Passive.MaxFails)
+		assert.Equal(t, []int{502, 503}, rp.HealthChecks.Passive.UnhealthyStatus)
+		assert.Equal(t, caddy.Duration(1e9), rp.HealthChecks.Passive.UnhealthyLatency)
+	})
+}
+
+func TestVeilHandler_handleOnboard_invalidUpstreams(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	require.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	body := `{
+		"path": "/weather/*",
+		"methods": ["GET"],
+		"upstreams": [{"url": "http://a.internal"}, {"url": "https://b.internal"}]
+	}`
+	w := httptest.NewRecorder()
+	require.NoError(t, handler.handleManagementAPI(w, httptest.NewRequest(http.MethodPost, "/veil/api/routes", strings.NewReader(body))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "must have the scheme and path")
+
+	api, err := handler.store.GetAPIByPath("/weather/x")
+	require.NoError(t, err)
+	assert.Nil(t, api)
+}
@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,39 +16,64 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
 	"github.com/try-veil/veil/packages/caddy/internal/config"
 	"github.com/try-veil/veil/packages/caddy/internal/dto"
 	"github.com/try-veil/veil/packages/caddy/internal/events"
 	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"github.com/try-veil/veil/packages/caddy/internal/ratelimit"
 	"github.com/try-veil/veil/packages/caddy/internal/store"
 
 	"github.com/google/uuid"
-	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
 // VeilHandler implements an HTTP handler that validates API subscriptions
 type VeilHandler struct {
-	DBPath          string             `json:"db_path,omitempty"`
-	SubscriptionKey string             `json:"subscription_key,omitempty"`
-	EventsEndpoint  string             `json:"events_endpoint,omitempty"`
-	Config          *config.VeilConfig `json:"-"`
-	store           *store.APIStore
-	eventQueue      events.UsageEventQueue
-	natsConn        *nats.Conn
-	logger          *zap.Logger
-	ctx             caddy.Context
+	DBPath            string             `json:"db_path,omitempty"`
+	SubscriptionKey   string             `json:"subscription_key,omitempty"`
+	SubscriptionQuery string             `json:"subscription_query,omitempty"`
+	EventsEndpoint    string             `json:"events_endpoint,omitempty"`
+	Events            *events.Config     `json:"events,omitempty"`
+	NATS              *NATSConfig        `json:"nats,omitempty"`
+	KeyPepper         string             `json:"key_pepper,omitempty"`
+	SecretKey         string             `json:"secret_key,omitempty"`
+	IdentitySecret    string             `json:"identity_secret,omitempty"`
+	RateLimit         *models.RateLimit  `json:"rate_limit,omitempty"`
+	Tracing           *TracingConfig     `json:"tracing,omitempty"`
+	Admin             *auth.AdminConfig  `json:"admin,omitempty"`
+	ReconcileInterval caddy.Duration     `json:"reconcile_interval,omitempty"`
+	AdminAddress      string             `json:"admin_address,omitempty"`
+	RouteServer       string             `json:"route_server,omitempty"`
+	RouteListen       []string           `json:"route_listen,omitempty"`
+	InheritSecrets    bool               `json:"inherit_secrets,omitempty"`
+	Config            *config.VeilConfig `json:"-"`
+	settings          json.RawMessage
+	store             *store.APIStore
+	adminAuth         []auth.Authenticator
+	limiter           *ratelimit.Limiter
+	reconciler        *routeReconciler
+	eventQueue        events.UsageEventQueue
+	eventQueueKey     string
+	nats              *natsClient
+	tracer            trace.Tracer
+	tracingProvider   *tracingProvider
+	logger            *zap.Logger
+	ctx               caddy.Context
 }
 
-// KeySyncEvent represents a key status synchronization event from platform-api
-// This matches the event structure published by the credit worker
-type KeySyncEvent struct {
-	KeyValue  string `json:"key_value"`
-	IsActive  bool   `json:"is_active"`
-	Timestamp string `json:"timestamp"`
-	Reason    string `json:"reason"`
-}
+const (
+	// defaultRouteServer and defaultRouteListen identify the server onboarded
+	// API routes are added to when route_server and route_listen are not set
+	defaultRouteServer = "srv1"
+	defaultRouteListen = ":2021"
+
+	// adminRequestTimeout bounds requests to the Caddy admin endpoint
+	adminRequestTimeout = 10 * time.Second
+)
 
 // CaddyModule returns the Caddy module information.
 func (VeilHandler) CaddyModule() caddy.ModuleInfo {
@@ -56,41 +83,6 @@ func (VeilHandler) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
-func (h *VeilHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	// The directive name is already consumed when UnmarshalCaddyfile is called,
-	// but we use a for loop with d.Next() to handle multiple occurrences
-	for d.Next() {
-		// Get all arguments
-		args := d.RemainingArgs()
-
-		// Need at least 2 arguments: db_path and subscription_key
-		if len(args) < 2 {
-			return d.Errf("expected at least 2 arguments (db_path, subscription_key), got %d", len(args))
-		}
-
-		h.DBPath = args[0]
-		h.SubscriptionKey = args[1]
-
-		// Optional third argument for events endpoint
-		if len(args) >= 3 {
-			h.EventsEndpoint = args[2]
-		}
-
-		// Ensure no extra arguments beyond the first 3
-		if len(args) > 3 {
-			return d.Errf("expected at most 3 arguments, got %d", len(args))
-		}
-
-		// Reject any block configuration as this directive doesn't support it
-		for d.NextBlock(d.Nesting()) {
-			return d.Err("veil_handler directive does not support block configuration")
-		}
-	}
-
-	return nil
-}
-
 func (h *VeilHandler) Start() error {
 	h.logger = h.ctx.Logger().Named("veil_handler")
 	return nil
@@ -101,6 +93,25 @@ func (h *VeilHandler) Provision(ctx caddy.Context) error {
 	h.logger = ctx.Logger().Named("veil_handler")
 	h.ctx = ctx
 
+	// Keep the settings as configured, before defaults and environment
+	// variables are applied, for the handlers of generated routes
+	settings, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode handler settings: %v", err)
+	}
+	h.settings = settings
+
+	if h.RouteServer == "" {
+		h.RouteServer = defaultRouteServer
+	}
+	if len(h.RouteListen) == 0 {
+		h.RouteListen = []string{defaultRouteListen}
+	}
+
+	if h.InheritSecrets {
+		h.inheritSecrets()
+	}
+
 	// Initialize config
 	h.Config = &config.VeilConfig{
 		DBPath: h.DBPath,
@@ -112,150 +123,156 @@ func (h *VeilHandler) Provision(ctx caddy.Context) error {
 
 	h.store = store.NewAPIStore(h.Config.GetDB())
 
+	// API keys are stored as peppered digests; the pepper must be stable across restarts
+	if h.KeyPepper == "" {
+		h.KeyPepper = os.Getenv("VEIL_KEY_PEPPER")
+	}
+	if h.KeyPepper == "" {
+		h.logger.Warn("no key pepper configured (set key_pepper or VEIL_KEY_PEPPER), API keys are hashed without a secret")
+	}
+	h.store.SetKeyPepper(h.KeyPepper)
+
+	// Upstream certificates are encrypted at rest with the secret key
+	if h.SecretKey == "" {
+		h.SecretKey = os.Getenv("VEIL_SECRET_KEY")
+	}
+	if err := h.store.SetSecretKey(h.SecretKey); err != nil {
+		return fmt.Errorf("failed to set up secret key: %v", err)
+	}
+
+	// Identity headers sent upstream are signed with the identity secret
+	if h.IdentitySecret == "" {
+		h.IdentitySecret = os.Getenv("VEIL_IDENTITY_SECRET")
+	}
+	if h.IdentitySecret == "" {
+		h.logger.Warn("no identity secret configured (set identity_secret or VEIL_IDENTITY_SECRET), identity headers are sent unsigned")
+	}
+	if !h.InheritSecrets {
+		h.registerSecrets()
+	}
+
 	// Run database migrations
 	if err := h.store.AutoMigrate(); err != nil {
 		return fmt.Errorf("failed to run database migrations: %v", err)
 	}
 
-	// Check if event streaming is enabled via environment variable
-	enableEventStreaming := os.Getenv("ENABLE_EVENT_STREAMING")
-	if enableEventStreaming == "true" || enableEventStreaming == "1" {
-		// Determine which event queue implementation to use
-		if h.EventsEndpoint != "" {
-			// Use HTTP event queue if endpoint is explicitly configured
-			h.eventQueue = events.NewHTTPEventQueue(h.EventsEndpoint, h.logger)
-			h.logger.Info("initializing HTTP event queue",
-				zap.String("endpoint", h.EventsEndpoint))
-		} else {
-			// Use slog-based event queue (RFC recommended pattern)
-			h.eventQueue = events.NewSlogEventQueue(h.logger)
-			h.logger.Info("initializing structured logging event queue (stdout)")
-		}
+	// Share rate limiter state with other handlers on the same database and
+	// default rate limit
+	if err := h.provisionRateLimiter(); err != nil {
+		return err
+	}
 
-		// Start the event queue - errors are non-fatal
-		if err := h.eventQueue.Start(); err != nil {
-			h.logger.Warn("failed to start event queue, disabling event streaming",
-				zap.Error(err))
-			h.eventQueue = nil
+	// Let the upstream transports of generated routes load certificates
+	h.provisionUpstreamTLS()
+
+	// Rebuild onboarded routes from the database, which survives restarts while
+	// the running config does not. Handlers provisioned outside a Caddy config
+	// load have no admin endpoint to reconcile against.
+	if ctx.Context != nil {
+		if err := h.provisionReconciler(); err != nil {
+			return err
 		}
-	} else {
-		h.logger.Info("event streaming disabled (set ENABLE_EVENT_STREAMING=true to enable)")
-		h.eventQueue = nil
 	}
 
-	// Initialize NATS connection for credit consumption tracking
-	enableNatsEvents := os.Getenv("ENABLE_NATS_EVENTS")
-	if enableNatsEvents == "true" || enableNatsEvents == "1" {
-		natsURL := os.Getenv("NATS_URL")
-		if natsURL == "" {
-			natsURL = "nats://localhost:4222" // Default NATS URL
-		}
+	h.provisionEventQueue()
 
-		nc, err := nats.Connect(natsURL)
-		if err != nil {
-			h.logger.Warn("failed to connect to NATS, credit consumption tracking disabled",
-				zap.Error(err),
-				zap.String("nats_url", natsURL))
-			h.natsConn = nil
-		} else {
-			h.natsConn = nc
-			h.logger.Info("NATS connection established for credit consumption tracking",
-				zap.String("nats_url", natsURL),
-				zap.String("status", nc.Status().String()))
+	// NATS is configured by the nats block, falling back to ENABLE_NATS_EVENTS
+	// and NATS_URL for handlers without one
+	if h.NATS == nil && envEnabled("ENABLE_NATS_EVENTS") {
+		h.NATS = &NATSConfig{URL: os.Getenv("NATS_URL")}
+	}
+	if h.NATS != nil && !h.NATS.Disabled {
+		h.NATS = h.NATS.withDefaults()
 
-			// Start key sync subscriber to receive status updates from platform-api
-			go h.subscribeToKeySyncEvents()
+		// Connect for credit consumption tracking and key status sync. An
+		// unreachable server is retried in the background.
+		if err := h.provisionNATS(); err != nil {
+			h.logger.Warn("failed to set up NATS, credit consumption tracking disabled",
+				zap.Error(err),
+				zap.String("nats_url", h.NATS.URL))
+			h.nats = nil
 		}
 	} else {
-		h.logger.Info("NATS credit tracking disabled (set ENABLE_NATS_EVENTS=true to enable)")
-		h.natsConn = nil
+		h.logger.Info("NATS credit tracking disabled (add a nats block or set ENABLE_NATS_EVENTS=true to enable)")
+		h.nats = nil
+	}
+
+	if err := h.provisionTracing(); err != nil {
+		return fmt.Errorf("failed to set up tracing: %v", err)
+	}
+
+	// Build the management API authenticator chain
+	switch {
+	case h.Admin.Enabled():
+		h.adminAuth = h.Admin.Authenticators()
+	case h.Admin.Open():
+		h.logger.Warn("management API is open to anyone who can reach it (admin insecure_open) - use only for local development")
+	default:
+		h.logger.Warn("management API denies every call - configure admin credentials to use /veil/api/")
 	}
 
 	h.logger.Info("VeilHandler provisioned successfully",
 		zap.String("db_path", h.DBPath),
 		zap.Bool("event_streaming_enabled", h.eventQueue != nil),
-		zap.Bool("nats_enabled", h.natsConn != nil))
+		zap.Bool("nats_enabled", h.nats != nil),
+		zap.Bool("tracing_enabled", h.tracingProvider != nil),
+		zap.Bool("key_query_enabled", h.SubscriptionQuery != ""),
+		zap.Bool("admin_auth_enabled", h.Admin.Enabled()))
 
 	return nil
 }
 
-// Stop implements caddy.App.
-func (h *VeilHandler) Stop() error {
-	if h.eventQueue != nil {
-		if err := h.eventQueue.Stop(); err != nil {
-			h.logger.Error("failed to stop event queue", zap.Error(err))
+// Cleanup implements caddy.CleanerUpper. It detaches the store from route
+// index refreshes and releases shared rate limiter and reconciler state once
+// the handler is unloaded by a config reload. Its event queue is stopped, or
+// released if it is a shared disk queue, and its NATS connection and tracer
+// provider released.
+func (h *VeilHandler) Cleanup() error {
+	if h.store != nil {
+		h.store.Close()
+	}
+	if h.limiter != nil {
+		if _, err := rateLimiters.Delete(h.rateLimiterKey()); err != nil {
+			h.logger.Error("failed to release rate limiter", zap.Error(err))
 		}
 	}
-	if h.natsConn != nil {
-		h.natsConn.Close()
-		h.logger.Info("NATS connection closed")
-	}
+	h.releaseReconciler()
+	h.releaseUpstreamTLS()
+	h.releaseEventQueue()
+	h.releaseNATS()
+	h.releaseTracing()
 	return nil
 }
 
-// subscribeToKeySyncEvents subscribes to key.sync events and updates API key status in the database
-// This allows platform-api to synchronize key status changes (like quota exhaustion) to Caddy's cache
-func (h *VeilHandler) subscribeToKeySyncEvents() {
-	if h.natsConn == nil {
-		h.logger.Error("cannot subscribe to key sync events - no NATS connection")
-		return
-	}
-
-	h.logger.Info("subscribing to key sync events on topic 'key.sync'")
-
-	// Subscribe to key.sync topic
-	sub, err := h.natsConn.Subscribe("key.sync", func(msg *nats.Msg) {
-		// Decode the sync event
-		var syncEvent KeySyncEvent
-		if err := json.Unmarshal(msg.Data, &syncEvent); err != nil {
-			h.logger.Error("failed to decode key sync event",
-				zap.Error(err),
-				zap.String("data", string(msg.Data)))
-			return
-		}
-
-		h.logger.Info("received key sync event",
-			zap.String("key", syncEvent.KeyValue[:min(15, len(syncEvent.KeyValue))]+"..."),
-			zap.Bool("is_active", syncEvent.IsActive),
-			zap.String("reason", syncEvent.Reason),
-			zap.String("timestamp", syncEvent.Timestamp))
-
-		// Update key status in database
-		if err := h.store.UpdateKeyStatusByValue(syncEvent.KeyValue, syncEvent.IsActive); err != nil {
-			h.logger.Error("failed to update key status from sync event",
-				zap.Error(err),
-				zap.String("key", syncEvent.KeyValue[:min(15, len(syncEvent.KeyValue))]+"..."),
-				zap.Bool("is_active", syncEvent.IsActive))
-		} else {
-			h.logger.Info("successfully synchronized key status from platform-api",
-				zap.String("key", syncEvent.KeyValue[:min(15, len(syncEvent.KeyValue))]+"..."),
-				zap.Bool("is_active", syncEvent.IsActive),
-				zap.String("reason", syncEvent.Reason))
-		}
-	})
-
-	if err != nil {
-		h.logger.Error("failed to subscribe to key sync events",
-			zap.Error(err))
-		return
-	}
-
-	h.logger.Info("successfully subscribed to key sync events",
-		zap.String("subject", sub.Subject))
+// Stop implements caddy.App.
+func (h *VeilHandler) Stop() error {
+	h.releaseEventQueue()
+	h.releaseNATS()
+	h.releaseTracing()
+	return nil
 }
 
+// ErrNoAPIKey is returned when the request carries no API key
+var ErrNoAPIKey = fmt.Errorf("no API key provided")
+
 // ErrKeyInactive is returned when an API key is found but is inactive (exhausted quota)
 var ErrKeyInactive = fmt.Errorf("API key is inactive due to exhausted quota")
 
+// ErrKeyExpired is returned when an API key is found but its expiry has passed
+var ErrKeyExpired = fmt.Errorf("API key has expired")
+
 // validateAPIKey checks if the provided API key is valid for the given path
-func (h *VeilHandler) validateAPIKey(path string, apiKey string) (*models.APIConfig, error) {
+func (h *VeilHandler) validateAPIKey(ctx context.Context, path string, apiKey string) (api *models.APIConfig, err error) {
+	ctx, span := h.tracer.Start(ctx, "veil.validate_api_key")
+	defer func() { endSpan(span, err) }()
+
 	if apiKey == "" {
-		return nil, fmt.Errorf("no API key provided")
+		return nil, ErrNoAPIKey
 	}
 
-	api, err := h.store.GetAPIByPath(path)
+	api, key, err := h.lookupAPIKey(ctx, path, apiKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get API config: %v", err)
+		return nil, err
 	}
 
 	// Check if API exists and is active
@@ -263,96 +280,73 @@ func (h *VeilHandler) validateAPIKey(path string, apiKey string) (*models.APICon
 		return nil, fmt.Errorf("API not found for path: %s", path)
 	}
 
-	// Validate API key and check if it's active
-	keyFound := false
-	keyActive := false
-	for _, key := range api.APIKeys {
-		if key.Key == apiKey {
-			keyFound = true
-			if key.IsActive != nil && *key.IsActive {
-				keyActive = true
-			}
-			break
-		}
-	}
-
-	if !keyFound {
+	if key == nil {
 		return nil, fmt.Errorf("invalid API key")
 	}
 
-	if !keyActive {
+	if key.IsActive == nil || !*key.IsActive {
 		return nil, ErrKeyInactive
 	}
 
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, ErrKeyExpired
+	}
+
 	return api, nil
 }
 
-// updateCaddyfile updates the Caddy configuration with new API routes
-func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
-	// Get current configuration
-	currentConfig, err := h.getCurrentConfig()
+// lookupAPIKey finds the API serving path and the given key in the store
+func (h *VeilHandler) lookupAPIKey(ctx context.Context, path string, apiKey string) (*models.APIConfig, *models.APIKey, error) {
+	_, span := h.tracer.Start(ctx, "veil.store.lookup")
+	defer span.End()
+
+	api, err := h.store.GetAPIByPath(path)
 	if err != nil {
-		h.logger.Error("failed to get current config",
-			zap.Error(err))
-		return fmt.Errorf("failed to get current config: %v", err)
+		return nil, nil, fmt.Errorf("failed to get API config: %v", err)
 	}
+	if api == nil {
+		return nil, nil, nil
+	}
+	span.SetAttributes(attribute.String("veil.api_path", api.Path))
 
-	// Parse upstream URL to get scheme
-	upstreamURL, err := url.Parse(api.Upstream)
+	// Validate API key against the in-memory key index
+	key, err := h.store.FindAPIKey(api, apiKey)
 	if err != nil {
-		h.logger.Error("failed to parse upstream URL",
-			zap.Error(err))
-		return fmt.Errorf("failed to parse upstream URL: %v", err)
+		return nil, nil, fmt.Errorf("failed to look up API key: %v", err)
 	}
+	return api, key, nil
+}
 
-	// Create transport config based on scheme
-	var transportConfig string
-	if upstreamURL.Scheme == "https" {
-		transportConfig = `"transport": {
-			"protocol": "http",
-			"tls": {
-				"insecure_skip_verify": true
-			}
-		},`
-	} else {
-		transportConfig = `"transport": {
-			"protocol": "http"
-		},`
+// updateCaddyfile updates the Caddy configuration with new API routes
+func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
+	newRoute, err := h.buildRoute(api)
+	if err != nil {
+		return err
 	}
 
-	// Create a rewrite configuration to strip the API path prefix
-	// Remove any wildcards from the path for the rewrite pattern
-	apiPathForRewrite := strings.TrimSuffix(strings.TrimSuffix(api.Path, "*"), "/")
-
-	// Extract the upstream path from the upstream URL
-	upstreamPath := "/"
-	if parsedUpstream, err := url.Parse(api.Upstream); err == nil && parsedUpstream.Path != "" {
-		upstreamPath = parsedUpstream.Path
+	err = h.modifyRoutes(func(routes []interface{}) []interface{} {
+		// Replace the route of the same path if it already exists
+		for i, route := range routes {
+			if path, ok := routePath(route); ok && path == strings.TrimSuffix(api.Path, "*") {
+				routes[i] = newRoute
+				return routes
+			}
+		}
+		return append(routes, newRoute)
+	})
+	if err != nil {
+		return err
 	}
 
-	h.logger.Debug("generating rewrite pattern",
-		zap.String("original_path", api.Path),
-		zap.String("rewrite_path", apiPathForRewrite),
-		zap.String("upstream_path", upstreamPath))
-
-	// Create a rewrite rule that strips the API ID prefix and replaces with upstream path
-	// The regex captures everything after the API ID prefix
-	// IMPORTANT: Use $1 (not ${1}) for regex backreference - Caddy's path_regexp expects this format
-	replacePath := upstreamPath + "$1"
-	rewriteConfig := fmt.Sprintf(`"rewrite": {
-		"method": "GET",
-		"path_regexp": [
-			{
-				"find": "^%s(.*)",
-				"replace": "%s"
-			}
-		]
-	},`, apiPathForRewrite, replacePath)
+	h.logger.Info("successfully updated Caddy configuration",
+		zap.String("path", api.Path),
+		zap.String("upstream", api.Upstream))
 
-	h.logger.Debug("generated rewrite config",
-		zap.String("replace_path", replacePath),
-		zap.String("rewrite_config", rewriteConfig))
+	return nil
+}
 
+// buildRoute generates the route that validates and proxies an onboarded API
+func (h *VeilHandler) buildRoute(api models.APIConfig) (map[string]interface{}, error) {
 	// Get the list of methods from the API config
 	methodsList := []string{}
 	for _, method := range api.Methods {
@@ -378,8 +372,25 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 
 	h.logger.Debug("configuring path patterns",
 		zap.String("original_path", api.Path),
-		zap.String("matching_path", apiPathForMatching),
-		zap.String("rewrite_path", apiPathForRewrite))
+		zap.String("matching_path", apiPathForMatching))
+
+	// The route's veil_handler carries the settings this handler was configured with
+	handlerConfig, err := h.routeHandlerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The reverse_proxy handler, choosing between the stable upstreams and
+	// the canary if the API has one
+	proxyConfig, err := h.reverseProxyConfig(api)
+	if err != nil {
+		return nil, err
+	}
+	if api.Canary != nil {
+		if proxyConfig, err = h.canaryProxyConfig(api, proxyConfig); err != nil {
+			return nil, err
+		}
+	}
 
 	// Create the new route JSON
 	newRouteJSON := fmt.Sprintf(`{
@@ -395,31 +406,15 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 				"routes": [
 					{
 						"handle": [
-							{
-								"handler": "veil_handler",
-								"db_path": "./veil.db",
-								"subscription_key": "X-Subscription-Key"
-							},
-							{
-								"handler": "reverse_proxy",
-								%s
-								%s
-								"upstreams": [{"dial": "%s"}],
-								"headers": {
-									"request": {
-										"set": {
-											"Host": ["%s"]
-										}
-									}
-								}
-							}
+							%s,
+							%s
 						]
 					}
 				]
 			}
 		],
 		"terminal": true
-	}`, methodsJSON, apiPathForMatching, transportConfig, rewriteConfig, h.getUpstreamDialAddress(api.Upstream), h.getUpstreamHost(api.Upstream))
+	}`, methodsJSON, apiPathForMatching, handlerConfig, proxyConfig)
 
 	h.logger.Debug("generated route JSON before unmarshal",
 		zap.String("newRouteJSON", newRouteJSON))
@@ -428,7 +423,138 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 	if err := json.Unmarshal([]byte(newRouteJSON), &newRoute); err != nil {
 		h.logger.Error("failed to unmarshal new route",
 			zap.Error(err))
-		return fmt.Errorf("failed to unmarshal new route: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal new route: %v", err)
+	}
+
+	return newRoute, nil
+}
+
+// reverseProxyConfig generates the reverse_proxy handler JSON that proxies
+// requests to the upstreams of an API
+func (h *VeilHandler) reverseProxyConfig(api models.APIConfig) (string, error) {
+	// Verify https upstreams with the API's TLS settings
+	transportConfig, err := h.transportConfig(api)
+	if err != nil {
+		return "", err
+	}
+
+	// Create a rewrite configuration to strip the API path prefix
+	// Remove any wildcards from the path for the rewrite pattern
+	apiPathForRewrite := strings.TrimSuffix(strings.TrimSuffix(api.Path, "*"), "/")
+
+	// Extract the upstream path from the upstream URL
+	upstreamPath := "/"
+	if parsedUpstream, err := url.Parse(api.Upstream); err == nil && parsedUpstream.Path != "" {
+		upstreamPath = parsedUpstream.Path
+	}
+
+	h.logger.Debug("generating rewrite pattern",
+		zap.String("original_path", api.Path),
+		zap.String("rewrite_path", apiPathForRewrite),
+		zap.String("upstream_path", upstreamPath))
+
+	// Create a rewrite rule that strips the API ID prefix and replaces with upstream path
+	// The regex captures everything after the API ID prefix
+	// IMPORTANT: Use $1 (not ${1}) for regex backreference - Caddy's path_regexp expects this format
+	replacePath := upstreamPath + "$1"
+	rewriteConfig := fmt.Sprintf(`"rewrite": {
+		"path_regexp": [
+			{
+				"find": "^%s(.*)",
+				"replace": "%s"
+			}
+		]
+	},`, apiPathForRewrite, replacePath)
+
+	h.logger.Debug("generated rewrite config",
+		zap.String("replace_path", replacePath),
+		zap.String("rewrite_config", rewriteConfig))
+
+	// Upstream targets with their load balancing and health checks
+	upstreamsConfig, err := h.upstreamsConfig(api)
+	if err != nil {
+		return "", err
+	}
+
+	// The caller's subscription key is not forwarded. Header operations run
+	// after the upstream is selected, so header_hash balancing still sees it.
+	requestHeaders := map[string]interface{}{
+		"set": map[string][]string{"Host": {h.upstreamHostHeader(api)}},
+	}
+	if h.SubscriptionKey != "" {
+		requestHeaders["delete"] = []string{h.SubscriptionKey}
+	}
+	headersConfig, err := json.Marshal(map[string]interface{}{"request": requestHeaders})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode headers: %v", err)
+	}
+
+	return fmt.Sprintf(`{
+		"handler": "reverse_proxy",
+		%s
+		%s
+		%s
+		"headers": %s
+	}`, transportConfig, rewriteConfig, upstreamsConfig, headersConfig), nil
+}
+
+// routeHandlerConfig returns the veil_handler JSON of generated routes, which
+// inherit the settings of the handler that generates them. Secrets are left
+// out and taken from the generating handler when the route is provisioned.
+func (h *VeilHandler) routeHandlerConfig() (string, error) {
+	settings := h.settings
+	if settings == nil {
+		var err error
+		if settings, err = json.Marshal(h); err != nil {
+			return "", fmt.Errorf("failed to encode handler settings: %v", err)
+		}
+	}
+
+	var handler map[string]interface{}
+	if err := json.Unmarshal(settings, &handler); err != nil {
+		return "", fmt.Errorf("failed to decode handler settings: %v", err)
+	}
+	handler["handler"] = "veil_handler"
+	stripSecrets(handler)
+	handler["inherit_secrets"] = true
+
+	handlerJSON, err := json.Marshal(handler)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode route handler: %v", err)
+	}
+	return string(handlerJSON), nil
+}
+
+// routeTable is the route server's route list in the running config, kept
+// together with the full config so it can be loaded back
+type routeTable struct {
+	config map[string]interface{}
+	server map[string]interface{}
+	routes []interface{}
+}
+
+// modifyRoutes applies fn to the route server's route list in the running
+// config, then loads and saves the result
+func (h *VeilHandler) modifyRoutes(fn func(routes []interface{}) []interface{}) error {
+	routeUpdateMu.Lock()
+	defer routeUpdateMu.Unlock()
+
+	table, err := h.loadRouteTable()
+	if err != nil {
+		return err
+	}
+	table.routes = fn(table.routes)
+	return h.saveRouteTable(table)
+}
+
+// loadRouteTable reads the route server's routes from the running config
+func (h *VeilHandler) loadRouteTable() (*routeTable, error) {
+	// Get current configuration
+	currentConfig, err := h.getCurrentConfig()
+	if err != nil {
+		h.logger.Error("failed to get current config",
+			zap.Error(err))
+		return nil, fmt.Errorf("failed to get current config: %v", err)
 	}
 
 	// Get the current config as a map
@@ -437,98 +563,58 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 	if err != nil {
 		h.logger.Error("failed to marshal current config",
 			zap.Error(err))
-		return fmt.Errorf("failed to marshal current config: %v", err)
+		return nil, fmt.Errorf("failed to marshal current config: %v", err)
 	}
 
 	if err := json.Unmarshal(configBytes, &currentConfigMap); err != nil {
 		h.logger.Error("failed to unmarshal current config",
 			zap.Error(err))
-		return fmt.Errorf("failed to unmarshal current config: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal current config: %v", err)
 	}
 
 	// Get the apps section
 	apps, ok := currentConfigMap["apps"].(map[string]interface{})
 	if !ok {
 		h.logger.Error("apps section not found in config")
-		return fmt.Errorf("apps section not found in config")
+		return nil, fmt.Errorf("apps section not found in config")
 	}
 
 	// Get the http app
 	httpApp, ok := apps["http"].(map[string]interface{})
 	if !ok {
 		h.logger.Error("http app not found in config")
-		return fmt.Errorf("http app not found in config")
+		return nil, fmt.Errorf("http app not found in config")
 	}
 
 	// Get the servers section
 	servers, ok := httpApp["servers"].(map[string]interface{})
 	if !ok {
 		h.logger.Error("servers section not found in config")
-		return fmt.Errorf("servers section not found in config")
+		return nil, fmt.Errorf("servers section not found in config")
 	}
 
-	// Get srv1 (onboarded APIs server on port 2021)
-	srv1, ok := servers["srv1"].(map[string]interface{})
+	// Get the server onboarded APIs are routed on
+	server, ok := servers[h.RouteServer].(map[string]interface{})
 	if !ok {
-		h.logger.Error("srv1 not found in config")
-		return fmt.Errorf("srv1 not found in config")
+		h.logger.Error("route server not found in config",
+			zap.String("server", h.RouteServer))
+		return nil, fmt.Errorf("server %q not found in config", h.RouteServer)
 	}
 
 	// Get the routes array
-	routes, ok := srv1["routes"].([]interface{})
+	routes, ok := server["routes"].([]interface{})
 	if !ok {
 		routes = make([]interface{}, 0)
 	}
 
-	// Find if a route with the same path already exists
-	routeExists := false
-	for i, route := range routes {
-		routeMap, ok := route.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		matchers, ok := routeMap["match"].([]interface{})
-		if !ok || len(matchers) == 0 {
-			continue
-		}
-
-		matcher, ok := matchers[0].(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		paths, ok := matcher["path"].([]interface{})
-		if !ok || len(paths) == 0 {
-			continue
-		}
-
-		// Check if path with or without wildcard exists
-		if path, ok := paths[0].(string); ok {
-			// Strip wildcard for comparison
-			pathWithoutWildcard := strings.TrimSuffix(path, "*")
-			apiPathWithoutWildcard := strings.TrimSuffix(api.Path, "*")
-
-			if pathWithoutWildcard == apiPathWithoutWildcard {
-				// Replace the existing route
-				routes[i] = newRoute
-				routeExists = true
-				break
-			}
-		}
-	}
-
-	// If route doesn't exist, append it
-	if !routeExists {
-		routes = append(routes, newRoute)
-	}
+	return &routeTable{config: currentConfigMap, server: server, routes: routes}, nil
+}
 
-	// Update the routes in the config
-	srv1["routes"] = routes
-	servers["srv1"] = srv1
-	httpApp["servers"] = servers
-	apps["http"] = httpApp
-	currentConfigMap["apps"] = apps
+// saveRouteTable loads the config with the table's routes and saves a copy of it
+func (h *VeilHandler) saveRouteTable(table *routeTable) error {
+	// Update the routes in the config; the server map is shared with the config map
+	table.server["routes"] = table.routes
+	currentConfigMap := table.config
 
 	// Convert the updated config back to JSON
 	updatedConfig, err := json.Marshal(currentConfigMap)
@@ -555,10 +641,6 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	h.logger.Info("successfully updated Caddy configuration",
-		zap.String("path", api.Path),
-		zap.String("upstream", api.Upstream))
-
 	// Save the updated config to a file
 	if err := h.saveCaddyfile(currentConfigMap); err != nil {
 		h.logger.Error("failed to save updated config",
@@ -569,14 +651,20 @@ func (h *VeilHandler) updateCaddyfile(api models.APIConfig) error {
 	return nil
 }
 
-// getCurrentConfig retrieves the current Caddy config
+// getCurrentConfig retrieves the current Caddy config from the admin endpoint
+// and makes sure the route server exists
 func (h *VeilHandler) getCurrentConfig() (*caddy.Config, error) {
-	resp, err := http.Get("http://localhost:2019/config/")
+	client, configURL := h.adminClient()
+	resp, err := client.Get(configURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get current config: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get current config: admin endpoint returned %s", resp.Status)
+	}
+
 	var config caddy.Config
 	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
 		return nil, fmt.Errorf("failed to decode current config: %v", err)
@@ -587,39 +675,36 @@ func (h *VeilHandler) getCurrentConfig() (*caddy.Config, error) {
 		config.AppsRaw = make(map[string]json.RawMessage)
 	}
 
-	// Get or create HTTP app
-	var httpApp struct {
-		Servers map[string]*caddyhttp.Server `json:"servers"`
-	}
-
+	// Get or create HTTP app, keeping its settings other than servers
+	httpApp := make(map[string]json.RawMessage)
 	if rawApp, ok := config.AppsRaw["http"]; ok {
 		if err := json.Unmarshal(rawApp, &httpApp); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal HTTP app: %v", err)
 		}
 	}
 
-	// Initialize servers if not present
-	if httpApp.Servers == nil {
-		httpApp.Servers = make(map[string]*caddyhttp.Server)
-	}
-
-	// Get or create management API server (srv0) - Port 2020
-	if _, ok := httpApp.Servers["srv0"]; !ok {
-		httpApp.Servers["srv0"] = &caddyhttp.Server{
-			Listen: []string{":2020"},
-			Routes: []caddyhttp.Route{},
+	servers := make(map[string]*caddyhttp.Server)
+	if rawServers, ok := httpApp["servers"]; ok {
+		if err := json.Unmarshal(rawServers, &servers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal HTTP servers: %v", err)
 		}
 	}
 
-	// Get or create onboarded APIs server (srv1) - Port 2021
-	if _, ok := httpApp.Servers["srv1"]; !ok {
-		httpApp.Servers["srv1"] = &caddyhttp.Server{
-			Listen: []string{":2021"},
+	// Get or create the server onboarded API routes are added to
+	if _, ok := servers[h.RouteServer]; !ok {
+		servers[h.RouteServer] = &caddyhttp.Server{
+			Listen: h.RouteListen,
 			Routes: []caddyhttp.Route{},
 		}
 	}
 
 	// Update HTTP app in config
+	rawServers, err := json.Marshal(servers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal HTTP servers: %v", err)
+	}
+	httpApp["servers"] = rawServers
+
 	rawApp, err := json.Marshal(httpApp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal HTTP app: %v", err)
@@ -629,6 +714,28 @@ func (h *VeilHandler) getCurrentConfig() (*caddy.Config, error) {
 	return &config, nil
 }
 
+// adminClient returns an HTTP client and config URL for the Caddy admin
+// endpoint, which may listen on a unix socket ("unix//path/to/admin.sock")
+func (h *VeilHandler) adminClient() (*http.Client, string) {
+	address := h.AdminAddress
+	if address == "" {
+		address = caddy.DefaultAdminListen
+	}
+
+	if socket, ok := strings.CutPrefix(address, "unix/"); ok {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &http.Client{Transport: transport, Timeout: adminRequestTimeout}, "http://localhost/config/"
+	}
+
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "tcp/"), "http://")
+	return &http.Client{Timeout: adminRequestTimeout}, "http://" + strings.TrimSuffix(address, "/") + "/config/"
+}
+
 // getUpstreamDialAddress returns the dial address for the given upstream URL
 func (h *VeilHandler) getUpstreamDialAddress(upstream string) string {
 	upstreamURL, err := url.Parse(upstream)
@@ -675,18 +782,58 @@ func (h *VeilHandler) Validate() error {
 	if h.DBPath == "" {
 		return fmt.Errorf("db_path is required")
 	}
-	if h.SubscriptionKey == "" {
-		return fmt.Errorf("subscription_key header name is required")
+	if h.SubscriptionKey == "" && h.SubscriptionQuery == "" {
+		return fmt.Errorf("subscription_key header name or subscription_query parameter is required")
+	}
+	if err := h.Events.Validate(); err != nil {
+		return fmt.Errorf("invalid events configuration: %v", err)
+	}
+	if err := h.NATS.Validate(); err != nil {
+		return fmt.Errorf("invalid nats configuration: %v", err)
+	}
+	if err := h.Tracing.Validate(); err != nil {
+		return fmt.Errorf("invalid tracing configuration: %v", err)
+	}
+	if err := h.Admin.Validate(); err != nil {
+		return fmt.Errorf("invalid admin configuration: %v", err)
+	}
+	if h.RateLimit != nil && (h.RateLimit.RequestsPerSecond < 0 || h.RateLimit.Burst < 0 ||
+		h.RateLimit.RequestsPerMinute < 0 || h.RateLimit.RequestsPerDay < 0) {
+		return fmt.Errorf("rate_limit values must not be negative")
+	}
+	for _, addr := range h.RouteListen {
+		if _, err := caddy.ParseNetworkAddress(addr); err != nil {
+			return fmt.Errorf("invalid route_listen address %q: %v", addr, err)
+		}
 	}
 	// EventsEndpoint is optional
 	return nil
 }
 
+// subscriptionKey returns the API key sent with the request
+func (h *VeilHandler) subscriptionKey(r *http.Request) string {
+	if h.SubscriptionKey != "" {
+		if key := r.Header.Get(h.SubscriptionKey); key != "" {
+			return key
+		}
+	}
+	if h.SubscriptionQuery != "" {
+		return r.URL.Query().Get(h.SubscriptionQuery)
+	}
+	return ""
+}
+
+// envEnabled reports whether a boolean feature environment variable is set
+func envEnabled(name string) bool {
+	value := os.Getenv(name)
+	return value == "true" || value == "1"
+}
+
 // saveCaddyfile saves the current Caddy configuration to a file
 func (h *VeilHandler) saveCaddyfile(configMap map[string]interface{}) error {
 	// Create configs directory if it doesn't exist
 	configDir := "configs"
-	if err := os.MkdirAll(configDir, 0755); err != nil {
+	if err := os.MkdirAll(configDir, 0700); err != nil {
 		return fmt.Errorf("failed to create configs directory: %v", err)
 	}
 
@@ -699,7 +846,8 @@ func (h *VeilHandler) saveCaddyfile(configMap map[string]interface{}) error {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	if err := os.WriteFile(configPath, jsonConfig, 0644); err != nil {
+	// The config holds the secrets of handlers from the Caddyfile
+	if err := os.WriteFile(configPath, jsonConfig, 0600); err != nil {
 		return fmt.Errorf("failed to write config file: %v", err)
 	}
 
@@ -711,23 +859,41 @@ func (h *VeilHandler) saveCaddyfile(configMap map[string]interface{}) error {
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (h *VeilHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Handle management API without validation
+	// Handle management API after authenticating the caller
 	if strings.HasPrefix(r.URL.Path, "/veil/api/") {
 		h.logger.Debug("handling management API request",
 			zap.String("path", r.URL.Path),
 			zap.String("method", r.Method))
+		if ok, err := h.authorizeManagement(w, r); !ok {
+			return err
+		}
 		return h.handleManagementAPI(w, r)
 	}
 
-	// Extract API key from header
-	apiKey := r.Header.Get(h.SubscriptionKey)
+	// Label by the path the caller requested; request transforms may rewrite it
+	apiPath := h.metricsAPIPath(r.URL.Path)
+	r, span := h.startRequestSpan(r)
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := h.serveAPI(rec, r, next)
+
+	status := responseStatus(rec, err)
+	h.observeRequest(r, apiPath, status)
+	endRequestSpan(span, apiPath, status, err)
+	return err
+}
+
+// serveAPI authorizes a request to an onboarded API and proxies it upstream
+func (h *VeilHandler) serveAPI(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Extract API key from header, or from the query string if configured
+	apiKey := h.subscriptionKey(r)
 
 	// Validate API key
-	api, err := h.validateAPIKey(r.URL.Path, apiKey)
+	api, err := h.validateAPIKey(r.Context(), r.URL.Path, apiKey)
 	if err != nil {
 		h.logger.Debug("API key validation failed",
 			zap.String("path", r.URL.Path),
 			zap.Error(err))
+		h.countAuthFailure(r, authFailureReason(err))
 
 		// Return 429 for inactive keys (exhausted quota), 401 for invalid keys
 		if err == ErrKeyInactive {
@@ -753,6 +919,7 @@ func (h *VeilHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next cad
 			h.logger.Debug("method not allowed",
 				zap.String("path", r.URL.Path),
 				zap.String("method", r.Method))
+			h.countAuthFailure(r, authFailureMethod)
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return nil
 		}
@@ -764,132 +931,119 @@ func (h *VeilHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next cad
 			h.logger.Debug("missing required header",
 				zap.String("path", r.URL.Path),
 				zap.String("header", header))
+			h.countAuthFailure(r, authFailureMissingHeader)
 			http.Error(w, fmt.Sprintf("Missing required header: %s", header), http.StatusBadRequest)
 			return nil
 		}
 	}
 
-	h.logger.Debug("request authorized",
-		zap.String("path", r.URL.Path),
-		zap.String("method", r.Method))
-
-	// Capture usage event if event queue is enabled
-	if h.eventQueue != nil {
-		// Wrap response writer to capture response details
-		recorder := events.NewResponseRecorder(w)
+	// Check query, path, header and body parameter rules
+	violations, err := validateParameters(r, api)
+	if err != nil {
+		h.logger.Error("failed to validate request parameters",
+			zap.Error(err))
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return nil
+	}
+	if len(violations) > 0 {
+		h.logger.Debug("request parameters failed validation",
+			zap.String("path", r.URL.Path),
+			zap.Int("violations", len(violations)))
+		return writeJSONError(w, http.StatusBadRequest, "invalid_parameters",
+			"request parameters failed validation",
+			map[string]interface{}{"violations": violations})
+	}
 
-		// Calculate request size
-		requestSize := r.ContentLength
-		if requestSize < 0 {
-			requestSize = 0
-		}
+	// Check the request against the API's OpenAPI document
+	match, ok, err := h.checkContract(w, r, api)
+	if !ok {
+		return err
+	}
 
-		// Process the request
-		err := next.ServeHTTP(recorder, r)
-
-		// Create usage event
-		usageEvent := events.UsageEvent{
-			ID:             uuid.New().String(),
-			APIPath:        r.URL.Path,
-			SubscriptionKey: apiKey,
-			Method:         r.Method,
-			ResponseTime:   recorder.GetResponseTime().Milliseconds(),
-			StatusCode:     recorder.StatusCode,
-			Success:        recorder.IsSuccess(),
-			Timestamp:      time.Now(),
-			RequestSize:    requestSize,
-			ResponseSize:   recorder.ResponseSize,
-		}
+	// Enforce the per-key rate limit
+	key, err := h.store.FindAPIKey(api, apiKey)
+	if err != nil {
+		h.logger.Error("failed to look up API key for rate limiting",
+			zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	if ok, err := h.enforceRateLimit(w, r, api, key); !ok {
+		return err
+	}
 
-		// Enqueue the event (non-blocking, fire-and-forget)
-		// Errors are logged but never propagated to prevent impacting proxy flow
-		if enqueueErr := h.eventQueue.Enqueue(usageEvent); enqueueErr != nil {
-			h.logger.Debug("failed to enqueue usage event",
-				zap.Error(enqueueErr),
-				zap.String("api_path", r.URL.Path))
-		}
+	// Send the request to the canary or the stable upstreams
+	upstreamVersion, versionSelection := h.selectUpstreamVersion(r, api, key)
 
-		// Publish to NATS for credit consumption tracking (fire-and-forget)
-		if h.natsConn != nil {
-			eventJSON, err := json.Marshal(usageEvent)
-			if err != nil {
-				h.logger.Debug("failed to marshal usage event for NATS",
-					zap.Error(err),
-					zap.String("api_path", r.URL.Path))
-			} else {
-				// Fire-and-forget publish to NATS
-				if err := h.natsConn.Publish("credit.events", eventJSON); err != nil {
-					h.logger.Debug("failed to publish event to NATS",
-						zap.Error(err),
-						zap.String("api_path", r.URL.Path))
-				}
-			}
-		}
+	// Rewrite the request headers and identify the consumer to the upstream
+	requestID := uuid.New().String()
+	h.applyHeaderPolicy(r, api, key, requestID)
 
+	// Rewrite the path, query and body with the API's request transforms;
+	// usage is still recorded under the path the caller requested
+	requestPath := r.URL.Path
+	if ok, err := h.transformRequest(w, r, api); !ok {
 		return err
 	}
 
-	// If no event queue is enabled, check if NATS is available for credit tracking
-	if h.natsConn != nil {
-		h.logger.Info("NATS credit tracking enabled - processing request",
-			zap.String("api_path", r.URL.Path),
-			zap.String("method", r.Method))
+	// Authenticate to the upstream with the API's credentials
+	if ok, err := h.injectUpstreamAuth(w, r, api); !ok {
+		return err
+	}
 
-		// Wrap response writer to capture response details
-		recorder := events.NewResponseRecorder(w)
+	// Record the response as returned to the caller, after transforms, for
+	// the event queue and NATS credit tracking
+	var recorder *events.ResponseRecorder
+	if h.eventQueue != nil || h.nats != nil {
+		recorder = events.NewResponseRecorder(w)
+		w = recorder
+	}
 
-		// Calculate request size
-		requestSize := r.ContentLength
-		if requestSize < 0 {
-			requestSize = 0
+	// Rewrite the upstream's responses before they are returned. Responses
+	// with field rules are requested uncompressed so they can be filtered.
+	var transformer *responseTransformer
+	if api.Transforms != nil && api.Transforms.Response != nil {
+		if rules := api.Transforms.Response; len(rules.RenameFields) > 0 || len(rules.RemoveFields) > 0 {
+			r.Header.Del("Accept-Encoding")
 		}
+		transformer = newResponseTransformer(w, api.Transforms.Response, r.Method)
+		w = transformer
+	}
 
-		// Process the request
-		err := next.ServeHTTP(recorder, r)
-
-		// Create usage event for NATS
-		usageEvent := events.UsageEvent{
-			ID:             uuid.New().String(),
-			APIPath:        r.URL.Path,
-			SubscriptionKey: apiKey,
-			Method:         r.Method,
-			ResponseTime:   recorder.GetResponseTime().Milliseconds(),
-			StatusCode:     recorder.StatusCode,
-			Success:        recorder.IsSuccess(),
-			Timestamp:      time.Now(),
-			RequestSize:    requestSize,
-			ResponseSize:   recorder.ResponseSize,
-		}
+	// Monitor upstream responses without blocking them. The capture sits
+	// next to the upstream, so the contract is checked before transforms.
+	if match != nil && api.ResponseValidation == models.ResponseValidationMonitor {
+		capture := newResponseCapture(w)
+		defer h.monitorResponse(r, api, match, capture)
+		w = capture
+	}
 
-		// Publish to NATS (fire-and-forget)
-		h.logger.Info("Publishing event to NATS",
-			zap.String("event_id", usageEvent.ID),
-			zap.String("subscription_key", usageEvent.SubscriptionKey[:15]+"..."),
-			zap.Int("status_code", usageEvent.StatusCode))
-
-		eventJSON, marshalErr := json.Marshal(usageEvent)
-		if marshalErr != nil {
-			h.logger.Error("failed to marshal usage event for NATS",
-				zap.Error(marshalErr),
-				zap.String("api_path", r.URL.Path))
-		} else {
-			h.logger.Info("Publishing to NATS topic credit.events",
-				zap.Int("payload_size", len(eventJSON)))
-
-			if publishErr := h.natsConn.Publish("credit.events", eventJSON); publishErr != nil {
-				h.logger.Error("failed to publish event to NATS",
-					zap.Error(publishErr),
-					zap.String("api_path", r.URL.Path))
-			} else {
-				h.logger.Info("Successfully published event to NATS",
-					zap.String("event_id", usageEvent.ID))
-			}
-		}
+	h.logger.Debug("request authorized",
+		zap.String("path", r.URL.Path),
+		zap.String("method", r.Method))
 
-		return err
+	err = h.serveUpstream(w, r, next, api.Path)
+
+	if transformer != nil {
+		if err := transformer.finish(); err != nil {
+			h.logger.Warn("failed to transform upstream response",
+				zap.String("api_path", api.Path),
+				zap.Error(err))
+		}
 	}
 
-	return next.ServeHTTP(w, r)
+	if recorder != nil {
+		h.recordUsage(r, events.UsageEvent{
+			ID:               requestID,
+			APIPath:          requestPath,
+			SubscriptionKey:  apiKey,
+			Method:           r.Method,
+			RequestSize:      max(r.ContentLength, 0),
+			UpstreamVersion:  upstreamVersion,
+			VersionSelection: versionSelection,
+		}, recorder)
+	}
+	return err
 }
 
 // handleManagementAPI handles the management API endpoints
@@ -915,6 +1069,10 @@ func (h *VeilHandler) handleManagementAPI(w http.ResponseWriter, r *http.Request
 
 	switch resource {
 	case "routes":
+		if r.Method == http.MethodGet {
+			// List routes or get one: /veil/api/routes or /veil/api/routes/{path}
+			return h.handleGetRoutes(w, r, "/"+strings.Join(cleanSegments[3:], "/"))
+		}
 		// Handle API routes: /veil/api/routes or /veil/api/routes/{id}
 		return h.handleOnboard(w, r)
 	case "keys":
@@ -926,8 +1084,40 @@ func (h *VeilHandler) handleManagementAPI(w http.ResponseWriter, r *http.Request
 		if r.Method == http.MethodDelete {
 			return h.handleDeleteAPIKey(w, r)
 		}
+		if r.Method == http.MethodGet {
+			// List the keys of an API: /veil/api/keys?path=
+			return h.handleListAPIKeys(w, r)
+		}
 		// Handle API keys: /veil/api/keys
 		return h.handleAddAPIKeys(w, r)
+	case "export":
+		// Dump every API as a catalog document
+		return h.handleExport(w, r)
+	case "import":
+		// Apply a catalog document
+		return h.handleImport(w, r)
+	case "openapi":
+		// Onboard APIs from an OpenAPI 3 document
+		return h.handleOpenAPIImport(w, r)
+	case "specs":
+		// Manage OpenAPI documents: /veil/api/specs or /veil/api/specs/{name}
+		return h.handleSpecs(w, r, strings.Join(cleanSegments[3:], "/"))
+	case "certificates":
+		// Manage upstream certificates: /veil/api/certificates or /veil/api/certificates/{name}
+		return h.handleCertificates(w, r, strings.Join(cleanSegments[3:], "/"))
+	case "canary":
+		// Manage the canary of an API: /veil/api/canary/{path}
+		return h.handleCanary(w, r, "/"+strings.Join(cleanSegments[3:], "/"))
+	case "reconcile":
+		// Report or repair drift between the database and the route server
+		return h.handleReconcile(w, r)
+	case "events":
+		if len(cleanSegments) > 3 && cleanSegments[3] == "replay" {
+			// Resend dead-lettered batches: /veil/api/events/replay
+			return h.handleReplayDeadLetters(w, r)
+		}
+		// Report usage event queue counters
+		return h.handleEventStats(w, r)
 	default:
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return nil
@@ -1013,7 +1203,7 @@ func (h *VeilHandler) handleOnboard(w http.ResponseWriter, r *http.Request) erro
 		zap.Int("api_keys_count", len(req.APIKeys)))
 
 	// Validate required fields
-	if req.Path == "" || req.Upstream == "" {
+	if req.Path == "" || (req.Upstream == "" && len(req.Upstreams) == 0) {
 		h.logger.Warn("missing required fields",
 			zap.String("path", req.Path),
 			zap.String("upstream", req.Upstream))
@@ -1021,12 +1211,59 @@ func (h *VeilHandler) handleOnboard(w http.ResponseWriter, r *http.Request) erro
 		return nil
 	}
 
+	rateLimit, err := toRateLimit(req.RateLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	responseValidation, err := h.checkSpecReference(req.Spec, req.ResponseValidation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
 	// Create API config
 	config := &models.APIConfig{
 		Path:                 req.Path,
 		Upstream:             req.Upstream,
 		RequiredSubscription: req.RequiredSubscription,
 		RequiredHeaders:      req.RequiredHeaders,
+		RateLimit:            rateLimit,
+		Upstreams:            toUpstreamTargets(req.Upstreams),
+		LoadBalancing:        toLoadBalancing(req.LoadBalancing),
+		HealthChecks:         toHealthChecks(req.HealthChecks),
+		Canary:               toCanary(req.Canary),
+		TLS:                  toUpstreamTLS(req.TLS),
+		UpstreamAuth:         toUpstreamAuth(req.UpstreamAuth),
+		RequestHeaders:       toHeaderPolicy(req.RequestHeaders),
+		Transforms:           toTransforms(req.Transforms),
+		SpecName:             req.Spec,
+		ResponseValidation:   responseValidation,
+	}
+	if err := validateUpstreams(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := h.prepareCanary(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := h.checkUpstreamTLS(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := h.prepareUpstreamAuth(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := h.prepareHeaderPolicy(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := prepareTransforms(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
 	}
 
 	// Create API methods
@@ -1038,11 +1275,17 @@ func (h *VeilHandler) handleOnboard(w http.ResponseWriter, r *http.Request) erro
 
 	// Create API parameters
 	for _, param := range req.Parameters {
-		config.Parameters = append(config.Parameters, models.APIParameter{
-			Name:     param.Name,
-			Type:     param.Type,
-			Required: param.Required,
-		})
+		parameter := models.APIParameter{
+			Name:       param.Name,
+			Type:       param.Type,
+			Required:   param.Required,
+			Validation: param.Validation,
+		}
+		if err := validateParameterDefinition(parameter); err != nil {
+			http.Error(w, "Invalid parameter: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		config.Parameters = append(config.Parameters, parameter)
 	}
 
 	// Create API keys
@@ -1051,10 +1294,17 @@ func (h *VeilHandler) handleOnboard(w http.ResponseWriter, r *http.Request) erro
 		if key.IsActive != nil {
 			isActive = *key.IsActive
 		}
+		keyRateLimit, err := toRateLimit(key.RateLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
 		config.APIKeys = append(config.APIKeys, models.APIKey{
-			Key:      key.Key,
-			Name:     key.Name,
-			IsActive: &isActive,
+			Key:       key.Key,
+			Name:      key.Name,
+			IsActive:  &isActive,
+			ExpiresAt: key.ExpiresAt,
+			RateLimit: keyRateLimit,
 		})
 	}
 
@@ -1253,10 +1503,17 @@ func (h *VeilHandler) handleAddAPIKeys(w http.ResponseWriter, r *http.Request) e
 	// Convert request keys to model keys
 	newKeys := make([]models.APIKey, len(req.APIKeys))
 	for i, key := range req.APIKeys {
+		keyRateLimit, err := toRateLimit(key.RateLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
 		newKeys[i] = models.APIKey{
-			Key:      key.Key,
-			Name:     key.Name,
-			IsActive: key.IsActive,
+			Key:       key.Key,
+			Name:      key.Name,
+			IsActive:  key.IsActive,
+			ExpiresAt: key.ExpiresAt,
+			RateLimit: keyRateLimit,
 		}
 	}
 
@@ -1281,6 +1538,15 @@ func (h *VeilHandler) handleAddAPIKeys(w http.ResponseWriter, r *http.Request) e
 		return nil
 	}
 
+	// Return the plaintext of the keys just created; it cannot be retrieved later
+	created := make(map[string]string, len(newKeys))
+	for _, key := range newKeys {
+		created[key.KeyHash] = key.Key
+	}
+	for i := range api.APIKeys {
+		api.APIKeys[i].Key = created[api.APIKeys[i].KeyHash]
+	}
+
 	// Return success response with 201 Created status
 	w.WriteHeader(http.StatusCreated)
 	return json.NewEncoder(w).Encode(dto.APIResponseDTO{
@@ -1349,6 +1615,7 @@ func (h *VeilHandler) handleUpdateAPIKeyStatus(w http.ResponseWriter, r *http.Re
 var (
 	_ caddy.Provisioner           = (*VeilHandler)(nil) // Ensures VeilHandler can be provisioned
 	_ caddy.Validator             = (*VeilHandler)(nil) // Ensures VeilHandler can validate its configuration
+	_ caddy.CleanerUpper          = (*VeilHandler)(nil) // Ensures VeilHandler releases shared state on unload
 	_ caddyfile.Unmarshaler       = (*VeilHandler)(nil) // Ensures VeilHandler can unmarshal from Caddyfile
 	_ caddyhttp.MiddlewareHandler = (*VeilHandler)(nil) // Ensures VeilHandler can serve as a middleware handler
 	_ caddy.App                   = (*VeilHandler)(nil) // Ensures VeilHandler can serve as a Caddy app
@@ -2,16 +2,24 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bytedance/mockey"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/stretchr/testify/assert"
+	"github.com/try-veil/veil/packages/caddy/internal/auth"
 	"github.com/try-veil/veil/packages/caddy/internal/dto"
+	"github.com/try-veil/veil/packages/caddy/internal/events"
 	"github.com/try-veil/veil/packages/caddy/internal/models"
 	"go.uber.org/zap"
 )
@@ -68,6 +76,77 @@ func TestVeilHandler_Validate(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "Query Parameter Only",
+			handler: &VeilHandler{
+				DBPath:            "test.db",
+				SubscriptionQuery: "api_key",
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid Events Endpoint",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Events:          &events.Config{Endpoint: "localhost:3000"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid NATS URL",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				NATS:            &NATSConfig{URL: "http://localhost:4222"},
+			},
+			expectError: true,
+		},
+		{
+			name: "NATS Stream Without JetStream",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				NATS:            &NATSConfig{Stream: "CREDITS"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid NATS Sync Public Key",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				NATS:            &NATSConfig{SyncPublicKeys: []string{"not-an-nkey"}},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid Tracing Endpoint",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Tracing:         &TracingConfig{Endpoint: "localhost:4318"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid Admin Role",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Admin:           &auth.AdminConfig{Tokens: []auth.TokenCredential{{Name: "ops", Token: "t", Role: "superuser"}}},
+			},
+			expectError: true,
+		},
+		{
+			name: "Negative Rate Limit",
+			handler: &VeilHandler{
+				DBPath:          "test.db",
+				SubscriptionKey: "X-Subscription-Key",
+				RateLimit:       &models.RateLimit{RequestsPerMinute: -1},
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -100,6 +179,7 @@ func TestVeilHandler_ServeHTTP(t *testing.T) {
 	handler := &VeilHandler{
 		DBPath:          tmpDB,
 		SubscriptionKey: "X-Subscription-Key",
+		Admin:           &auth.AdminConfig{InsecureOpen: true},
 		logger:          zap.NewNop(),
 	}
 
@@ -155,13 +235,13 @@ func TestVeilHandler_ServeHTTP(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Verify the inactive key is properly set
-	savedAPI, err := handler.store.GetAPIByPath("/test/endpoint")
+	savedAPI, err := handler.store.GetAPIWithKeys("/test/endpoint")
 	assert.NoError(t, err)
 	assert.NotNil(t, savedAPI)
 
 	var foundInactiveKey bool
 	for _, key := range savedAPI.APIKeys {
-		if key.Key == "inactive-key" {
+		if key.Name == "Inactive Key" {
 			assert.False(t, *key.IsActive, "inactive-key should be inactive")
 			foundInactiveKey = true
 			break
@@ -434,13 +514,13 @@ func TestVeilHandler_validateAPIKey(t *testing.T) {
 	}
 
 	// Verify the inactive key is properly set
-	savedAPI, err := handler.store.GetAPIByPath("/test/endpoint")
+	savedAPI, err := handler.store.GetAPIWithKeys("/test/endpoint")
 	assert.NoError(t, err)
 	assert.NotNil(t, savedAPI)
 
 	var foundInactiveKey bool
 	for _, key := range savedAPI.APIKeys {
-		if key.Key == "inactive-key" {
+		if key.Name == "Inactive Key" {
 			assert.False(t, *key.IsActive, "inactive-key should be inactive")
 			foundInactiveKey = true
 			break
@@ -494,7 +574,7 @@ func TestVeilHandler_validateAPIKey(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			api, err := handler.validateAPIKey(tt.path, tt.apiKey)
+			api, err := handler.validateAPIKey(context.Background(), tt.path, tt.apiKey)
 			if tt.wantErr {
 				assert.Error(t, err)
 				assert.Nil(t, api)
@@ -818,3 +898,734 @@ func TestVeilHandler_getUpstreamHost(t *testing.T) {
 		})
 	}
 }
+
+func TestVeilHandler_managementAuth(t *testing.T) {
+	tmpDB := "test_veil.db"
+	defer os.Remove(tmpDB)
+
+	handler := &VeilHandler{
+		DBPath:          tmpDB,
+		SubscriptionKey: "X-Subscription-Key",
+		Admin: &auth.AdminConfig{
+			Tokens: []auth.TokenCredential{
+				{Name: "reader", Token: "read-token", Role: auth.RoleReadOnly},
+				{Name: "keys", Token: "keys-token", Role: auth.RoleKeyManager},
+			},
+		},
+	}
+	err := handler.Provision(caddy.Context{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		expectedCode int
+		expectedErr  string
+	}{
+		{
+			name:         "Missing Credentials",
+			method:       http.MethodPost,
+			path:         "/veil/api/routes",
+			expectedCode: http.StatusUnauthorized,
+			expectedErr:  "unauthenticated",
+		},
+		{
+			name:         "Invalid Token",
+			method:       http.MethodPost,
+			path:         "/veil/api/routes",
+			token:        "wrong-token",
+			expectedCode: http.StatusUnauthorized,
+			expectedErr:  "unauthenticated",
+		},
+		{
+			name:         "Read-only Cannot Delete Keys",
+			method:       http.MethodDelete,
+			path:         "/veil/api/keys",
+			token:        "read-token",
+			expectedCode: http.StatusForbidden,
+			expectedErr:  "forbidden",
+		},
+		{
+			name:         "Key Manager Cannot Onboard Routes",
+			method:       http.MethodPost,
+			path:         "/veil/api/routes",
+			token:        "keys-token",
+			expectedCode: http.StatusForbidden,
+			expectedErr:  "forbidden",
+		},
+		{
+			name:         "Read-only Cannot Export",
+			method:       http.MethodGet,
+			path:         "/veil/api/export",
+			token:        "read-token",
+			expectedCode: http.StatusForbidden,
+			expectedErr:  "forbidden",
+		},
+		{
+			name:         "Key Manager Cannot Export",
+			method:       http.MethodGet,
+			path:         "/veil/api/export",
+			token:        "keys-token",
+			expectedCode: http.StatusForbidden,
+			expectedErr:  "forbidden",
+		},
+		{
+			name:         "Key Manager Can Manage Keys",
+			method:       http.MethodPost,
+			path:         "/veil/api/keys",
+			token:        "keys-token",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString("{}"))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			err := handler.ServeHTTP(w, req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {}})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, w.Code)
+
+			if tt.expectedErr != "" {
+				var resp dto.ErrorResponseDTO
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.expectedErr, resp.Code)
+			}
+		})
+	}
+	handler.Cleanup()
+
+	// Without credentials every call is denied unless explicitly opened
+	for _, admin := range []*auth.AdminConfig{nil, {}, {InsecureOpen: true}} {
+		open := &VeilHandler{DBPath: tmpDB, SubscriptionKey: "X-Subscription-Key", Admin: admin}
+		assert.NoError(t, open.Provision(caddy.Context{}))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/veil/api/routes", nil)
+		assert.NoError(t, open.ServeHTTP(w, req, &mockHandler{fn: func(w http.ResponseWriter, r *http.Request) {}}))
+		if admin.Open() {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+		open.Cleanup()
+	}
+
+	// Open access cannot be combined with credentials
+	assert.Error(t, (&auth.AdminConfig{InsecureOpen: true, Tokens: []auth.TokenCredential{
+		{Name: "ops", Token: "t", Role: auth.RoleRouteAdmin}}}).Validate())
+}
+
+func TestValidateParameters(t *testing.T) {
+	api := &models.APIConfig{
+		Path: "/orders/*",
+		Parameters: []models.APIParameter{
+			{Name: "id", Type: "path", Required: true, Validation: `^[0-9]+$`},
+			{Name: "limit", Type: "query", Validation: `^[0-9]{1,3}$`},
+			{Name: "X-Tenant", Type: "header", Required: true},
+			{Name: "customer.email", Type: "body", Required: true, Validation: `^[^@]+@[^@]+$`},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		headers        map[string]string
+		body           string
+		wantViolations []string
+	}{
+		{
+			name:    "Valid Request",
+			path:    "/orders/42?limit=10",
+			headers: map[string]string{"X-Tenant": "acme", "Content-Type": "application/json"},
+			body:    `{"customer":{"email":"a@example.com"}}`,
+		},
+		{
+			name:           "Every Location Failing",
+			path:           "/orders/abc?limit=10000",
+			headers:        map[string]string{"Content-Type": "application/json"},
+			body:           `{"customer":{"email":"not-an-email"}}`,
+			wantViolations: []string{"path:id", "query:limit", "header:X-Tenant", "body:customer.email"},
+		},
+		{
+			name:           "Missing Path Segment And Body Field",
+			path:           "/orders/",
+			headers:        map[string]string{"X-Tenant": "acme", "Content-Type": "application/json"},
+			body:           `{}`,
+			wantViolations: []string{"path:id", "body:customer.email"},
+		},
+		{
+			name:           "Non-JSON Body",
+			path:           "/orders/42",
+			headers:        map[string]string{"X-Tenant": "acme", "Content-Type": "text/plain"},
+			body:           `email=a@example.com`,
+			wantViolations: []string{"body:body"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			violations, err := validateParameters(req, api)
+			assert.NoError(t, err)
+
+			var got []string
+			for _, v := range violations {
+				got = append(got, v.In+":"+v.Name)
+			}
+			assert.Equal(t, tt.wantViolations, got)
+
+			// The body must still be readable by the upstream
+			body, err := io.ReadAll(req.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+func TestVeilHandler_reconcileRoutes(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	assert.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	for _, api := range []*models.APIConfig{
+		CreateAPI(t, "/weather/*", "http://localhost:8083", "basic", []string{"GET"}, nil, nil),
+		CreateAPI(t, "/weather/premium/*", "http://localhost:8084", "premium", []string{"GET"}, nil, nil),
+		CreateAPI(t, "/orders/*", "http://localhost:8085", "basic", []string{"POST"}, nil, nil),
+	} {
+		assert.NoError(t, handler.store.CreateAPI(api))
+	}
+
+	// The running config still has a route for a deleted API, an outdated
+	// route for /orders and a route that was not generated by veil
+	orphan, err := handler.buildRoute(models.APIConfig{Path: "/deleted/*", Upstream: "http://localhost:9000"})
+	assert.NoError(t, err)
+	outdated, err := handler.buildRoute(models.APIConfig{Path: "/orders/*", Upstream: "http://localhost:9999"})
+	assert.NoError(t, err)
+	static := map[string]interface{}{
+		"match":  []interface{}{map[string]interface{}{"path": []interface{}{"/health"}}},
+		"handle": []interface{}{map[string]interface{}{"handler": "static_response", "body": "ok"}},
+	}
+
+	srv1Routes, err := json.Marshal([]interface{}{static, orphan, outdated})
+	assert.NoError(t, err)
+	current := &caddy.Config{
+		AppsRaw: map[string]json.RawMessage{
+			"http": json.RawMessage(`{"servers": {"srv1": {"listen": [":2021"], "routes": ` + string(srv1Routes) + `}}}`),
+		},
+	}
+
+	loads := 0
+	configMocker := mockey.Mock((*VeilHandler).getCurrentConfig).To(func(h *VeilHandler) (*caddy.Config, error) {
+		return current, nil
+	}).Build()
+	loadMocker := mockey.Mock(caddy.Load).To(func(cfgJSON []byte, forceReload bool) error {
+		loads++
+		var loaded caddy.Config
+		if err := json.Unmarshal(cfgJSON, &loaded); err != nil {
+			return err
+		}
+		current = &loaded
+		return nil
+	}).Build()
+	defer configMocker.Release()
+	defer loadMocker.Release()
+	defer os.RemoveAll("configs")
+
+	// A drift report does not touch the running config
+	report, err := handler.reconcileRoutes(context.Background(), false)
+	assert.NoError(t, err)
+	assert.False(t, report.InSync)
+	assert.False(t, report.Applied)
+	assert.Equal(t, []string{"/weather/premium/*", "/weather/*"}, report.Missing)
+	assert.Equal(t, []string{"/deleted/*"}, report.Orphaned)
+	assert.Equal(t, []string{"/orders/*"}, report.Changed)
+	assert.Equal(t, 0, loads)
+
+	// A cancelled pass, e.g. of a reconciler destroyed by a reload, stops
+	// without loading a config
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = handler.reconcileRoutes(cancelled, true)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, loads)
+
+	// Reconciling rewrites the route table
+	report, err = handler.reconcileRoutes(context.Background(), true)
+	assert.NoError(t, err)
+	assert.True(t, report.Applied)
+	assert.Equal(t, 1, loads)
+
+	// The saved config is only readable by its owner
+	saved, err := filepath.Glob("configs/caddy-config-*.json")
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, saved) {
+		info, err := os.Stat(saved[0])
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	table, err := handler.loadRouteTable()
+	assert.NoError(t, err)
+	var paths []string
+	for _, route := range table.routes {
+		path, _ := routePath(route)
+		paths = append(paths, path)
+	}
+	assert.Equal(t, []string{"/health", "/orders/", "/weather/premium/", "/weather/"}, paths)
+
+	// Once reconciled there is no drift and nothing is reloaded
+	report, err = handler.reconcileRoutes(context.Background(), true)
+	assert.NoError(t, err)
+	assert.True(t, report.InSync)
+	assert.False(t, report.Applied)
+	assert.Equal(t, 1, loads)
+
+	// The drift report is served by the management API
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/veil/api/reconcile", nil)
+	assert.NoError(t, handler.handleManagementAPI(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var served dto.RouteDriftDTO
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&served))
+	assert.True(t, served.InSync)
+}
+
+func TestVeilHandler_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    VeilHandler
+		expectError bool
+	}{
+		{
+			name:  "Positional Arguments",
+			input: `veil_handler ./veil.db X-Subscription-Key http://localhost:3000/events`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				EventsEndpoint:  "http://localhost:3000/events",
+			},
+		},
+		{
+			name: "Route Generation Block",
+			input: `veil_handler /data/veil.db X-Api-Key {
+				admin_address unix//run/caddy/admin.sock
+				route_server proxy
+				route_listen :8443 :8080
+				reconcile_interval 30s
+			}`,
+			expected: VeilHandler{
+				DBPath:            "/data/veil.db",
+				SubscriptionKey:   "X-Api-Key",
+				AdminAddress:      "unix//run/caddy/admin.sock",
+				RouteServer:       "proxy",
+				RouteListen:       []string{":8443", ":8080"},
+				ReconcileInterval: caddy.Duration(30 * time.Second),
+			},
+		},
+		{
+			name: "Full Block",
+			input: `veil_handler {
+				db /data/veil.db
+				key_header X-Api-Key
+				key_query api_key
+				key_pepper s3cret
+				events {
+					endpoint http://localhost:3000/events
+				}
+				nats {
+					url nats://nats:4222
+					credit_subject billing.credits
+				}
+				admin {
+					token ops route-admin ops-token
+					hmac platform key-manager hmac-secret
+					client_cert cn platform-api read-only
+					max_clock_skew 1m
+				}
+				rate_limit {
+					requests_per_second 2.5
+					burst 5
+					requests_per_day 1000
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:            "/data/veil.db",
+				SubscriptionKey:   "X-Api-Key",
+				SubscriptionQuery: "api_key",
+				KeyPepper:         "s3cret",
+				Events:            &events.Config{Endpoint: "http://localhost:3000/events"},
+				NATS:              &NATSConfig{URL: "nats://nats:4222", CreditSubject: "billing.credits"},
+				Admin: &auth.AdminConfig{
+					Tokens:       []auth.TokenCredential{{Name: "ops", Role: auth.RoleRouteAdmin, Token: "ops-token"}},
+					HMACKeys:     []auth.HMACCredential{{KeyID: "platform", Role: auth.RoleKeyManager, Secret: "hmac-secret"}},
+					ClientCerts:  []auth.ClientCertIdentity{{CommonName: "platform-api", Role: auth.RoleReadOnly}},
+					MaxClockSkew: caddy.Duration(time.Minute),
+				},
+				RateLimit: &models.RateLimit{RequestsPerSecond: 2.5, Burst: 5, RequestsPerDay: 1000},
+			},
+		},
+		{
+			name: "NATS JetStream",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				nats {
+					url nats://nats:4222
+					jetstream CREDITS
+					ack_timeout 2s
+					max_pending 500
+					reconnect_wait 500ms
+					max_reconnect_wait 1m
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				NATS: &NATSConfig{
+					URL:              "nats://nats:4222",
+					JetStream:        true,
+					Stream:           "CREDITS",
+					AckTimeout:       caddy.Duration(2 * time.Second),
+					MaxPending:       500,
+					ReconnectWait:    caddy.Duration(500 * time.Millisecond),
+					MaxReconnectWait: caddy.Duration(time.Minute),
+				},
+			},
+		},
+		{
+			name: "NATS Key Sync",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				nats {
+					sync_secret s3cret
+					sync_public_keys UA6KOMQ67XOE3FHE37W4OXADVXVYISBNLTBUT2LSY5VFKAIJ7CRDR2RZ
+					snapshot_subject key.snapshot
+					snapshot_timeout 3s
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				NATS: &NATSConfig{
+					SyncSecret:      "s3cret",
+					SyncPublicKeys:  []string{"UA6KOMQ67XOE3FHE37W4OXADVXVYISBNLTBUT2LSY5VFKAIJ7CRDR2RZ"},
+					SnapshotSubject: "key.snapshot",
+					SnapshotTimeout: caddy.Duration(3 * time.Second),
+				},
+			},
+		},
+		{
+			name: "Tracing",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				tracing {
+					endpoint https://otel.example.com:4318
+					header Authorization "Bearer collector-token"
+					service_name veil-gateway
+					sample_ratio 0.25
+					timeout 5s
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Tracing: &TracingConfig{
+					Endpoint:    "https://otel.example.com:4318",
+					Headers:     map[string]string{"Authorization": "Bearer collector-token"},
+					ServiceName: "veil-gateway",
+					SampleRatio: 0.25,
+					Timeout:     caddy.Duration(5 * time.Second),
+				},
+			},
+		},
+		{
+			name: "Disabled Events And NATS",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				events off
+				nats off
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Events:          &events.Config{Disabled: true},
+				NATS:            &NATSConfig{Disabled: true},
+			},
+		},
+		{
+			name: "Disk Event Queue",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				events {
+					endpoint http://localhost:3000/events
+					queue disk
+					dir /var/lib/veil/events
+					max_size 1GiB
+					segment_size 16MB
+					overflow drop_oldest
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Events: &events.Config{
+					Endpoint:    "http://localhost:3000/events",
+					Queue:       events.QueueDisk,
+					Dir:         "/var/lib/veil/events",
+					MaxSize:     1 << 30,
+					SegmentSize: 16_000_000,
+					Overflow:    events.OverflowDropOldest,
+				},
+			},
+		},
+		{
+			name: "Event Delivery Options",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				events {
+					endpoint http://localhost:3000/events
+					batch_size 50
+					flush_interval 2s
+					senders 8
+					max_attempts 3
+					dead_letter_file /var/lib/veil/dead-letter.jsonl
+				}
+			}`,
+			expected: VeilHandler{
+				DBPath:          "./veil.db",
+				SubscriptionKey: "X-Subscription-Key",
+				Events: &events.Config{
+					Endpoint:       "http://localhost:3000/events",
+					BatchSize:      50,
+					FlushInterval:  caddy.Duration(2 * time.Second),
+					Senders:        8,
+					MaxAttempts:    3,
+					DeadLetterFile: "/var/lib/veil/dead-letter.jsonl",
+				},
+			},
+		},
+		{
+			name: "Invalid Event Queue Size",
+			input: `veil_handler {
+				events {
+					max_size lots
+				}
+			}`,
+			expectError: true,
+		},
+		{
+			name:        "Too Many Arguments",
+			input:       `veil_handler ./veil.db X-Subscription-Key http://localhost:3000/events extra`,
+			expectError: true,
+		},
+		{
+			name: "Invalid Rate Limit",
+			input: `veil_handler {
+				rate_limit {
+					burst -1
+				}
+			}`,
+			expectError: true,
+		},
+		{
+			name: "Unknown Admin Credential",
+			input: `veil_handler {
+				admin {
+					password ops secret
+				}
+			}`,
+			expectError: true,
+		},
+		{
+			name: "Unknown Option",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				upstream http://localhost:8080
+			}`,
+			expectError: true,
+		},
+		{
+			name: "Option Without Value",
+			input: `veil_handler ./veil.db X-Subscription-Key {
+				route_server
+			}`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler VeilHandler
+			err := handler.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, handler)
+		})
+	}
+}
+
+func TestVeilHandler_buildRouteInheritsSettings(t *testing.T) {
+	t.Setenv("VEIL_KEY_PEPPER", "pepper-from-env")
+
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Api-Key",
+		EventsEndpoint:  "http://localhost:3000/events",
+		RouteServer:     "proxy",
+		SecretKey:       "secret-key",
+		IdentitySecret:  "identity-secret",
+		Admin:           &auth.AdminConfig{Tokens: []auth.TokenCredential{{Name: "ops", Token: "admin-token"}}},
+		NATS:            &NATSConfig{Disabled: true, SyncSecret: "sync-secret"},
+		Tracing:         &TracingConfig{Disabled: true, Headers: map[string]string{"Authorization": "Bearer otlp-token"}},
+	}
+	assert.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	route, err := handler.buildRoute(models.APIConfig{Path: "/weather/*", Upstream: "http://localhost:8083"})
+	assert.NoError(t, err)
+
+	encoded, err := json.Marshal(route)
+	assert.NoError(t, err)
+	var decoded struct {
+		Handle []struct {
+			Routes []struct {
+				Handle []map[string]interface{} `json:"handle"`
+			} `json:"routes"`
+		} `json:"handle"`
+	}
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	veil := decoded.Handle[0].Routes[0].Handle[0]
+	assert.Equal(t, "veil_handler", veil["handler"])
+	assert.Equal(t, handler.DBPath, veil["db_path"])
+	assert.Equal(t, "X-Api-Key", veil["subscription_key"])
+	assert.Equal(t, "http://localhost:3000/events", veil["events_endpoint"])
+	assert.Equal(t, "proxy", veil["route_server"])
+	// Settings taken from the environment are not written into the config
+	assert.NotContains(t, veil, "key_pepper")
+	assert.NotContains(t, veil, "route_listen")
+
+	// Secrets are not written into the config either, the route's handler
+	// takes them from the handler that generated it
+	for _, secret := range []string{"secret-key", "identity-secret", "admin-token", "sync-secret", "otlp-token"} {
+		assert.NotContains(t, string(encoded), secret)
+	}
+	assert.Equal(t, true, veil["inherit_secrets"])
+
+	routeJSON, err := json.Marshal(veil)
+	assert.NoError(t, err)
+	var routeHandler VeilHandler
+	assert.NoError(t, json.Unmarshal(routeJSON, &routeHandler))
+	assert.NoError(t, routeHandler.Provision(caddy.Context{}))
+	defer routeHandler.Cleanup()
+	assert.Equal(t, "pepper-from-env", routeHandler.KeyPepper)
+	assert.Equal(t, "secret-key", routeHandler.SecretKey)
+	assert.Equal(t, "identity-secret", routeHandler.IdentitySecret)
+	assert.True(t, routeHandler.Admin.Enabled())
+	assert.Equal(t, "sync-secret", routeHandler.NATS.SyncSecret)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer otlp-token"}, routeHandler.Tracing.Headers)
+}
+
+func TestVeilHandler_sharedStatePerSettings(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "veil.db")
+	provision := func(h *VeilHandler) *VeilHandler {
+		h.DBPath = dbPath
+		h.SubscriptionKey = "X-Subscription-Key"
+		assert.NoError(t, h.Provision(caddy.Context{}))
+		t.Cleanup(func() { h.Cleanup() })
+		return h
+	}
+
+	// Two handlers on one database generate routes on different servers
+	public := provision(&VeilHandler{RouteServer: "public", IdentitySecret: "public-secret",
+		RateLimit: &models.RateLimit{RequestsPerSecond: 1}})
+	partner := provision(&VeilHandler{RouteServer: "partner", IdentitySecret: "partner-secret",
+		RateLimit: &models.RateLimit{RequestsPerSecond: 10}})
+	assert.NotSame(t, public.limiter, partner.limiter)
+	assert.NotEqual(t, public.reconcilerKey(), partner.reconcilerKey())
+
+	// The handlers of their routes share state with the handler generating them
+	publicRoute := provision(&VeilHandler{RouteServer: "public", InheritSecrets: true,
+		RateLimit: &models.RateLimit{RequestsPerSecond: 1}})
+	partnerRoute := provision(&VeilHandler{RouteServer: "partner", InheritSecrets: true,
+		RateLimit: &models.RateLimit{RequestsPerSecond: 10}})
+	assert.Equal(t, "public-secret", publicRoute.IdentitySecret)
+	assert.Equal(t, "partner-secret", partnerRoute.IdentitySecret)
+	assert.Same(t, public.limiter, publicRoute.limiter)
+	assert.Same(t, partner.limiter, partnerRoute.limiter)
+	assert.Equal(t, public.reconcilerKey(), publicRoute.reconcilerKey())
+}
+
+func TestVeilHandler_reverseProxyConfigKeepsMethod(t *testing.T) {
+	handler := &VeilHandler{
+		DBPath:          filepath.Join(t.TempDir(), "veil.db"),
+		SubscriptionKey: "X-Subscription-Key",
+	}
+	assert.NoError(t, handler.Provision(caddy.Context{}))
+	defer handler.Cleanup()
+
+	// The rewrite only changes the path; the upstream receives the caller's
+	// method, which used to be replaced with GET
+	config, err := handler.reverseProxyConfig(models.APIConfig{Path: "/orders/*", Upstream: "http://localhost:8082/v1"})
+	assert.NoError(t, err)
+
+	var proxy struct {
+		Rewrite map[string]json.RawMessage `json:"rewrite"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(config), &proxy))
+	assert.NotContains(t, proxy.Rewrite, "method")
+	assert.JSONEq(t, `[{"find": "^/orders(.*)", "replace": "/v1$1"}]`, string(proxy.Rewrite["path_regexp"]))
+}
+
+func TestVeilHandler_getCurrentConfig(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/config/", r.URL.Path)
+		w.Write([]byte(`{"apps": {"http": {"http_port": 8080, "servers": {"mgmt": {"listen": [":9000"]}}}}}`))
+	}))
+	defer admin.Close()
+
+	handler := &VeilHandler{
+		AdminAddress: strings.TrimPrefix(admin.URL, "http://"),
+		RouteServer:  "proxy",
+		RouteListen:  []string{":9001"},
+	}
+
+	config, err := handler.getCurrentConfig()
+	assert.NoError(t, err)
+
+	var httpApp struct {
+		HTTPPort int `json:"http_port"`
+		Servers  map[string]struct {
+			Listen []string `json:"listen"`
+		} `json:"servers"`
+	}
+	assert.NoError(t, json.Unmarshal(config.AppsRaw["http"], &httpApp))
+	assert.Equal(t, 8080, httpApp.HTTPPort)
+	assert.Equal(t, []string{":9000"}, httpApp.Servers["mgmt"].Listen)
+	assert.Equal(t, []string{":9001"}, httpApp.Servers["proxy"].Listen)
+	assert.Len(t, httpApp.Servers, 2)
+}
+
+func TestVeilHandler_subscriptionKey(t *testing.T) {
+	handler := &VeilHandler{SubscriptionKey: "X-Subscription-Key", SubscriptionQuery: "api_key"}
+
+	req := httptest.NewRequest(http.MethodGet, "/weather/current?api_key=from-query", nil)
+	assert.Equal(t, "from-query", handler.subscriptionKey(req))
+
+	req.Header.Set("X-Subscription-Key", "from-header")
+	assert.Equal(t, "from-header", handler.subscriptionKey(req))
+
+	handler.SubscriptionQuery = ""
+	req = httptest.NewRequest(http.MethodGet, "/weather/current?api_key=from-query", nil)
+	assert.Equal(t, "", handler.subscriptionKey(req))
+}
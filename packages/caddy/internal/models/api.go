@@ -6,14 +6,35 @@ import (
 	"gorm.io/gorm"
 )
 
-// APIKey represents an API key for accessing an API
+// APIKey represents an API key for accessing an API.
+// Only a peppered digest of the key is persisted (in the legacy "key" column);
+// the plaintext Key is populated only when the key is created.
 type APIKey struct {
 	gorm.Model
 	APIConfigID uint       `json:"api_config_id" gorm:"index"`
-	Key         string     `json:"key" gorm:"uniqueIndex;not null"`
+	Key         string     `json:"key,omitempty" gorm:"-"`
+	KeyHash     string     `json:"-" gorm:"column:key;uniqueIndex;not null"`
+	KeyPrefix   string     `json:"key_prefix" gorm:"index"`
 	Name        string     `json:"name" gorm:"not null"`
 	IsActive    *bool      `json:"is_active,omitempty" gorm:"default:true"`
 	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RateLimit   *RateLimit `json:"rate_limit,omitempty" gorm:"serializer:json"`
+	// SyncVersion is the version of the last key.sync update applied to the key
+	SyncVersion uint64 `json:"-" gorm:"not null;default:0"`
+}
+
+// RateLimit configures request limits for an API or a single API key.
+// Zero values leave the corresponding window unlimited.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	RequestsPerMinute int     `json:"requests_per_minute,omitempty"`
+	RequestsPerDay    int     `json:"requests_per_day,omitempty"`
+}
+
+// Enabled reports whether any limit is set
+func (r *RateLimit) Enabled() bool {
+	return r != nil && (r.RequestsPerSecond > 0 || r.RequestsPerMinute > 0 || r.RequestsPerDay > 0)
 }
 
 // APIParameter represents a parameter configuration for an API
@@ -45,6 +66,232 @@ type APIConfig struct {
 	Parameters           []APIParameter `json:"parameters" gorm:"foreignKey:APIConfigID"`
 	RequiredHeaders      []string       `json:"required_headers" gorm:"serializer:json"`
 	APIKeys              []APIKey       `json:"api_keys" gorm:"foreignKey:APIConfigID"`
+	RateLimit            *RateLimit     `json:"rate_limit,omitempty" gorm:"serializer:json"`
+	// Upstreams lists the targets requests are balanced across. When empty,
+	// Upstream is the only target; otherwise Upstream is the first target.
+	Upstreams     []UpstreamTarget `json:"upstreams,omitempty" gorm:"serializer:json"`
+	LoadBalancing *LoadBalancing   `json:"load_balancing,omitempty" gorm:"serializer:json"`
+	HealthChecks  *HealthChecks    `json:"health_checks,omitempty" gorm:"serializer:json"`
+	// Canary sends part of the traffic to a new upstream version
+	Canary *Canary `json:"canary,omitempty" gorm:"serializer:json"`
+	// TLS configures how https upstreams are verified and authenticated to
+	TLS *UpstreamTLS `json:"tls,omitempty" gorm:"serializer:json"`
+	// UpstreamAuth are the credentials the gateway presents to the upstream
+	UpstreamAuth *UpstreamAuth `json:"upstream_auth,omitempty" gorm:"serializer:json"`
+	// RequestHeaders rewrites the request headers sent to the upstream
+	RequestHeaders *HeaderPolicy `json:"request_headers,omitempty" gorm:"serializer:json"`
+	// Transforms rewrites requests to and responses from the upstream
+	Transforms *Transforms `json:"transforms,omitempty" gorm:"serializer:json"`
+	// SpecName names the stored OpenAPI document requests are validated against
+	SpecName string `json:"spec,omitempty"`
+	// ResponseValidation is "monitor" to check upstream responses against the
+	// spec without blocking them; empty leaves responses unchecked
+	ResponseValidation string `json:"response_validation,omitempty"`
+}
+
+// Targets returns the upstream targets of the API
+func (c *APIConfig) Targets() []UpstreamTarget {
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+	return []UpstreamTarget{{URL: c.Upstream}}
+}
+
+// UpstreamTarget is one of the upstreams an API's requests are balanced across
+type UpstreamTarget struct {
+	URL string `json:"url"`
+	// Weight is the relative share of requests with round robin; 0 means 1
+	Weight int `json:"weight,omitempty"`
+}
+
+// Load balancing policies
+const (
+	LoadBalanceRoundRobin = "round_robin"
+	LoadBalanceLeastConn  = "least_conn"
+	LoadBalanceHeaderHash = "header_hash"
+)
+
+// LoadBalancing selects the upstream target of each request. Durations use
+// Caddy's duration syntax (e.g. "5s").
+type LoadBalancing struct {
+	// Policy is round_robin (default), least_conn, or header_hash, which
+	// pins each subscription key to one target
+	Policy string `json:"policy,omitempty"`
+	// Retries is how many other targets are tried when a target cannot be reached
+	Retries     int    `json:"retries,omitempty"`
+	TryDuration string `json:"try_duration,omitempty"`
+}
+
+// HealthChecks configures how unhealthy upstream targets are detected
+type HealthChecks struct {
+	Active  *ActiveHealthCheck  `json:"active,omitempty"`
+	Passive *PassiveHealthCheck `json:"passive,omitempty"`
+}
+
+// ActiveHealthCheck polls every target in the background
+type ActiveHealthCheck struct {
+	// Path is requested on each target, e.g. "/health"
+	Path         string `json:"path"`
+	Interval     string `json:"interval,omitempty"`
+	Timeout      string `json:"timeout,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty"`
+}
+
+// PassiveHealthCheck marks a target unhealthy after failed proxied requests
+type PassiveHealthCheck struct {
+	// FailDuration is how long a failure is remembered
+	FailDuration     string `json:"fail_duration"`
+	MaxFails         int    `json:"max_fails,omitempty"`
+	UnhealthyStatus  []int  `json:"unhealthy_status,omitempty"`
+	UnhealthyLatency string `json:"unhealthy_latency,omitempty"`
+}
+
+// Canary routes a share of an API's requests, or the requests of pinned
+// subscription keys, to a new upstream while the rest stay on the API's
+// upstreams
+type Canary struct {
+	Upstream string `json:"upstream"`
+	// Weight is the percentage of requests (0-100) sent to the canary
+	Weight int `json:"weight"`
+	// Sticky sends every request of a subscription key to the same version.
+	// Keys move to the canary as the weight grows and never move back
+	// until it shrinks.
+	Sticky bool `json:"sticky,omitempty"`
+	// Keys are the digests of subscription keys always sent to the canary
+	Keys []string `json:"keys,omitempty"`
+}
+
+// UpstreamTLS configures the TLS connections to an API's https upstreams.
+// Upstream certificates are verified against the system roots unless CA
+// names a stored bundle to trust instead.
+type UpstreamTLS struct {
+	// CA names the stored certificate bundle upstream certificates must chain to
+	CA string `json:"ca,omitempty"`
+	// ServerName overrides the SNI and the name the certificate is verified for
+	ServerName string `json:"server_name,omitempty"`
+	// PinnedSHA256 are base64 SHA-256 digests of subject public keys; the
+	// upstream's chain must contain one of them
+	PinnedSHA256 []string `json:"pinned_sha256,omitempty"`
+	// ClientCertificate names the stored certificate and key presented to
+	// upstreams that require mutual TLS
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	// InsecureSkipVerify disables certificate verification; pins still apply
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// Certificates returns the names of the stored certificates the settings use
+func (t *UpstreamTLS) Certificates() []string {
+	var names []string
+	if t == nil {
+		return names
+	}
+	if t.CA != "" {
+		names = append(names, t.CA)
+	}
+	if t.ClientCertificate != "" {
+		names = append(names, t.ClientCertificate)
+	}
+	return names
+}
+
+// HeaderPolicy rewrites the request headers sent to an API's upstream. The
+// operations apply in the order remove, rename, set, append.
+type HeaderPolicy struct {
+	Remove []string          `json:"remove,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Append map[string]string `json:"append,omitempty"`
+	// DisableIdentity stops sending the X-Veil identity headers
+	DisableIdentity bool `json:"disable_identity,omitempty"`
+}
+
+// Transforms rewrites an API's requests before they are proxied and the
+// upstream's responses before they are returned
+type Transforms struct {
+	Request  *RequestTransform  `json:"request,omitempty"`
+	Response *ResponseTransform `json:"response,omitempty"`
+}
+
+// RequestTransform rewrites requests sent to the upstream. JSON field paths
+// are dot separated and apply to every element of the arrays they cross.
+type RequestTransform struct {
+	// Paths rewrites the path below the API path; the first matching rule applies
+	Paths       []PathRewrite     `json:"paths,omitempty"`
+	SetQuery    map[string]string `json:"set_query,omitempty"`
+	RemoveQuery []string          `json:"remove_query,omitempty"`
+	// RenameFields maps JSON body field paths to their new names
+	RenameFields map[string]string `json:"rename_fields,omitempty"`
+}
+
+// PathRewrite rewrites request paths matching From to To. Segments of From
+// like {id} capture a path segment and a trailing * captures the rest of the
+// path; To inserts them where it has the same {id} and *.
+type PathRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ResponseTransform rewrites upstream responses. Field rules only apply to
+// JSON bodies.
+type ResponseTransform struct {
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	// RenameFields maps JSON body field paths to their new names
+	RenameFields map[string]string `json:"rename_fields,omitempty"`
+	// RemoveFields lists JSON body field paths that are not returned
+	RemoveFields []string `json:"remove_fields,omitempty"`
+}
+
+// Upstream authentication types
+const (
+	UpstreamAuthHeader = "header"
+	UpstreamAuthBasic  = "basic"
+	UpstreamAuthOAuth2 = "oauth2"
+)
+
+// UpstreamAuth are the credentials sent to an API's upstream in place of the
+// caller's subscription key. Value, Password and ClientSecret are encrypted
+// at rest.
+type UpstreamAuth struct {
+	// Type is header, basic or oauth2
+	Type string `json:"type"`
+	// Header and Value are the static header of header authentication
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Username and Password are sent with basic authentication
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TokenURL, ClientID, ClientSecret and Scopes request an OAuth2 access
+	// token with the client credentials grant
+	TokenURL     string   `json:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// TLSCertificate is a stored PEM certificate bundle, with a private key for
+// client certificates. Certificate and PrivateKey are encrypted at rest.
+type TLSCertificate struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;not null"`
+	Certificate string `gorm:"not null"`
+	PrivateKey  string
+	// Subject, NotAfter and Fingerprint describe the first certificate of
+	// the bundle, so listings need not decrypt it
+	Subject       string
+	NotAfter      time.Time
+	Fingerprint   string
+	HasPrivateKey bool
+}
+
+// ResponseValidationMonitor counts and logs response contract violations
+const ResponseValidationMonitor = "monitor"
+
+// APISpec is a stored OpenAPI 3 document APIs can be validated against
+type APISpec struct {
+	gorm.Model
+	Name     string `json:"name" gorm:"uniqueIndex;not null"`
+	Document string `json:"document" gorm:"not null"`
 }
 
 // APIOnboardRequest represents a request to onboard a new API
@@ -0,0 +1,611 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnknownPath is returned by Match for a path no operation serves
+	ErrUnknownPath = errors.New("path is not described by the API document")
+	// ErrUnknownMethod is returned by Match for a path without an operation
+	// for the method
+	ErrUnknownMethod = errors.New("method is not described by the API document")
+)
+
+// specURL is the URL the document is compiled under; $ref to other documents
+// cannot be loaded
+const specURL = "mem:///openapi.json"
+
+// maxViolations bounds the violations reported for one body
+const maxViolations = 20
+
+// Violation is a part of a request or response that breaks the contract
+type Violation struct {
+	Name   string `json:"name"`
+	In     string `json:"in"`
+	Reason string `json:"reason"`
+}
+
+// Contract validates requests and responses against the operations of an
+// OpenAPI document. Paths are matched against the request path below the API
+// path, so they are relative to the API's upstream.
+type Contract struct {
+	routes []*route
+}
+
+// route is a compiled path template with its operations by method
+type route struct {
+	template   string
+	pattern    *regexp.Regexp
+	names      []string
+	literal    int
+	operations map[string]*operationContract
+}
+
+// operationContract holds the compiled rules of an operation
+type operationContract struct {
+	params    []paramContract
+	body      *bodyContract
+	responses map[string][]mediaContract
+}
+
+// paramContract is a parameter with the schema its values are checked with
+type paramContract struct {
+	name     string
+	in       string
+	required bool
+	kind     string
+	itemKind string
+	schema   *jsonschema.Schema
+}
+
+// bodyContract lists the content types of a request body
+type bodyContract struct {
+	required bool
+	content  []mediaContract
+}
+
+// mediaContract is a content type with the schema of its JSON bodies, if any
+type mediaContract struct {
+	mediaType string
+	schema    *jsonschema.Schema
+}
+
+// Compile parses an OpenAPI 3.x document and compiles the schemas of every
+// operation. OpenAPI 3.0 schemas are checked as JSON Schema draft 4 with
+// nullable, 3.1 schemas as draft 2020-12.
+func Compile(data []byte) (*Contract, error) {
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	legacy := strings.HasPrefix(doc.OpenAPI, "3.0")
+	encoded, err := json.Marshal(normalize(raw, legacy))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	if legacy {
+		compiler.Draft = jsonschema.Draft4
+	}
+	if err := compiler.AddResource(specURL, bytes.NewReader(encoded)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	compile := func(ptr string) (*jsonschema.Schema, error) {
+		schema, err := compiler.Compile(specURL + "#" + ptr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: schema at %s: %v", ErrInvalidSpec, ptr, err)
+		}
+		return schema, nil
+	}
+
+	c := &Contract{}
+	for template, item := range doc.Paths {
+		if item == nil {
+			continue
+		}
+		if item.Ref != "" {
+			return nil, fmt.Errorf("%w: path %s: $ref path items are not supported", ErrInvalidSpec, template)
+		}
+		rt := newRoute(template)
+		itemPtr := "/paths/" + escapePointer(template)
+		for _, op := range item.operations() {
+			opPtr := itemPtr + "/" + strings.ToLower(op.method)
+			compiled, err := doc.compileOperation(item, op.op, itemPtr, opPtr, compile)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", op.method, template, err)
+			}
+			rt.operations[op.method] = compiled
+		}
+		if len(rt.operations) > 0 {
+			c.routes = append(c.routes, rt)
+		}
+	}
+
+	// Concrete paths are matched before templated ones
+	sort.Slice(c.routes, func(i, j int) bool {
+		a, b := c.routes[i], c.routes[j]
+		if len(a.names) != len(b.names) {
+			return len(a.names) < len(b.names)
+		}
+		if a.literal != b.literal {
+			return a.literal > b.literal
+		}
+		return a.template < b.template
+	})
+	return c, nil
+}
+
+// templateParam matches a {parameter} in a path template
+var templateParam = regexp.MustCompile(`\{([^}/]+)\}`)
+
+// newRoute compiles a path template to a pattern with one group per parameter
+func newRoute(template string) *route {
+	rt := &route{template: template, operations: make(map[string]*operationContract)}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, loc := range templateParam.FindAllStringSubmatchIndex(template, -1) {
+		literal := template[last:loc[0]]
+		pattern.WriteString(regexp.QuoteMeta(literal))
+		pattern.WriteString("([^/]+)")
+		rt.literal += len(literal)
+		rt.names = append(rt.names, template[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+	rt.literal += len(template) - last
+	rt.pattern = regexp.MustCompile(pattern.String())
+	return rt
+}
+
+// compileOperation compiles the parameters, request body and responses of an
+// operation
+func (d *Document) compileOperation(item *PathItem, op *Operation, itemPtr, opPtr string,
+	compile func(string) (*jsonschema.Schema, error)) (*operationContract, error) {
+	compiled := &operationContract{responses: make(map[string][]mediaContract)}
+
+	// Operation parameters override path item parameters
+	index := make(map[string]int)
+	for _, list := range []struct {
+		params []Parameter
+		ptr    string
+	}{{item.Parameters, itemPtr}, {op.Parameters, opPtr}} {
+		for i, param := range list.params {
+			ptr := fmt.Sprintf("%s/parameters/%d", list.ptr, i)
+			p, err := d.compileParameter(param, ptr, compile)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil {
+				continue
+			}
+			key := p.in + ":" + p.name
+			if i, ok := index[key]; ok {
+				compiled.params[i] = *p
+				continue
+			}
+			index[key] = len(compiled.params)
+			compiled.params = append(compiled.params, *p)
+		}
+	}
+
+	if body := op.RequestBody; body != nil {
+		ptr := opPtr + "/requestBody"
+		for depth := 0; body.Ref != ""; depth++ {
+			name, err := localRef(body.Ref, "requestBodies", depth)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+			}
+			ptr = strings.TrimPrefix(body.Ref, "#")
+			if body = d.Components.RequestBodies[name]; body == nil {
+				return nil, fmt.Errorf("%w: unknown request body %s", ErrInvalidSpec, name)
+			}
+		}
+		content, err := compileContent(body.Content, ptr, compile)
+		if err != nil {
+			return nil, err
+		}
+		compiled.body = &bodyContract{required: body.Required, content: content}
+	}
+
+	for status, response := range op.Responses {
+		if response == nil {
+			continue
+		}
+		ptr := opPtr + "/responses/" + escapePointer(status)
+		for depth := 0; response.Ref != ""; depth++ {
+			name, err := localRef(response.Ref, "responses", depth)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+			}
+			ptr = strings.TrimPrefix(response.Ref, "#")
+			if response = d.Components.Responses[name]; response == nil {
+				return nil, fmt.Errorf("%w: unknown response %s", ErrInvalidSpec, name)
+			}
+		}
+		content, err := compileContent(response.Content, ptr, compile)
+		if err != nil {
+			return nil, err
+		}
+		compiled.responses[strings.ToUpper(status)] = content
+	}
+	return compiled, nil
+}
+
+// compileParameter resolves and compiles a parameter. Cookie parameters and
+// the headers OpenAPI ignores yield nil.
+func (d *Document) compileParameter(param Parameter, ptr string,
+	compile func(string) (*jsonschema.Schema, error)) (*paramContract, error) {
+	resolved, err := d.resolveParameter(param)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	ptr = d.parameterPointer(param, ptr)
+	switch resolved.In {
+	case "path", "query", "header":
+	default:
+		return nil, nil
+	}
+	if resolved.In == "header" && ignoredHeader(resolved.Name) {
+		return nil, nil
+	}
+
+	p := &paramContract{
+		name:     resolved.Name,
+		in:       resolved.In,
+		required: resolved.Required || resolved.In == "path",
+	}
+	if resolved.Schema != nil {
+		p.kind = string(resolved.Schema.Type)
+		if items, err := d.resolveSchema(resolved.Schema.Items); err == nil && items != nil {
+			p.itemKind = string(items.Type)
+		}
+		if p.schema, err = compile(ptr + "/schema"); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parameterPointer returns the JSON pointer of the parameter a chain of
+// references ends at
+func (d *Document) parameterPointer(param Parameter, ptr string) string {
+	for depth := 0; param.Ref != "" && depth < maxRefDepth; depth++ {
+		ptr = strings.TrimPrefix(param.Ref, "#")
+		target := d.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]
+		if target == nil {
+			break
+		}
+		param = *target
+	}
+	return ptr
+}
+
+// compileContent compiles the schemas of the JSON content types of a body
+func compileContent(content map[string]MediaType, ptr string,
+	compile func(string) (*jsonschema.Schema, error)) ([]mediaContract, error) {
+	var out []mediaContract
+	for mediaType, media := range content {
+		mc := mediaContract{mediaType: baseMediaType(mediaType)}
+		if media.Schema != nil && isJSON(mc.mediaType) {
+			schema, err := compile(ptr + "/content/" + escapePointer(mediaType) + "/schema")
+			if err != nil {
+				return nil, err
+			}
+			mc.schema = schema
+		}
+		out = append(out, mc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].mediaType < out[j].mediaType })
+	return out, nil
+}
+
+// Match is an operation of the contract matched by a request
+type Match struct {
+	// Template is the path template of the operation
+	Template   string
+	op         *operationContract
+	pathValues map[string]string
+}
+
+// Match finds the operation for a method and a path below the API path.
+// HEAD requests use the GET operation unless HEAD is described.
+func (c *Contract) Match(method, path string) (*Match, error) {
+	if path == "" {
+		path = "/"
+	}
+	pathMatched := false
+	for _, rt := range c.routes {
+		values := rt.pattern.FindStringSubmatch(path)
+		if values == nil {
+			continue
+		}
+		pathMatched = true
+		op, ok := rt.operations[method]
+		if !ok && method == http.MethodHead {
+			op, ok = rt.operations[http.MethodGet]
+		}
+		if !ok {
+			continue
+		}
+		m := &Match{Template: rt.template, op: op, pathValues: make(map[string]string, len(rt.names))}
+		for i, name := range rt.names {
+			m.pathValues[name] = values[i+1]
+		}
+		return m, nil
+	}
+	if pathMatched {
+		return nil, ErrUnknownMethod
+	}
+	return nil, ErrUnknownPath
+}
+
+// ValidateRequest checks the parameters, content type and body of a request.
+// The body schema is only checked when complete is set, i.e. the whole body
+// was read.
+func (m *Match) ValidateRequest(query url.Values, header http.Header, body []byte, complete bool) []Violation {
+	var violations []Violation
+	for _, p := range m.op.params {
+		var values []string
+		switch p.in {
+		case "path":
+			values = []string{m.pathValues[p.name]}
+		case "query":
+			values = query[p.name]
+		case "header":
+			values = header.Values(p.name)
+		}
+		if len(values) == 0 {
+			if p.required {
+				violations = append(violations, Violation{Name: p.name, In: p.in, Reason: "missing required parameter"})
+			}
+			continue
+		}
+		if v := p.validate(values); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+
+	if m.op.body == nil {
+		return violations
+	}
+	if len(body) == 0 {
+		if m.op.body.required {
+			violations = append(violations, Violation{Name: "body", In: "body", Reason: "missing required request body"})
+		}
+		return violations
+	}
+	contentType := header.Get("Content-Type")
+	media, ok := matchMedia(m.op.body.content, contentType)
+	if !ok {
+		return append(violations, Violation{Name: "Content-Type", In: "header",
+			Reason: fmt.Sprintf("content type %q is not accepted", contentType)})
+	}
+	if complete && media.schema != nil {
+		violations = append(violations, validateJSON(media.schema, body, "body")...)
+	}
+	return violations
+}
+
+// ValidateResponse checks the status, content type and body of a response.
+// The body schema is only checked when complete is set.
+func (m *Match) ValidateResponse(status int, header http.Header, body []byte, complete bool) []Violation {
+	if len(m.op.responses) == 0 {
+		// An operation without documented responses does not constrain them
+		return nil
+	}
+	content, ok := m.op.responses[strconv.Itoa(status)]
+	if !ok {
+		content, ok = m.op.responses[fmt.Sprintf("%dXX", status/100)]
+	}
+	if !ok {
+		content, ok = m.op.responses["DEFAULT"]
+	}
+	if !ok {
+		return []Violation{{Name: "status", In: "response", Reason: fmt.Sprintf("status %d is not documented", status)}}
+	}
+	if len(content) == 0 || len(body) == 0 {
+		return nil
+	}
+
+	contentType := header.Get("Content-Type")
+	media, ok := matchMedia(content, contentType)
+	if !ok {
+		return []Violation{{Name: "Content-Type", In: "response",
+			Reason: fmt.Sprintf("content type %q is not documented for status %d", contentType, status)}}
+	}
+	if complete && media.schema != nil {
+		return validateJSON(media.schema, body, "response")
+	}
+	return nil
+}
+
+// validate checks the values of a parameter against its schema, converting
+// them to the schema's type first
+func (p *paramContract) validate(values []string) *Violation {
+	if p.schema == nil {
+		return nil
+	}
+	var value interface{}
+	switch p.kind {
+	case "array":
+		if len(values) == 1 && p.in != "query" {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			items = append(items, convert(v, p.itemKind))
+		}
+		value = items
+	case "object":
+		// Serialized objects cannot be checked without their style
+		return nil
+	default:
+		value = convert(values[0], p.kind)
+	}
+	if err := p.schema.Validate(value); err != nil {
+		return &Violation{Name: p.name, In: p.in, Reason: leafReason(err)}
+	}
+	return nil
+}
+
+// convert turns a parameter value into the JSON type of its schema. Values
+// that do not convert stay strings so the schema reports the type mismatch.
+func convert(value, kind string) interface{} {
+	switch kind {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+			return b
+		}
+	}
+	return value
+}
+
+// validateJSON checks a JSON body against a schema and returns a violation per
+// failing location
+func validateJSON(schema *jsonschema.Schema, body []byte, in string) []Violation {
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil || dec.More() {
+		return []Violation{{Name: in, In: in, Reason: "body is not valid JSON"}}
+	}
+	err := schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []Violation{{Name: in, In: in, Reason: err.Error()}}
+	}
+
+	var violations []Violation
+	var walk func(*jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(violations) >= maxViolations {
+			return
+		}
+		if len(e.Causes) == 0 {
+			name := e.InstanceLocation
+			if name == "" {
+				name = "/"
+			}
+			violations = append(violations, Violation{Name: name, In: in, Reason: e.Message})
+			return
+		}
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(ve)
+	return violations
+}
+
+// leafReason returns the message of the first failing keyword of an error
+func leafReason(err error) string {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err.Error()
+	}
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	return ve.Message
+}
+
+// matchMedia returns the content type of a body matching a Content-Type
+// header, preferring exact types over type/* and */* ranges
+func matchMedia(content []mediaContract, contentType string) (mediaContract, bool) {
+	mediaType := baseMediaType(contentType)
+	major, _, _ := strings.Cut(mediaType, "/")
+	best, rank := mediaContract{}, 0
+	for _, mc := range content {
+		switch {
+		case mc.mediaType == mediaType && mediaType != "":
+			return mc, true
+		case mc.mediaType == major+"/*" && major != "" && rank < 2:
+			best, rank = mc, 2
+		case mc.mediaType == "*/*" && rank < 1:
+			best, rank = mc, 1
+		}
+	}
+	return best, rank > 0
+}
+
+// baseMediaType returns the lower-cased media type without parameters
+func baseMediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// isJSON reports whether a media type carries JSON
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// escapePointer escapes a JSON pointer token for use in a URL fragment
+func escapePointer(token string) string {
+	token = strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+	return url.PathEscape(token)
+}
+
+// normalize converts a decoded YAML document to JSON-compatible values. For
+// OpenAPI 3.0 documents, nullable schemas also accept null.
+func normalize(v interface{}, nullable bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalize(value, nullable)
+		}
+		if nullable && v["nullable"] == true {
+			if t, ok := v["type"].(string); ok {
+				v["type"] = []interface{}{t, "null"}
+			}
+			if enum, ok := v["enum"].([]interface{}); ok {
+				v["enum"] = append(enum, nil)
+			}
+		}
+		return v
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[fmt.Sprint(key)] = value
+		}
+		return normalize(out, nullable)
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalize(value, nullable)
+		}
+		return v
+	}
+	return v
+}
@@ -0,0 +1,308 @@
+package openapi
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ordersContract = `
+openapi: 3.0.3
+paths:
+  /orders:
+    get:
+      parameters:
+        - name: status
+          in: query
+          schema:
+            type: string
+            enum: [open, closed]
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            maximum: 100
+        - name: tag
+          in: query
+          schema:
+            type: array
+            items:
+              type: string
+              maxLength: 3
+      responses:
+        200:
+          description: Orders
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: '#/components/schemas/Order'
+    post:
+      parameters:
+        - name: X-Request-Id
+          in: header
+          required: true
+          schema:
+            type: string
+            format: uuid
+      requestBody:
+        $ref: '#/components/requestBodies/NewOrder'
+      responses:
+        '201':
+          $ref: '#/components/responses/Order'
+        4XX:
+          description: Rejected
+          content:
+            application/problem+json:
+              schema:
+                type: object
+                required: [title]
+  /orders/summary:
+    get:
+      responses:
+        default:
+          description: Summary
+  /orders/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+          minimum: 1
+    get:
+      responses:
+        '200':
+          $ref: '#/components/responses/Order'
+    delete:
+      responses:
+        '204':
+          description: Deleted
+components:
+  schemas:
+    Order:
+      type: object
+      required: [id, quantity]
+      properties:
+        id:
+          type: integer
+        quantity:
+          type: integer
+          minimum: 1
+        note:
+          type: string
+          nullable: true
+  requestBodies:
+    NewOrder:
+      required: true
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [quantity]
+            properties:
+              quantity:
+                type: integer
+                exclusiveMinimum: true
+                minimum: 0
+        text/*: {}
+  responses:
+    Order:
+      description: An order
+      content:
+        application/json:
+          schema:
+            $ref: '#/components/schemas/Order'
+`
+
+func TestContract_Match(t *testing.T) {
+	contract, err := Compile([]byte(ordersContract))
+	require.NoError(t, err)
+
+	tests := []struct {
+		method       string
+		path         string
+		wantTemplate string
+		wantErr      error
+	}{
+		{method: http.MethodGet, path: "/orders", wantTemplate: "/orders"},
+		{method: http.MethodGet, path: "/orders/summary", wantTemplate: "/orders/summary"},
+		{method: http.MethodGet, path: "/orders/42", wantTemplate: "/orders/{id}"},
+		{method: http.MethodHead, path: "/orders/42", wantTemplate: "/orders/{id}"},
+		{method: http.MethodDelete, path: "/orders/42", wantTemplate: "/orders/{id}"},
+		{method: http.MethodDelete, path: "/orders", wantErr: ErrUnknownMethod},
+		{method: http.MethodGet, path: "/orders/42/items", wantErr: ErrUnknownPath},
+		{method: http.MethodGet, path: "", wantErr: ErrUnknownPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			m, err := contract.Match(tt.method, tt.path)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTemplate, m.Template)
+		})
+	}
+}
+
+func TestMatch_ValidateRequest(t *testing.T) {
+	contract, err := Compile([]byte(ordersContract))
+	require.NoError(t, err)
+
+	const requestID = "7b0c3c2e-8f5a-4a7e-9a53-2f2b8d6d1c11"
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		query       string
+		contentType string
+		requestID   string
+		body        string
+		want        []Violation
+	}{
+		{name: "valid query", method: http.MethodGet, path: "/orders", query: "status=open&limit=10&tag=a&tag=b"},
+		{name: "query enum", method: http.MethodGet, path: "/orders", query: "status=lost",
+			want: []Violation{{Name: "status", In: "query", Reason: "value must be one of \"open\", \"closed\""}}},
+		{name: "query type", method: http.MethodGet, path: "/orders", query: "limit=ten",
+			want: []Violation{{Name: "limit", In: "query", Reason: "expected integer, but got string"}}},
+		{name: "query maximum", method: http.MethodGet, path: "/orders", query: "limit=101",
+			want: []Violation{{Name: "limit", In: "query", Reason: "must be <= 100 but found 101"}}},
+		{name: "query array items", method: http.MethodGet, path: "/orders", query: "tag=a&tag=long",
+			want: []Violation{{Name: "tag", In: "query", Reason: "length must be <= 3, but got 4"}}},
+		{name: "path parameter", method: http.MethodGet, path: "/orders/0",
+			want: []Violation{{Name: "id", In: "path", Reason: "must be >= 1 but found 0"}}},
+		{name: "valid body", method: http.MethodPost, path: "/orders", contentType: "application/json; charset=utf-8",
+			requestID: requestID, body: `{"quantity": 2}`},
+		{name: "text body", method: http.MethodPost, path: "/orders", contentType: "text/plain",
+			requestID: requestID, body: "two please"},
+		{name: "missing header and body", method: http.MethodPost, path: "/orders",
+			want: []Violation{
+				{Name: "X-Request-Id", In: "header", Reason: "missing required parameter"},
+				{Name: "body", In: "body", Reason: "missing required request body"},
+			}},
+		{name: "header format", method: http.MethodPost, path: "/orders", contentType: "application/json",
+			requestID: "42", body: `{"quantity": 2}`,
+			want: []Violation{{Name: "X-Request-Id", In: "header", Reason: "'42' is not valid 'uuid'"}}},
+		{name: "content type", method: http.MethodPost, path: "/orders", contentType: "application/xml",
+			requestID: requestID, body: `<order/>`,
+			want: []Violation{{Name: "Content-Type", In: "header", Reason: "content type \"application/xml\" is not accepted"}}},
+		{name: "body schema", method: http.MethodPost, path: "/orders", contentType: "application/json",
+			requestID: requestID, body: `{"quantity": 0}`,
+			want: []Violation{{Name: "/quantity", In: "body", Reason: "must be > 0 but found 0"}}},
+		{name: "malformed body", method: http.MethodPost, path: "/orders", contentType: "application/json",
+			requestID: requestID, body: `{"quantity":`,
+			want: []Violation{{Name: "body", In: "body", Reason: "body is not valid JSON"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := contract.Match(tt.method, tt.path)
+			require.NoError(t, err)
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			header := http.Header{}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			if tt.requestID != "" {
+				header.Set("X-Request-Id", tt.requestID)
+			}
+			assert.Equal(t, tt.want, m.ValidateRequest(query, header, []byte(tt.body), true))
+		})
+	}
+
+	// Incomplete bodies are only checked for their content type
+	m, err := contract.Match(http.MethodPost, "/orders")
+	require.NoError(t, err)
+	header := http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {requestID}}
+	assert.Empty(t, m.ValidateRequest(nil, header, []byte(`{"quantity": 0`), false))
+}
+
+func TestMatch_ValidateResponse(t *testing.T) {
+	contract, err := Compile([]byte(ordersContract))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		status      int
+		contentType string
+		body        string
+		want        []Violation
+	}{
+		{name: "valid", method: http.MethodGet, path: "/orders/1", status: 200, contentType: "application/json",
+			body: `{"id": 1, "quantity": 2, "note": null}`},
+		{name: "nullable", method: http.MethodGet, path: "/orders", status: 200, contentType: "application/json",
+			body: `[{"id": 1, "quantity": 2, "note": 7}]`,
+			want: []Violation{{Name: "/0/note", In: "response", Reason: "expected string or null, but got number"}}},
+		{name: "missing property", method: http.MethodGet, path: "/orders/1", status: 200, contentType: "application/json",
+			body: `{"id": 1}`,
+			want: []Violation{{Name: "/", In: "response", Reason: "missing properties: 'quantity'"}}},
+		{name: "status range", method: http.MethodPost, path: "/orders", status: 422, contentType: "application/problem+json",
+			body: `{"title": "no stock"}`},
+		{name: "undocumented status", method: http.MethodGet, path: "/orders/1", status: 500,
+			want: []Violation{{Name: "status", In: "response", Reason: "status 500 is not documented"}}},
+		{name: "default response", method: http.MethodGet, path: "/orders/summary", status: 503, body: "down"},
+		{name: "content type", method: http.MethodGet, path: "/orders/1", status: 200, contentType: "text/html",
+			body: "<p>1</p>",
+			want: []Violation{{Name: "Content-Type", In: "response", Reason: "content type \"text/html\" is not documented for status 200"}}},
+		{name: "empty body", method: http.MethodDelete, path: "/orders/1", status: 204},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := contract.Match(tt.method, tt.path)
+			require.NoError(t, err)
+			header := http.Header{}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			assert.Equal(t, tt.want, m.ValidateResponse(tt.status, header, []byte(tt.body), true))
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	// OpenAPI 3.1 schemas are JSON Schema 2020-12
+	contract, err := Compile([]byte(`{
+		"openapi": "3.1.0",
+		"paths": {"/items": {"post": {
+			"requestBody": {"content": {"application/json": {"schema": {
+				"type": "object",
+				"properties": {"price": {"type": ["number", "null"], "exclusiveMinimum": 0}}
+			}}}}
+		}}}
+	}`))
+	require.NoError(t, err)
+	m, err := contract.Match(http.MethodPost, "/items")
+	require.NoError(t, err)
+	header := http.Header{"Content-Type": {"application/json"}}
+	assert.Empty(t, m.ValidateRequest(nil, header, []byte(`{"price": null}`), true))
+	assert.Equal(t, []Violation{{Name: "/price", In: "body", Reason: "must be > 0 but found 0"}},
+		m.ValidateRequest(nil, header, []byte(`{"price": 0}`), true))
+
+	invalid := []struct {
+		name string
+		spec string
+	}{
+		{name: "external reference", spec: `{"openapi": "3.0.0", "paths": {"/a": {"get": {"responses": {"200": {
+			"description": "ok", "content": {"application/json": {"schema": {"$ref": "other.json#/Thing"}}}}}}}}}`},
+		{name: "invalid schema", spec: `{"openapi": "3.0.0", "paths": {"/a": {"get": {"responses": {"200": {
+			"description": "ok", "content": {"application/json": {"schema": {"type": 5}}}}}}}}}`},
+		{name: "unknown request body", spec: `{"openapi": "3.0.0", "paths": {"/a": {"post": {
+			"requestBody": {"$ref": "#/components/requestBodies/Missing"}}}}}`},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.spec))
+			assert.ErrorIs(t, err, ErrInvalidSpec)
+		})
+	}
+}
@@ -0,0 +1,721 @@
+// Package openapi derives API configurations from OpenAPI 3 documents
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidSpec is returned for a document that cannot be converted
+var ErrInvalidSpec = errors.New("invalid OpenAPI document")
+
+// maxRefDepth bounds chains of $ref
+const maxRefDepth = 16
+
+// Document is the subset of an OpenAPI 3.x document used for onboarding. JSON
+// documents are decoded as YAML.
+type Document struct {
+	OpenAPI    string                 `yaml:"openapi"`
+	Servers    []Server               `yaml:"servers"`
+	Paths      map[string]*PathItem   `yaml:"paths"`
+	Components Components             `yaml:"components"`
+	Security   *[]SecurityRequirement `yaml:"security"`
+}
+
+// Server is a base URL of the API
+type Server struct {
+	URL       string                    `yaml:"url"`
+	Variables map[string]ServerVariable `yaml:"variables"`
+}
+
+// ServerVariable is a substitution in a server URL
+type ServerVariable struct {
+	Default string `yaml:"default"`
+}
+
+// PathItem holds the operations of a path template
+type PathItem struct {
+	Ref        string      `yaml:"$ref"`
+	Servers    []Server    `yaml:"servers"`
+	Parameters []Parameter `yaml:"parameters"`
+	Get        *Operation  `yaml:"get"`
+	Put        *Operation  `yaml:"put"`
+	Post       *Operation  `yaml:"post"`
+	Delete     *Operation  `yaml:"delete"`
+	Options    *Operation  `yaml:"options"`
+	Head       *Operation  `yaml:"head"`
+	Patch      *Operation  `yaml:"patch"`
+	Trace      *Operation  `yaml:"trace"`
+}
+
+// Operation is a single method of a path
+type Operation struct {
+	Servers     []Server               `yaml:"servers"`
+	Parameters  []Parameter            `yaml:"parameters"`
+	Security    *[]SecurityRequirement `yaml:"security"`
+	RequestBody *RequestBody           `yaml:"requestBody"`
+	Responses   map[string]*Response   `yaml:"responses"`
+}
+
+// RequestBody describes the body an operation accepts
+type RequestBody struct {
+	Ref      string               `yaml:"$ref"`
+	Required bool                 `yaml:"required"`
+	Content  map[string]MediaType `yaml:"content"`
+}
+
+// Response describes a response of an operation
+type Response struct {
+	Ref     string               `yaml:"$ref"`
+	Content map[string]MediaType `yaml:"content"`
+}
+
+// MediaType holds the schema of a body in one content type. The schema is
+// compiled from the document itself, so only its presence is decoded.
+type MediaType struct {
+	Schema interface{} `yaml:"schema"`
+}
+
+// SecurityRequirement maps security scheme names to their scopes
+type SecurityRequirement map[string][]string
+
+// Parameter is an operation parameter
+type Parameter struct {
+	Ref      string  `yaml:"$ref"`
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *Schema `yaml:"schema"`
+}
+
+// Schema is the part of a parameter schema that maps to a validation pattern
+type Schema struct {
+	Ref     string        `yaml:"$ref"`
+	Type    SchemaType    `yaml:"type"`
+	Format  string        `yaml:"format"`
+	Pattern string        `yaml:"pattern"`
+	Enum    []interface{} `yaml:"enum"`
+	Items   *Schema       `yaml:"items"`
+}
+
+// SchemaType is the type of a schema. OpenAPI 3.1 allows a list of types, of
+// which the first one other than null is used.
+type SchemaType string
+
+// UnmarshalYAML accepts a type name or a list of type names
+func (t *SchemaType) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var types []string
+		if err := node.Decode(&types); err != nil {
+			return err
+		}
+		for _, name := range types {
+			if name != "null" {
+				*t = SchemaType(name)
+				return nil
+			}
+		}
+		return nil
+	}
+	var name string
+	if err := node.Decode(&name); err != nil {
+		return err
+	}
+	*t = SchemaType(name)
+	return nil
+}
+
+// SecurityScheme describes how an operation is authenticated
+type SecurityScheme struct {
+	Ref  string `yaml:"$ref"`
+	Type string `yaml:"type"`
+	Name string `yaml:"name"`
+	In   string `yaml:"in"`
+}
+
+// Components holds the reusable objects that $ref can point to
+type Components struct {
+	Parameters      map[string]*Parameter      `yaml:"parameters"`
+	Schemas         map[string]*Schema         `yaml:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `yaml:"securitySchemes"`
+	RequestBodies   map[string]*RequestBody    `yaml:"requestBodies"`
+	Responses       map[string]*Response       `yaml:"responses"`
+}
+
+// Options control how a document is mapped to API configurations
+type Options struct {
+	// Upstream replaces the scheme and host of the server URLs, and is
+	// required when they are relative
+	Upstream string
+	// Prefix is prepended to the server paths to form the gateway paths
+	Prefix string
+	// SubscriptionHeader is the gateway's subscription key header, which is
+	// never added to the required headers
+	SubscriptionHeader string
+}
+
+// Result holds the derived API configurations, ordered by path, and notes
+// about parts of the document that could not be mapped
+type Result struct {
+	APIs     []models.APIConfig
+	Warnings []string
+}
+
+// Parse decodes an OpenAPI 3.x document in JSON or YAML
+func Parse(data []byte) (*Document, error) {
+	var doc Document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("%w: unsupported version %q, expected OpenAPI 3.x", ErrInvalidSpec, doc.OpenAPI)
+	}
+	if len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("%w: no paths", ErrInvalidSpec)
+	}
+	return &doc, nil
+}
+
+// operation is one method of a path template with its resolved parameters
+type operation struct {
+	template string
+	method   string
+	params   []Parameter
+	headers  []string
+}
+
+// group collects the operations served under one server path prefix
+type group struct {
+	upstream   string
+	operations []operation
+}
+
+// Configs derives one API configuration per server path prefix. Methods are
+// the union of the operations, parameters are required if every operation
+// requires them, and required headers are those every operation's security
+// requirements need.
+func (d *Document) Configs(opts Options) (*Result, error) {
+	result := &Result{}
+	warned := make(map[string]bool)
+	warn := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if !warned[msg] {
+			warned[msg] = true
+			result.Warnings = append(result.Warnings, msg)
+		}
+	}
+
+	templates := make([]string, 0, len(d.Paths))
+	for template := range d.Paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+
+	groups := make(map[string]*group)
+	for _, template := range templates {
+		item := d.Paths[template]
+		if item == nil {
+			continue
+		}
+		if item.Ref != "" {
+			warn("path %s: $ref path items are not supported and were skipped", template)
+			continue
+		}
+
+		for _, op := range item.operations() {
+			params, err := d.mergeParameters(item.Parameters, op.op.Parameters)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s %s: %v", ErrInvalidSpec, op.method, template, err)
+			}
+			headers, err := d.securityHeaders(op.op, opts.SubscriptionHeader)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s %s: %v", ErrInvalidSpec, op.method, template, err)
+			}
+
+			servers := op.op.Servers
+			if len(servers) == 0 {
+				servers = item.Servers
+			}
+			if len(servers) == 0 {
+				servers = d.Servers
+			}
+			if len(servers) == 0 {
+				servers = []Server{{URL: "/"}}
+			}
+
+			// Servers that differ only by host share a prefix, and the first
+			// one is the upstream
+			added := make(map[string]bool)
+			for _, server := range servers {
+				prefix, upstream, err := resolveServer(server, opts)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+				}
+				if added[prefix] {
+					continue
+				}
+				added[prefix] = true
+				g, ok := groups[prefix]
+				if !ok {
+					g = &group{upstream: upstream}
+					groups[prefix] = g
+				}
+				g.operations = append(g.operations, operation{
+					template: template,
+					method:   op.method,
+					params:   params,
+					headers:  headers,
+				})
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("%w: no operations", ErrInvalidSpec)
+	}
+
+	prefixes := make([]string, 0, len(groups))
+	for prefix := range groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		result.APIs = append(result.APIs, groups[prefix].config(prefix+"/*", warn))
+	}
+	return result, nil
+}
+
+// pathOperation is an operation of a path item with its method
+type pathOperation struct {
+	method string
+	op     *Operation
+}
+
+// operations returns the operations of the path item in a fixed order
+func (p *PathItem) operations() []pathOperation {
+	var ops []pathOperation
+	for _, candidate := range []pathOperation{
+		{"GET", p.Get}, {"PUT", p.Put}, {"POST", p.Post}, {"DELETE", p.Delete},
+		{"OPTIONS", p.Options}, {"HEAD", p.Head}, {"PATCH", p.Patch}, {"TRACE", p.Trace},
+	} {
+		if candidate.op != nil {
+			ops = append(ops, candidate)
+		}
+	}
+	return ops
+}
+
+// config merges the operations of a group into an API configuration
+func (g *group) config(path string, warn func(string, ...interface{})) models.APIConfig {
+	api := models.APIConfig{Path: path, Upstream: g.upstream}
+
+	methods := make(map[string]bool)
+	for _, op := range g.operations {
+		methods[op.method] = true
+	}
+	for _, method := range sortedKeys(methods) {
+		api.Methods = append(api.Methods, models.APIMethod{Method: method})
+	}
+
+	api.Parameters = append(g.pathParameters(path, warn), g.otherParameters(path, warn)...)
+
+	// A header is required if every operation needs it
+	counts := make(map[string]int)
+	names := make(map[string]string)
+	for _, op := range g.operations {
+		for _, header := range op.headers {
+			key := strings.ToLower(header)
+			counts[key]++
+			if _, ok := names[key]; !ok {
+				names[key] = header
+			}
+		}
+	}
+	for _, key := range sortedKeys(counts) {
+		if counts[key] == len(g.operations) {
+			api.RequiredHeaders = append(api.RequiredHeaders, names[key])
+		}
+	}
+	return api
+}
+
+// pathParameters returns the path parameters that can be checked by position.
+// The gateway matches path parameters to the segments after the API path in
+// order, so only leading parameters shared by every template are kept.
+func (g *group) pathParameters(path string, warn func(string, ...interface{})) []models.APIParameter {
+	var params []models.APIParameter
+	usable := make(map[string]bool)
+	for position := 0; ; position++ {
+		var name string
+		shared := true
+		for _, op := range g.operations {
+			segment := templateSegment(op.template, position)
+			if !isTemplateParam(segment) || (name != "" && segment != name) {
+				shared = false
+				break
+			}
+			name = segment
+		}
+		if !shared || name == "" {
+			break
+		}
+		name = strings.Trim(name, "{}")
+		usable[name] = true
+
+		param := models.APIParameter{Name: name, Type: "path", Required: true}
+		param.Validation = g.mergePattern(path, "path", name, warn)
+		params = append(params, param)
+	}
+
+	skipped := make(map[string]bool)
+	for _, op := range g.operations {
+		for _, param := range op.params {
+			key := op.template + " " + param.Name
+			if param.In != "path" || usable[param.Name] || skipped[key] {
+				continue
+			}
+			skipped[key] = true
+			warn("%s: path parameter %s of %s cannot be matched by position and was skipped", path, param.Name, op.template)
+		}
+	}
+	return params
+}
+
+// otherParameters merges the query and header parameters of the operations
+func (g *group) otherParameters(path string, warn func(string, ...interface{})) []models.APIParameter {
+	type seen struct {
+		param    models.APIParameter
+		required int
+	}
+	var order []string
+	params := make(map[string]*seen)
+	for _, op := range g.operations {
+		for _, param := range op.params {
+			switch param.In {
+			case "query", "header":
+			case "path":
+				continue
+			default:
+				warn("%s: %s parameter %s is not supported and was skipped", path, param.In, param.Name)
+				continue
+			}
+			if param.In == "header" && ignoredHeader(param.Name) {
+				continue
+			}
+			key := param.In + ":" + param.Name
+			s, ok := params[key]
+			if !ok {
+				s = &seen{param: models.APIParameter{Name: param.Name, Type: param.In}}
+				params[key] = s
+				order = append(order, key)
+			}
+			if param.Required {
+				s.required++
+			}
+		}
+	}
+
+	var out []models.APIParameter
+	for _, key := range order {
+		s := params[key]
+		s.param.Required = s.required == len(g.operations)
+		s.param.Validation = g.mergePattern(path, s.param.Type, s.param.Name, warn)
+		out = append(out, s.param)
+	}
+	return out
+}
+
+// mergePattern returns the validation pattern of a parameter if all
+// operations that declare it agree on one
+func (g *group) mergePattern(path, in, name string, warn func(string, ...interface{})) string {
+	var pattern string
+	first := true
+	for _, op := range g.operations {
+		for _, param := range op.params {
+			if param.In != in || param.Name != name {
+				continue
+			}
+			p := schemaPattern(param.Schema)
+			if first {
+				pattern, first = p, false
+			} else if p != pattern {
+				warn("%s: %s parameter %s has different schemas across operations and is not validated", path, in, name)
+				return ""
+			}
+		}
+	}
+	if pattern == "" {
+		return ""
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		warn("%s: pattern of %s parameter %s is not supported (%v) and is not validated", path, in, name, err)
+		return ""
+	}
+	return pattern
+}
+
+// Validation patterns for schemas without a pattern of their own
+const (
+	integerPattern = `^-?[0-9]+$`
+	numberPattern  = `^-?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?$`
+	booleanPattern = `^(?:true|false)$`
+	uuidPattern    = `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`
+)
+
+// schemaPattern maps a schema to a validation pattern: its pattern, its enum,
+// or a pattern for its type or format
+func schemaPattern(schema *Schema) string {
+	if schema == nil {
+		return ""
+	}
+	if schema.Pattern != "" {
+		return schema.Pattern
+	}
+	if len(schema.Enum) > 0 {
+		values := make([]string, 0, len(schema.Enum))
+		for _, v := range schema.Enum {
+			if v == nil {
+				continue
+			}
+			values = append(values, regexp.QuoteMeta(fmt.Sprint(v)))
+		}
+		return "^(?:" + strings.Join(values, "|") + ")$"
+	}
+	switch schema.Type {
+	case "integer":
+		return integerPattern
+	case "number":
+		return numberPattern
+	case "boolean":
+		return booleanPattern
+	case "string":
+		if schema.Format == "uuid" {
+			return uuidPattern
+		}
+	}
+	return ""
+}
+
+// mergeParameters resolves path item and operation parameters. Operation
+// parameters override path item parameters with the same name and location.
+func (d *Document) mergeParameters(pathParams, opParams []Parameter) ([]Parameter, error) {
+	var out []Parameter
+	index := make(map[string]int)
+	for _, list := range [][]Parameter{pathParams, opParams} {
+		for _, param := range list {
+			resolved, err := d.resolveParameter(param)
+			if err != nil {
+				return nil, err
+			}
+			key := resolved.In + ":" + resolved.Name
+			if i, ok := index[key]; ok {
+				out[i] = resolved
+				continue
+			}
+			index[key] = len(out)
+			out = append(out, resolved)
+		}
+	}
+	return out, nil
+}
+
+// resolveParameter follows the $ref of a parameter and of its schema
+func (d *Document) resolveParameter(param Parameter) (Parameter, error) {
+	for depth := 0; param.Ref != ""; depth++ {
+		name, err := localRef(param.Ref, "parameters", depth)
+		if err != nil {
+			return Parameter{}, err
+		}
+		target, ok := d.Components.Parameters[name]
+		if !ok || target == nil {
+			return Parameter{}, fmt.Errorf("unknown parameter %s", param.Ref)
+		}
+		param = *target
+	}
+	if param.Name == "" || param.In == "" {
+		return Parameter{}, fmt.Errorf("parameter needs a name and a location")
+	}
+
+	schema, err := d.resolveSchema(param.Schema)
+	if err != nil {
+		return Parameter{}, err
+	}
+	param.Schema = schema
+	return param, nil
+}
+
+// resolveSchema follows the $ref of a schema
+func (d *Document) resolveSchema(schema *Schema) (*Schema, error) {
+	for depth := 0; schema != nil && schema.Ref != ""; depth++ {
+		name, err := localRef(schema.Ref, "schemas", depth)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := d.Components.Schemas[name]
+		if !ok || target == nil {
+			return nil, fmt.Errorf("unknown schema %s", schema.Ref)
+		}
+		schema = target
+	}
+	return schema, nil
+}
+
+// securityHeaders returns the headers an operation needs under every one of
+// its alternative security requirements
+func (d *Document) securityHeaders(op *Operation, subscriptionHeader string) ([]string, error) {
+	requirements := d.Security
+	if op.Security != nil {
+		requirements = op.Security
+	}
+	if requirements == nil || len(*requirements) == 0 {
+		return nil, nil
+	}
+
+	var common map[string]string
+	for _, requirement := range *requirements {
+		headers := make(map[string]string)
+		for name := range requirement {
+			header, err := d.schemeHeader(name)
+			if err != nil {
+				return nil, err
+			}
+			if header != "" && !strings.EqualFold(header, subscriptionHeader) {
+				headers[strings.ToLower(header)] = header
+			}
+		}
+		if common == nil {
+			common = headers
+			continue
+		}
+		for key := range common {
+			if _, ok := headers[key]; !ok {
+				delete(common, key)
+			}
+		}
+	}
+
+	var out []string
+	for _, key := range sortedKeys(common) {
+		out = append(out, common[key])
+	}
+	return out, nil
+}
+
+// schemeHeader returns the header a security scheme is sent in, or "" for
+// schemes that do not use a header
+func (d *Document) schemeHeader(name string) (string, error) {
+	scheme, ok := d.Components.SecuritySchemes[name]
+	for depth := 0; ok && scheme != nil && scheme.Ref != ""; depth++ {
+		ref, err := localRef(scheme.Ref, "securitySchemes", depth)
+		if err != nil {
+			return "", err
+		}
+		scheme, ok = d.Components.SecuritySchemes[ref]
+	}
+	if !ok || scheme == nil {
+		return "", fmt.Errorf("unknown security scheme %s", name)
+	}
+
+	switch scheme.Type {
+	case "apiKey":
+		if scheme.In == "header" {
+			return scheme.Name, nil
+		}
+		return "", nil
+	case "http", "oauth2", "openIdConnect":
+		return "Authorization", nil
+	}
+	return "", nil
+}
+
+// localRef returns the component name of a reference to
+// #/components/<kind>/<name>
+func localRef(ref, kind string, depth int) (string, error) {
+	if depth >= maxRefDepth {
+		return "", fmt.Errorf("$ref chain of %s is too deep", ref)
+	}
+	prefix := "#/components/" + kind + "/"
+	if !strings.HasPrefix(ref, prefix) {
+		return "", fmt.Errorf("$ref %s is not supported; only references to %s are resolved", ref, prefix)
+	}
+	return strings.TrimPrefix(ref, prefix), nil
+}
+
+// serverVariable matches a {variable} in a server URL
+var serverVariable = regexp.MustCompile(`\{([^}]+)\}`)
+
+// resolveServer returns the gateway path prefix and the upstream URL for a
+// server
+func resolveServer(server Server, opts Options) (string, string, error) {
+	raw := serverVariable.ReplaceAllStringFunc(server.URL, func(match string) string {
+		return server.Variables[strings.Trim(match, "{}")].Default
+	})
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("server %s: %v", server.URL, err)
+	}
+	serverPath := strings.TrimSuffix(u.Path, "/")
+
+	var upstream string
+	switch {
+	case opts.Upstream != "":
+		base, err := url.Parse(opts.Upstream)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			return "", "", fmt.Errorf("upstream %s must be an absolute URL", opts.Upstream)
+		}
+		upstream = strings.TrimSuffix(base.Scheme+"://"+base.Host+base.Path, "/") + serverPath
+	case u.Scheme == "http" || u.Scheme == "https":
+		upstream = u.Scheme + "://" + u.Host + serverPath
+	default:
+		return "", "", fmt.Errorf("server %s is not an absolute http(s) URL; set an upstream", server.URL)
+	}
+
+	prefix := strings.TrimSuffix(opts.Prefix, "/") + serverPath
+	if prefix == "" {
+		return "", "", fmt.Errorf("server %s has no base path; set a prefix", server.URL)
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix, upstream, nil
+}
+
+// templateSegment returns the segment of a path template at a position, or ""
+func templateSegment(template string, position int) string {
+	segments := strings.FieldsFunc(template, func(c rune) bool { return c == '/' })
+	if position < len(segments) {
+		return segments[position]
+	}
+	return ""
+}
+
+// isTemplateParam reports whether a path template segment is a parameter
+func isTemplateParam(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// ignoredHeader reports whether a header parameter is ignored by OpenAPI
+func ignoredHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "accept", "content-type", "authorization":
+		return true
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
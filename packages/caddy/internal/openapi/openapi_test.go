@@ -0,0 +1,191 @@
+package openapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+const weatherSpec = `
+openapi: 3.0.3
+info:
+  title: Weather
+  version: "1.0"
+servers:
+  - url: https://{region}.weather.example.com/v1
+    variables:
+      region:
+        default: eu
+  - url: https://sandbox.weather.example.com/v1
+security:
+  - apiKey: []
+    tenant: []
+  - bearer: []
+    tenant: []
+paths:
+  /{city}/forecast:
+    parameters:
+      - $ref: '#/components/parameters/City'
+    get:
+      parameters:
+        - $ref: '#/components/parameters/Units'
+        - name: days
+          in: query
+          required: true
+          schema:
+            type: integer
+        - name: session
+          in: cookie
+          schema:
+            type: string
+  /{city}/alerts:
+    get:
+      parameters:
+        - $ref: '#/components/parameters/City'
+        - $ref: '#/components/parameters/Units'
+        - name: Accept
+          in: header
+          schema:
+            type: string
+    post:
+      security: []
+      parameters:
+        - $ref: '#/components/parameters/City'
+        - name: X-Request-Id
+          in: header
+          schema:
+            type: string
+            format: uuid
+  /stations/{id}:
+    servers:
+      - url: https://stations.example.com/v2
+    get:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: string
+components:
+  parameters:
+    City:
+      name: city
+      in: path
+      required: true
+      schema:
+        $ref: '#/components/schemas/CityName'
+    Units:
+      name: units
+      in: query
+      schema:
+        type: [string, "null"]
+        enum: [metric, imperial]
+  schemas:
+    CityName:
+      type: string
+      pattern: '^[a-z-]+$'
+  securitySchemes:
+    apiKey:
+      type: apiKey
+      in: header
+      name: X-Subscription-Key
+    tenant:
+      type: apiKey
+      in: header
+      name: X-Tenant
+    bearer:
+      type: http
+      scheme: bearer
+`
+
+func TestDocument_Configs(t *testing.T) {
+	doc, err := Parse([]byte(weatherSpec))
+	require.NoError(t, err)
+
+	result, err := doc.Configs(Options{Prefix: "/weather", SubscriptionHeader: "X-Subscription-Key"})
+	require.NoError(t, err)
+	require.Len(t, result.APIs, 2)
+
+	v1 := result.APIs[0]
+	assert.Equal(t, "/weather/v1/*", v1.Path)
+	assert.Equal(t, "https://eu.weather.example.com/v1", v1.Upstream)
+	assert.Equal(t, []models.APIMethod{{Method: "GET"}, {Method: "POST"}}, v1.Methods)
+	assert.Equal(t, []models.APIParameter{
+		{Name: "city", Type: "path", Required: true, Validation: "^[a-z-]+$"},
+		{Name: "units", Type: "query", Validation: "^(?:metric|imperial)$"},
+		{Name: "X-Request-Id", Type: "header", Validation: uuidPattern},
+		{Name: "days", Type: "query", Validation: integerPattern},
+	}, v1.Parameters)
+	// POST /alerts needs no credentials, so no header is required by all
+	assert.Empty(t, v1.RequiredHeaders)
+
+	v2 := result.APIs[1]
+	assert.Equal(t, "/weather/v2/*", v2.Path)
+	assert.Equal(t, "https://stations.example.com/v2", v2.Upstream)
+	assert.Equal(t, []models.APIMethod{{Method: "GET"}}, v2.Methods)
+	assert.Empty(t, v2.Parameters)
+	assert.Equal(t, []string{"X-Tenant"}, v2.RequiredHeaders)
+
+	assert.ElementsMatch(t, []string{
+		"/weather/v1/*: cookie parameter session is not supported and was skipped",
+		"/weather/v2/*: path parameter id of /stations/{id} cannot be matched by position and was skipped",
+	}, result.Warnings)
+}
+
+func TestDocument_Configs_upstream(t *testing.T) {
+	spec := `
+openapi: 3.1.0
+servers:
+  - url: /api
+security:
+  - bearer: []
+paths:
+  /orders:
+    get: {}
+    post: {}
+components:
+  securitySchemes:
+    bearer:
+      type: http
+      scheme: bearer
+`
+	doc, err := Parse([]byte(spec))
+	require.NoError(t, err)
+
+	// Relative servers need an upstream
+	_, err = doc.Configs(Options{})
+	assert.ErrorIs(t, err, ErrInvalidSpec)
+
+	result, err := doc.Configs(Options{Upstream: "http://localhost:8085/"})
+	require.NoError(t, err)
+	require.Len(t, result.APIs, 1)
+	assert.Equal(t, "/api/*", result.APIs[0].Path)
+	assert.Equal(t, "http://localhost:8085/api", result.APIs[0].Upstream)
+	assert.Equal(t, []string{"Authorization"}, result.APIs[0].RequiredHeaders)
+	assert.Empty(t, result.Warnings)
+}
+
+func TestParse_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{name: "swagger 2", spec: `{"swagger": "2.0", "paths": {"/a": {"get": {}}}}`},
+		{name: "no paths", spec: `{"openapi": "3.0.0"}`},
+		{name: "malformed", spec: `openapi: [`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.spec))
+			assert.ErrorIs(t, err, ErrInvalidSpec)
+		})
+	}
+
+	doc, err := Parse([]byte(`{"openapi": "3.0.0", "servers": [{"url": "https://example.com/v1"}],
+		"paths": {"/a": {"get": {"parameters": [{"$ref": "other.yaml#/Limit"}]}}}}`))
+	require.NoError(t, err)
+	_, err = doc.Configs(Options{})
+	assert.ErrorIs(t, err, ErrInvalidSpec)
+}
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// sweepEvery controls how many Allow calls happen between idle state sweeps
+const sweepEvery = 1024
+
+// Decision is the outcome of a rate limit check for a single request
+type Decision struct {
+	Allowed bool
+	// Limit, Remaining and Reset describe the most restrictive window and are
+	// reported in the RateLimit-* response headers
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// tokenBucket enforces a per-second rate with bursts
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// slidingWindow approximates a sliding window by weighting the previous
+// fixed window's count by how much of it still overlaps the sliding window
+type slidingWindow struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// state holds the limiter state of a single identity
+type state struct {
+	bucket   *tokenBucket
+	minute   *slidingWindow
+	day      *slidingWindow
+	lastSeen time.Time
+}
+
+// Limiter tracks request rates per identity (usually an API key).
+// It is safe for concurrent use and is shared across config reloads.
+type Limiter struct {
+	mu     sync.Mutex
+	states map[string]*state
+	calls  int
+	now    func() time.Time
+}
+
+// NewLimiter creates an empty limiter
+func NewLimiter() *Limiter {
+	return &Limiter{
+		states: make(map[string]*state),
+		now:    time.Now,
+	}
+}
+
+// Destruct implements caddy.Destructor so the limiter can live in a UsagePool.
+func (l *Limiter) Destruct() error {
+	return nil
+}
+
+// Allow records a request for the identity and reports whether it is within
+// the limit. Requests rejected by any window are not counted against the others.
+func (l *Limiter) Allow(id string, limit *models.RateLimit) Decision {
+	if !limit.Enabled() {
+		return Decision{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	st, ok := l.states[id]
+	if !ok {
+		st = &state{}
+		l.states[id] = st
+	}
+	st.lastSeen = now
+
+	var decisions []Decision
+	var commits []func()
+
+	if limit.RequestsPerSecond > 0 {
+		d, commit := st.checkBucket(now, limit.RequestsPerSecond, limit.Burst)
+		decisions = append(decisions, d)
+		commits = append(commits, commit)
+	}
+	if limit.RequestsPerMinute > 0 {
+		if st.minute == nil {
+			st.minute = &slidingWindow{start: now.Truncate(time.Minute)}
+		}
+		d, commit := st.minute.check(now, time.Minute, limit.RequestsPerMinute)
+		decisions = append(decisions, d)
+		commits = append(commits, commit)
+	}
+	if limit.RequestsPerDay > 0 {
+		if st.day == nil {
+			st.day = &slidingWindow{start: now.Truncate(24 * time.Hour)}
+		}
+		d, commit := st.day.check(now, 24*time.Hour, limit.RequestsPerDay)
+		decisions = append(decisions, d)
+		commits = append(commits, commit)
+	}
+
+	result := Decision{Allowed: true, Remaining: math.MaxInt}
+	for _, d := range decisions {
+		if !d.Allowed {
+			result.Allowed = false
+			if d.RetryAfter > result.RetryAfter {
+				result.RetryAfter = d.RetryAfter
+			}
+		}
+		// Report the window with the fewest remaining requests
+		if d.Remaining < result.Remaining {
+			result.Limit = d.Limit
+			result.Remaining = d.Remaining
+			result.Reset = d.Reset
+		}
+	}
+
+	if result.Allowed {
+		for _, commit := range commits {
+			commit()
+		}
+		if result.Remaining > 0 {
+			result.Remaining--
+		}
+	}
+
+	return result
+}
+
+// checkBucket refills the token bucket and checks whether a token is available
+func (st *state) checkBucket(now time.Time, rate float64, burst int) (Decision, func()) {
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = math.Max(1, math.Ceil(rate))
+	}
+
+	if st.bucket == nil {
+		st.bucket = &tokenBucket{tokens: capacity, last: now}
+	}
+	b := st.bucket
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+		b.last = now
+	}
+
+	d := Decision{
+		Allowed:   b.tokens >= 1,
+		Limit:     int(capacity),
+		Remaining: int(math.Floor(b.tokens)),
+		Reset:     time.Duration((capacity - b.tokens) / rate * float64(time.Second)),
+	}
+	if !d.Allowed {
+		d.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	return d, func() { b.tokens-- }
+}
+
+// check rolls the window forward and checks the weighted request count
+func (w *slidingWindow) check(now time.Time, size time.Duration, limit int) (Decision, func()) {
+	windowStart := now.Truncate(size)
+	switch {
+	case windowStart.Sub(w.start) >= 2*size:
+		w.previous, w.current = 0, 0
+		w.start = windowStart
+	case windowStart.Sub(w.start) >= size:
+		w.previous, w.current = w.current, 0
+		w.start = windowStart
+	}
+
+	elapsed := now.Sub(w.start)
+	overlap := float64(size-elapsed) / float64(size)
+	used := int(math.Floor(float64(w.previous)*overlap)) + w.current
+
+	d := Decision{
+		Allowed:   used < limit,
+		Limit:     limit,
+		Remaining: max(0, limit-used),
+		Reset:     size - elapsed,
+	}
+	if !d.Allowed {
+		d.RetryAfter = retryAfter(w.previous, w.current, limit, size, elapsed)
+	}
+	return d, func() { w.current++ }
+}
+
+// retryAfter estimates when enough of the previous window will have slid out
+// for one more request to fit
+func retryAfter(previous, current, limit int, size, elapsed time.Duration) time.Duration {
+	if current >= limit || previous == 0 {
+		return size - elapsed
+	}
+	// Solve floor(previous * (size-t)/size) + current < limit for t
+	allowedPrevious := float64(limit - current - 1)
+	t := time.Duration((1 - allowedPrevious/float64(previous)) * float64(size))
+	if t <= elapsed {
+		return time.Second
+	}
+	return t - elapsed
+}
+
+// sweep drops identities that have been idle for longer than the largest window
+func (l *Limiter) sweep(now time.Time) {
+	for id, st := range l.states {
+		if now.Sub(st.lastSeen) > 48*time.Hour {
+			delete(l.states, id)
+		}
+	}
+}
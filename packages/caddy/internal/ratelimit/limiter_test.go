@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// newTestLimiter returns a limiter driven by a manually advanced clock
+func newTestLimiter(start time.Time) (*Limiter, func(time.Duration)) {
+	l := NewLimiter()
+	now := start
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiter_TokenBucket(t *testing.T) {
+	l, advance := newTestLimiter(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	limit := &models.RateLimit{RequestsPerSecond: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		d := l.Allow("key", limit)
+		assert.True(t, d.Allowed, "request %d should be within burst", i)
+		assert.Equal(t, 3, d.Limit)
+		assert.Equal(t, 2-i, d.Remaining)
+	}
+
+	d := l.Allow("key", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+
+	// Half a second refills one token at 2 requests per second
+	advance(500 * time.Millisecond)
+	assert.True(t, l.Allow("key", limit).Allowed)
+	assert.False(t, l.Allow("key", limit).Allowed)
+
+	// Other identities are tracked separately
+	assert.True(t, l.Allow("other", limit).Allowed)
+}
+
+func TestLimiter_SlidingWindow(t *testing.T) {
+	l, advance := newTestLimiter(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	limit := &models.RateLimit{RequestsPerMinute: 4}
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, l.Allow("key", limit).Allowed)
+	}
+	d := l.Allow("key", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	assert.Equal(t, time.Minute, d.Reset)
+
+	// Halfway into the next window half of the previous count still applies
+	advance(90 * time.Second)
+	assert.True(t, l.Allow("key", limit).Allowed)
+	assert.True(t, l.Allow("key", limit).Allowed)
+	assert.False(t, l.Allow("key", limit).Allowed)
+
+	// Two full windows later the history is gone
+	advance(2 * time.Minute)
+	d = l.Allow("key", limit)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 3, d.Remaining)
+}
+
+func TestLimiter_MostRestrictiveWindow(t *testing.T) {
+	l, _ := newTestLimiter(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	limit := &models.RateLimit{RequestsPerSecond: 10, Burst: 10, RequestsPerDay: 2}
+
+	d := l.Allow("key", limit)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Limit)
+	assert.Equal(t, 1, d.Remaining)
+
+	assert.True(t, l.Allow("key", limit).Allowed)
+	d = l.Allow("key", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 24*time.Hour, d.RetryAfter)
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	l := NewLimiter()
+	assert.True(t, l.Allow("key", nil).Allowed)
+	assert.True(t, l.Allow("key", &models.RateLimit{}).Allowed)
+}
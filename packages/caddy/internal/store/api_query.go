@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Listing page sizes
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// ErrInvalidSort is returned for a sort field that listings do not support
+var ErrInvalidSort = errors.New("invalid sort field")
+
+// apiSortColumns maps the sort fields of API listings to their columns
+var apiSortColumns = map[string]string{
+	"path":          "path",
+	"upstream":      "upstream",
+	"subscription":  "required_subscription",
+	"created_at":    "created_at",
+	"last_accessed": "last_accessed",
+	"request_count": "request_count",
+}
+
+// APIQuery filters, sorts and pages an API listing
+type APIQuery struct {
+	// PathPrefix keeps APIs whose path starts with it
+	PathPrefix string
+	// Upstream keeps APIs whose upstream URL contains it
+	Upstream string
+	// Subscription keeps APIs requiring exactly this subscription
+	Subscription string
+	// Sort is a sort field, descending with a leading "-"; path by default
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// Page is the window of a listing that was returned
+type Page struct {
+	Total  int64
+	Limit  int
+	Offset int
+}
+
+// pageOf clamps the requested limit and offset
+func pageOf(limit, offset int) Page {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	return Page{Limit: min(limit, MaxPageSize), Offset: max(offset, 0)}
+}
+
+// likePattern escapes the LIKE wildcards of s
+func likePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// QueryAPIs returns one page of the API configurations matching q, with their
+// methods, parameters and keys, and the page with the total number of matches
+func (s *APIStore) QueryAPIs(q APIQuery) ([]models.APIConfig, Page, error) {
+	page := pageOf(q.Limit, q.Offset)
+
+	field, desc := strings.CutPrefix(q.Sort, "-")
+	if field == "" {
+		field = "path"
+	}
+	column, ok := apiSortColumns[field]
+	if !ok {
+		return nil, page, ErrInvalidSort
+	}
+	order := column
+	if desc {
+		order += " DESC"
+	}
+
+	filter := func(db *gorm.DB) *gorm.DB {
+		if q.PathPrefix != "" {
+			db = db.Where(`path LIKE ? ESCAPE '\'`, likePattern(q.PathPrefix)+"%")
+		}
+		if q.Upstream != "" {
+			db = db.Where(`upstream LIKE ? ESCAPE '\'`, "%"+likePattern(q.Upstream)+"%")
+		}
+		if q.Subscription != "" {
+			db = db.Where("required_subscription = ?", q.Subscription)
+		}
+		return db
+	}
+
+	if err := s.db.Model(&models.APIConfig{}).Scopes(filter).Count(&page.Total).Error; err != nil {
+		s.logger.Error("failed to count APIs",
+			zap.Error(err))
+		return nil, page, err
+	}
+
+	var configs []models.APIConfig
+	err := s.db.Scopes(filter).
+		Preload("Methods").
+		Preload("Parameters").
+		Preload("APIKeys").
+		Order(order + ", id").
+		Limit(page.Limit).
+		Offset(page.Offset).
+		Find(&configs).Error
+	if err != nil {
+		s.logger.Error("failed to list APIs",
+			zap.Error(err))
+		return nil, page, err
+	}
+	return configs, page, nil
+}
+
+// QueryAPIKeys returns one page of the keys of the API with exactly the given
+// path, oldest first. It returns gorm.ErrRecordNotFound if there is no such API.
+func (s *APIStore) QueryAPIKeys(path string, limit, offset int) ([]models.APIKey, Page, error) {
+	page := pageOf(limit, offset)
+
+	var api models.APIConfig
+	if err := s.db.Where("path = ?", path).First(&api).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error("failed to find API configuration",
+				zap.Error(err),
+				zap.String("path", path))
+		}
+		return nil, page, err
+	}
+
+	if err := s.db.Model(&models.APIKey{}).Where("api_config_id = ?", api.ID).Count(&page.Total).Error; err != nil {
+		return nil, page, err
+	}
+
+	var keys []models.APIKey
+	err := s.db.Where("api_config_id = ?", api.ID).
+		Order("id").
+		Limit(page.Limit).
+		Offset(page.Offset).
+		Find(&keys).Error
+	if err != nil {
+		s.logger.Error("failed to list API keys",
+			zap.Error(err),
+			zap.String("path", path))
+		return nil, page, err
+	}
+	return keys, page, nil
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newQueryTestStore returns a store with five APIs:
+// /weather/*, /weather_v2/*, /news/*, /orders/* and /order_items/*
+func newQueryTestStore(t *testing.T) *APIStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "veil.db")), &gorm.Config{})
+	require.NoError(t, err)
+	s := NewAPIStore(db)
+	require.NoError(t, s.AutoMigrate())
+	t.Cleanup(s.Close)
+
+	apis := []struct {
+		path, upstream, subscription string
+		requests                     int64
+	}{
+		{"/weather/*", "http://weather.internal:8083", "basic", 30},
+		{"/weather_v2/*", "http://weather.internal:8084", "premium", 10},
+		{"/news/*", "http://news.internal:8085", "basic", 50},
+		{"/orders/*", "http://orders.internal:8082", "premium", 20},
+		{"/order_items/*", "http://orders.internal:8082", "premium", 40},
+	}
+	for _, api := range apis {
+		require.NoError(t, s.CreateAPI(&models.APIConfig{
+			Path:                 api.path,
+			Upstream:             api.upstream,
+			RequiredSubscription: api.subscription,
+			RequestCount:         api.requests,
+			Methods:              []models.APIMethod{{Method: "GET"}},
+		}))
+	}
+	return s
+}
+
+func TestAPIStore_QueryAPIs(t *testing.T) {
+	s := newQueryTestStore(t)
+
+	tests := []struct {
+		name      string
+		query     APIQuery
+		wantPaths []string
+		wantTotal int64
+		wantErr   error
+	}{
+		{
+			name:      "all sorted by path",
+			wantPaths: []string{"/news/*", "/order_items/*", "/orders/*", "/weather/*", "/weather_v2/*"},
+			wantTotal: 5,
+		},
+		{
+			name:      "path prefix",
+			query:     APIQuery{PathPrefix: "/weather"},
+			wantPaths: []string{"/weather/*", "/weather_v2/*"},
+			wantTotal: 2,
+		},
+		{
+			name:      "path prefix wildcards are literal",
+			query:     APIQuery{PathPrefix: "/order_"},
+			wantPaths: []string{"/order_items/*"},
+			wantTotal: 1,
+		},
+		{
+			name:      "upstream substring",
+			query:     APIQuery{Upstream: "orders.internal"},
+			wantPaths: []string{"/order_items/*", "/orders/*"},
+			wantTotal: 2,
+		},
+		{
+			name:      "subscription",
+			query:     APIQuery{Subscription: "basic"},
+			wantPaths: []string{"/news/*", "/weather/*"},
+			wantTotal: 2,
+		},
+		{
+			name:      "combined filters",
+			query:     APIQuery{Subscription: "premium", Upstream: "weather"},
+			wantPaths: []string{"/weather_v2/*"},
+			wantTotal: 1,
+		},
+		{
+			name:      "sorted by request count descending",
+			query:     APIQuery{Sort: "-request_count"},
+			wantPaths: []string{"/news/*", "/order_items/*", "/weather/*", "/orders/*", "/weather_v2/*"},
+			wantTotal: 5,
+		},
+		{
+			name:      "page",
+			query:     APIQuery{Limit: 2, Offset: 2},
+			wantPaths: []string{"/orders/*", "/weather/*"},
+			wantTotal: 5,
+		},
+		{
+			name:      "offset past the end",
+			query:     APIQuery{Offset: 10},
+			wantPaths: []string{},
+			wantTotal: 5,
+		},
+		{
+			name:    "unknown sort field",
+			query:   APIQuery{Sort: "key"},
+			wantErr: ErrInvalidSort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apis, page, err := s.QueryAPIs(tt.query)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			paths := []string{}
+			for _, api := range apis {
+				paths = append(paths, api.Path)
+				assert.Len(t, api.Methods, 1)
+			}
+			assert.Equal(t, tt.wantPaths, paths)
+			assert.Equal(t, tt.wantTotal, page.Total)
+		})
+	}
+}
+
+func TestAPIStore_QueryAPIKeys(t *testing.T) {
+	s := newQueryTestStore(t)
+
+	var keys []models.APIKey
+	for i := 1; i <= 3; i++ {
+		keys = append(keys, models.APIKey{Key: fmt.Sprintf("weather-key-%d", i), Name: fmt.Sprintf("Key %d", i)})
+	}
+	require.NoError(t, s.AddAPIKeys("/weather/*", keys))
+
+	got, page, err := s.QueryAPIKeys("/weather/*", 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, Page{Total: 3, Limit: 2, Offset: 1}, page)
+	require.Len(t, got, 2)
+	assert.Equal(t, "Key 2", got[0].Name)
+	assert.Equal(t, "Key 3", got[1].Name)
+	assert.Empty(t, got[0].Key)
+
+	// Pages are clamped to the maximum size
+	_, page, err = s.QueryAPIKeys("/weather/*", MaxPageSize+1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, MaxPageSize, page.Limit)
+
+	// Keys are listed for the exact API path only
+	_, _, err = s.QueryAPIKeys("/weather/current", 0, 0)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
@@ -1,27 +1,40 @@
 package store
 
 import (
+	"crypto/cipher"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/try-veil/veil/packages/caddy/internal/models"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // APIStore handles database operations for API configurations
 type APIStore struct {
-	db     *gorm.DB
-	logger *zap.Logger
+	db      *gorm.DB
+	logger  *zap.Logger
+	name    string
+	pepper  []byte
+	secrets cipher.AEAD
+	shared  *sharedIndex
 }
 
 // NewAPIStore creates a new APIStore instance
 func NewAPIStore(db *gorm.DB) *APIStore {
-	return &APIStore{
+	s := &APIStore{
 		db:     db,
 		logger: zap.L().Named("api_store"),
+		name:   databaseName(db),
 	}
+	s.shared = register(s)
+	return s
+}
+
+// Close releases the store's use of the index shared on its database
+func (s *APIStore) Close() {
+	unregister(s)
 }
 
 // CreateAPI creates a new API configuration in the database
@@ -32,12 +45,14 @@ func (s *APIStore) CreateAPI(config *models.APIConfig) error {
 		zap.String("subscription", config.RequiredSubscription),
 		zap.Int("api_keys", len(config.APIKeys)))
 
-	// Log API keys before creation
-	for _, key := range config.APIKeys {
+	// Hash API keys before creation
+	for i := range config.APIKeys {
+		if err := s.prepareKey(&config.APIKeys[i]); err != nil {
+			return err
+		}
 		s.logger.Debug("API key to be created",
-			zap.String("key_name", key.Name),
-			zap.String("key_value", key.Key),
-			zap.Bool("is_active", *key.IsActive))
+			zap.String("key_name", config.APIKeys[i].Name),
+			zap.String("key_prefix", config.APIKeys[i].KeyPrefix))
 	}
 
 	err := s.db.Create(config).Error
@@ -65,130 +80,84 @@ func (s *APIStore) CreateAPI(config *models.APIConfig) error {
 		zap.String("path", config.Path),
 		zap.Uint("id", config.ID))
 
+	s.refreshAfterWrite()
 	return nil
 }
 
-// GetAPIByPath retrieves an API configuration by its path
+// GetAPIByPath retrieves the API configuration whose path is the longest
+// prefix of the given request path, without its keys. It is served from the
+// in-memory route index and never touches the database once the index has
+// been built.
 func (s *APIStore) GetAPIByPath(path string) (*models.APIConfig, error) {
-	s.logger.Debug("searching for API configuration",
-		zap.String("path", path))
-
-	var configs []models.APIConfig
-	err := s.db.Preload("Methods").
-		Preload("Parameters").
-		Preload("APIKeys").
-		Find(&configs).Error
+	idx, err := s.routes()
 	if err != nil {
-		s.logger.Error("failed to query API configurations",
-			zap.Error(err))
 		return nil, err
 	}
 
-	s.logger.Debug("found API configurations",
-		zap.Int("count", len(configs)))
-
-	// Log all found configurations
-	for _, config := range configs {
-		s.logger.Debug("found configuration",
-			zap.String("path", config.Path),
-			zap.String("upstream", config.Upstream),
-			zap.Int("api_keys", len(config.APIKeys)))
-
-		for _, key := range config.APIKeys {
-			s.logger.Debug("found API key",
-				zap.String("key_name", key.Name),
-				zap.String("key_value", key.Key),
-				zap.Bool("is_active", *key.IsActive))
-		}
+	match := idx.match(path)
+	if match == nil {
+		s.logger.Debug("no matching API configuration found",
+			zap.String("path", path))
+		return nil, nil
 	}
 
-	// Find the best matching path
-	var bestMatch *models.APIConfig
-	bestMatchLen := 0
+	s.logger.Debug("found matching API configuration",
+		zap.String("path", match.Path))
 
-	for i, config := range configs {
-		s.logger.Debug("checking path match",
-			zap.String("config_path", config.Path),
-			zap.String("request_path", path),
-			zap.Int("api_keys", len(config.APIKeys)))
+	// The copy shares its slices and nested settings with the index, which
+	// callers must treat as read-only; only top-level assignments are private
+	api := *match
+	return &api, nil
+}
 
-		configPath := strings.TrimSuffix(config.Path, "/*")
-		if strings.HasPrefix(path, configPath) && len(configPath) > bestMatchLen {
-			bestMatch = &configs[i]
-			bestMatchLen = len(configPath)
-			s.logger.Debug("found better match",
-				zap.String("path", configPath),
-				zap.Int("match_len", bestMatchLen))
-		}
+// FindAPIKey returns the API key with the given value if it belongs to the API
+func (s *APIStore) FindAPIKey(apiConfig *models.APIConfig, apiKey string) (*models.APIKey, error) {
+	if apiConfig == nil || apiKey == "" {
+		return nil, nil
 	}
 
-	if bestMatch != nil {
-		s.logger.Debug("found matching API configuration",
-			zap.String("path", bestMatch.Path),
-			zap.Int("api_keys", len(bestMatch.APIKeys)))
+	idx, err := s.routes()
+	if err != nil {
+		return nil, err
+	}
 
-		for _, key := range bestMatch.APIKeys {
-			s.logger.Debug("matched configuration API key",
-				zap.String("key_name", key.Name),
-				zap.String("key_value", key.Key),
-				zap.Bool("is_active", *key.IsActive))
-		}
-	} else {
-		s.logger.Debug("no matching API configuration found",
-			zap.String("path", path))
+	key := idx.key(apiConfig.ID, hashKey(s.pepper, apiKey))
+	if key == nil {
+		return nil, nil
 	}
 
-	return bestMatch, nil
+	// Indexed keys are replaced rather than modified; the copy keeps callers'
+	// assignments out of the index, nested fields are read-only
+	found := *key
+	return &found, nil
 }
 
 // ValidateAPIKey checks if the provided API key is valid for the given API
 func (s *APIStore) ValidateAPIKey(apiConfig *models.APIConfig, apiKey string) bool {
-	if apiKey == "" || apiConfig == nil {
-		s.logger.Debug("invalid input for API key validation",
-			zap.Bool("has_api_key", apiKey != ""),
-			zap.Bool("has_config", apiConfig != nil))
+	key, err := s.FindAPIKey(apiConfig, apiKey)
+	if err != nil || key == nil {
+		s.logger.Debug("no valid API key found",
+			zap.Error(err))
 		return false
 	}
 
-	s.logger.Debug("validating API key",
-		zap.String("api_key", apiKey),
-		zap.String("path", apiConfig.Path),
-		zap.Int("available_keys", len(apiConfig.APIKeys)))
-
-	// Reload API keys to ensure we have the latest data
-	if err := s.db.Model(apiConfig).Association("APIKeys").Find(&apiConfig.APIKeys); err != nil {
-		s.logger.Error("failed to reload API keys",
-			zap.Error(err),
-			zap.String("path", apiConfig.Path))
+	if key.IsActive == nil || !*key.IsActive {
+		s.logger.Debug("API key inactive",
+			zap.String("key_name", key.Name))
 		return false
 	}
 
-	s.logger.Debug("reloaded API keys",
-		zap.Int("available_keys", len(apiConfig.APIKeys)))
-
-	for _, key := range apiConfig.APIKeys {
-		s.logger.Debug("checking API key",
+	// Check expiration if set
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		s.logger.Debug("API key expired",
 			zap.String("key_name", key.Name),
-			zap.String("key_value", key.Key),
-			zap.Bool("is_active", *key.IsActive),
-			zap.Bool("matches", key.Key == apiKey))
-
-		if key.Key == apiKey && *key.IsActive {
-			// Check expiration if set
-			if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
-				s.logger.Debug("API key expired",
-					zap.String("key_name", key.Name),
-					zap.Time("expired_at", *key.ExpiresAt))
-				continue
-			}
-			s.logger.Debug("valid API key found",
-				zap.String("key_name", key.Name))
-			return true
-		}
+			zap.Time("expired_at", *key.ExpiresAt))
+		return false
 	}
 
-	s.logger.Debug("no valid API key found")
-	return false
+	s.logger.Debug("valid API key found",
+		zap.String("key_name", key.Name))
+	return true
 }
 
 // UpdateAPIStats updates the last accessed time and request count for an API
@@ -242,17 +211,20 @@ func (s *APIStore) DeleteAPI(path string) error {
 	s.logger.Info("deleting API configuration",
 		zap.String("path", path))
 
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
 		// Get API config to delete
 		var api models.APIConfig
 		if err := tx.Where("path = ?", path).First(&api).Error; err != nil {
 			return err
 		}
 
-		// Delete associated methods and API keys
+		// Delete associated methods, parameters and API keys
 		if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIMethod{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIParameter{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIKey{}).Error; err != nil {
 			return err
 		}
@@ -264,6 +236,12 @@ func (s *APIStore) DeleteAPI(path string) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	s.refreshAfterWrite()
+	return nil
 }
 
 // AutoMigrate performs database migrations for API-related models
@@ -275,6 +253,8 @@ func (s *APIStore) AutoMigrate() error {
 		&models.APIMethod{},
 		&models.APIParameter{},
 		&models.APIKey{},
+		&models.APISpec{},
+		&models.TLSCertificate{},
 	)
 
 	if err != nil {
@@ -283,8 +263,17 @@ func (s *APIStore) AutoMigrate() error {
 		return err
 	}
 
+	// Hash any API keys still stored in plaintext
+	if err := s.migratePlaintextKeys(); err != nil {
+		s.logger.Error("failed to migrate plaintext API keys",
+			zap.Error(err))
+		return err
+	}
+
 	s.logger.Info("database migrations completed successfully")
-	return nil
+
+	// Build the route index so the first request does not hit the database
+	return s.Refresh()
 }
 
 // UpdateAPI updates an existing API configuration
@@ -301,18 +290,17 @@ func (s *APIStore) UpdateAPI(config *models.APIConfig) error {
 		return tx.Error
 	}
 
-	// Delete existing methods and API keys
+	// Delete existing methods and parameters; keys are updated in place below
 	if err := tx.Where("api_config_id = ?", config.ID).Delete(&models.APIMethod{}).Error; err != nil {
 		tx.Rollback()
 		return err
 	}
-	if err := tx.Where("api_config_id = ?", config.ID).Delete(&models.APIKey{}).Error; err != nil {
+	if err := tx.Where("api_config_id = ?", config.ID).Delete(&models.APIParameter{}).Error; err != nil {
 		tx.Rollback()
 		return err
 	}
-
-	// Update API config
-	if err := tx.Save(config).Error; err != nil {
+	// Update API config; associations are recreated below
+	if err := tx.Omit(clause.Associations).Save(config).Error; err != nil {
 		tx.Rollback()
 		s.logger.Error("failed to update API configuration",
 			zap.Error(err),
@@ -330,16 +318,21 @@ func (s *APIStore) UpdateAPI(config *models.APIConfig) error {
 		}
 	}
 
-	// Create new API keys
-	for i := range config.APIKeys {
-		config.APIKeys[i].ID = 0
-		config.APIKeys[i].APIConfigID = config.ID
-		if err := tx.Create(&config.APIKeys[i]).Error; err != nil {
+	// Create new parameters
+	for i := range config.Parameters {
+		config.Parameters[i].ID = 0
+		config.Parameters[i].APIConfigID = config.ID
+		if err := tx.Create(&config.Parameters[i]).Error; err != nil {
 			tx.Rollback()
 			return err
 		}
 	}
 
+	if err := s.updateAPIKeys(tx, config); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	// Commit transaction
 	if err := tx.Commit().Error; err != nil {
 		s.logger.Error("failed to commit transaction",
@@ -352,15 +345,113 @@ func (s *APIStore) UpdateAPI(config *models.APIConfig) error {
 		zap.String("path", config.Path),
 		zap.Uint("id", config.ID))
 
+	s.refreshAfterWrite()
 	return nil
 }
 
+// updateAPIKeys replaces the keys of an API with the configured ones. Keys
+// that are kept are updated in place so their IDs and sync versions survive;
+// the others are removed permanently so they can be re-added under their
+// unique digest. Tombstones of keys deleted by key sync are left alone.
+func (s *APIStore) updateAPIKeys(tx *gorm.DB, config *models.APIConfig) error {
+	var existing []models.APIKey
+	if err := tx.Unscoped().Where("api_config_id = ?", config.ID).Order("id").Find(&existing).Error; err != nil {
+		return err
+	}
+	byHash := make(map[string]models.APIKey, len(existing))
+	for _, key := range existing {
+		byHash[key.KeyHash] = key
+	}
+	s.keepStoredKeys(config.APIKeys, existing)
+
+	for i := range config.APIKeys {
+		key := &config.APIKeys[i]
+		key.ID = 0
+		key.APIConfigID = config.ID
+		if err := s.prepareKey(key); err != nil {
+			return err
+		}
+
+		old, ok := byHash[key.KeyHash]
+		if !ok {
+			if err := tx.Create(key).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		delete(byHash, key.KeyHash)
+
+		key.ID = old.ID
+		key.CreatedAt = old.CreatedAt
+		key.DeletedAt = gorm.DeletedAt{}
+		key.SyncVersion = old.SyncVersion
+		if key.IsActive == nil {
+			active := true
+			key.IsActive = &active
+		}
+		if err := tx.Unscoped().Save(key).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, key := range byHash {
+		if key.DeletedAt.Valid {
+			continue
+		}
+		if err := tx.Unscoped().Delete(&models.APIKey{}, key.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepStoredKeys gives keys configured without a value the digest of the
+// stored key with the same name, so that an update sending the keys it listed
+// keeps them instead of generating new ones. Each stored key is kept at most
+// once; keys without a match are generated as on creation.
+func (s *APIStore) keepStoredKeys(keys []models.APIKey, existing []models.APIKey) {
+	claimed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		switch {
+		case key.Key != "":
+			claimed[hashKey(s.pepper, key.Key)] = true
+		case key.KeyHash != "":
+			claimed[key.KeyHash] = true
+		}
+	}
+
+	for i := range keys {
+		key := &keys[i]
+		if key.Key != "" || key.KeyHash != "" {
+			continue
+		}
+		for _, stored := range existing {
+			if stored.DeletedAt.Valid || stored.Name != key.Name || claimed[stored.KeyHash] {
+				continue
+			}
+			key.KeyHash = stored.KeyHash
+			key.KeyPrefix = stored.KeyPrefix
+			claimed[stored.KeyHash] = true
+			break
+		}
+	}
+}
+
+// DeleteAPIKey removes an API key from the API configuration matching the path
 func (s *APIStore) DeleteAPIKey(path, key string) error {
 	api, err := s.GetAPIByPath(path)
 	if err != nil {
 		return err
 	}
-	return s.db.Where("api_config_id = ? AND key = ?", api.ID, key).Delete(&models.APIKey{}).Error
+	if api == nil {
+		return gorm.ErrRecordNotFound
+	}
+	if err := s.db.Where("api_config_id = ? AND key = ?", api.ID, hashKey(s.pepper, key)).Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+
+	s.refreshKeysAfterWrite(api.ID)
+	return nil
 }
 
 // AddAPIKeys adds new API keys to an existing API configuration
@@ -397,10 +488,15 @@ func (s *APIStore) AddAPIKeys(path string, newKeys []models.APIKey) error {
 
 	// Check for duplicates and prepare new keys
 	var keysToAdd []models.APIKey
-	for _, newKey := range newKeys {
+	for i := range newKeys {
+		if err := s.prepareKey(&newKeys[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		newKey := newKeys[i]
 		isDuplicate := false
 		for _, existingKey := range existingKeys {
-			if existingKey.Key == newKey.Key {
+			if digestsEqual(existingKey.KeyHash, newKey.KeyHash) {
 				isDuplicate = true
 				break
 			}
@@ -438,6 +534,7 @@ func (s *APIStore) AddAPIKeys(path string, newKeys []models.APIKey) error {
 		zap.String("path", path),
 		zap.Int("added_keys", len(keysToAdd)))
 
+	s.refreshKeysAfterWrite(apiConfig.ID)
 	return nil
 }
 
@@ -445,7 +542,7 @@ func (s *APIStore) AddAPIKeys(path string, newKeys []models.APIKey) error {
 func (s *APIStore) UpdateAPIKeyStatus(path string, apiKey string, isActive bool) error {
 	s.logger.Info("updating API key status",
 		zap.String("path", path),
-		zap.String("key", apiKey),
+		zap.String("key_prefix", KeyPrefix(apiKey)),
 		zap.Bool("is_active", isActive))
 
 	// Begin transaction
@@ -466,7 +563,7 @@ func (s *APIStore) UpdateAPIKeyStatus(path string, apiKey string, isActive bool)
 
 	// Update key status
 	result := tx.Model(&models.APIKey{}).
-		Where("api_config_id = ? AND key = ?", apiConfig.ID, apiKey).
+		Where("api_config_id = ? AND key = ?", apiConfig.ID, hashKey(s.pepper, apiKey)).
 		Update("is_active", isActive)
 
 	if result.Error != nil {
@@ -474,7 +571,7 @@ func (s *APIStore) UpdateAPIKeyStatus(path string, apiKey string, isActive bool)
 		s.logger.Error("failed to update API key status",
 			zap.Error(result.Error),
 			zap.String("path", path),
-			zap.String("key", apiKey))
+			zap.String("key_prefix", KeyPrefix(apiKey)))
 		return result.Error
 	}
 
@@ -482,7 +579,7 @@ func (s *APIStore) UpdateAPIKeyStatus(path string, apiKey string, isActive bool)
 		tx.Rollback()
 		s.logger.Error("API key not found",
 			zap.String("path", path),
-			zap.String("key", apiKey))
+			zap.String("key_prefix", KeyPrefix(apiKey)))
 		return fmt.Errorf("API key not found")
 	}
 
@@ -496,16 +593,20 @@ func (s *APIStore) UpdateAPIKeyStatus(path string, apiKey string, isActive bool)
 
 	s.logger.Info("successfully updated API key status",
 		zap.String("path", path),
-		zap.String("key", apiKey),
+		zap.String("key_prefix", KeyPrefix(apiKey)),
 		zap.Bool("is_active", isActive))
 
+	s.refreshKeysAfterWrite(apiConfig.ID)
 	return nil
 }
 
-// GetAPIWithKeys retrieves an API configuration with its keys
+// GetAPIWithKeys retrieves the API configuration with exactly the given path,
+// with its methods, parameters and keys
 func (s *APIStore) GetAPIWithKeys(path string) (*models.APIConfig, error) {
 	var apiConfig models.APIConfig
-	err := s.db.Preload("APIKeys").
+	err := s.db.Preload("Methods").
+		Preload("Parameters").
+		Preload("APIKeys").
 		Where("path = ?", path).
 		First(&apiConfig).Error
 
@@ -529,34 +630,21 @@ func (s *APIStore) GetAPIByID(id uint) (*models.APIConfig, error) {
 	return &api, nil
 }
 
-// UpdateKeyStatusByValue updates an API key status directly by its value
-// This is used by the NATS sync subscriber to update key status from platform-api events
-func (s *APIStore) UpdateKeyStatusByValue(keyValue string, isActive bool) error {
-	s.logger.Info("updating API key status by value",
-		zap.String("key", keyValue[:min(15, len(keyValue))]+"..."),
-		zap.Bool("is_active", isActive))
-
-	result := s.db.Model(&models.APIKey{}).
-		Where("key = ?", keyValue).
-		Update("is_active", isActive)
-
-	if result.Error != nil {
-		s.logger.Error("failed to update API key status",
-			zap.Error(result.Error),
-			zap.String("key", keyValue[:min(15, len(keyValue))]+"..."))
-		return result.Error
+// refreshAfterWrite refreshes the route index after a successful write. Failures
+// are logged rather than returned since the write itself has been committed.
+func (s *APIStore) refreshAfterWrite() {
+	if err := s.Refresh(); err != nil {
+		s.logger.Warn("failed to refresh route index after write",
+			zap.Error(err))
 	}
+}
 
-	if result.RowsAffected == 0 {
-		s.logger.Warn("API key not found in database",
-			zap.String("key", keyValue[:min(15, len(keyValue))]+"..."))
-		return fmt.Errorf("API key not found")
+// refreshKeysAfterWrite reloads the keys of the given APIs after a write
+// that only changed keys, rebuilding the whole index if that fails
+func (s *APIStore) refreshKeysAfterWrite(apiIDs ...uint) {
+	if err := s.refreshKeys(apiIDs...); err != nil {
+		s.logger.Warn("failed to refresh API keys after write",
+			zap.Error(err))
+		s.refreshAfterWrite()
 	}
-
-	s.logger.Info("successfully updated API key status",
-		zap.String("key", keyValue[:min(15, len(keyValue))]+"..."),
-		zap.Bool("is_active", isActive),
-		zap.Int64("rows_affected", result.RowsAffected))
-
-	return nil
 }
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// SetCanary replaces the canary of the API at path, or removes it if canary
+// is nil. It fails with gorm.ErrRecordNotFound if there is no such API.
+func (s *APIStore) SetCanary(path string, canary *models.Canary) error {
+	fields := []zap.Field{zap.String("path", path)}
+	if canary != nil {
+		fields = append(fields,
+			zap.String("upstream", canary.Upstream),
+			zap.Int("weight", canary.Weight))
+	}
+	s.logger.Info("updating API canary", fields...)
+
+	result := s.db.Model(&models.APIConfig{}).Where("path = ?", path).Updates(map[string]interface{}{
+		"canary":     jsonColumn(canary),
+		"updated_at": time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	s.refreshAfterWrite()
+	return nil
+}
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/gorm"
+)
+
+func TestAPIStore_SetCanary(t *testing.T) {
+	s := newCatalogTestStore(t, "")
+	require.NoError(t, s.CreateAPI(&models.APIConfig{
+		Path:                 "/orders/*",
+		Upstream:             "http://orders-v1.internal",
+		RequiredSubscription: "basic",
+	}))
+
+	canary := &models.Canary{Upstream: "http://orders-v2.internal", Weight: 10, Sticky: true,
+		Keys: []string{s.KeyDigest("tester-key")}}
+	require.NoError(t, s.SetCanary("/orders/*", canary))
+	api, err := s.GetAPIByPath("/orders/x")
+	require.NoError(t, err)
+	assert.Equal(t, canary, api.Canary)
+
+	// Stored digests are kept as they are
+	assert.Equal(t, canary.Keys[0], s.KeyDigest(canary.Keys[0]))
+
+	require.NoError(t, s.SetCanary("/orders/*", nil))
+	api, err = s.GetAPIByPath("/orders/x")
+	require.NoError(t, err)
+	assert.Nil(t, api.Canary)
+
+	assert.ErrorIs(t, s.SetCanary("/billing/*", nil), gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,388 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ImportMode selects how an imported catalog is applied
+type ImportMode string
+
+const (
+	// ImportMerge creates and updates the APIs in the catalog and keeps every
+	// other API and key
+	ImportMerge ImportMode = "merge"
+	// ImportReplace makes the database match the catalog: APIs and keys that
+	// are not in it are deleted
+	ImportReplace ImportMode = "replace"
+)
+
+var (
+	// ErrInvalidCatalog is returned for a catalog that cannot be imported
+	ErrInvalidCatalog = errors.New("invalid catalog")
+
+	// errDryRun rolls back the import transaction of a dry run
+	errDryRun = errors.New("dry run")
+)
+
+// ImportResult lists the API paths an import created, updated, left
+// unchanged and deleted
+type ImportResult struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	Deleted   []string `json:"deleted"`
+}
+
+// Changed reports whether the import changed any API
+func (r *ImportResult) Changed() bool {
+	return len(r.Created) > 0 || len(r.Updated) > 0 || len(r.Deleted) > 0
+}
+
+// ExportAPIs returns every API configuration with its methods, parameters and
+// keys, ordered by path
+func (s *APIStore) ExportAPIs() ([]models.APIConfig, error) {
+	var configs []models.APIConfig
+	err := s.db.Preload("Methods").
+		Preload("Parameters").
+		Preload("APIKeys").
+		Order("path").
+		Find(&configs).Error
+	if err != nil {
+		s.logger.Error("failed to export APIs",
+			zap.Error(err))
+		return nil, err
+	}
+	return configs, nil
+}
+
+// ImportAPIs applies a catalog of API configurations in one transaction.
+// Keys are given either as plaintext or as the digest of an export; digests
+// only match on gateways sharing the same key pepper. A dry run reports what
+// would change and rolls everything back.
+func (s *APIStore) ImportAPIs(apis []models.APIConfig, mode ImportMode, dryRun bool) (*ImportResult, error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, fmt.Errorf("%w: unknown import mode %q", ErrInvalidCatalog, mode)
+	}
+
+	seenPaths := make(map[string]bool, len(apis))
+	seenKeys := make(map[string]string)
+	for i := range apis {
+		api := &apis[i]
+		if api.Path == "" || api.Upstream == "" {
+			return nil, fmt.Errorf("%w: API %d: path and upstream are required", ErrInvalidCatalog, i+1)
+		}
+		if seenPaths[api.Path] {
+			return nil, fmt.Errorf("%w: API %s is listed more than once", ErrInvalidCatalog, api.Path)
+		}
+		seenPaths[api.Path] = true
+
+		for j := range api.APIKeys {
+			key := &api.APIKeys[j]
+			if key.Key == "" && !isKeyDigest(key.KeyHash) {
+				return nil, fmt.Errorf("%w: key %q of %s needs a key or a key digest", ErrInvalidCatalog, key.Name, api.Path)
+			}
+			if err := s.prepareKey(key); err != nil {
+				return nil, err
+			}
+			if key.IsActive == nil {
+				active := true
+				key.IsActive = &active
+			}
+			if other, ok := seenKeys[key.KeyHash]; ok {
+				return nil, fmt.Errorf("%w: key %q of %s is also listed for %s", ErrInvalidCatalog, key.Name, api.Path, other)
+			}
+			seenKeys[key.KeyHash] = api.Path
+		}
+	}
+
+	result := &ImportResult{Created: []string{}, Updated: []string{}, Unchanged: []string{}, Deleted: []string{}}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Deleted APIs keep their path, so an import revives them
+		var existing, deleted []models.APIConfig
+		if err := tx.Preload("Methods").
+			Preload("Parameters").
+			Preload("APIKeys").
+			Find(&existing).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("deleted_at IS NOT NULL").Find(&deleted).Error; err != nil {
+			return err
+		}
+		byPath := make(map[string]*models.APIConfig, len(existing)+len(deleted))
+		for _, rows := range [][]models.APIConfig{deleted, existing} {
+			for i := range rows {
+				byPath[rows[i].Path] = &rows[i]
+			}
+		}
+
+		for i := range apis {
+			api := &apis[i]
+			current := byPath[api.Path]
+			switch {
+			case current == nil || current.DeletedAt.Valid:
+				result.Created = append(result.Created, api.Path)
+			case sameDefinition(current, api, mode):
+				result.Unchanged = append(result.Unchanged, api.Path)
+				continue
+			default:
+				result.Updated = append(result.Updated, api.Path)
+			}
+			if err := importAPI(tx, current, api, mode); err != nil {
+				return fmt.Errorf("failed to import %s: %v", api.Path, err)
+			}
+		}
+
+		if mode == ImportReplace {
+			for _, api := range existing {
+				if seenPaths[api.Path] {
+					continue
+				}
+				if err := deleteAPI(tx, &api); err != nil {
+					return fmt.Errorf("failed to delete %s: %v", api.Path, err)
+				}
+				result.Deleted = append(result.Deleted, api.Path)
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		s.logger.Error("failed to import API catalog",
+			zap.Error(err),
+			zap.String("mode", string(mode)))
+		return nil, err
+	}
+
+	s.logger.Info("imported API catalog",
+		zap.String("mode", string(mode)),
+		zap.Bool("dry_run", dryRun),
+		zap.Int("created", len(result.Created)),
+		zap.Int("updated", len(result.Updated)),
+		zap.Int("unchanged", len(result.Unchanged)),
+		zap.Int("deleted", len(result.Deleted)))
+
+	if !dryRun && result.Changed() {
+		s.refreshAfterWrite()
+	}
+	return result, nil
+}
+
+// importAPI writes one catalog API over its current row, which is nil for a
+// new API and may be soft-deleted
+func importAPI(tx *gorm.DB, current, api *models.APIConfig, mode ImportMode) error {
+	if current == nil {
+		row := *api
+		row.Methods, row.Parameters, row.APIKeys = nil, nil, nil
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		api.ID = row.ID
+	} else {
+		api.ID = current.ID
+		err := tx.Unscoped().Model(&models.APIConfig{}).Where("id = ?", current.ID).Updates(map[string]interface{}{
+			"deleted_at":            nil,
+			"upstream":              api.Upstream,
+			"required_subscription": api.RequiredSubscription,
+			"required_headers":      jsonColumn(api.RequiredHeaders),
+			"rate_limit":            jsonColumn(api.RateLimit),
+			"upstreams":             jsonColumn(api.Upstreams),
+			"load_balancing":        jsonColumn(api.LoadBalancing),
+			"health_checks":         jsonColumn(api.HealthChecks),
+			"canary":                jsonColumn(api.Canary),
+			"tls":                   jsonColumn(api.TLS),
+			"upstream_auth":         jsonColumn(api.UpstreamAuth),
+			"request_headers":       jsonColumn(api.RequestHeaders),
+			"transforms":            jsonColumn(api.Transforms),
+			"spec_name":             api.SpecName,
+			"response_validation":   api.ResponseValidation,
+			"updated_at":            time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("api_config_id = ?", current.ID).Delete(&models.APIMethod{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("api_config_id = ?", current.ID).Delete(&models.APIParameter{}).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, method := range api.Methods {
+		if err := tx.Create(&models.APIMethod{APIConfigID: api.ID, Method: method.Method}).Error; err != nil {
+			return err
+		}
+	}
+	for _, param := range api.Parameters {
+		param.ID, param.APIConfigID = 0, api.ID
+		if err := tx.Create(&param).Error; err != nil {
+			return err
+		}
+	}
+
+	keep := make([]string, 0, len(api.APIKeys))
+	for i := range api.APIKeys {
+		if err := importKey(tx, api.ID, &api.APIKeys[i]); err != nil {
+			return err
+		}
+		keep = append(keep, api.APIKeys[i].KeyHash)
+	}
+	if mode == ImportReplace && current != nil {
+		query := tx.Unscoped().Where("api_config_id = ?", api.ID)
+		if len(keep) > 0 {
+			query = query.Where("key NOT IN ?", keep)
+		}
+		if err := query.Delete(&models.APIKey{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importKey creates a key of the API, or moves and updates the row already
+// holding its digest, which may belong to another API or be soft-deleted
+func importKey(tx *gorm.DB, apiID uint, key *models.APIKey) error {
+	var row models.APIKey
+	err := tx.Unscoped().Where("key = ?", key.KeyHash).First(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		created := *key
+		created.ID, created.APIConfigID = 0, apiID
+		return tx.Create(&created).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"deleted_at":    nil,
+		"api_config_id": apiID,
+		"name":          key.Name,
+		"is_active":     *key.IsActive,
+		"expires_at":    key.ExpiresAt,
+		"rate_limit":    jsonColumn(key.RateLimit),
+		"updated_at":    time.Now(),
+	}
+	if key.KeyPrefix != "" {
+		updates["key_prefix"] = key.KeyPrefix
+	}
+	return tx.Unscoped().Model(&models.APIKey{}).Where("id = ?", row.ID).Updates(updates).Error
+}
+
+// deleteAPI soft-deletes an API with its methods, parameters and keys
+func deleteAPI(tx *gorm.DB, api *models.APIConfig) error {
+	if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIMethod{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIParameter{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("api_config_id = ?", api.ID).Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(api).Error
+}
+
+// jsonColumn encodes a value stored with the json serializer for a map update,
+// which bypasses serializers
+func jsonColumn(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return string(data)
+}
+
+// sameDefinition reports whether importing api would leave current as it is.
+// In merge mode keys that are not in the catalog are ignored.
+func sameDefinition(current, api *models.APIConfig, mode ImportMode) bool {
+	if current.Upstream != api.Upstream ||
+		current.RequiredSubscription != api.RequiredSubscription ||
+		!sameJSON(current.RequiredHeaders, api.RequiredHeaders) ||
+		!sameJSON(current.RateLimit, api.RateLimit) ||
+		!sameJSON(current.Upstreams, api.Upstreams) ||
+		!sameJSON(current.LoadBalancing, api.LoadBalancing) ||
+		!sameJSON(current.HealthChecks, api.HealthChecks) ||
+		!sameJSON(current.Canary, api.Canary) ||
+		!sameJSON(current.TLS, api.TLS) ||
+		!sameJSON(current.UpstreamAuth, api.UpstreamAuth) ||
+		!sameJSON(current.RequestHeaders, api.RequestHeaders) ||
+		!sameJSON(current.Transforms, api.Transforms) ||
+		current.SpecName != api.SpecName ||
+		current.ResponseValidation != api.ResponseValidation {
+		return false
+	}
+
+	methods := func(ms []models.APIMethod) []string {
+		out := make([]string, 0, len(ms))
+		for _, m := range ms {
+			out = append(out, m.Method)
+		}
+		sort.Strings(out)
+		return out
+	}
+	if !sameJSON(methods(current.Methods), methods(api.Methods)) {
+		return false
+	}
+
+	params := func(ps []models.APIParameter) [][4]interface{} {
+		out := make([][4]interface{}, 0, len(ps))
+		for _, p := range ps {
+			out = append(out, [4]interface{}{p.Name, p.Type, p.Required, p.Validation})
+		}
+		return out
+	}
+	if !sameJSON(params(current.Parameters), params(api.Parameters)) {
+		return false
+	}
+
+	keys := make(map[string]models.APIKey, len(current.APIKeys))
+	for _, key := range current.APIKeys {
+		keys[key.KeyHash] = key
+	}
+	if mode == ImportReplace && len(keys) != len(api.APIKeys) {
+		return false
+	}
+	for _, key := range api.APIKeys {
+		stored, ok := keys[key.KeyHash]
+		if !ok || stored.Name != key.Name ||
+			!sameJSON(stored.IsActive, key.IsActive) ||
+			!sameTime(stored.ExpiresAt, key.ExpiresAt) ||
+			!sameJSON(stored.RateLimit, key.RateLimit) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTime compares two optional times by instant
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// sameJSON compares two values by their JSON encoding, so that nil and empty
+// slices compare equal
+func sameJSON(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	if string(ja) == "[]" {
+		ja = []byte("null")
+	}
+	if string(jb) == "[]" {
+		jb = []byte("null")
+	}
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newCatalogTestStore returns an empty store hashing keys with the given pepper
+func newCatalogTestStore(t *testing.T, pepper string) *APIStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "veil.db")), &gorm.Config{})
+	require.NoError(t, err)
+	s := NewAPIStore(db)
+	s.SetKeyPepper(pepper)
+	require.NoError(t, s.AutoMigrate())
+	t.Cleanup(s.Close)
+	return s
+}
+
+// catalog returns the import catalog used by the tests: an updated
+// /weather/* and a new /orders/* API
+func catalog() []models.APIConfig {
+	return []models.APIConfig{
+		{
+			Path:     "/weather/*",
+			Upstream: "http://localhost:9083",
+			Methods:  []models.APIMethod{{Method: "GET"}},
+			APIKeys:  []models.APIKey{{Key: "weather-key-2", Name: "Weather 2"}},
+		},
+		{
+			Path:            "/orders/*",
+			Upstream:        "http://localhost:8085",
+			Methods:         []models.APIMethod{{Method: "GET"}, {Method: "POST"}},
+			RequiredHeaders: []string{"X-Tenant"},
+			Parameters:      []models.APIParameter{{Name: "id", Type: "path", Required: true}},
+			APIKeys:         []models.APIKey{{Key: "orders-key", Name: "Orders"}},
+		},
+	}
+}
+
+func TestAPIStore_ImportAPIs(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          ImportMode
+		dryRun        bool
+		want          ImportResult
+		wantPaths     []string
+		wantWeatherKs []string
+		wantOldKey    bool
+	}{
+		{
+			name:          "merge",
+			mode:          ImportMerge,
+			want:          ImportResult{Created: []string{"/orders/*"}, Updated: []string{"/weather/*"}, Unchanged: []string{}, Deleted: []string{}},
+			wantPaths:     []string{"/news/*", "/orders/*", "/weather/*"},
+			wantWeatherKs: []string{"Weather", "Weather 2"},
+			wantOldKey:    true,
+		},
+		{
+			name:          "replace",
+			mode:          ImportReplace,
+			want:          ImportResult{Created: []string{"/orders/*"}, Updated: []string{"/weather/*"}, Unchanged: []string{}, Deleted: []string{"/news/*"}},
+			wantPaths:     []string{"/orders/*", "/weather/*"},
+			wantWeatherKs: []string{"Weather 2"},
+		},
+		{
+			name:          "dry run",
+			mode:          ImportReplace,
+			dryRun:        true,
+			want:          ImportResult{Created: []string{"/orders/*"}, Updated: []string{"/weather/*"}, Unchanged: []string{}, Deleted: []string{"/news/*"}},
+			wantPaths:     []string{"/news/*", "/weather/*"},
+			wantWeatherKs: []string{"Weather"},
+			wantOldKey:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newKeySyncTestStore(t)
+
+			result, err := s.ImportAPIs(catalog(), tt.mode, tt.dryRun)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *result)
+
+			apis, err := s.ExportAPIs()
+			require.NoError(t, err)
+			var paths []string
+			for _, api := range apis {
+				paths = append(paths, api.Path)
+			}
+			assert.Equal(t, tt.wantPaths, paths)
+
+			weather, err := s.GetAPIWithKeys("/weather/*")
+			require.NoError(t, err)
+			var names []string
+			for _, key := range weather.APIKeys {
+				names = append(names, key.Name)
+			}
+			assert.Equal(t, tt.wantWeatherKs, names)
+
+			// The route index serves the imported state
+			api, err := s.GetAPIByPath("/weather/current")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantOldKey, s.ValidateAPIKey(api, "weather-key"))
+			assert.Equal(t, !tt.dryRun, s.ValidateAPIKey(api, "weather-key-2"))
+
+			// Importing the same catalog again changes nothing
+			if !tt.dryRun {
+				again, err := s.ImportAPIs(catalog(), tt.mode, false)
+				require.NoError(t, err)
+				assert.False(t, again.Changed())
+				assert.Equal(t, []string{"/weather/*", "/orders/*"}, again.Unchanged)
+			}
+		})
+	}
+}
+
+func TestAPIStore_ImportAPIs_revivesDeletedAPI(t *testing.T) {
+	s := newKeySyncTestStore(t)
+	require.NoError(t, s.DeleteAPI("/weather/*"))
+
+	// The deleted key moves back with its API
+	result, err := s.ImportAPIs([]models.APIConfig{{
+		Path:     "/weather/*",
+		Upstream: "http://localhost:8083",
+		APIKeys:  []models.APIKey{{Key: "weather-key", Name: "Weather"}},
+	}}, ImportMerge, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/weather/*"}, result.Created)
+
+	api, err := s.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+	require.NotNil(t, api)
+	assert.True(t, s.ValidateAPIKey(api, "weather-key"))
+}
+
+func TestAPIStore_ImportAPIs_hashedKeys(t *testing.T) {
+	source := newKeySyncTestStore(t)
+	exported, err := source.ExportAPIs()
+	require.NoError(t, err)
+
+	// Export only carries digests
+	for i := range exported {
+		for j := range exported[i].APIKeys {
+			require.Empty(t, exported[i].APIKeys[j].Key)
+		}
+	}
+
+	target := newCatalogTestStore(t, "")
+	_, err = target.ImportAPIs(exported, ImportMerge, false)
+	require.NoError(t, err)
+	api, err := target.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+	assert.True(t, target.ValidateAPIKey(api, "weather-key"))
+
+	// Digests do not match on a gateway with another pepper
+	other := newCatalogTestStore(t, "another-pepper")
+	exported, err = source.ExportAPIs()
+	require.NoError(t, err)
+	_, err = other.ImportAPIs(exported, ImportMerge, false)
+	require.NoError(t, err)
+	api, err = other.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+	assert.False(t, other.ValidateAPIKey(api, "weather-key"))
+}
+
+func TestAPIStore_ImportAPIs_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		apis []models.APIConfig
+		mode ImportMode
+	}{
+		{name: "unknown mode", mode: "upsert"},
+		{name: "missing upstream", mode: ImportMerge, apis: []models.APIConfig{{Path: "/weather/*"}}},
+		{name: "duplicate path", mode: ImportMerge, apis: []models.APIConfig{
+			{Path: "/weather/*", Upstream: "http://localhost:8083"},
+			{Path: "/weather/*", Upstream: "http://localhost:8084"},
+		}},
+		{name: "key without value", mode: ImportMerge, apis: []models.APIConfig{
+			{Path: "/weather/*", Upstream: "http://localhost:8083", APIKeys: []models.APIKey{{Name: "Empty"}}},
+		}},
+		{name: "key listed twice", mode: ImportMerge, apis: []models.APIConfig{
+			{Path: "/weather/*", Upstream: "http://localhost:8083", APIKeys: []models.APIKey{{Key: "shared", Name: "A"}}},
+			{Path: "/news/*", Upstream: "http://localhost:8084", APIKeys: []models.APIKey{{Key: "shared", Name: "B"}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newKeySyncTestStore(t)
+			_, err := s.ImportAPIs(tt.apis, tt.mode, false)
+			assert.ErrorIs(t, err, ErrInvalidCatalog)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrCertificateInUse is returned when deleting a certificate the upstream
+// TLS settings of an API still reference
+var ErrCertificateInUse = errors.New("certificate is referenced by an API")
+
+// PutCertificate encrypts and stores a certificate under its name, replacing
+// the certificate stored under it before. It reports whether the name was new.
+func (s *APIStore) PutCertificate(cert *models.TLSCertificate) (bool, error) {
+	s.logger.Info("storing upstream certificate",
+		zap.String("name", cert.Name),
+		zap.String("subject", cert.Subject),
+		zap.Bool("private_key", cert.PrivateKey != ""))
+
+	certificate, err := s.seal(cert.Certificate)
+	if err != nil {
+		return false, err
+	}
+	privateKey, err := s.seal(cert.PrivateKey)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Deleted certificates are revived so the unique name can be reused
+		var row models.TLSCertificate
+		err := tx.Unscoped().Where("name = ?", cert.Name).First(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			created = true
+			return tx.Create(&models.TLSCertificate{
+				Name:          cert.Name,
+				Certificate:   certificate,
+				PrivateKey:    privateKey,
+				Subject:       cert.Subject,
+				NotAfter:      cert.NotAfter,
+				Fingerprint:   cert.Fingerprint,
+				HasPrivateKey: cert.PrivateKey != "",
+			}).Error
+		}
+		if err != nil {
+			return err
+		}
+		created = row.DeletedAt.Valid
+		return tx.Unscoped().Model(&row).Updates(map[string]interface{}{
+			"certificate":     certificate,
+			"private_key":     privateKey,
+			"subject":         cert.Subject,
+			"not_after":       cert.NotAfter,
+			"fingerprint":     cert.Fingerprint,
+			"has_private_key": cert.PrivateKey != "",
+			"deleted_at":      nil,
+		}).Error
+	})
+	if err != nil {
+		s.logger.Error("failed to store upstream certificate",
+			zap.Error(err),
+			zap.String("name", cert.Name))
+		return false, err
+	}
+	return created, nil
+}
+
+// GetCertificate returns the decrypted certificate stored under the given
+// name, or gorm.ErrRecordNotFound
+func (s *APIStore) GetCertificate(name string) (*models.TLSCertificate, error) {
+	var cert models.TLSCertificate
+	if err := s.db.Where("name = ?", name).First(&cert).Error; err != nil {
+		return nil, err
+	}
+	var err error
+	if cert.Certificate, err = s.open(cert.Certificate); err != nil {
+		return nil, err
+	}
+	if cert.PrivateKey, err = s.open(cert.PrivateKey); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// ListCertificates returns every stored certificate ordered by name, without
+// the encrypted certificate and key
+func (s *APIStore) ListCertificates() ([]models.TLSCertificate, error) {
+	var certs []models.TLSCertificate
+	err := s.db.Omit("certificate", "private_key").Order("name").Find(&certs).Error
+	return certs, err
+}
+
+// CertificateUsers returns the APIs whose upstream TLS settings reference
+// the named certificate, with their methods and parameters
+func (s *APIStore) CertificateUsers(name string) ([]models.APIConfig, error) {
+	var apis []models.APIConfig
+	if err := s.db.Preload("Methods").Preload("Parameters").Where("tls IS NOT NULL").Order("id").Find(&apis).Error; err != nil {
+		return nil, err
+	}
+	users := apis[:0]
+	for _, api := range apis {
+		if slices.Contains(api.TLS.Certificates(), name) {
+			users = append(users, api)
+		}
+	}
+	return users, nil
+}
+
+// DeleteCertificate removes the certificate stored under the given name. It
+// fails with ErrCertificateInUse while an API references the certificate.
+func (s *APIStore) DeleteCertificate(name string) error {
+	s.logger.Info("deleting upstream certificate",
+		zap.String("name", name))
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var cert models.TLSCertificate
+		if err := tx.Where("name = ?", name).First(&cert).Error; err != nil {
+			return err
+		}
+
+		var apis []models.APIConfig
+		if err := tx.Select("id", "tls").Where("tls IS NOT NULL").Find(&apis).Error; err != nil {
+			return err
+		}
+		for _, api := range apis {
+			if slices.Contains(api.TLS.Certificates(), name) {
+				return ErrCertificateInUse
+			}
+		}
+
+		return tx.Delete(&cert).Error
+	})
+}
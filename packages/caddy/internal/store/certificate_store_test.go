@@ -0,0 +1,113 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/gorm"
+)
+
+func TestAPIStore_secrets(t *testing.T) {
+	s := newCatalogTestStore(t, "")
+
+	_, err := s.seal("secret")
+	assert.ErrorIs(t, err, ErrNoSecretKey)
+	assert.False(t, s.HasSecretKey())
+
+	require.NoError(t, s.SetSecretKey("veil-secret"))
+	assert.True(t, s.HasSecretKey())
+	sealed, err := s.seal("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedVersion))
+	assert.NotContains(t, sealed, "secret")
+	again, err := s.seal("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "every seal uses a fresh nonce")
+
+	opened, err := s.open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	// Secrets sealed with another key cannot be read
+	require.NoError(t, s.SetSecretKey("other-secret"))
+	_, err = s.open(sealed)
+	assert.Error(t, err)
+	_, err = s.open("secret")
+	assert.Error(t, err)
+}
+
+func TestAPIStore_certificates(t *testing.T) {
+	s := newCatalogTestStore(t, "")
+	cert := &models.TLSCertificate{
+		Name:        "partner-ca",
+		Certificate: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		Subject:     "CN=Partner CA",
+		NotAfter:    time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		Fingerprint: "ab12",
+	}
+
+	// Certificates are only stored encrypted
+	_, err := s.PutCertificate(cert)
+	assert.ErrorIs(t, err, ErrNoSecretKey)
+	require.NoError(t, s.SetSecretKey("veil-secret"))
+
+	created, err := s.PutCertificate(cert)
+	require.NoError(t, err)
+	assert.True(t, created)
+	var row models.TLSCertificate
+	require.NoError(t, s.db.Where("name = ?", "partner-ca").First(&row).Error)
+	assert.True(t, strings.HasPrefix(row.Certificate, sealedVersion))
+
+	client := &models.TLSCertificate{Name: "partner-client", Certificate: "client-cert", PrivateKey: "client-key"}
+	created, err = s.PutCertificate(client)
+	require.NoError(t, err)
+	assert.True(t, created)
+	client.PrivateKey = "rotated-key"
+	created, err = s.PutCertificate(client)
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	got, err := s.GetCertificate("partner-client")
+	require.NoError(t, err)
+	assert.Equal(t, "client-cert", got.Certificate)
+	assert.Equal(t, "rotated-key", got.PrivateKey)
+	assert.True(t, got.HasPrivateKey)
+	_, err = s.GetCertificate("missing")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	list, err := s.ListCertificates()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "partner-ca", list[0].Name)
+	assert.Equal(t, "CN=Partner CA", list[0].Subject)
+	assert.Empty(t, list[0].Certificate)
+	assert.Empty(t, list[1].PrivateKey)
+
+	// A referenced certificate cannot be deleted
+	require.NoError(t, s.CreateAPI(&models.APIConfig{
+		Path:                 "/partner/*",
+		Upstream:             "https://partner.example.com",
+		RequiredSubscription: "basic",
+		TLS:                  &models.UpstreamTLS{CA: "partner-ca"},
+	}))
+	users, err := s.CertificateUsers("partner-ca")
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "/partner/*", users[0].Path)
+	users, err = s.CertificateUsers("partner-client")
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	assert.ErrorIs(t, s.DeleteCertificate("partner-ca"), ErrCertificateInUse)
+	require.NoError(t, s.DeleteCertificate("partner-client"))
+	assert.ErrorIs(t, s.DeleteCertificate("partner-client"), gorm.ErrRecordNotFound)
+
+	// Deleted names can be reused
+	created, err = s.PutCertificate(client)
+	require.NoError(t, err)
+	assert.True(t, created)
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	// keyDigestVersion marks a stored key column value as a digest rather than
+	// a legacy plaintext key
+	keyDigestVersion = "v1$"
+
+	// keyDigestLength is the length of a digest: the version and a hex SHA-256
+	keyDigestLength = len(keyDigestVersion) + 2*sha256.Size
+
+	// GeneratedKeyPrefix is prepended to keys generated by the gateway
+	GeneratedKeyPrefix = "veil_live_"
+)
+
+// hashKey returns the peppered digest stored for an API key value.
+// A keyed SHA-256 (HMAC) is used instead of a per-row salt so that keys can
+// still be looked up in O(1) by digest on every proxied request.
+func hashKey(pepper []byte, value string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(value))
+	return keyDigestVersion + hex.EncodeToString(mac.Sum(nil))
+}
+
+// KeyDigest returns the digest stored for a key value. Values that already
+// are digests, such as the key hashes of an exported catalog, are returned as is.
+func (s *APIStore) KeyDigest(value string) string {
+	if isKeyDigest(value) {
+		return value
+	}
+	return hashKey(s.pepper, value)
+}
+
+// isKeyDigest reports whether a stored key column value is already hashed.
+// Only the exact digest format counts, so legacy plaintext keys that happen
+// to start with the version are still hashed.
+func isKeyDigest(stored string) bool {
+	if len(stored) != keyDigestLength || !strings.HasPrefix(stored, keyDigestVersion) {
+		return false
+	}
+	for _, c := range stored[len(keyDigestVersion):] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// digestsEqual compares two digests in constant time
+func digestsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// KeyPrefix returns the short, non-secret part of a key shown in listings and
+// logs, e.g. "veil_live_ab12". Short custom keys reveal at most half their length.
+func KeyPrefix(value string) string {
+	if strings.HasPrefix(value, GeneratedKeyPrefix) {
+		return value[:min(len(value), len(GeneratedKeyPrefix)+4)]
+	}
+	return value[:min(6, len(value)/2)]
+}
+
+// GenerateKey returns a new random API key with the gateway prefix
+func GenerateKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	return GeneratedKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// SetKeyPepper sets the secret mixed into every key digest. It must be set
+// before AutoMigrate and stay stable, otherwise stored keys no longer match.
+func (s *APIStore) SetKeyPepper(pepper string) {
+	s.pepper = []byte(pepper)
+}
+
+// prepareKey fills the digest and prefix of a key from its plaintext value.
+// A missing value is generated so the caller can return it once.
+func (s *APIStore) prepareKey(key *models.APIKey) error {
+	if key.KeyHash != "" && key.Key == "" {
+		return nil
+	}
+	if key.Key == "" {
+		generated, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		key.Key = generated
+	}
+	key.KeyHash = hashKey(s.pepper, key.Key)
+	key.KeyPrefix = KeyPrefix(key.Key)
+	return nil
+}
+
+// migratePlaintextKeys hashes API keys stored in plaintext by earlier versions
+func (s *APIStore) migratePlaintextKeys() error {
+	// A GLOB without wildcards matches the whole value: exactly a digest
+	digestPattern := keyDigestVersion + strings.Repeat("[0-9a-f]", 2*sha256.Size)
+
+	var legacy []models.APIKey
+	err := s.db.Unscoped().
+		Where("key NOT GLOB ?", digestPattern).
+		Find(&legacy).Error
+	if err != nil {
+		return fmt.Errorf("failed to load plaintext API keys: %v", err)
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	s.logger.Info("hashing plaintext API keys",
+		zap.Int("count", len(legacy)))
+
+	for _, key := range legacy {
+		// The legacy plaintext value was read into KeyHash since they share a column
+		plaintext := key.KeyHash
+		err := s.db.Unscoped().Model(&models.APIKey{}).
+			Where("id = ?", key.ID).
+			Updates(map[string]interface{}{
+				"key":        hashKey(s.pepper, plaintext),
+				"key_prefix": KeyPrefix(plaintext),
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to hash API key %d: %v", key.ID, err)
+		}
+	}
+
+	s.logger.Info("plaintext API keys hashed",
+		zap.Int("count", len(legacy)))
+
+	return nil
+}
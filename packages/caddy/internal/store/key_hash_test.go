@@ -0,0 +1,62 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, "veil_live_ab12", KeyPrefix("veil_live_ab12cd34ef56"))
+	assert.Equal(t, "weathe", KeyPrefix("weather-test-key-1"))
+	assert.Equal(t, "te", KeyPrefix("test"))
+	assert.Equal(t, "", KeyPrefix(""))
+}
+
+func TestAPIStore_migratePlaintextKeys(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "veil.db")), &gorm.Config{})
+	assert.NoError(t, err)
+
+	// Simulate a database written by a version that stored keys in plaintext
+	assert.NoError(t, db.Exec(`CREATE TABLE api_configs (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, path text NOT NULL UNIQUE, upstream text NOT NULL, required_subscription text NOT NULL, last_accessed datetime, request_count integer DEFAULT 0, required_headers text)`).Error)
+	assert.NoError(t, db.Exec(`CREATE TABLE api_keys (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, api_config_id integer, key text NOT NULL UNIQUE, name text NOT NULL, is_active numeric DEFAULT true, expires_at datetime)`).Error)
+	assert.NoError(t, db.Exec(`INSERT INTO api_configs (path, upstream, required_subscription) VALUES ('/weather/*', 'http://localhost:8083', 'basic')`).Error)
+	assert.NoError(t, db.Exec(`INSERT INTO api_keys (api_config_id, key, name, is_active) VALUES (1, 'legacy-plaintext-key', 'Legacy', true)`).Error)
+	// A plaintext key that merely starts like a digest is hashed as well
+	assert.NoError(t, db.Exec(`INSERT INTO api_keys (api_config_id, key, name, is_active) VALUES (1, 'v1$partner-key', 'Partner', true)`).Error)
+
+	s := NewAPIStore(db)
+	t.Cleanup(s.Close)
+	s.SetKeyPepper("pepper")
+	assert.NoError(t, s.AutoMigrate())
+
+	var stored models.APIKey
+	assert.NoError(t, db.First(&stored).Error)
+	assert.True(t, strings.HasPrefix(stored.KeyHash, keyDigestVersion))
+	assert.NotContains(t, stored.KeyHash, "legacy-plaintext-key")
+	assert.Equal(t, "legacy", stored.KeyPrefix)
+
+	// The legacy key still validates after migration
+	api, err := s.GetAPIByPath("/weather/current")
+	assert.NoError(t, err)
+	assert.True(t, s.ValidateAPIKey(api, "legacy-plaintext-key"))
+	assert.True(t, s.ValidateAPIKey(api, "v1$partner-key"))
+
+	// A second migration is a no-op
+	assert.NoError(t, s.AutoMigrate())
+	assert.True(t, s.ValidateAPIKey(api, "legacy-plaintext-key"))
+	assert.True(t, s.ValidateAPIKey(api, "v1$partner-key"))
+}
+
+func TestIsKeyDigest(t *testing.T) {
+	assert.True(t, isKeyDigest(hashKey([]byte("pepper"), "test-key")))
+	assert.False(t, isKeyDigest("v1$partner-key"))
+	assert.False(t, isKeyDigest("v1$"+strings.Repeat("A", 64)))
+	assert.False(t, isKeyDigest("v1$"+strings.Repeat("a", 63)))
+	assert.False(t, isKeyDigest("test-key"))
+}
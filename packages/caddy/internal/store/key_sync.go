@@ -0,0 +1,203 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// KeyOperation is a change to an API key sent over key.sync
+type KeyOperation string
+
+const (
+	KeyOpStatus KeyOperation = "status"
+	KeyOpCreate KeyOperation = "create"
+	KeyOpDelete KeyOperation = "delete"
+	KeyOpExpire KeyOperation = "expire"
+	KeyOpRename KeyOperation = "rename"
+	KeyOpMove   KeyOperation = "move"
+)
+
+// ErrKeyNotFound is returned when a key change targets a key the gateway
+// does not have
+var ErrKeyNotFound = errors.New("API key not found")
+
+// KeyChange is a versioned change to a single API key. Changes are applied
+// only if their version is newer than the last one applied to the key, so
+// redelivered and reordered changes are no-ops. Version 0 only applies to
+// keys that never received a versioned change.
+type KeyChange struct {
+	Operation KeyOperation
+	KeyValue  string
+	Version   uint64
+	// APIPath is the path of the API a created or moved key belongs to
+	APIPath   string
+	Name      string
+	IsActive  *bool
+	ExpiresAt *time.Time
+}
+
+// Validate checks that the change carries the fields its operation needs
+func (c KeyChange) Validate() error {
+	if c.KeyValue == "" {
+		return fmt.Errorf("key value is required")
+	}
+	switch c.Operation {
+	case KeyOpStatus:
+		if c.IsActive == nil {
+			return fmt.Errorf("is_active is required for %s", c.Operation)
+		}
+	case KeyOpCreate:
+		if c.APIPath == "" || c.Name == "" {
+			return fmt.Errorf("api_path and name are required for %s", c.Operation)
+		}
+	case KeyOpRename:
+		if c.Name == "" {
+			return fmt.Errorf("name is required for %s", c.Operation)
+		}
+	case KeyOpMove:
+		if c.APIPath == "" {
+			return fmt.Errorf("api_path is required for %s", c.Operation)
+		}
+	case KeyOpDelete, KeyOpExpire:
+	default:
+		return fmt.Errorf("unknown key operation %q", c.Operation)
+	}
+	return nil
+}
+
+// ApplyKeyChange applies a key.sync change and reports whether it changed
+// anything. Stale changes, whose version is not newer than the key's, and
+// deletes of missing keys return false without an error; version 0 only
+// applies to keys that were never synced. Deleted keys keep their version,
+// so a stale create cannot bring them back.
+func (s *APIStore) ApplyKeyChange(change KeyChange) (bool, error) {
+	if err := change.Validate(); err != nil {
+		return false, err
+	}
+
+	keyHash := hashKey(s.pepper, change.KeyValue)
+	applied := false
+	// apiIDs are the APIs whose keys changed
+	var apiIDs []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var key models.APIKey
+		err := tx.Unscoped().Where("key = ?", keyHash).First(&key).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			switch change.Operation {
+			case KeyOpCreate:
+				apiID, err := s.createSyncedKey(tx, change, keyHash)
+				applied, apiIDs = err == nil, []uint{apiID}
+				return err
+			case KeyOpDelete:
+				return nil
+			default:
+				return ErrKeyNotFound
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if change.Version == 0 && key.SyncVersion > 0 || change.Version > 0 && key.SyncVersion >= change.Version {
+			return nil
+		}
+		if key.DeletedAt.Valid && change.Operation != KeyOpCreate {
+			if change.Operation == KeyOpDelete {
+				return nil
+			}
+			return ErrKeyNotFound
+		}
+
+		updates := map[string]interface{}{"sync_version": change.Version}
+		apiIDs = []uint{key.APIConfigID}
+		switch change.Operation {
+		case KeyOpStatus:
+			updates["is_active"] = *change.IsActive
+		case KeyOpCreate:
+			apiID, err := apiIDByPath(tx, change.APIPath)
+			if err != nil {
+				return err
+			}
+			active := true
+			if change.IsActive != nil {
+				active = *change.IsActive
+			}
+			updates["api_config_id"] = apiID
+			apiIDs = append(apiIDs, apiID)
+			updates["name"] = change.Name
+			updates["is_active"] = active
+			updates["expires_at"] = change.ExpiresAt
+			updates["deleted_at"] = nil
+		case KeyOpDelete:
+			updates["deleted_at"] = time.Now()
+		case KeyOpExpire:
+			updates["expires_at"] = change.ExpiresAt
+		case KeyOpRename:
+			updates["name"] = change.Name
+		case KeyOpMove:
+			apiID, err := apiIDByPath(tx, change.APIPath)
+			if err != nil {
+				return err
+			}
+			updates["api_config_id"] = apiID
+			apiIDs = append(apiIDs, apiID)
+		}
+
+		// Guard against a concurrent change from another process
+		result := tx.Unscoped().Model(&models.APIKey{}).
+			Where("id = ? AND sync_version = ?", key.ID, key.SyncVersion).
+			Updates(updates)
+		applied = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if applied {
+		s.logger.Info("applied API key change",
+			zap.String("operation", string(change.Operation)),
+			zap.String("key_prefix", KeyPrefix(change.KeyValue)),
+			zap.Uint64("version", change.Version))
+		s.refreshKeysAfterWrite(apiIDs...)
+	}
+	return applied, nil
+}
+
+// createSyncedKey inserts the key of a create change and returns its API
+func (s *APIStore) createSyncedKey(tx *gorm.DB, change KeyChange, keyHash string) (uint, error) {
+	apiID, err := apiIDByPath(tx, change.APIPath)
+	if err != nil {
+		return 0, err
+	}
+	active := true
+	if change.IsActive != nil {
+		active = *change.IsActive
+	}
+	return apiID, tx.Create(&models.APIKey{
+		APIConfigID: apiID,
+		KeyHash:     keyHash,
+		KeyPrefix:   KeyPrefix(change.KeyValue),
+		Name:        change.Name,
+		IsActive:    &active,
+		ExpiresAt:   change.ExpiresAt,
+		SyncVersion: change.Version,
+	}).Error
+}
+
+// apiIDByPath returns the ID of the API registered under exactly path
+func apiIDByPath(tx *gorm.DB, path string) (uint, error) {
+	var api models.APIConfig
+	if err := tx.Select("id").Where("path = ?", path).First(&api).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, fmt.Errorf("API %q not found", path)
+		}
+		return 0, err
+	}
+	return api.ID, nil
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newKeySyncTestStore returns a store with the /weather/* API holding
+// weather-key and an empty /news/* API
+func newKeySyncTestStore(t *testing.T) *APIStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "veil.db")), &gorm.Config{})
+	require.NoError(t, err)
+	s := NewAPIStore(db)
+	require.NoError(t, s.AutoMigrate())
+	t.Cleanup(s.Close)
+
+	active := true
+	require.NoError(t, s.CreateAPI(&models.APIConfig{
+		Path:     "/weather/*",
+		Upstream: "http://localhost:8083",
+		APIKeys:  []models.APIKey{{Key: "weather-key", Name: "Weather", IsActive: &active}},
+	}))
+	require.NoError(t, s.CreateAPI(&models.APIConfig{
+		Path:     "/news/*",
+		Upstream: "http://localhost:8084",
+	}))
+	return s
+}
+
+func TestAPIStore_ApplyKeyChangeStatus(t *testing.T) {
+	s := newKeySyncTestStore(t)
+	api, err := s.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+
+	steps := []struct {
+		name        string
+		isActive    bool
+		version     uint64
+		wantApplied bool
+		wantActive  bool
+	}{
+		{name: "unversioned update applies to a never synced key", isActive: false, version: 0, wantApplied: true, wantActive: false},
+		{name: "newer version applies", isActive: true, version: 5, wantApplied: true, wantActive: true},
+		{name: "same version is ignored", isActive: false, version: 5, wantApplied: false, wantActive: true},
+		{name: "older version is ignored", isActive: false, version: 3, wantApplied: false, wantActive: true},
+		{name: "unversioned update is ignored once synced", isActive: false, version: 0, wantApplied: false, wantActive: true},
+		{name: "next version applies", isActive: false, version: 6, wantApplied: true, wantActive: false},
+	}
+
+	for _, step := range steps {
+		isActive := step.isActive
+		applied, err := s.ApplyKeyChange(KeyChange{Operation: KeyOpStatus, KeyValue: "weather-key", IsActive: &isActive, Version: step.version})
+		require.NoError(t, err, step.name)
+		assert.Equal(t, step.wantApplied, applied, step.name)
+		assert.Equal(t, step.wantActive, s.ValidateAPIKey(api, "weather-key"), step.name)
+	}
+
+	active := true
+	_, err = s.ApplyKeyChange(KeyChange{Operation: KeyOpStatus, KeyValue: "unknown-key", IsActive: &active, Version: 7})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestAPIStore_ApplyKeyChange(t *testing.T) {
+	s := newKeySyncTestStore(t)
+	weather, err := s.GetAPIByPath("/weather/current")
+	require.NoError(t, err)
+	news, err := s.GetAPIByPath("/news/today")
+	require.NoError(t, err)
+
+	inactive := false
+	expiry := time.Now().Add(-time.Hour)
+
+	steps := []struct {
+		name        string
+		change      KeyChange
+		wantApplied bool
+		wantErr     bool
+		wantWeather bool
+		wantNews    bool
+	}{
+		{
+			name:        "create",
+			change:      KeyChange{Operation: KeyOpCreate, KeyValue: "synced-key", Version: 1, APIPath: "/weather/*", Name: "Synced"},
+			wantApplied: true, wantWeather: true,
+		},
+		{
+			name:        "redelivered create is a no-op",
+			change:      KeyChange{Operation: KeyOpCreate, KeyValue: "synced-key", Version: 1, APIPath: "/weather/*", Name: "Synced"},
+			wantWeather: true,
+		},
+		{
+			name:        "rename",
+			change:      KeyChange{Operation: KeyOpRename, KeyValue: "synced-key", Version: 2, Name: "Renamed"},
+			wantApplied: true, wantWeather: true,
+		},
+		{
+			name:        "move to another API",
+			change:      KeyChange{Operation: KeyOpMove, KeyValue: "synced-key", Version: 3, APIPath: "/news/*"},
+			wantApplied: true, wantNews: true,
+		},
+		{
+			name:    "move to an unknown API",
+			change:  KeyChange{Operation: KeyOpMove, KeyValue: "synced-key", Version: 4, APIPath: "/unknown/*"},
+			wantErr: true, wantNews: true,
+		},
+		{
+			name:        "expire",
+			change:      KeyChange{Operation: KeyOpExpire, KeyValue: "synced-key", Version: 4, ExpiresAt: &expiry},
+			wantApplied: true,
+		},
+		{
+			name:        "clear expiry",
+			change:      KeyChange{Operation: KeyOpExpire, KeyValue: "synced-key", Version: 5},
+			wantApplied: true, wantNews: true,
+		},
+		{
+			name:        "delete",
+			change:      KeyChange{Operation: KeyOpDelete, KeyValue: "synced-key", Version: 6},
+			wantApplied: true,
+		},
+		{
+			name:   "redelivered delete is a no-op",
+			change: KeyChange{Operation: KeyOpDelete, KeyValue: "synced-key", Version: 6},
+		},
+		{
+			name:    "status of a deleted key",
+			change:  KeyChange{Operation: KeyOpStatus, KeyValue: "synced-key", Version: 7, IsActive: &inactive},
+			wantErr: true,
+		},
+		{
+			name:   "stale create does not bring a deleted key back",
+			change: KeyChange{Operation: KeyOpCreate, KeyValue: "synced-key", Version: 5, APIPath: "/weather/*", Name: "Synced"},
+		},
+		{
+			name:        "newer create restores a deleted key",
+			change:      KeyChange{Operation: KeyOpCreate, KeyValue: "synced-key", Version: 8, APIPath: "/weather/*", Name: "Synced"},
+			wantApplied: true, wantWeather: true,
+		},
+		{
+			name:        "delete of an unknown key is a no-op",
+			change:      KeyChange{Operation: KeyOpDelete, KeyValue: "unknown-key", Version: 1},
+			wantWeather: true,
+		},
+		{
+			name:        "create without an API",
+			change:      KeyChange{Operation: KeyOpCreate, KeyValue: "other-key", Version: 1, Name: "Other"},
+			wantErr:     true,
+			wantWeather: true,
+		},
+		{
+			name:        "unknown operation",
+			change:      KeyChange{Operation: "suspend", KeyValue: "synced-key", Version: 9},
+			wantErr:     true,
+			wantWeather: true,
+		},
+	}
+
+	for _, step := range steps {
+		applied, err := s.ApplyKeyChange(step.change)
+		if step.wantErr {
+			assert.Error(t, err, step.name)
+		} else {
+			assert.NoError(t, err, step.name)
+		}
+		assert.Equal(t, step.wantApplied, applied, step.name)
+		assert.Equal(t, step.wantWeather, s.ValidateAPIKey(weather, "synced-key"), step.name)
+		assert.Equal(t, step.wantNews, s.ValidateAPIKey(news, "synced-key"), step.name)
+	}
+
+	key, err := s.FindAPIKey(weather, "synced-key")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, "Synced", key.Name)
+	assert.Equal(t, uint64(8), key.SyncVersion)
+}
+
+func TestAPIStore_UpdateAPIKeepsSyncedKeys(t *testing.T) {
+	s := newKeySyncTestStore(t)
+	inactive := false
+	applied, err := s.ApplyKeyChange(KeyChange{Operation: KeyOpStatus, KeyValue: "weather-key", Version: 5, IsActive: &inactive})
+	require.NoError(t, err)
+	require.True(t, applied)
+	applied, err = s.ApplyKeyChange(KeyChange{Operation: KeyOpCreate, KeyValue: "removed-key", Version: 1, APIPath: "/weather/*", Name: "Removed"})
+	require.NoError(t, err)
+	require.True(t, applied)
+	applied, err = s.ApplyKeyChange(KeyChange{Operation: KeyOpDelete, KeyValue: "removed-key", Version: 2})
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	before, err := s.GetAPIWithKeys("/weather/*")
+	require.NoError(t, err)
+	require.Len(t, before.APIKeys, 1)
+
+	// The update keeps weather-key, renames it and adds a key
+	update := *before
+	update.APIKeys = []models.APIKey{
+		{Key: "weather-key", Name: "Renamed", IsActive: &inactive},
+		{Key: "new-key", Name: "New"},
+	}
+	require.NoError(t, s.UpdateAPI(&update))
+
+	after, err := s.GetAPIWithKeys("/weather/*")
+	require.NoError(t, err)
+	require.Len(t, after.APIKeys, 2)
+	key, err := s.FindAPIKey(after, "weather-key")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, before.APIKeys[0].ID, key.ID)
+	assert.Equal(t, "Renamed", key.Name)
+	assert.Equal(t, uint64(5), key.SyncVersion)
+	assert.True(t, s.ValidateAPIKey(after, "new-key"))
+
+	// Stale sync updates are still ignored, also for keys deleted by sync
+	applied, err = s.ApplyKeyChange(KeyChange{Operation: KeyOpStatus, KeyValue: "weather-key", Version: 4, IsActive: &inactive})
+	require.NoError(t, err)
+	assert.False(t, applied)
+	applied, err = s.ApplyKeyChange(KeyChange{Operation: KeyOpCreate, KeyValue: "removed-key", Version: 1, APIPath: "/weather/*", Name: "Removed"})
+	require.NoError(t, err)
+	assert.False(t, applied)
+
+	// Keys sent without a value keep the stored key of the same name
+	update.APIKeys = []models.APIKey{{Name: "Renamed"}, {Key: "new-key", Name: "New"}, {Name: "Added"}}
+	require.NoError(t, s.UpdateAPI(&update))
+	kept, err := s.FindAPIKey(after, "weather-key")
+	require.NoError(t, err)
+	require.NotNil(t, kept)
+	assert.Equal(t, key.ID, kept.ID)
+	assert.True(t, *kept.IsActive)
+	assert.True(t, s.ValidateAPIKey(after, "new-key"))
+	assert.NotEmpty(t, update.APIKeys[2].Key, "keys without a stored match are generated")
+	assert.True(t, s.ValidateAPIKey(after, update.APIKeys[2].Key))
+
+	// Keys left out of an update are removed
+	update.APIKeys = []models.APIKey{{Key: "new-key", Name: "New"}}
+	require.NoError(t, s.UpdateAPI(&update))
+	assert.False(t, s.ValidateAPIKey(after, "weather-key"))
+	assert.True(t, s.ValidateAPIKey(after, "new-key"))
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// radixNode is a node of a compressed prefix tree keyed by API path prefixes
+type radixNode struct {
+	prefix   string
+	children []*radixNode
+	api      *models.APIConfig
+}
+
+// insert adds an API under the given match prefix. If the prefix is already
+// taken the first inserted API is kept, matching the previous scan order.
+func (n *radixNode) insert(prefix string, api *models.APIConfig) {
+	node := n
+	for {
+		if prefix == "" {
+			if node.api == nil {
+				node.api = api
+			}
+			return
+		}
+
+		var next *radixNode
+		for _, child := range node.children {
+			if child.prefix[0] == prefix[0] {
+				next = child
+				break
+			}
+		}
+
+		if next == nil {
+			node.children = append(node.children, &radixNode{prefix: prefix, api: api})
+			return
+		}
+
+		common := commonPrefixLen(next.prefix, prefix)
+		if common < len(next.prefix) {
+			// Split the child so the shared part becomes an intermediate node
+			split := &radixNode{
+				prefix:   next.prefix[common:],
+				children: next.children,
+				api:      next.api,
+			}
+			next.prefix = next.prefix[:common]
+			next.children = []*radixNode{split}
+			next.api = nil
+		}
+
+		node = next
+		prefix = prefix[common:]
+	}
+}
+
+// longestPrefix returns the API with the longest prefix of path
+func (n *radixNode) longestPrefix(path string) *models.APIConfig {
+	best := n.api
+	node := n
+	for path != "" {
+		var next *radixNode
+		for _, child := range node.children {
+			if strings.HasPrefix(path, child.prefix) {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		path = path[len(next.prefix):]
+		node = next
+		if node.api != nil {
+			best = node.api
+		}
+	}
+	return best
+}
+
+// commonPrefixLen returns the length of the shared prefix of a and b
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// indexedKey is an API key entry in the route index
+type indexedKey struct {
+	key   *models.APIKey
+	apiID uint
+}
+
+// keyTable holds the API keys of a route index. Unlike the rest of the index
+// it is updated in place, one API at a time, so key writes do not reload the
+// catalog. Entries are replaced, never modified.
+type keyTable struct {
+	mu       sync.RWMutex
+	byDigest map[string]indexedKey
+	byAPI    map[uint][]string
+}
+
+// get returns the key with the given digest and the API it belongs to
+func (t *keyTable) get(digest string) (indexedKey, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entry, ok := t.byDigest[digest]
+	return entry, ok
+}
+
+// replace swaps the keys of an API for the given ones
+func (t *keyTable) replace(apiID uint, keys []models.APIKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, digest := range t.byAPI[apiID] {
+		if entry, ok := t.byDigest[digest]; ok && entry.apiID == apiID {
+			delete(t.byDigest, digest)
+		}
+	}
+	delete(t.byAPI, apiID)
+
+	for i := range keys {
+		key := &keys[i]
+		t.byDigest[key.KeyHash] = indexedKey{key: key, apiID: apiID}
+		t.byAPI[apiID] = append(t.byAPI[apiID], key.KeyHash)
+	}
+}
+
+// routeIndex is a snapshot of every API configuration and OpenAPI document,
+// swapped atomically as a whole whenever they change. The indexed APIs carry
+// no keys; those live in the key table.
+type routeIndex struct {
+	root  *radixNode
+	apis  map[string]*models.APIConfig
+	keys  *keyTable
+	specs map[string]*models.APISpec
+}
+
+// newRouteIndex builds an index from fully preloaded API configurations
+func newRouteIndex(configs []models.APIConfig) *routeIndex {
+	idx := &routeIndex{
+		root: &radixNode{},
+		apis: make(map[string]*models.APIConfig, len(configs)),
+		keys: &keyTable{
+			byDigest: make(map[string]indexedKey),
+			byAPI:    make(map[uint][]string, len(configs)),
+		},
+		specs: make(map[string]*models.APISpec),
+	}
+
+	for i := range configs {
+		api := &configs[i]
+		idx.keys.replace(api.ID, api.APIKeys)
+		api.APIKeys = nil
+		idx.apis[api.Path] = api
+		idx.root.insert(matchPrefix(api.Path), api)
+	}
+
+	return idx
+}
+
+// matchPrefix returns the request path prefix an API path matches
+func matchPrefix(path string) string {
+	return strings.TrimSuffix(path, "/*")
+}
+
+// match returns the API whose path is the longest prefix of the request path
+func (idx *routeIndex) match(path string) *models.APIConfig {
+	return idx.root.longestPrefix(path)
+}
+
+// key returns the API key with the given digest if it belongs to the API
+func (idx *routeIndex) key(apiID uint, digest string) *models.APIKey {
+	entry, ok := idx.keys.get(digest)
+	if !ok || entry.apiID != apiID || !digestsEqual(entry.key.KeyHash, digest) {
+		return nil
+	}
+	return entry.key
+}
+
+// sharedIndex is the route index of one database file. Every store opened on
+// the file uses it, so a write made through one store (e.g. the management
+// API handler) is seen by all others (e.g. the handlers on generated proxy
+// routes) after a single rebuild.
+type sharedIndex struct {
+	refs  int
+	mu    sync.Mutex
+	index atomic.Pointer[routeIndex]
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*sharedIndex)
+)
+
+// register returns the shared index of the store's database
+func register(s *APIStore) *sharedIndex {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	shared, ok := registry[s.name]
+	if !ok {
+		shared = &sharedIndex{}
+		registry[s.name] = shared
+	}
+	shared.refs++
+	return shared
+}
+
+// unregister releases the store's use of the shared index, dropping the index
+// with its last store
+func unregister(s *APIStore) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if shared, ok := registry[s.name]; ok && shared == s.shared {
+		shared.refs--
+		if shared.refs == 0 {
+			delete(registry, s.name)
+		}
+	}
+}
+
+// databaseName identifies the database file a gorm connection points to
+func databaseName(db *gorm.DB) string {
+	if db != nil {
+		if dialector, ok := db.Dialector.(*sqlite.Dialector); ok {
+			if abs, err := filepath.Abs(dialector.DSN); err == nil {
+				return abs
+			}
+			return dialector.DSN
+		}
+	}
+	return fmt.Sprintf("%p", db)
+}
+
+// routes returns the current index, building it on first use
+func (s *APIStore) routes() (*routeIndex, error) {
+	if idx := s.shared.index.Load(); idx != nil {
+		return idx, nil
+	}
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	return s.shared.index.Load(), nil
+}
+
+// Refresh loads every API with its methods, parameters and keys, and every
+// OpenAPI document, and atomically replaces the index shared by all stores
+// on the database. It is called after every successful write that is not
+// limited to keys.
+func (s *APIStore) Refresh() error {
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	var configs []models.APIConfig
+	err := s.db.Preload("Methods").
+		Preload("Parameters").
+		Preload("APIKeys").
+		Order("id").
+		Find(&configs).Error
+	if err != nil {
+		s.logger.Error("failed to rebuild route index",
+			zap.Error(err))
+		return err
+	}
+
+	var specs []models.APISpec
+	if err := s.db.Find(&specs).Error; err != nil {
+		s.logger.Error("failed to rebuild route index",
+			zap.Error(err))
+		return err
+	}
+
+	idx := newRouteIndex(configs)
+	for i := range specs {
+		idx.specs[specs[i].Name] = &specs[i]
+	}
+	s.shared.index.Store(idx)
+
+	s.logger.Debug("rebuilt route index",
+		zap.Int("apis", len(idx.apis)),
+		zap.Int("api_keys", len(idx.keys.byDigest)))
+
+	return nil
+}
+
+// refreshKeys reloads the keys of the given APIs into the shared index
+// after a write that only changed keys
+func (s *APIStore) refreshKeys(apiIDs ...uint) error {
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	idx := s.shared.index.Load()
+	if idx == nil {
+		// Built with the current keys on first use
+		return nil
+	}
+	for _, apiID := range apiIDs {
+		var keys []models.APIKey
+		if err := s.db.Where("api_config_id = ?", apiID).Find(&keys).Error; err != nil {
+			return err
+		}
+		idx.keys.replace(apiID, keys)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestRouteIndex_match(t *testing.T) {
+	configs := []models.APIConfig{
+		{Path: "/weather/*"},
+		{Path: "/weather/forecast/*"},
+		{Path: "/orders"},
+		{Path: "/order-items/*"},
+	}
+	for i := range configs {
+		configs[i].ID = uint(i + 1)
+	}
+	idx := newRouteIndex(configs)
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "Prefix Match", path: "/weather/current", want: "/weather/*"},
+		{name: "Longest Prefix Wins", path: "/weather/forecast/daily", want: "/weather/forecast/*"},
+		{name: "Exact Path", path: "/orders", want: "/orders"},
+		{name: "Shared Prefix Split", path: "/order-items/42", want: "/order-items/*"},
+		{name: "Raw String Prefix", path: "/orders123", want: "/orders"},
+		{name: "No Match", path: "/users", want: ""},
+		{name: "Partial Prefix", path: "/ord", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idx.match(tt.path)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			assert.NotNil(t, got)
+			assert.Equal(t, tt.want, got.Path)
+		})
+	}
+}
+
+func TestAPIStore_RefreshSharedDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "veil.db")
+
+	open := func() *APIStore {
+		db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+		assert.NoError(t, err)
+		s := NewAPIStore(db)
+		assert.NoError(t, s.AutoMigrate())
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	writer := open()
+	reader := open()
+	assert.Same(t, writer.shared, reader.shared)
+
+	active := true
+	err := writer.CreateAPI(&models.APIConfig{
+		Path:     "/weather/*",
+		Upstream: "http://localhost:8083",
+		APIKeys:  []models.APIKey{{Key: "weather-key", Name: "Weather", IsActive: &active}},
+	})
+	assert.NoError(t, err)
+
+	// The reader's index is refreshed by the writer without touching its own store
+	api, err := reader.GetAPIByPath("/weather/current")
+	assert.NoError(t, err)
+	assert.NotNil(t, api)
+	assert.True(t, reader.ValidateAPIKey(api, "weather-key"))
+
+	// Key writes patch the shared index instead of rebuilding it
+	idx := reader.shared.index.Load()
+	inactive := false
+	applied, err := writer.ApplyKeyChange(KeyChange{Operation: KeyOpStatus, KeyValue: "weather-key", IsActive: &inactive, Version: 1})
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.False(t, reader.ValidateAPIKey(api, "weather-key"))
+	assert.Same(t, idx, reader.shared.index.Load())
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedVersion marks a column value encrypted with the secret key
+const sealedVersion = "enc1$"
+
+// ErrNoSecretKey is returned when a secret is stored or read while no secret
+// key is configured
+var ErrNoSecretKey = errors.New("no secret key configured")
+
+// SetSecretKey sets the secret that certificates and other secrets are
+// encrypted with at rest (AES-256-GCM with a key derived by SHA-256). It must
+// stay stable, otherwise stored secrets can no longer be read.
+func (s *APIStore) SetSecretKey(secret string) error {
+	if secret == "" {
+		s.secrets = nil
+		return nil
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	s.secrets, err = cipher.NewGCM(block)
+	return err
+}
+
+// HasSecretKey reports whether secrets can be stored
+func (s *APIStore) HasSecretKey() bool {
+	return s.secrets != nil
+}
+
+// seal encrypts a secret for storage
+func (s *APIStore) seal(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if s.secrets == nil {
+		return "", ErrNoSecretKey
+	}
+	nonce := make([]byte, s.secrets.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := s.secrets.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedVersion + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a secret sealed by seal
+func (s *APIStore) open(stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	encoded, ok := strings.CutPrefix(stored, sealedVersion)
+	if !ok {
+		return "", errors.New("stored secret is not encrypted")
+	}
+	if s.secrets == nil {
+		return "", ErrNoSecretKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < s.secrets.NonceSize() {
+		return "", errors.New("stored secret is corrupt")
+	}
+	nonce, ciphertext := sealed[:s.secrets.NonceSize()], sealed[s.secrets.NonceSize():]
+	plaintext, err := s.secrets.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("stored secret cannot be decrypted with the configured secret key")
+	}
+	return string(plaintext), nil
+}
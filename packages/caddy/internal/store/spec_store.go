@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrSpecInUse is returned when deleting an OpenAPI document APIs still
+// validate against
+var ErrSpecInUse = errors.New("OpenAPI document is referenced by an API")
+
+// PutSpec stores an OpenAPI document under the given name, replacing the
+// document stored under it before. It reports whether the name was new.
+func (s *APIStore) PutSpec(name, document string) (bool, error) {
+	s.logger.Info("storing OpenAPI document",
+		zap.String("name", name),
+		zap.Int("size", len(document)))
+
+	created := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Deleted documents are revived so the unique name can be reused
+		var spec models.APISpec
+		err := tx.Unscoped().Where("name = ?", name).First(&spec).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			created = true
+			return tx.Create(&models.APISpec{Name: name, Document: document}).Error
+		}
+		if err != nil {
+			return err
+		}
+		created = spec.DeletedAt.Valid
+		return tx.Unscoped().Model(&spec).Updates(map[string]interface{}{
+			"document":   document,
+			"deleted_at": nil,
+		}).Error
+	})
+	if err != nil {
+		s.logger.Error("failed to store OpenAPI document",
+			zap.Error(err),
+			zap.String("name", name))
+		return false, err
+	}
+
+	s.refreshAfterWrite()
+	return created, nil
+}
+
+// GetSpec returns the OpenAPI document stored under the given name. It is
+// served from the in-memory route index and returns gorm.ErrRecordNotFound
+// for unknown names.
+func (s *APIStore) GetSpec(name string) (*models.APISpec, error) {
+	idx, err := s.routes()
+	if err != nil {
+		return nil, err
+	}
+
+	spec, ok := idx.specs[name]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	// The copy keeps callers' assignments out of the shared index
+	found := *spec
+	return &found, nil
+}
+
+// ListSpecs returns every stored OpenAPI document ordered by name
+func (s *APIStore) ListSpecs() ([]models.APISpec, error) {
+	var specs []models.APISpec
+	if err := s.db.Order("name").Find(&specs).Error; err != nil {
+		s.logger.Error("failed to list OpenAPI documents",
+			zap.Error(err))
+		return nil, err
+	}
+	return specs, nil
+}
+
+// DeleteSpec removes the OpenAPI document stored under the given name. It
+// fails with ErrSpecInUse while an API references the document.
+func (s *APIStore) DeleteSpec(name string) error {
+	s.logger.Info("deleting OpenAPI document",
+		zap.String("name", name))
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var spec models.APISpec
+		if err := tx.Where("name = ?", name).First(&spec).Error; err != nil {
+			return err
+		}
+
+		var refs int64
+		if err := tx.Model(&models.APIConfig{}).Where("spec_name = ?", name).Count(&refs).Error; err != nil {
+			return err
+		}
+		if refs > 0 {
+			return ErrSpecInUse
+		}
+
+		return tx.Delete(&spec).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.refreshAfterWrite()
+	return nil
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+	"gorm.io/gorm"
+)
+
+func TestAPIStore_specs(t *testing.T) {
+	s := newCatalogTestStore(t, "")
+
+	created, err := s.PutSpec("orders", "openapi: 3.0.3")
+	require.NoError(t, err)
+	assert.True(t, created)
+	created, err = s.PutSpec("orders", "openapi: 3.1.0")
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	spec, err := s.GetSpec("orders")
+	require.NoError(t, err)
+	assert.Equal(t, "openapi: 3.1.0", spec.Document)
+	_, err = s.GetSpec("billing")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	// A referenced document cannot be deleted
+	require.NoError(t, s.CreateAPI(&models.APIConfig{
+		Path:                 "/orders/*",
+		Upstream:             "http://orders.internal:8082",
+		RequiredSubscription: "basic",
+		SpecName:             "orders",
+	}))
+	assert.ErrorIs(t, s.DeleteSpec("orders"), ErrSpecInUse)
+	require.NoError(t, s.DeleteAPI("/orders/*"))
+	require.NoError(t, s.DeleteSpec("orders"))
+	_, err = s.GetSpec("orders")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.ErrorIs(t, s.DeleteSpec("orders"), gorm.ErrRecordNotFound)
+
+	// The name of a deleted document can be reused
+	created, err = s.PutSpec("orders", "openapi: 3.0.0")
+	require.NoError(t, err)
+	assert.True(t, created)
+	_, err = s.PutSpec("billing", "openapi: 3.0.0")
+	require.NoError(t, err)
+
+	specs, err := s.ListSpecs()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, "billing", specs[0].Name)
+	assert.Equal(t, "orders", specs[1].Name)
+	assert.Equal(t, "openapi: 3.0.0", specs[1].Document)
+}
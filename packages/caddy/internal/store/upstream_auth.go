@@ -0,0 +1,45 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+// SealUpstreamAuth encrypts the secrets of upstream credentials in place.
+// Secrets that are already encrypted, as in exported catalogs, are kept if
+// the configured secret key can decrypt them.
+func (s *APIStore) SealUpstreamAuth(auth *models.UpstreamAuth) error {
+	if auth == nil {
+		return nil
+	}
+	for _, secret := range []*string{&auth.Value, &auth.Password, &auth.ClientSecret} {
+		if strings.HasPrefix(*secret, sealedVersion) {
+			if _, err := s.open(*secret); err != nil {
+				return err
+			}
+			continue
+		}
+		sealed, err := s.seal(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = sealed
+	}
+	return nil
+}
+
+// OpenUpstreamAuth returns a copy of stored upstream credentials with their
+// secrets decrypted
+func (s *APIStore) OpenUpstreamAuth(auth *models.UpstreamAuth) (*models.UpstreamAuth, error) {
+	opened := *auth
+	for _, secret := range []*string{&opened.Value, &opened.Password, &opened.ClientSecret} {
+		plaintext, err := s.open(*secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt upstream credentials: %v", err)
+		}
+		*secret = plaintext
+	}
+	return &opened, nil
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/try-veil/veil/packages/caddy/internal/models"
+)
+
+func TestAPIStore_upstreamAuth(t *testing.T) {
+	s := newCatalogTestStore(t, "")
+	require.NoError(t, s.SetSecretKey("veil-secret"))
+
+	auth := &models.UpstreamAuth{Type: models.UpstreamAuthBasic, Username: "veil", Password: "p@ss"}
+	require.NoError(t, s.SealUpstreamAuth(auth))
+	assert.Equal(t, "veil", auth.Username)
+	assert.NotEqual(t, "p@ss", auth.Password)
+	assert.Empty(t, auth.Value, "empty secrets stay empty")
+
+	// Sealing again keeps the encrypted secret
+	sealed := auth.Password
+	require.NoError(t, s.SealUpstreamAuth(auth))
+	assert.Equal(t, sealed, auth.Password)
+
+	opened, err := s.OpenUpstreamAuth(auth)
+	require.NoError(t, err)
+	assert.Equal(t, "p@ss", opened.Password)
+	assert.Equal(t, sealed, auth.Password, "opening returns a copy")
+
+	// Secrets encrypted with another key are rejected
+	other := newCatalogTestStore(t, "")
+	require.NoError(t, other.SetSecretKey("other-secret"))
+	assert.Error(t, other.SealUpstreamAuth(auth))
+	_, err = other.OpenUpstreamAuth(auth)
+	assert.Error(t, err)
+}
@@ -1,8 +1,6 @@
 package veil
 
 import (
-	"fmt"
-
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -15,6 +13,9 @@ func init() {
 	// Register the VeilHandler
 	caddy.RegisterModule(handlers.VeilHandler{})
 
+	// Register the reverse_proxy transport for upstreams with stored certificates
+	caddy.RegisterModule(handlers.UpstreamTransport{})
+
 	// Register the handler directive for Caddyfile parsing
 	httpcaddyfile.RegisterHandlerDirective("veil_handler", parseVeilHandler)
 }
@@ -23,29 +24,9 @@ func init() {
 func parseVeilHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var handler handlers.VeilHandler
 
-	// Parse the directive
-	for h.Next() {
-		// First argument is the database path
-		if !h.NextArg() {
-			return nil, h.ArgErr()
-		}
-		handler.DBPath = h.Val()
-
-		// Second argument is the subscription header name
-		if !h.NextArg() {
-			return nil, h.ArgErr()
-		}
-		handler.SubscriptionKey = h.Val()
-
-		// No more arguments allowed
-		if h.NextArg() {
-			return nil, h.ArgErr()
-		}
-
-		// Parse any block
-		for h.NextBlock(0) {
-			return nil, fmt.Errorf("no block directives are supported")
-		}
+	// Parse the directive and its block
+	if err := handler.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
 	}
 
 	// Initialize the config